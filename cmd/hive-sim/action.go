@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+)
+
+// Actions a sector can perform.
+const (
+	ActionCreate      = "create"
+	ActionEdit        = "edit"
+	ActionAutoAccept  = "autoaccept"
+	ActionJoin        = "join"
+	ActionCancelJoin  = "canceljoin"
+	ActionAccept      = "accept"
+	ActionPromote     = "promote"
+	ActionDemote      = "demote"
+	ActionKick        = "kick"
+	ActionLeave       = "leave"
+	ActionPeace       = "peace"
+	ActionCancelPeace = "cancelpeace"
+	ActionAcceptPeace = "acceptpeace"
+	ActionWar         = "war"
+)
+
+var memberEvents = map[string]string{
+	ActionJoin:       hive.EventTypeFactionMemberSendJoin,
+	ActionCancelJoin: hive.EventTypeFactionMemberCancelJoin,
+	ActionAccept:     hive.EventTypeFactionMemberAcceptJoin,
+	ActionPromote:    hive.EventTypeFactionMemberPromote,
+	ActionDemote:     hive.EventTypeFactionMemberDemote,
+	ActionKick:       hive.EventTypeFactionMemberKick,
+	ActionLeave:      hive.EventTypeFactionMemberLeave,
+}
+
+var relationEvents = map[string]string{
+	ActionPeace:       hive.EventTypeFactionSendPeaceRequest,
+	ActionCancelPeace: hive.EventTypeFactionCancelPeaceRequest,
+	ActionAcceptPeace: hive.EventTypeFactionAcceptPeace,
+	ActionWar:         hive.EventTypeFactionDeclareWar,
+}
+
+// errBusy is returned for actions on factions that wait for an ack or are not
+// yet known to every sector.
+var errBusy = errors.New("faction is busy")
+
+// action is a step of a script or of the random traffic. Player is an index
+// into the simulated players. Empty fields are picked at random.
+type action struct {
+	Sector   int    `json:"sector"`
+	Action   string `json:"action"`
+	Faction  string `json:"faction,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Player   *int   `json:"player,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// perform sends the event of an action. The returned channel receives the
+// ack once the expected state was updated.
+func (s *simulator) perform(sec *sector, a action) (<-chan protocol.Ack, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acks := make(chan protocol.Ack, 1)
+	var err error
+	switch {
+	case a.Action == ActionCreate:
+		err = s.create(sec, a, acks)
+	case a.Action == ActionEdit || a.Action == ActionAutoAccept:
+		err = s.change(sec, a, acks)
+	case memberEvents[a.Action] != "":
+		err = s.member(sec, a, acks)
+	case relationEvents[a.Action] != "":
+		err = s.relation(sec, a, acks)
+	default:
+		return nil, fmt.Errorf("unknown action %q", a.Action)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return acks, nil
+}
+
+// readyFaction returns the faction of an action, a random one if tag is
+// empty.
+func (s *simulator) readyFaction(tag string) (*expectedFaction, error) {
+	if tag == "" {
+		factions := s.world.readyFactions()
+		if len(factions) == 0 {
+			return nil, errImpossible
+		}
+		return factions[rand.Intn(len(factions))], nil
+	}
+
+	f, ok := s.world.factions[tag]
+	if !ok {
+		return nil, fmt.Errorf("unknown faction %s", tag)
+	}
+	if !f.ready(s.world.sectors) {
+		return nil, errBusy
+	}
+	return f, nil
+}
+
+func (s *simulator) create(sec *sector, a action, acks chan protocol.Ack) error {
+	if a.Faction == "" && len(s.world.factions) >= s.maxFactions {
+		return errImpossible
+	}
+
+	tag := a.Faction
+	if tag == "" {
+		tag = s.world.nextTag()
+	}
+	if _, ok := s.world.factions[tag]; ok {
+		return fmt.Errorf("faction %s exists", tag)
+	}
+
+	name := "Simulated " + tag
+	entity := sec.createFaction(tag, name)
+	f := &expectedFaction{
+		factionState: newFactionState(tag, name),
+		entities:     map[int]int64{sec.index: entity},
+		founder:      s.world.players[rand.Intn(len(s.world.players))],
+		busy:         true,
+	}
+	s.world.factions[tag] = f
+
+	founder := f.founder
+	return s.send(sec, hive.EventTypeFactionCreated, hive.EventFactionCreated{
+		FactionID:      entity,
+		Tag:            tag,
+		Name:           name,
+		Description:    "",
+		PrivateInfo:    "",
+		AcceptHumans:   true,
+		FounderID:      playerEntity(founder),
+		FounderSteamID: founder,
+		FounderName:    playerName(founder),
+	}, acks, func(ack protocol.Ack) {
+		f.busy = false
+		if !ack.Success {
+			delete(s.world.factions, tag)
+			sec.removeFaction(tag, entity)
+		}
+	})
+}
+
+func (s *simulator) change(sec *sector, a action, acks chan protocol.Ack) error {
+	f, err := s.readyFaction(a.Faction)
+	if err != nil {
+		return err
+	}
+	entity := f.entities[sec.index]
+
+	f.busy = true
+	if a.Action == ActionEdit {
+		s.edits++
+		description := fmt.Sprintf("edit %d from sector %d", s.edits, sec.index)
+		return s.send(sec, hive.EventTypeFactionEdited, hive.EventFactionEdited{
+			FactionID:   entity,
+			Tag:         f.Tag,
+			Name:        f.Name,
+			Description: description,
+			PrivateInfo: f.PrivateInfo,
+		}, acks, func(ack protocol.Ack) {
+			f.busy = false
+			if ack.Success {
+				f.Description = description
+				sec.update(func(factions map[string]*factionState) {
+					factions[f.Tag].Description = description
+				})
+			}
+		})
+	}
+
+	member, peace := !f.AutoAcceptMember, rand.Intn(2) == 0
+	return s.send(sec, hive.EventTypeFactionAutoAcceptChanged, hive.EventFactionAutoAcceptChangeEvent{
+		FactionID:        entity,
+		AutoAcceptMember: member,
+		AutoAcceptPeace:  peace,
+	}, acks, func(ack protocol.Ack) {
+		f.busy = false
+		if ack.Success {
+			f.AutoAcceptMember, f.AutoAcceptPeace = member, peace
+			sec.update(func(factions map[string]*factionState) {
+				factions[f.Tag].AutoAcceptMember, factions[f.Tag].AutoAcceptPeace = member, peace
+			})
+		}
+	})
+}
+
+// memberCandidates returns the players an action may apply to.
+func (s *simulator) memberCandidates(f *expectedFaction, action string) []uint64 {
+	if action == ActionJoin {
+		return s.world.freePlayers()
+	}
+
+	var players []uint64
+	for steamID, m := range f.Members {
+		var ok bool
+		switch action {
+		case ActionCancelJoin, ActionAccept:
+			ok = !m.Joined
+		case ActionPromote:
+			ok = m.Joined && !m.Leader
+		case ActionDemote:
+			ok = m.Leader
+		case ActionKick, ActionLeave:
+			ok = m.Joined
+		}
+		if ok {
+			players = append(players, steamID)
+		}
+	}
+	return players
+}
+
+func (s *simulator) member(sec *sector, a action, acks chan protocol.Ack) error {
+	f, err := s.readyFaction(a.Faction)
+	if err != nil {
+		return err
+	}
+
+	candidates := s.memberCandidates(f, a.Action)
+	var steamID uint64
+	switch {
+	case a.Player != nil:
+		if *a.Player < 0 || *a.Player >= len(s.world.players) {
+			return fmt.Errorf("unknown player %d", *a.Player)
+		}
+		steamID = s.world.players[*a.Player]
+		if !containsPlayer(candidates, steamID) {
+			return errImpossible
+		}
+	case len(candidates) == 0:
+		return errImpossible
+	default:
+		steamID = candidates[rand.Intn(len(candidates))]
+	}
+
+	eventType := memberEvents[a.Action]
+	f.busy = true
+	if a.Action == ActionJoin {
+		// reserve the player until the ack
+		s.world.playerFaction[steamID] = f.Tag
+	}
+	return s.send(sec, eventType, hive.EventFactionMember{
+		FactionID:     f.entities[sec.index],
+		PlayerID:      playerEntity(steamID),
+		PlayerSteamID: steamID,
+		PlayerName:    playerName(steamID),
+	}, acks, func(ack protocol.Ack) {
+		f.busy = false
+		if !ack.Success {
+			if a.Action == ActionJoin {
+				delete(s.world.playerFaction, steamID)
+			}
+			return
+		}
+
+		f.applyMember(eventType, steamID)
+		if _, ok := f.Members[steamID]; !ok {
+			delete(s.world.playerFaction, steamID)
+		}
+		sec.update(func(factions map[string]*factionState) {
+			factions[f.Tag].applyMember(eventType, steamID)
+		})
+	})
+}
+
+func (s *simulator) relation(sec *sector, a action, acks chan protocol.Ack) error {
+	from, err := s.readyFaction(a.Faction)
+	if err != nil {
+		return err
+	}
+
+	var to *expectedFaction
+	if a.Target != "" {
+		if to, err = s.readyFaction(a.Target); err != nil {
+			return err
+		}
+	} else {
+		var targets []*expectedFaction
+		for _, f := range s.world.readyFactions() {
+			if f != from && relationPossible(a.Action, from, f) {
+				targets = append(targets, f)
+			}
+		}
+		if len(targets) == 0 {
+			return errImpossible
+		}
+		to = targets[rand.Intn(len(targets))]
+	}
+	if from == to || !relationPossible(a.Action, from, to) {
+		return errImpossible
+	}
+
+	eventType := relationEvents[a.Action]
+	from.busy, to.busy = true, true
+	return s.send(sec, eventType, hive.EventFactionPeaceWar{
+		FromFactionID: from.entities[sec.index],
+		ToFactionID:   to.entities[sec.index],
+	}, acks, func(ack protocol.Ack) {
+		from.busy, to.busy = false, false
+		if !ack.Success {
+			return
+		}
+
+		applyRelation(eventType, from.factionState, to.factionState)
+		sec.update(func(factions map[string]*factionState) {
+			applyRelation(eventType, factions[from.Tag], factions[to.Tag])
+		})
+	})
+}
+
+func relationPossible(action string, from *expectedFaction, to *expectedFaction) bool {
+	relation := from.Relations[to.Tag]
+	switch action {
+	case ActionPeace:
+		return relation != hive.FactionRelationSendPeaceRequest && relation != hive.FactionRelationPeace
+	case ActionCancelPeace:
+		return relation == hive.FactionRelationSendPeaceRequest
+	case ActionAcceptPeace:
+		return to.Relations[from.Tag] == hive.FactionRelationSendPeaceRequest
+	case ActionWar:
+		return relation != hive.FactionRelationWar
+	}
+	return false
+}
+
+// send writes the event of an action. apply runs with the simulator locked
+// when the ack arrives, before the ack is passed on.
+func (s *simulator) send(sec *sector, eventType string, payload interface{}, acks chan protocol.Ack, apply func(ack protocol.Ack)) error {
+	err := sec.send(eventType, payload, func(ack protocol.Ack) {
+		s.mu.Lock()
+		apply(ack)
+		s.mu.Unlock()
+
+		if !ack.Success {
+			s.fail("sector %d: %s rejected: %s %s", sec.index, eventType, ack.Code, ack.Message)
+		}
+		acks <- ack
+	})
+	if err != nil {
+		// nothing was sent, undo the reservations
+		apply(protocol.Ack{Code: "not_sent", Message: err.Error()})
+	}
+	return err
+}
+
+// factionCompleted records the entity id of a faction in a sector that
+// created it after another sector founded it.
+func (s *simulator) factionCompleted(sec *sector, tag string, entity int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.world.factions[tag]
+	if !ok {
+		s.inconsistent("sector %d: completed unknown faction %s", sec.index, tag)
+		return
+	}
+	f.entities[sec.index] = entity
+}
+
+func containsPlayer(players []uint64, steamID uint64) bool {
+	for _, v := range players {
+		if v == steamID {
+			return true
+		}
+	}
+	return false
+}
+
+// playerEntity returns the identity of a player, the same in every sector.
+func playerEntity(steamID uint64) int64 {
+	return int64(steamID%1000000) + 1
+}
+
+func playerName(steamID uint64) string {
+	return fmt.Sprintf("Player %d", steamID%1000000)
+}
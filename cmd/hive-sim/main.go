@@ -0,0 +1,136 @@
+// Command hive-sim registers fake sectors in a hive, connects them over the
+// websocket and sends faction traffic like the Torch plugin. At the end it
+// checks that every sector and the hive agree on the faction state.
+//
+// A script is a JSON array of actions, performed in order before the random
+// traffic, for example:
+//
+//	[
+//	  {"sector": 0, "action": "create", "faction": "ABC"},
+//	  {"sector": 1, "action": "create", "faction": "XYZ"},
+//	  {"sector": 1, "action": "join", "faction": "ABC", "player": 0},
+//	  {"sector": 2, "action": "accept", "faction": "ABC", "player": 0},
+//	  {"action": "wait", "duration": "1s"},
+//	  {"sector": 0, "action": "war", "faction": "ABC", "target": "XYZ"}
+//	]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	hiveURL     = flag.String("hive", "http://localhost:8080", "base url of the hive system")
+	sectorCount = flag.Int("sectors", 3, "number of simulated sectors")
+	playerCount = flag.Int("players", 50, "number of simulated players")
+	maxFactions = flag.Int("factions", 10, "maximum number of factions the random traffic creates")
+	rate        = flag.Float64("rate", 20, "events per second of all sectors")
+	duration    = flag.Duration("duration", 30*time.Second, "duration of the random traffic, 0 disables it")
+	mixFlag     = flag.String("mix", defaultMix, "weights of the actions of the random traffic")
+	scriptFile  = flag.String("script", "", "JSON file with actions performed before the random traffic")
+	ackTimeout  = flag.Duration("ack-timeout", 30*time.Second, "time to wait for outstanding acks")
+	settle      = flag.Duration("settle", 2*time.Second, "time for forwarded events to arrive before the verification")
+	seed        = flag.Int64("seed", 0, "seed of the random traffic, 0 uses the current time")
+	keep        = flag.Bool("keep", false, "keep the hive of the run instead of deleting it")
+)
+
+func main() {
+	flag.Parse()
+
+	if !run() {
+		os.Exit(1)
+	}
+}
+
+func run() bool {
+	if *sectorCount < 1 || *playerCount < 1 || *rate <= 0 {
+		logrus.Errorln("sectors, players and rate must be positive")
+		return false
+	}
+
+	base, err := url.Parse(*hiveURL)
+	if err != nil {
+		logrus.Errorln(err)
+		return false
+	}
+
+	m, err := parseMix(*mixFlag)
+	if err != nil {
+		logrus.Errorln(err)
+		return false
+	}
+
+	var script []action
+	if *scriptFile != "" {
+		script, err = loadScript(*scriptFile, *sectorCount)
+		if err != nil {
+			logrus.Errorln(err)
+			return false
+		}
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rand.Seed(*seed)
+
+	runID := fmt.Sprintf("sim%x", time.Now().UnixNano())
+	logrus.WithFields(logrus.Fields{
+		"run":  runID,
+		"seed": *seed,
+	}).Info("starting simulation")
+
+	rest := newRestClient(base)
+	h, err := rest.createHive("hive-sim " + runID)
+	if err != nil {
+		logrus.Errorln(err)
+		return false
+	}
+	if !*keep {
+		defer func() {
+			if err := rest.deleteHive(h.ID.Hex()); err != nil {
+				logrus.Errorln(err)
+			}
+		}()
+	}
+
+	sim := newSimulator(runID, *sectorCount, *playerCount, *maxFactions)
+	defer func() {
+		for _, sec := range sim.sectors {
+			sec.close()
+		}
+	}()
+
+	if err := sim.connectSectors(rest, base, h.ID.Hex(), *sectorCount); err != nil {
+		logrus.Errorln(err)
+		return false
+	}
+	logrus.WithField("hive", h.ID.Hex()).Infof("%d sectors connected", len(sim.sectors))
+
+	start := time.Now()
+	if len(script) > 0 {
+		sim.runScript(script, *ackTimeout)
+	}
+	if *duration > 0 {
+		sim.runTraffic(m, *rate, *duration)
+	}
+	elapsed := time.Since(start)
+
+	if !sim.waitPending(*ackTimeout) {
+		sim.fail("%d events without ack after %s", sim.pending(), *ackTimeout)
+	}
+	time.Sleep(*settle)
+
+	if err := sim.verify(rest, h.ID.Hex()); err != nil {
+		sim.fail("verification: %v", err)
+	}
+
+	return sim.report(os.Stdout, elapsed)
+}
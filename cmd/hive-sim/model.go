@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+// errImpossible is returned for actions whose preconditions do not hold.
+var errImpossible = errors.New("action is not possible in the current state")
+
+type memberState struct {
+	Joined bool
+	Leader bool
+}
+
+// factionState is the view of a faction, either the expected one or the one
+// of a sector.
+type factionState struct {
+	Tag              string
+	Name             string
+	Description      string
+	PrivateInfo      string
+	AutoAcceptMember bool
+	AutoAcceptPeace  bool
+	Members          map[uint64]memberState
+	Relations        map[string]hive.FactionRelationState
+}
+
+func newFactionState(tag string, name string) *factionState {
+	return &factionState{
+		Tag:       tag,
+		Name:      name,
+		Members:   make(map[uint64]memberState),
+		Relations: make(map[string]hive.FactionRelationState),
+	}
+}
+
+// applyMember applies a member event of a player.
+func (f *factionState) applyMember(eventType string, steamID uint64) {
+	switch eventType {
+	case hive.EventTypeFactionMemberSendJoin:
+		f.Members[steamID] = memberState{}
+	case hive.EventTypeFactionMemberAcceptJoin:
+		m := f.Members[steamID]
+		m.Joined = true
+		f.Members[steamID] = m
+	case hive.EventTypeFactionMemberPromote, hive.EventTypeFactionMemberDemote:
+		m := f.Members[steamID]
+		m.Leader = eventType == hive.EventTypeFactionMemberPromote
+		f.Members[steamID] = m
+	case hive.EventTypeFactionMemberCancelJoin, hive.EventTypeFactionMemberKick, hive.EventTypeFactionMemberLeave:
+		delete(f.Members, steamID)
+	}
+}
+
+// applyRelation applies a peace or war event of from towards to.
+func applyRelation(eventType string, from *factionState, to *factionState) {
+	switch eventType {
+	case hive.EventTypeFactionSendPeaceRequest:
+		from.Relations[to.Tag] = hive.FactionRelationSendPeaceRequest
+	case hive.EventTypeFactionCancelPeaceRequest:
+		from.Relations[to.Tag] = hive.FactionRelationNeutral
+		to.Relations[from.Tag] = hive.FactionRelationNeutral
+	case hive.EventTypeFactionAcceptPeace:
+		from.Relations[to.Tag] = hive.FactionRelationPeace
+		to.Relations[from.Tag] = hive.FactionRelationPeace
+	case hive.EventTypeFactionDeclareWar:
+		from.Relations[to.Tag] = hive.FactionRelationWar
+		to.Relations[from.Tag] = hive.FactionRelationWar
+	}
+}
+
+// diff describes the differences of f from the expected faction.
+func (f *factionState) diff(expected *factionState) []string {
+	var diffs []string
+	check := func(field string, got interface{}, want interface{}) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s is %v, expected %v", field, got, want))
+		}
+	}
+
+	check("name", f.Name, expected.Name)
+	check("description", f.Description, expected.Description)
+	check("private info", f.PrivateInfo, expected.PrivateInfo)
+	check("auto accept member", f.AutoAcceptMember, expected.AutoAcceptMember)
+	check("auto accept peace", f.AutoAcceptPeace, expected.AutoAcceptPeace)
+
+	for steamID, want := range expected.Members {
+		got, ok := f.Members[steamID]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("member %d is missing", steamID))
+			continue
+		}
+		check(fmt.Sprintf("member %d", steamID), got, want)
+	}
+	for steamID := range f.Members {
+		if _, ok := expected.Members[steamID]; !ok {
+			diffs = append(diffs, fmt.Sprintf("member %d is unexpected", steamID))
+		}
+	}
+
+	for _, tag := range relationTags(f, expected) {
+		check("relation to "+tag, f.Relations[tag], expected.Relations[tag])
+	}
+
+	return diffs
+}
+
+func relationTags(factions ...*factionState) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, f := range factions {
+		for tag := range f.Relations {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// expectedFaction is a faction of the world the sectors should agree on.
+type expectedFaction struct {
+	*factionState
+
+	// Entity ids of the faction in the sectors that created it.
+	entities map[int]int64
+
+	founder uint64
+
+	// An event of the faction is waiting for its ack.
+	busy bool
+}
+
+func (f *expectedFaction) ready(sectors int) bool {
+	return !f.busy && len(f.entities) == sectors
+}
+
+// world is the expected state, changed by every event the hive acknowledged.
+type world struct {
+	sectors  int
+	factions map[string]*expectedFaction
+	players  []uint64
+
+	// Faction of every player with a join request or membership.
+	playerFaction map[uint64]string
+
+	created int
+}
+
+func newWorld(sectors int, players int) *world {
+	w := &world{
+		sectors:       sectors,
+		factions:      make(map[string]*expectedFaction),
+		playerFaction: make(map[uint64]string),
+	}
+	for i := 0; i < players; i++ {
+		w.players = append(w.players, 76561198000000000+uint64(i))
+	}
+	return w
+}
+
+func (w *world) readyFactions() []*expectedFaction {
+	var factions []*expectedFaction
+	for _, tag := range w.tags() {
+		if f := w.factions[tag]; f.ready(w.sectors) {
+			factions = append(factions, f)
+		}
+	}
+	return factions
+}
+
+func (w *world) tags() []string {
+	tags := make([]string, 0, len(w.factions))
+	for tag := range w.factions {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (w *world) freePlayers() []uint64 {
+	var players []uint64
+	for _, p := range w.players {
+		if _, ok := w.playerFaction[p]; !ok {
+			players = append(players, p)
+		}
+	}
+	return players
+}
+
+// nextTag returns an unused faction tag.
+func (w *world) nextTag() string {
+	w.created++
+	return fmt.Sprintf("S%03d", w.created)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+// restClient talks to the REST API of the hive.
+type restClient struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func newRestClient(base *url.URL) *restClient {
+	return &restClient{
+		base:   base,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// do sends a request and decodes the response into out, if not nil. It
+// returns the response headers.
+func (c *restClient) do(method string, path string, query url.Values, in interface{}, out interface{}) (http.Header, error) {
+	u := *c.base
+	u.Path = path
+	u.RawQuery = query.Encode()
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, u.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		var envelope struct {
+			Error api.Error `json:"error"`
+		}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error.Message != "" {
+			return nil, fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, envelope.Error.Error())
+		}
+		return nil, fmt.Errorf("%s %s: %d", method, path, resp.StatusCode)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func (c *restClient) createHive(name string) (*hive.Hive, error) {
+	var h hive.Hive
+	_, err := c.do(http.MethodPost, "/api/hive", nil, map[string]interface{}{
+		"name": name,
+	}, &h)
+	return &h, err
+}
+
+func (c *restClient) deleteHive(hiveID string) error {
+	_, err := c.do(http.MethodDelete, "/api/hive/"+hiveID, nil, nil, nil)
+	return err
+}
+
+func (c *restClient) createSector(hiveID string, index int) (*hive.Sector, error) {
+	var sector hive.Sector
+	_, err := c.do(http.MethodPost, "/api/hive/"+hiveID+"/sector", nil, map[string]interface{}{
+		"name":       fmt.Sprintf("hive-sim %d", index),
+		"address":    fmt.Sprintf("127.0.0.1:%d", 27016+index),
+		"max_player": 16,
+		"position":   hive.SectorPosition{X: index},
+	}, &sector)
+	return &sector, err
+}
+
+func (c *restClient) createSectorToken(hiveID string, sectorID string) (string, error) {
+	var token hive.SectorToken
+	_, err := c.do(http.MethodPost, "/api/hive/"+hiveID+"/sector/"+sectorID+"/token", nil, nil, &token)
+	return token.Token, err
+}
+
+// factions returns every faction of the hive.
+func (c *restClient) factions(hiveID string) ([]hive.Faction, error) {
+	var factions []hive.Faction
+	query := url.Values{"limit": {"100"}}
+	for {
+		var page []hive.Faction
+		header, err := c.do(http.MethodGet, "/api/hive/"+hiveID+"/faction", query, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		factions = append(factions, page...)
+
+		next := header.Get("X-Next-Cursor")
+		if next == "" {
+			return factions, nil
+		}
+		query.Set("cursor", next)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/client"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+)
+
+// sector is a fake Torch plugin. It keeps its own view of the factions,
+// changed by its own acknowledged events and the events the hive sends.
+type sector struct {
+	index int
+	id    string
+	sim   *simulator
+
+	client *client.Client
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	nextEntity int64
+	factions   map[string]*factionState
+	entities   map[int64]string
+	closing    bool
+}
+
+func newSector(sim *simulator, index int, id string) *sector {
+	return &sector{
+		index: index,
+		id:    id,
+		sim:   sim,
+		// entity ids differ between sectors like in the game
+		nextEntity: int64(index+1) * 1000000,
+		factions:   make(map[string]*factionState),
+		entities:   make(map[int64]string),
+	}
+}
+
+// connect opens the websocket and waits for the first handshake. Later
+// connection losses are repaired by the client.
+func (s *sector) connect(base *url.URL, hiveID string, token string) error {
+	connected := make(chan struct{}, 1)
+	c, err := client.New(client.Config{
+		URL:           base.String(),
+		HiveID:        hiveID,
+		SectorID:      s.id,
+		Token:         token,
+		PluginVersion: "hive-sim",
+		Events:        hive.SectorEventTypes,
+		Handler:       s.receive,
+		OnConnect: func(welcome protocol.Welcome) {
+			if !welcome.Acknowledges() {
+				s.sim.fail("sector %d: hive negotiated protocol version %d without acks", s.index, welcome.ProtocolVersion)
+			}
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.client, s.cancel = c, cancel
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- c.Run(ctx)
+	}()
+
+	select {
+	case <-connected:
+	case err := <-stopped:
+		return err
+	case <-time.After(10 * time.Second):
+		cancel()
+		return fmt.Errorf("no handshake within 10s")
+	}
+
+	go func() {
+		err := <-stopped
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+		if !closing {
+			s.sim.fail("sector %d stopped: %v", s.index, err)
+		}
+	}()
+	return nil
+}
+
+func (s *sector) close() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	s.cancel()
+}
+
+// send writes an event, done is called with its final ack.
+func (s *sector) send(eventType string, payload interface{}, done func(ack protocol.Ack)) error {
+	call, err := s.client.Send(eventType, payload)
+	if err != nil {
+		return err
+	}
+	s.sim.stats.sent(eventType)
+
+	go func() {
+		ack, err := call.Result()
+		if err != nil {
+			done(protocol.Ack{EventID: call.ID, Code: "not_sent", Message: err.Error()})
+			return
+		}
+
+		s.sim.stats.acknowledged(ack, time.Since(call.SentAt), call.Queued())
+		done(ack)
+	}()
+	return nil
+}
+
+func (s *sector) pendingCount() int {
+	return s.client.Pending()
+}
+
+// createFaction founds a faction in the sector and returns its entity id.
+func (s *sector) createFaction(tag string, name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextEntity++
+	s.factions[tag] = newFactionState(tag, name)
+	s.entities[s.nextEntity] = tag
+	return s.nextEntity
+}
+
+// removeFaction drops a faction whose creation the hive rejected.
+func (s *sector) removeFaction(tag string, entity int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.factions, tag)
+	delete(s.entities, entity)
+}
+
+// update changes the view of the sector.
+func (s *sector) update(change func(factions map[string]*factionState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	change(s.factions)
+}
+
+// faction returns the view of the faction with the entity id.
+func (s *sector) faction(entity int64) (*factionState, error) {
+	tag, ok := s.entities[entity]
+	if !ok {
+		return nil, fmt.Errorf("unknown faction %d", entity)
+	}
+	return s.factions[tag], nil
+}
+
+func (s *sector) receive(e client.Event) {
+	s.sim.stats.received(e.Type)
+	if err := s.apply(e); err != nil {
+		s.sim.inconsistent("sector %d: %s: %v", s.index, e.Type, err)
+	}
+}
+
+// apply applies an event the hive forwarded from another sector.
+func (s *sector) apply(e client.Event) error {
+	if created, ok := e.Payload.(*hive.EventFactionCreated); ok {
+		return s.joinFaction(*created)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch p := e.Payload.(type) {
+	case *hive.EventFactionEdited:
+		f, err := s.faction(p.FactionID)
+		if err != nil {
+			return err
+		}
+		f.Name, f.Description, f.PrivateInfo = p.Name, p.Description, p.PrivateInfo
+	case *hive.EventFactionAutoAcceptChangeEvent:
+		f, err := s.faction(p.FactionID)
+		if err != nil {
+			return err
+		}
+		f.AutoAcceptMember, f.AutoAcceptPeace = p.AutoAcceptMember, p.AutoAcceptPeace
+	case *hive.EventFactionMember:
+		f, err := s.faction(p.FactionID)
+		if err != nil {
+			return err
+		}
+		f.applyMember(e.Type, p.PlayerSteamID)
+	case *hive.EventFactionPeaceWar:
+		from, err := s.faction(p.FromFactionID)
+		if err != nil {
+			return err
+		}
+		to, err := s.faction(p.ToFactionID)
+		if err != nil {
+			return err
+		}
+		applyRelation(e.Type, from, to)
+	default:
+		return fmt.Errorf("unexpected message")
+	}
+
+	return nil
+}
+
+// joinFaction creates a faction founded in another sector and reports it to
+// the hive like the plugin does.
+func (s *sector) joinFaction(event hive.EventFactionCreated) error {
+	s.mu.Lock()
+	if _, ok := s.factions[event.Tag]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("faction %s exists", event.Tag)
+	}
+	s.nextEntity++
+	entity := s.nextEntity
+	f := newFactionState(event.Tag, event.Name)
+	f.Description, f.PrivateInfo = event.Description, event.PrivateInfo
+	s.factions[event.Tag] = f
+	s.entities[entity] = event.Tag
+	s.mu.Unlock()
+
+	return s.send(hive.EventTypeFactionCreatedComplete, hive.EventFactionCreatedComplete{
+		FactionID: entity,
+		Tag:       event.Tag,
+	}, func(ack protocol.Ack) {
+		if !ack.Success {
+			s.sim.inconsistent("sector %d: completing faction %s failed: %s", s.index, event.Tag, ack.Message)
+			return
+		}
+		s.sim.factionCompleted(s, event.Tag, entity)
+	})
+}
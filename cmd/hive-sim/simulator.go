@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+)
+
+// simulator drives the fake sectors of one run against a hive.
+type simulator struct {
+	runID       string
+	maxFactions int
+	stats       *stats
+
+	mu      sync.Mutex
+	world   *world
+	sectors []*sector
+	edits   int
+
+	reportMu       sync.Mutex
+	failures       []string
+	inconsistences []string
+}
+
+func newSimulator(runID string, sectors int, players int, maxFactions int) *simulator {
+	return &simulator{
+		runID:       runID,
+		maxFactions: maxFactions,
+		stats:       newStats(),
+		world:       newWorld(sectors, players),
+	}
+}
+
+// connectSectors registers the sectors in the hive and connects them.
+func (s *simulator) connectSectors(rest *restClient, base *url.URL, hiveID string, count int) error {
+	for i := 0; i < count; i++ {
+		hs, err := rest.createSector(hiveID, i)
+		if err != nil {
+			return err
+		}
+
+		token, err := rest.createSectorToken(hiveID, hs.ID.Hex())
+		if err != nil {
+			return err
+		}
+
+		sec := newSector(s, i, hs.ID.Hex())
+		if err := sec.connect(base, hiveID, token); err != nil {
+			return fmt.Errorf("sector %d: %v", i, err)
+		}
+		s.sectors = append(s.sectors, sec)
+	}
+	return nil
+}
+
+// fail records an error of the hive or the connection.
+func (s *simulator) fail(format string, args ...interface{}) {
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+	s.failures = append(s.failures, fmt.Sprintf(format, args...))
+}
+
+// inconsistent records a difference between the expected and an actual
+// faction state.
+func (s *simulator) inconsistent(format string, args ...interface{}) {
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+	s.inconsistences = append(s.inconsistences, fmt.Sprintf(format, args...))
+}
+
+// pending returns the number of events waiting for their final ack.
+func (s *simulator) pending() int {
+	n := 0
+	for _, sec := range s.sectors {
+		n += sec.pendingCount()
+	}
+	return n
+}
+
+// waitPending waits until every event was acknowledged.
+func (s *simulator) waitPending(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.pending() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// report writes the statistics and problems of the run and tells whether it
+// succeeded.
+func (s *simulator) report(w io.Writer, elapsed time.Duration) bool {
+	s.stats.report(w, elapsed)
+
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+
+	for _, problems := range []struct {
+		title    string
+		messages []string
+	}{
+		{"failures", s.failures},
+		{"inconsistencies", s.inconsistences},
+	} {
+		fmt.Fprintf(w, "%s: %d\n", problems.title, len(problems.messages))
+		for _, m := range problems.messages {
+			fmt.Fprintf(w, "  %s\n", m)
+		}
+	}
+
+	return len(s.failures) == 0 && len(s.inconsistences) == 0
+}
+
+// stats counts the traffic of a run.
+type stats struct {
+	mu        sync.Mutex
+	sentBy    map[string]int
+	receiveBy map[string]int
+	skipped   map[string]int
+	nacks     int
+	duplicate int
+	queued    int
+	latencies []time.Duration
+}
+
+func newStats() *stats {
+	return &stats{
+		sentBy:    make(map[string]int),
+		receiveBy: make(map[string]int),
+		skipped:   make(map[string]int),
+	}
+}
+
+func (s *stats) sent(eventType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sentBy[eventType]++
+}
+
+func (s *stats) received(eventType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receiveBy[eventType]++
+}
+
+// skip counts an action of the random traffic that was not possible.
+func (s *stats) skip(action string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped[action]++
+}
+
+func (s *stats) acknowledged(ack protocol.Ack, latency time.Duration, queued bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if queued {
+		s.queued++
+	}
+	switch {
+	case !ack.Success:
+		s.nacks++
+	case ack.Duplicate:
+		s.duplicate++
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for _, n := range s.sentBy {
+		total += n
+	}
+	fmt.Fprintf(w, "sent %d events in %s (%.1f/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	writeCounts(w, s.sentBy)
+	fmt.Fprintf(w, "received events\n")
+	writeCounts(w, s.receiveBy)
+	if len(s.skipped) > 0 {
+		fmt.Fprintf(w, "skipped actions\n")
+		writeCounts(w, s.skipped)
+	}
+	fmt.Fprintf(w, "acks: %d, nacks: %d, duplicates: %d, queued: %d\n", len(s.latencies), s.nacks, s.duplicate, s.queued)
+
+	if len(s.latencies) == 0 {
+		return
+	}
+	latencies := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Fprintf(w, "ack latency: p50 %s, p95 %s, p99 %s, max %s\n",
+		percentile(0.5), percentile(0.95), percentile(0.99), latencies[len(latencies)-1])
+}
+
+func writeCounts(w io.Writer, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	width := 0
+	for k := range counts {
+		keys = append(keys, k)
+		if len(k) > width {
+			width = len(k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %-*s %d\n", width, k, counts[k])
+	}
+}
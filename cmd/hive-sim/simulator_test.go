@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+const testTimeout = 5 * time.Second
+
+const testScript = `[
+  {"sector": 0, "action": "create", "faction": "ABC"},
+  {"sector": 1, "action": "create", "faction": "XYZ"},
+  {"sector": 1, "action": "join", "faction": "ABC", "player": 0},
+  {"sector": 0, "action": "accept", "faction": "ABC", "player": 0},
+  {"sector": 1, "action": "edit", "faction": "XYZ"},
+  {"sector": 0, "action": "war", "faction": "ABC", "target": "XYZ"}
+]`
+
+// newTestHive starts the hive system and hub on an in-memory store, wired
+// like the hive system command, behind the routes the simulator uses.
+func newTestHive(t *testing.T) *url.URL {
+	t.Helper()
+
+	system, err := hive.NewSystemWithStore(store.NewMemory(), hive.DefaultDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := notification.NewHub()
+	hub.RegisterEventHandler(system.ProcessSectorEvent)
+	hub.RegisterHandshakeHandler(system.SectorHandshake)
+	hub.RegisterPartitionHandler(system.EventPartitionKey)
+	hub.RegisterDedupStore(system)
+	hub.RegisterDeadLetterStore(system)
+	system.RegisterActivityHandler(hub.Publish)
+	go hub.Run()
+
+	router := mux.NewRouter()
+	router.Use(api.ValidateIDs)
+	router.HandleFunc("/ws/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		hiveID, sectorID := bson.ObjectIdHex(vars["hive_id"]), bson.ObjectIdHex(vars["sector_id"])
+
+		valid, err := system.IsSectorTokenValid(hiveID, sectorID, api.RequestToken(r))
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		if !valid {
+			api.WriteError(w, api.Unauthorized("invalid sector token"))
+			return
+		}
+
+		notification.ServeWs(hub, w, r, hiveID.Hex(), sectorID.Hex())
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive", system.CreateHive).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}", system.DeleteHive).Methods(http.MethodDelete)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction", system.GetFactions).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction", system.DeleteFactions).Methods(http.MethodDelete)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector", system.CreateSector).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}/token", system.CreateSectorToken).Methods(http.MethodPost)
+
+	server := httptest.NewServer(api.Recover(router))
+	t.Cleanup(server.Close)
+
+	base, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+// runTestScript connects two sectors to a new hive and performs the test
+// script.
+func runTestScript(t *testing.T) (*simulator, *restClient, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "script.json")
+	if err := ioutil.WriteFile(path, []byte(testScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script, err := loadScript(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := newTestHive(t)
+	rest := newRestClient(base)
+	h, err := rest.createHive("hive-sim test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim := newSimulator("test", 2, 5, 10)
+	t.Cleanup(func() {
+		for _, sec := range sim.sectors {
+			sec.close()
+		}
+	})
+	if err := sim.connectSectors(rest, base, h.ID.Hex(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	sim.runScript(script, testTimeout)
+	if !sim.waitPending(testTimeout) {
+		t.Fatalf("%d events without ack", sim.pending())
+	}
+	return sim, rest, h.ID.Hex()
+}
+
+// verifyNow verifies the state and returns the inconsistencies found.
+func verifyNow(t *testing.T, sim *simulator, rest *restClient, hiveID string) []string {
+	t.Helper()
+
+	sim.reportMu.Lock()
+	sim.inconsistences = nil
+	sim.reportMu.Unlock()
+
+	if err := sim.verify(rest, hiveID); err != nil {
+		t.Fatal(err)
+	}
+
+	sim.reportMu.Lock()
+	defer sim.reportMu.Unlock()
+	return sim.inconsistences
+}
+
+// verifyEventually verifies until the forwarded events arrived or the
+// timeout passed and returns the inconsistencies found last.
+func verifyEventually(t *testing.T, sim *simulator, rest *restClient, hiveID string) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		inconsistences := verifyNow(t, sim, rest, hiveID)
+		if len(inconsistences) == 0 || time.Now().After(deadline) {
+			return inconsistences
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func contains(messages []string, substr string) bool {
+	for _, m := range messages {
+		if strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifyConsistentState(t *testing.T) {
+	sim, rest, hiveID := runTestScript(t)
+
+	if inconsistences := verifyEventually(t, sim, rest, hiveID); len(inconsistences) > 0 {
+		t.Errorf("got inconsistencies %v", inconsistences)
+	}
+	if len(sim.failures) > 0 {
+		t.Errorf("got failures %v", sim.failures)
+	}
+	if got := sim.world.factions["ABC"].Relations["XYZ"]; got != hive.FactionRelationWar {
+		t.Errorf("got relation %v of ABC to XYZ, want war", got)
+	}
+}
+
+func TestVerifyDivergedFaction(t *testing.T) {
+	sim, rest, hiveID := runTestScript(t)
+	if inconsistences := verifyEventually(t, sim, rest, hiveID); len(inconsistences) > 0 {
+		t.Fatalf("got inconsistencies before the divergence %v", inconsistences)
+	}
+
+	// a sector that missed the edit of a faction
+	sim.sectors[0].update(func(factions map[string]*factionState) {
+		factions["XYZ"].Name = "Diverged"
+	})
+	inconsistences := verifyNow(t, sim, rest, hiveID)
+	if len(inconsistences) != 1 || !contains(inconsistences, "sector 0: faction XYZ: name is Diverged") {
+		t.Errorf("got inconsistencies %v, want the name of XYZ in sector 0", inconsistences)
+	}
+
+	// a hive that lost its factions
+	sim.sectors[0].update(func(factions map[string]*factionState) {
+		factions["XYZ"].Name = sim.world.factions["XYZ"].Name
+	})
+	if _, err := rest.do(http.MethodDelete, "/api/hive/"+hiveID+"/faction", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	inconsistences = verifyNow(t, sim, rest, hiveID)
+	if !contains(inconsistences, "hive: faction ABC is missing") || !contains(inconsistences, "hive: faction XYZ is missing") {
+		t.Errorf("got inconsistencies %v, want the factions missing in the hive", inconsistences)
+	}
+	if sim.report(ioutil.Discard, time.Second) {
+		t.Error("report passed a diverged run")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+)
+
+// ActionWait pauses a script for its duration.
+const ActionWait = "wait"
+
+const defaultMix = "create=2,edit=2,autoaccept=1,join=6,canceljoin=1,accept=4,promote=2,demote=1,kick=1,leave=1,peace=3,cancelpeace=1,acceptpeace=2,war=2"
+
+type weightedAction struct {
+	action string
+	weight int
+}
+
+// mix is the weighted choice of actions of the random traffic.
+type mix struct {
+	actions []weightedAction
+	total   int
+}
+
+// parseMix parses weights in the form action=weight,action=weight.
+func parseMix(v string) (*mix, error) {
+	m := &mix{}
+	for _, part := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("mix: %q is not in the form action=weight", part)
+		}
+		if !knownAction(kv[0]) {
+			return nil, fmt.Errorf("mix: unknown action %q", kv[0])
+		}
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("mix: weight of %s must be a non-negative integer", kv[0])
+		}
+		m.actions = append(m.actions, weightedAction{kv[0], weight})
+		m.total += weight
+	}
+	if m.total == 0 {
+		return nil, fmt.Errorf("mix: at least one weight must be positive")
+	}
+	return m, nil
+}
+
+func (m *mix) pick() string {
+	n := rand.Intn(m.total)
+	for _, a := range m.actions {
+		if n < a.weight {
+			return a.action
+		}
+		n -= a.weight
+	}
+	return m.actions[len(m.actions)-1].action
+}
+
+func knownAction(action string) bool {
+	return action == ActionCreate || action == ActionEdit || action == ActionAutoAccept ||
+		memberEvents[action] != "" || relationEvents[action] != ""
+}
+
+// loadScript reads a JSON array of actions.
+func loadScript(path string, sectors int) ([]action, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []action
+	if err := json.Unmarshal(data, &steps); err != nil {
+		return nil, fmt.Errorf("script: %v", err)
+	}
+
+	for i, step := range steps {
+		if step.Action == ActionWait {
+			if _, err := time.ParseDuration(step.Duration); err != nil {
+				return nil, fmt.Errorf("script step %d: invalid duration %q", i+1, step.Duration)
+			}
+			continue
+		}
+		if !knownAction(step.Action) {
+			return nil, fmt.Errorf("script step %d: unknown action %q", i+1, step.Action)
+		}
+		if step.Sector < 0 || step.Sector >= sectors {
+			return nil, fmt.Errorf("script step %d: sector must be between 0 and %d", i+1, sectors-1)
+		}
+	}
+	return steps, nil
+}
+
+// runScript performs the steps in order. Each step waits until its factions
+// are ready and for its ack.
+func (s *simulator) runScript(steps []action, timeout time.Duration) {
+	for i, step := range steps {
+		if step.Action == ActionWait {
+			d, _ := time.ParseDuration(step.Duration)
+			time.Sleep(d)
+			continue
+		}
+
+		acks, err := s.performReady(step, timeout)
+		if err != nil {
+			s.fail("script step %d (%s): %v", i+1, step.Action, err)
+			continue
+		}
+
+		select {
+		case <-acks:
+		case <-time.After(timeout):
+			s.fail("script step %d (%s): no ack within %s", i+1, step.Action, timeout)
+		}
+	}
+}
+
+func (s *simulator) performReady(a action, timeout time.Duration) (<-chan protocol.Ack, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		acks, err := s.perform(s.sectors[a.Sector], a)
+		if err != errBusy || time.Now().After(deadline) {
+			return acks, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// runTraffic performs random actions from every sector at the combined rate
+// per second.
+func (s *simulator) runTraffic(m *mix, rate float64, duration time.Duration) {
+	interval := time.Duration(float64(time.Second) * float64(len(s.sectors)) / rate)
+	stop := time.After(duration)
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for _, sec := range s.sectors {
+		wg.Add(1)
+		go func(sec *sector) {
+			defer wg.Done()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+
+				a := action{Sector: sec.index, Action: m.pick()}
+				_, err := s.perform(sec, a)
+				switch err {
+				case nil:
+				case errBusy, errImpossible:
+					s.stats.skip(a.Action)
+				default:
+					s.fail("sector %d: %s: %v", sec.index, a.Action, err)
+				}
+			}
+		}(sec)
+	}
+
+	<-stop
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+// verify compares the faction state of every sector and of the hive with the
+// expected world.
+func (s *simulator) verify(rest *restClient, hiveID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sec := range s.sectors {
+		sec.mu.Lock()
+		s.verifyFactions(fmt.Sprintf("sector %d", sec.index), sec.factions)
+		sec.mu.Unlock()
+	}
+
+	factions, err := rest.factions(hiveID)
+	if err != nil {
+		return err
+	}
+
+	tags := make(map[string]string, len(factions))
+	for _, f := range factions {
+		tags[f.ID.Hex()] = f.Tag
+	}
+	sectors := make(map[string]int, len(s.sectors))
+	for _, sec := range s.sectors {
+		sectors[sec.id] = sec.index
+	}
+
+	stored := make(map[string]*factionState, len(factions))
+	for _, f := range factions {
+		state := newFactionState(f.Tag, f.Name)
+		state.Description, state.PrivateInfo = f.Description, f.PrivateInfo
+		state.AutoAcceptMember, state.AutoAcceptPeace = f.AutoAcceptMember, f.AutoAcceptPeace
+		for _, m := range f.Members {
+			state.Members[m.SteamID] = memberState{
+				Joined: m.State == hive.FactionMemberJoined,
+				Leader: m.IsLeader,
+			}
+		}
+		for _, r := range f.Relations {
+			state.Relations[tags[r.FactionID.Hex()]] = r.Relation
+		}
+		stored[f.Tag] = state
+
+		expected, ok := s.world.factions[f.Tag]
+		if !ok {
+			continue
+		}
+		if f.FounderSteamID != expected.founder {
+			s.inconsistent("hive: faction %s: founder is %d, expected %d", f.Tag, f.FounderSteamID, expected.founder)
+		}
+		if len(f.Sectors) != len(expected.entities) {
+			s.inconsistent("hive: faction %s: known in %d sectors, expected %d", f.Tag, len(f.Sectors), len(expected.entities))
+		}
+		for _, fs := range f.Sectors {
+			index, ok := sectors[fs.SectorID.Hex()]
+			if !ok {
+				s.inconsistent("hive: faction %s: unknown sector %s", f.Tag, fs.SectorID.Hex())
+				continue
+			}
+			if fs.EntityID != expected.entities[index] {
+				s.inconsistent("hive: faction %s: entity in sector %d is %d, expected %d", f.Tag, index, fs.EntityID, expected.entities[index])
+			}
+		}
+	}
+	s.verifyFactions("hive", stored)
+
+	return nil
+}
+
+func (s *simulator) verifyFactions(name string, factions map[string]*factionState) {
+	for _, tag := range s.world.tags() {
+		f, ok := factions[tag]
+		if !ok {
+			s.inconsistent("%s: faction %s is missing", name, tag)
+			continue
+		}
+		if diffs := f.diff(s.world.factions[tag].factionState); len(diffs) > 0 {
+			s.inconsistent("%s: faction %s: %s", name, tag, strings.Join(diffs, ", "))
+		}
+	}
+	for tag := range factions {
+		if _, ok := s.world.factions[tag]; !ok {
+			s.inconsistent("%s: faction %s is unexpected", name, tag)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+// announce sends a message to the connected sectors of a hive.
+func announce(c *restClient, args []string) error {
+	fs := flagSet("announce")
+	sector := fs.String("sector", "", "only announce to this sector")
+	positional, err := parseArgs(fs, args, -2)
+	if err != nil {
+		return err
+	}
+
+	in := map[string]interface{}{
+		"message": strings.Join(positional[1:], " "),
+	}
+	if *sector != "" {
+		in["sector_id"] = *sector
+	}
+
+	var result hive.AnnouncementResult
+	if _, err := c.do(http.MethodPost, "/api/hive/"+positional[0]+"/announcement", nil, in, &result); err != nil {
+		return err
+	}
+
+	return render(result, []string{"SECTORS"}, func() [][]string {
+		return [][]string{{strconv.Itoa(result.Sectors)}}
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+)
+
+// Time to wait before a broken stream is resumed.
+const resumeDelay = 2 * time.Second
+
+// Table row of an activity.
+const activityFormat = "%-8s  %-20s  %-24s  %-26s  %s\n"
+
+// events tails the activity of a hive until interrupted. A broken stream is
+// resumed after the last received activity.
+func events(c *restClient, args []string) error {
+	fs := flagSet("events")
+	token := fs.String("token", os.Getenv("HIVECTL_OBSERVER_TOKEN"), "observer token of the hive, HIVECTL_OBSERVER_TOKEN")
+	types := fs.String("types", "", "comma separated activity or event types, all if empty")
+	sectors := fs.String("sector", "", "comma separated sector ids, all if empty")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *types != "" {
+		query.Set("types", *types)
+	}
+	if *sectors != "" {
+		query.Set("sector", *sectors)
+	}
+	path := "/api/hive/" + positional[0] + "/events"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	lastID := ""
+	for {
+		resume, err := c.stream(ctx, path, query, *token, lastID, func(id string, data []byte) {
+			if lastID == "" && *output == "table" {
+				fmt.Printf(activityFormat, "TIME", "TYPE", "SECTOR", "EVENT", "DATA")
+			}
+			lastID = id
+			printActivity(data)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !resume {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "hivectl: stream ended, resuming:", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(resumeDelay):
+		}
+	}
+}
+
+// stream reads the server-sent events of path and passes the id and data of
+// each to handle. It reports whether the stream can be resumed.
+func (c *restClient) stream(ctx context.Context, path string, query url.Values, token string, lastID string, handle func(id string, data []byte)) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(path, query), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+
+	// the stream has no deadline
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode >= 500, responseError(http.MethodGet, path, resp.StatusCode, data)
+	}
+
+	var id, name string
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// a truncated replay continues after resuming
+			if len(data) > 0 && name != "replay_truncated" {
+				handle(id, []byte(strings.Join(data, "\n")))
+			}
+			data, name = data[:0], ""
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, fmt.Errorf("connection closed")
+}
+
+// printActivity writes an activity as JSON line or table row.
+func printActivity(data []byte) {
+	if *output == "json" {
+		fmt.Println(string(data))
+		return
+	}
+
+	var activity struct {
+		notification.Activity
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &activity); err != nil {
+		fmt.Fprintln(os.Stderr, "hivectl: malformed activity:", err)
+		return
+	}
+
+	fmt.Printf(activityFormat,
+		activity.Time.Local().Format("15:04:05"),
+		activity.Type,
+		orDash(activity.SectorID),
+		orDash(activity.EventType),
+		orDash(string(activity.Data)),
+	)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/globalsign/mgo/bson"
+)
+
+var memberStates = map[hive.FactionMemberState]string{
+	hive.FactionMemberRequestJoin: "requested",
+	hive.FactionMemberJoined:      "joined",
+}
+
+func factionList(c *restClient, args []string) error {
+	positional, err := parseArgs(flagSet("faction list"), args, 1)
+	if err != nil {
+		return err
+	}
+
+	factions := []hive.Faction{}
+	err = c.list("/api/hive/"+positional[0]+"/faction", func(data []byte) error {
+		var page []hive.Faction
+		err := json.Unmarshal(data, &page)
+		factions = append(factions, page...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return render(factions, []string{"ID", "TAG", "NAME", "FOUNDER", "MEMBERS", "SECTORS", "RELATIONS"}, func() [][]string {
+		rows := make([][]string, 0, len(factions))
+		for _, v := range factions {
+			rows = append(rows, []string{
+				v.ID.Hex(),
+				v.Tag,
+				v.Name,
+				strconv.FormatUint(v.FounderSteamID, 10),
+				strconv.Itoa(len(v.Members)),
+				strconv.Itoa(len(v.Sectors)),
+				strconv.Itoa(len(v.Relations)),
+			})
+		}
+		return rows
+	})
+}
+
+// factionMembers lists the members of a faction given by id or tag.
+func factionMembers(c *restClient, args []string) error {
+	positional, err := parseArgs(flagSet("faction members"), args, 2)
+	if err != nil {
+		return err
+	}
+	hiveID, faction := positional[0], positional[1]
+
+	var members []hive.FactionMember
+	if bson.IsObjectIdHex(faction) {
+		_, err = c.do(http.MethodGet, "/api/hive/"+hiveID+"/faction/"+faction+"/members", nil, nil, &members)
+	} else {
+		var f hive.Faction
+		_, err = c.do(http.MethodGet, "/api/hive/"+hiveID+"/faction/tag/"+faction, nil, nil, &f)
+		members = f.Members
+	}
+	if err != nil {
+		return err
+	}
+	if members == nil {
+		members = []hive.FactionMember{}
+	}
+
+	return render(members, []string{"STEAM ID", "STATE", "LEADER"}, func() [][]string {
+		rows := make([][]string, 0, len(members))
+		for _, v := range members {
+			rows = append(rows, []string{
+				strconv.FormatUint(v.SteamID, 10),
+				memberStates[v.State],
+				strconv.FormatBool(v.IsLeader),
+			})
+		}
+		return rows
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+func hiveList(c *restClient, args []string) error {
+	if _, err := parseArgs(flagSet("hive list"), args, 0); err != nil {
+		return err
+	}
+
+	hives := []hive.Hive{}
+	err := c.list("/api/hive", func(data []byte) error {
+		var page []hive.Hive
+		err := json.Unmarshal(data, &page)
+		hives = append(hives, page...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return render(hives, []string{"ID", "NAME", "BACKPRESSURE"}, func() [][]string {
+		rows := make([][]string, 0, len(hives))
+		for _, v := range hives {
+			rows = append(rows, []string{v.ID.Hex(), v.Name, orDash(v.BackpressurePolicy)})
+		}
+		return rows
+	})
+}
+
+func renderHive(h hive.Hive) error {
+	return render(h, []string{"ID", "NAME", "BACKPRESSURE"}, func() [][]string {
+		return [][]string{{h.ID.Hex(), h.Name, orDash(h.BackpressurePolicy)}}
+	})
+}
+
+func hiveCreate(c *restClient, args []string) error {
+	fs := flagSet("hive create")
+	name := fs.String("name", "", "name of the hive")
+	policy := fs.String("backpressure-policy", "", "backpressure policy of the hive")
+	if _, err := parseArgs(fs, args, 0); err != nil || *name == "" {
+		return errUsage
+	}
+
+	in := map[string]interface{}{"name": *name}
+	if *policy != "" {
+		in["backpressure_policy"] = *policy
+	}
+
+	var h hive.Hive
+	if _, err := c.do(http.MethodPost, "/api/hive", nil, in, &h); err != nil {
+		return err
+	}
+	return renderHive(h)
+}
+
+func hiveUpdate(c *restClient, args []string) error {
+	fs := flagSet("hive update")
+	name := fs.String("name", "", "name of the hive")
+	policy := fs.String("backpressure-policy", "", "backpressure policy of the hive")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	in := map[string]interface{}{}
+	if isSet(fs, "name") {
+		in["name"] = *name
+	}
+	if isSet(fs, "backpressure-policy") {
+		in["backpressure_policy"] = *policy
+	}
+	if len(in) == 0 {
+		return errUsage
+	}
+
+	var h hive.Hive
+	if _, err := c.do(http.MethodPatch, "/api/hive/"+positional[0], nil, in, &h); err != nil {
+		return err
+	}
+	return renderHive(h)
+}
+
+func hiveDelete(c *restClient, args []string) error {
+	fs := flagSet("hive delete")
+	mode := fs.String("mode", "cascade", "cascade removes the sectors and factions, restrict refuses to delete a hive with sectors")
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	return deleteResource(c, "/api/hive/"+positional[0], *mode, *dryRun)
+}
+
+// deleteResource deletes a hive or sector and prints what was removed.
+func deleteResource(c *restClient, path string, mode string, dryRun bool) error {
+	query := url.Values{
+		"mode":    {mode},
+		"dry_run": {strconv.FormatBool(dryRun)},
+	}
+
+	var report hive.DeleteReport
+	if _, err := c.do(http.MethodDelete, path, query, nil, &report); err != nil {
+		return err
+	}
+
+	return render(report, []string{"DRY RUN", "HIVES", "SECTORS", "FACTIONS", "FACTION SECTORS", "MEMBERS", "RELATIONS"}, func() [][]string {
+		return [][]string{{
+			strconv.FormatBool(report.DryRun),
+			strconv.Itoa(report.Hives),
+			strconv.Itoa(report.Sectors),
+			strconv.Itoa(report.Factions),
+			strconv.Itoa(report.FactionSectors),
+			strconv.Itoa(report.Members),
+			strconv.Itoa(report.Relations),
+		}}
+	})
+}
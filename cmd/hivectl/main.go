@@ -0,0 +1,171 @@
+// Command hivectl manages the hives of a hive system over its REST API.
+//
+//	hivectl [-hive URL] [-o table|json] <command> [flags] [args]
+//
+// Commands:
+//
+//	hive list
+//	hive create -name NAME [-backpressure-policy POLICY]
+//	hive update [-name NAME] [-backpressure-policy POLICY] HIVE
+//	hive delete [-mode cascade|restrict] [-dry-run] HIVE
+//	sector list HIVE
+//	sector create -name NAME -address ADDR -max-player N [-x X] [-y Y] HIVE
+//	sector update [-name NAME] [-address ADDR] [-max-player N] [-x X -y Y] HIVE SECTOR
+//	sector delete [-mode cascade|restrict] [-dry-run] HIVE SECTOR
+//	sector rotate-token [-token TOKEN] HIVE SECTOR
+//	faction list HIVE
+//	faction members HIVE FACTION
+//	announce [-sector SECTOR] HIVE MESSAGE...
+//	events [-token TOKEN] [-types TYPES] [-sector SECTORS] HIVE
+//
+// Flags may be given before or after the arguments. A faction is given by id
+// or tag. events tails the activity of a hive until interrupted, it needs the
+// observer token of the hive. rotate-token needs the current token of a sector
+// that has one.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	hiveURL = flag.String("hive", envOr("HIVECTL_URL", "http://localhost:8080"), "base url of the hive system, HIVECTL_URL")
+	output  = flag.String("o", "table", "output format: table or json")
+)
+
+// errUsage reports wrong arguments, the usage of the command is printed.
+var errUsage = errors.New("usage")
+
+type command struct {
+	name  string
+	usage string
+	run   func(c *restClient, args []string) error
+}
+
+var commands = []command{
+	{"hive list", "", hiveList},
+	{"hive create", "-name NAME [-backpressure-policy POLICY]", hiveCreate},
+	{"hive update", "[-name NAME] [-backpressure-policy POLICY] HIVE", hiveUpdate},
+	{"hive delete", "[-mode cascade|restrict] [-dry-run] HIVE", hiveDelete},
+	{"sector list", "HIVE", sectorList},
+	{"sector create", "-name NAME -address ADDR -max-player N [-x X] [-y Y] HIVE", sectorCreate},
+	{"sector update", "[-name NAME] [-address ADDR] [-max-player N] [-x X -y Y] HIVE SECTOR", sectorUpdate},
+	{"sector delete", "[-mode cascade|restrict] [-dry-run] HIVE SECTOR", sectorDelete},
+	{"sector rotate-token", "[-token TOKEN] HIVE SECTOR", sectorRotateToken},
+	{"faction list", "HIVE", factionList},
+	{"faction members", "HIVE FACTION", factionMembers},
+	{"announce", "[-sector SECTOR] HIVE MESSAGE...", announce},
+	{"events", "[-token TOKEN] [-types TYPES] [-sector SECTORS] HIVE", events},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "hivectl: unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+
+	cmd, args, ok := findCommand(flag.Args())
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	base, err := url.Parse(*hiveURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hivectl:", err)
+		os.Exit(2)
+	}
+
+	err = cmd.run(newRestClient(base), args)
+	if err == errUsage {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace("usage: hivectl "+cmd.name+" "+cmd.usage))
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hivectl:", err)
+		os.Exit(1)
+	}
+}
+
+// findCommand returns the command named by the leading arguments and the
+// remaining arguments.
+func findCommand(args []string) (command, []string, bool) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hivectl [-hive URL] [-o table|json] <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace("  "+cmd.name+" "+cmd.usage))
+	}
+	fmt.Fprintln(os.Stderr)
+	flag.PrintDefaults()
+}
+
+// parseArgs parses the flags of a command, which may be mixed with its
+// arguments, and checks the number of arguments. A negative n requires at
+// least -n arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if (n >= 0 && len(positional) != n) || (n < 0 && len(positional) < -n) {
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// flagSet creates the flag set of a command, its errors are reported by
+// parseArgs.
+func flagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+// isSet reports whether a flag was given.
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func envOr(key string, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+)
+
+// restClient talks to the REST API of the hive.
+type restClient struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func newRestClient(base *url.URL) *restClient {
+	return &restClient{
+		base:   base,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *restClient) url(path string, query url.Values) string {
+	u := *c.base
+	u.Path = path
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// do sends a request and decodes the response into out, if not nil. It
+// returns the response headers.
+func (c *restClient) do(method string, path string, query url.Values, in interface{}, out interface{}) (http.Header, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.url(path, query), &body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		return nil, responseError(method, path, resp.StatusCode, data)
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// list fetches every page of a list endpoint and passes each to page.
+func (c *restClient) list(path string, page func(data []byte) error) error {
+	query := url.Values{"limit": {"1000"}}
+	for {
+		var data json.RawMessage
+		header, err := c.do(http.MethodGet, path, query, nil, &data)
+		if err != nil {
+			return err
+		}
+		if err := page(data); err != nil {
+			return err
+		}
+
+		next := header.Get("X-Next-Cursor")
+		if next == "" {
+			return nil
+		}
+		query.Set("cursor", next)
+	}
+}
+
+func responseError(method string, path string, status int, data []byte) error {
+	var envelope struct {
+		Error api.Error `json:"error"`
+	}
+	if json.Unmarshal(data, &envelope) == nil && envelope.Error.Message != "" {
+		return fmt.Errorf("%s %s: %d %s", method, path, status, envelope.Error.Error())
+	}
+	return fmt.Errorf("%s %s: %d", method, path, status)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+var sectorStates = map[hive.SectorState]string{
+	hive.SectorStateUnknown: "unknown",
+	hive.SectorStateOffline: "offline",
+	hive.SectorStateBooting: "booting",
+	hive.SectorStateOnline:  "online",
+}
+
+var sectorHeader = []string{"ID", "NAME", "ADDRESS", "STATE", "PLAYERS", "POSITION", "PROTOCOL"}
+
+func sectorRow(s hive.Sector) []string {
+	protocol := "-"
+	if s.Protocol != nil {
+		protocol = fmt.Sprintf("v%d %s", s.Protocol.Version, s.Protocol.PluginVersion)
+	}
+
+	return []string{
+		s.ID.Hex(),
+		s.Name,
+		s.Address,
+		sectorStates[s.State],
+		fmt.Sprintf("%d/%d", s.PlayerCount, s.MaxPlayer),
+		fmt.Sprintf("%d,%d", s.Position.X, s.Position.Y),
+		protocol,
+	}
+}
+
+func renderSector(s hive.Sector) error {
+	return render(s, sectorHeader, func() [][]string {
+		return [][]string{sectorRow(s)}
+	})
+}
+
+func sectorList(c *restClient, args []string) error {
+	positional, err := parseArgs(flagSet("sector list"), args, 1)
+	if err != nil {
+		return err
+	}
+
+	sectors := []hive.Sector{}
+	err = c.list("/api/hive/"+positional[0]+"/sector", func(data []byte) error {
+		var page []hive.Sector
+		err := json.Unmarshal(data, &page)
+		sectors = append(sectors, page...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return render(sectors, sectorHeader, func() [][]string {
+		rows := make([][]string, 0, len(sectors))
+		for _, v := range sectors {
+			rows = append(rows, sectorRow(v))
+		}
+		return rows
+	})
+}
+
+// sectorFlags are the settable fields of a sector.
+type sectorFlags struct {
+	fs        *flag.FlagSet
+	name      *string
+	address   *string
+	maxPlayer *int
+	x         *int
+	y         *int
+}
+
+func newSectorFlags(command string) sectorFlags {
+	fs := flagSet(command)
+	return sectorFlags{
+		fs:        fs,
+		name:      fs.String("name", "", "name of the sector"),
+		address:   fs.String("address", "", "address players connect to"),
+		maxPlayer: fs.Int("max-player", 0, "maximum number of players"),
+		x:         fs.Int("x", 0, "x position in the hive"),
+		y:         fs.Int("y", 0, "y position in the hive"),
+	}
+}
+
+// body returns the fields given on the command line.
+func (f sectorFlags) body() map[string]interface{} {
+	in := map[string]interface{}{}
+	if isSet(f.fs, "name") {
+		in["name"] = *f.name
+	}
+	if isSet(f.fs, "address") {
+		in["address"] = *f.address
+	}
+	if isSet(f.fs, "max-player") {
+		in["max_player"] = *f.maxPlayer
+	}
+	if isSet(f.fs, "x") || isSet(f.fs, "y") {
+		in["position"] = hive.SectorPosition{X: *f.x, Y: *f.y}
+	}
+	return in
+}
+
+func sectorCreate(c *restClient, args []string) error {
+	f := newSectorFlags("sector create")
+	positional, err := parseArgs(f.fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if !isSet(f.fs, "name") || !isSet(f.fs, "address") || !isSet(f.fs, "max-player") {
+		return errUsage
+	}
+
+	in := f.body()
+	in["position"] = hive.SectorPosition{X: *f.x, Y: *f.y}
+
+	var s hive.Sector
+	if _, err := c.do(http.MethodPost, "/api/hive/"+positional[0]+"/sector", nil, in, &s); err != nil {
+		return err
+	}
+	return renderSector(s)
+}
+
+func sectorUpdate(c *restClient, args []string) error {
+	f := newSectorFlags("sector update")
+	positional, err := parseArgs(f.fs, args, 2)
+	if err != nil {
+		return err
+	}
+	if isSet(f.fs, "x") != isSet(f.fs, "y") {
+		return fmt.Errorf("the position needs both -x and -y")
+	}
+
+	in := f.body()
+	if len(in) == 0 {
+		return errUsage
+	}
+
+	var s hive.Sector
+	if _, err := c.do(http.MethodPatch, "/api/hive/"+positional[0]+"/sector/"+positional[1], nil, in, &s); err != nil {
+		return err
+	}
+	return renderSector(s)
+}
+
+func sectorDelete(c *restClient, args []string) error {
+	fs := flagSet("sector delete")
+	mode := fs.String("mode", "cascade", "cascade removes the factions only present in the sector, restrict refuses to delete a sector with factions")
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	positional, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	return deleteResource(c, "/api/hive/"+positional[0]+"/sector/"+positional[1], *mode, *dryRun)
+}
+
+// sectorRotateToken generates a new token of a sector. The sector is
+// disconnected and has to reconnect with the new token.
+func sectorRotateToken(c *restClient, args []string) error {
+	fs := flagSet("sector rotate-token")
+	current := fs.String("token", os.Getenv("HIVECTL_SECTOR_TOKEN"), "current token of the sector, HIVECTL_SECTOR_TOKEN")
+	positional, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	var query url.Values
+	if *current != "" {
+		query = url.Values{"token": {*current}}
+	}
+
+	var token hive.SectorToken
+	_, err = c.do(http.MethodPost, "/api/hive/"+positional[0]+"/sector/"+positional[1]+"/token", query, nil, &token)
+	if err != nil {
+		return err
+	}
+
+	return render(token, []string{"SECTOR", "TOKEN"}, func() [][]string {
+		return [][]string{{positional[1], token.Token}}
+	})
+}
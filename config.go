@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fankserver/torchapi-hive-system/src/config"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/sirupsen/logrus"
+)
+
+// loadConfig loads the config file and the environment, the flags given on
+// the command line override both.
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dbconn":
+			cfg.Database.Connection = *dbConnection
+		case "reconnect-delay":
+			cfg.ReconnectDelay = *reconnectDelay
+		case "connection-policy":
+			cfg.ConnectionPolicy = *connectionPolicy
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// applyConfig applies the settings that can change while the system runs.
+func applyConfig(hub *notification.Hub, cfg *config.Config) error {
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+
+	if err := hub.SetSettings(cfg.Websocket.Settings()); err != nil {
+		return err
+	}
+	return hub.SetConnectionPolicy(cfg.ConnectionPolicy)
+}
+
+// reloadConfig reloads the config on SIGHUP and stores it in current. An
+// invalid config is ignored, changed settings that need a restart are logged
+// and keep their value from started.
+func reloadConfig(hub *notification.Hub, started *config.Config, current *atomic.Value) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		next, err := loadConfig()
+		if err != nil {
+			logrus.Errorln("config not reloaded:", err)
+			continue
+		}
+
+		if changed := started.KeepRestartSettings(next); len(changed) > 0 {
+			logrus.Warnln("changes of", strings.Join(changed, ", "), "take effect after a restart")
+		}
+
+		if err := applyConfig(hub, next); err != nil {
+			logrus.Errorln("config not reloaded:", err)
+			continue
+		}
+		current.Store(next)
+		logrus.Infoln("config reloaded")
+	}
+}
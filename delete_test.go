@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/event"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+// deleteFixture is a hive with three sectors. ABC is present in alpha and
+// bravo, SOLO only in alpha with a pending member and at war with ABC.
+// charlie has no factions.
+type deleteFixture struct {
+	*e2eHive
+	sectors map[string]*e2eSector
+}
+
+func newDeleteFixture(t *testing.T) *deleteFixture {
+	t.Helper()
+
+	h := newE2EHive(t)
+	a := h.connectSector("alpha", 0)
+	b := h.connectSector("bravo", 1)
+	c := h.connectSector("charlie", 2)
+
+	createFaction(t, []*e2eSector{a, b}, []int64{101, 201}, event.FactionCreated{
+		Tag:            "ABC",
+		Name:           "Alpha Bravo",
+		FounderID:      1,
+		FounderSteamID: 76561198000000001,
+	})
+	createFaction(t, []*e2eSector{a}, []int64{102}, event.FactionCreated{
+		Tag:            "SOLO",
+		Name:           "Solo",
+		FounderID:      2,
+		FounderSteamID: 76561198000000002,
+	})
+	a.mustSend(t, event.TypeFactionMemberSendJoin, event.FactionMember{
+		FactionID:     102,
+		PlayerID:      3,
+		PlayerSteamID: 76561198000000003,
+	})
+	a.mustSend(t, event.TypeFactionDeclareWar, event.FactionPeaceWar{
+		FromFactionID: 102,
+		ToFactionID:   101,
+	})
+
+	return &deleteFixture{
+		e2eHive: h,
+		sectors: map[string]*e2eSector{"alpha": a, "bravo": b, "charlie": c},
+	}
+}
+
+// status sends a REST request without a body and decodes the response into
+// out, whatever its status.
+func (h *e2eHive) status(method string, path string, out interface{}) int {
+	h.t.Helper()
+
+	req, err := http.NewRequest(method, h.server.URL+path, nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		h.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name   string
+		sector string // empty deletes the hive
+		query  string
+		status int
+		report hive.DeleteReport
+
+		// remaining documents of the hive
+		sectors  int
+		factions int
+	}{
+		{
+			name:     "restrict sector without factions",
+			sector:   "charlie",
+			query:    "?mode=restrict",
+			status:   http.StatusOK,
+			report:   hive.DeleteReport{Sectors: 1},
+			sectors:  2,
+			factions: 2,
+		},
+		{
+			name:     "restrict sector with its own faction",
+			sector:   "alpha",
+			query:    "?mode=restrict",
+			status:   http.StatusConflict,
+			report:   hive.DeleteReport{Sectors: 1, Factions: 1, FactionSectors: 2, Members: 1, Relations: 1},
+			sectors:  3,
+			factions: 2,
+		},
+		{
+			name:     "restrict sector with a shared faction",
+			sector:   "bravo",
+			query:    "?mode=restrict",
+			status:   http.StatusConflict,
+			report:   hive.DeleteReport{Sectors: 1, FactionSectors: 1},
+			sectors:  3,
+			factions: 2,
+		},
+		{
+			name:     "dry run sector",
+			sector:   "alpha",
+			query:    "?dry_run=true",
+			status:   http.StatusOK,
+			report:   hive.DeleteReport{DryRun: true, Sectors: 1, Factions: 1, FactionSectors: 2, Members: 1, Relations: 1},
+			sectors:  3,
+			factions: 2,
+		},
+		{
+			name:     "cascade sector",
+			sector:   "alpha",
+			status:   http.StatusOK,
+			report:   hive.DeleteReport{Sectors: 1, Factions: 1, FactionSectors: 2, Members: 1, Relations: 1},
+			sectors:  2,
+			factions: 1,
+		},
+		{
+			name:     "restrict hive",
+			query:    "?mode=restrict",
+			status:   http.StatusConflict,
+			report:   hive.DeleteReport{Hives: 1, Sectors: 3, Factions: 2, FactionSectors: 3, Members: 1, Relations: 2},
+			sectors:  3,
+			factions: 2,
+		},
+		{
+			name:   "cascade hive",
+			status: http.StatusOK,
+			report: hive.DeleteReport{Hives: 1, Sectors: 3, Factions: 2, FactionSectors: 3, Members: 1, Relations: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newDeleteFixture(t)
+
+			path := "/api/hive/" + h.hiveID
+			if tt.sector != "" {
+				path += "/sector/" + h.sectors[tt.sector].id.Hex()
+			}
+
+			var body struct {
+				hive.DeleteReport
+				Error struct {
+					Details hive.DeleteReport `json:"details"`
+				} `json:"error"`
+			}
+			status := h.status(http.MethodDelete, path+tt.query, &body)
+			if status != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, status)
+			}
+			report := body.DeleteReport
+			if status == http.StatusConflict {
+				report = body.Error.Details
+			}
+			if !reflect.DeepEqual(report, tt.report) {
+				t.Errorf("expected report %+v, got %+v", tt.report, report)
+			}
+
+			var sectors []hive.Sector
+			h.do(http.MethodGet, "/api/hive/"+h.hiveID+"/sector", nil, &sectors)
+			if len(sectors) != tt.sectors {
+				t.Errorf("expected %d sectors, got %d", tt.sectors, len(sectors))
+			}
+			var factions []hive.Faction
+			h.do(http.MethodGet, "/api/hive/"+h.hiveID+"/faction", nil, &factions)
+			if len(factions) != tt.factions {
+				t.Errorf("expected %d factions, got %d", tt.factions, len(factions))
+			}
+		})
+	}
+}
+
+func TestDeleteSectorCascadeKeepsSharedFactions(t *testing.T) {
+	h := newDeleteFixture(t)
+	h.do(http.MethodDelete, "/api/hive/"+h.hiveID+"/sector/"+h.sectors["alpha"].id.Hex(), nil, nil)
+
+	abc := h.faction("ABC")
+	want := []hive.FactionSector{{SectorID: h.sectors["bravo"].id, EntityID: 201}}
+	if !reflect.DeepEqual(abc.Sectors, want) {
+		t.Errorf("expected sectors %+v, got %+v", want, abc.Sectors)
+	}
+	if len(abc.Relations) != 0 {
+		t.Errorf("expected the relation to SOLO to be removed, got %+v", abc.Relations)
+	}
+}
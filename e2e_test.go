@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/client"
+	"github.com/fankserver/torchapi-hive-system/src/event"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo/bson"
+)
+
+const e2eTimeout = 5 * time.Second
+
+// e2eHive is the real router and hub on an in-memory store, with one hive
+// created through the REST API.
+type e2eHive struct {
+	t      *testing.T
+	server *httptest.Server
+	hiveID string
+}
+
+// newE2EHive starts the hive, the options set up the system and hub before
+// the hub runs.
+func newE2EHive(t *testing.T, options ...func(*hive.System, *notification.Hub)) *e2eHive {
+	t.Helper()
+
+	system, err := hive.NewSystemWithStore(store.NewMemory(), hive.DefaultDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := notification.NewHub()
+	connect(system, hub)
+	for _, option := range options {
+		option(system, hub)
+	}
+	go hub.Run()
+
+	h := &e2eHive{
+		t:      t,
+		server: httptest.NewServer(api.Recover(newRouter(system, hub))),
+	}
+	t.Cleanup(h.server.Close)
+
+	var created hive.Hive
+	h.do(http.MethodPost, "/api/hive", map[string]interface{}{"name": "e2e"}, &created)
+	h.hiveID = created.ID.Hex()
+	return h
+}
+
+// do sends a REST request and decodes a successful response into out.
+func (h *e2eHive) do(method string, path string, in interface{}, out interface{}) {
+	h.t.Helper()
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, h.server.URL+path, &body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		h.t.Fatalf("%s %s: %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			h.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+}
+
+// faction returns the persisted faction with the tag.
+func (h *e2eHive) faction(tag string) hive.Faction {
+	h.t.Helper()
+
+	var faction hive.Faction
+	h.do(http.MethodGet, "/api/hive/"+h.hiveID+"/faction/tag/"+tag, nil, &faction)
+	return faction
+}
+
+// e2eSector is a sector connected with the client package. It records every
+// event the hive sends.
+type e2eSector struct {
+	name   string
+	id     bson.ObjectId
+	client *client.Client
+	events chan client.Event
+}
+
+func (h *e2eHive) connectSector(name string, index int) *e2eSector {
+	h.t.Helper()
+
+	var created hive.Sector
+	h.do(http.MethodPost, "/api/hive/"+h.hiveID+"/sector", map[string]interface{}{
+		"name":       name,
+		"address":    fmt.Sprintf("127.0.0.1:%d", 27016+index),
+		"max_player": 16,
+		"position":   hive.SectorPosition{X: index},
+	}, &created)
+
+	s := &e2eSector{
+		name:   name,
+		id:     created.ID,
+		events: make(chan client.Event, 64),
+	}
+	connected := make(chan struct{}, 1)
+	c, err := client.New(client.Config{
+		URL:           h.server.URL,
+		HiveID:        h.hiveID,
+		SectorID:      created.ID.Hex(),
+		PluginVersion: "e2e",
+		Events:        event.Types,
+		Handler: func(e client.Event) {
+			s.events <- e
+		},
+		OnConnect: func(protocol.Welcome) {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	s.client = c
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.t.Cleanup(cancel)
+	go c.Run(ctx)
+
+	select {
+	case <-connected:
+	case <-time.After(e2eTimeout):
+		h.t.Fatalf("%s: no handshake", name)
+	}
+	return s
+}
+
+// send writes an event and waits for its final ack.
+func (s *e2eSector) send(t *testing.T, eventType string, payload interface{}) (string, protocol.Ack) {
+	t.Helper()
+
+	call, err := s.client.Send(eventType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+	ack, err := call.Wait(ctx)
+	if err != nil {
+		t.Fatalf("%s: %s: %v", s.name, eventType, err)
+	}
+	return call.ID, ack
+}
+
+// mustSend writes an event that has to succeed.
+func (s *e2eSector) mustSend(t *testing.T, eventType string, payload interface{}) string {
+	t.Helper()
+
+	id, ack := s.send(t, eventType, payload)
+	if !ack.Success {
+		t.Fatalf("%s: %s failed: %s %s", s.name, eventType, ack.Code, ack.Message)
+	}
+	return id
+}
+
+// expect checks the next event the sector received.
+func (s *e2eSector) expect(t *testing.T, id string, eventType string, payload interface{}) {
+	t.Helper()
+
+	select {
+	case e := <-s.events:
+		if e.ID != id || e.Type != eventType {
+			t.Fatalf("%s: expected %s %s, got %s %s", s.name, eventType, id, e.Type, e.ID)
+		}
+		if got := reflect.ValueOf(e.Payload).Elem().Interface(); !reflect.DeepEqual(got, payload) {
+			t.Fatalf("%s: %s: expected %+v, got %+v", s.name, eventType, payload, got)
+		}
+	case <-time.After(e2eTimeout):
+		t.Fatalf("%s: no %s received", s.name, eventType)
+	}
+}
+
+// expectNone checks that the sector received no further event.
+func (s *e2eSector) expectNone(t *testing.T) {
+	t.Helper()
+
+	select {
+	case e := <-s.events:
+		t.Fatalf("%s: unexpected %s %s", s.name, e.Type, e.Raw)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// createFaction creates a faction in the first sector and completes it in the
+// others with their entity ids.
+func createFaction(t *testing.T, sectors []*e2eSector, entities []int64, created event.FactionCreated) {
+	t.Helper()
+
+	created.FactionID = entities[0]
+	id := sectors[0].mustSend(t, event.TypeFactionCreated, created)
+	for i, s := range sectors[1:] {
+		s.expect(t, id, event.TypeFactionCreated, created)
+		s.mustSend(t, event.TypeFactionCreatedComplete, event.FactionCreatedComplete{
+			FactionID: entities[i+1],
+			Tag:       created.Tag,
+		})
+	}
+	sectors[0].expectNone(t)
+}
+
+func TestFactionScenario(t *testing.T) {
+	h := newE2EHive(t)
+	a := h.connectSector("alpha", 0)
+	b := h.connectSector("bravo", 1)
+	c := h.connectSector("charlie", 2)
+	sectors := []*e2eSector{a, b, c}
+
+	const founder, player = uint64(76561198000000001), uint64(76561198000000002)
+	abc := []int64{101, 201, 301}
+	xyz := []int64{102, 202, 302}
+
+	createFaction(t, sectors, abc, event.FactionCreated{
+		Tag:            "ABC",
+		Name:           "Alpha Bravo",
+		FounderID:      1,
+		FounderSteamID: founder,
+	})
+	createFaction(t, []*e2eSector{b, a, c}, []int64{xyz[1], xyz[0], xyz[2]}, event.FactionCreated{
+		Tag:            "XYZ",
+		Name:           "X-Ray",
+		FounderID:      2,
+		FounderSteamID: founder + 10,
+	})
+
+	// join in alpha, accepted in bravo, promoted in charlie
+	steps := []struct {
+		from      int
+		eventType string
+	}{
+		{0, event.TypeFactionMemberSendJoin},
+		{1, event.TypeFactionMemberAcceptJoin},
+		{2, event.TypeFactionMemberPromote},
+	}
+	for _, step := range steps {
+		id := sectors[step.from].mustSend(t, step.eventType, event.FactionMember{
+			FactionID:     abc[step.from],
+			PlayerID:      3,
+			PlayerSteamID: player,
+			PlayerName:    "Player",
+		})
+		for i, s := range sectors {
+			if i == step.from {
+				continue
+			}
+			s.expect(t, id, step.eventType, event.FactionMember{
+				FactionID:     abc[i],
+				PlayerID:      3,
+				PlayerSteamID: player,
+				PlayerName:    "Player",
+			})
+		}
+	}
+
+	faction := h.faction("ABC")
+	if faction.FounderSteamID != founder {
+		t.Errorf("expected founder %d, got %d", founder, faction.FounderSteamID)
+	}
+	wantMembers := []hive.FactionMember{{SteamID: player, State: hive.FactionMemberJoined, IsLeader: true}}
+	if !reflect.DeepEqual(faction.Members, wantMembers) {
+		t.Errorf("expected members %+v, got %+v", wantMembers, faction.Members)
+	}
+	wantSectors := []hive.FactionSector{
+		{SectorID: a.id, EntityID: abc[0]},
+		{SectorID: b.id, EntityID: abc[1]},
+		{SectorID: c.id, EntityID: abc[2]},
+	}
+	if !reflect.DeepEqual(faction.Sectors, wantSectors) {
+		t.Errorf("expected sectors %+v, got %+v", wantSectors, faction.Sectors)
+	}
+
+	// war from alpha, peace requested by bravo and accepted in charlie
+	relationSteps := []struct {
+		from      int
+		eventType string
+		fromIDs   []int64
+		toIDs     []int64
+		abc       hive.FactionRelationState
+		xyz       hive.FactionRelationState
+	}{
+		{0, event.TypeFactionDeclareWar, abc, xyz, hive.FactionRelationWar, hive.FactionRelationWar},
+		{1, event.TypeFactionSendPeaceRequest, xyz, abc, hive.FactionRelationWar, hive.FactionRelationSendPeaceRequest},
+		{2, event.TypeFactionAcceptPeace, abc, xyz, hive.FactionRelationPeace, hive.FactionRelationPeace},
+	}
+	for _, step := range relationSteps {
+		id := sectors[step.from].mustSend(t, step.eventType, event.FactionPeaceWar{
+			FromFactionID: step.fromIDs[step.from],
+			ToFactionID:   step.toIDs[step.from],
+		})
+		for i, s := range sectors {
+			if i == step.from {
+				continue
+			}
+			s.expect(t, id, step.eventType, event.FactionPeaceWar{
+				FromFactionID: step.fromIDs[i],
+				ToFactionID:   step.toIDs[i],
+			})
+		}
+
+		abcFaction, xyzFaction := h.faction("ABC"), h.faction("XYZ")
+		wantABC := []hive.FactionRelation{{FactionID: xyzFaction.ID, Relation: step.abc}}
+		if !reflect.DeepEqual(abcFaction.Relations, wantABC) {
+			t.Errorf("%s: expected ABC relations %+v, got %+v", step.eventType, wantABC, abcFaction.Relations)
+		}
+		wantXYZ := []hive.FactionRelation{{FactionID: abcFaction.ID, Relation: step.xyz}}
+		if !reflect.DeepEqual(xyzFaction.Relations, wantXYZ) {
+			t.Errorf("%s: expected XYZ relations %+v, got %+v", step.eventType, wantXYZ, xyzFaction.Relations)
+		}
+	}
+
+	for _, s := range sectors {
+		s.expectNone(t)
+	}
+}
+
+func TestFactionEventsAreProcessedInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	h := newE2EHive(t, func(system *hive.System, hub *notification.Hub) {
+		hub.RegisterEventHandler(func(hiveHex string, sectorHex string, message []byte) (bool, map[string][]byte, error) {
+			var envelope protocol.Envelope
+			if err := json.Unmarshal(message, &envelope); err != nil {
+				return false, nil, err
+			}
+			// a slow creation is overtaken unless the war waits for it
+			if envelope.Type == event.TypeFactionCreated {
+				time.Sleep(50 * time.Millisecond)
+			}
+			mu.Lock()
+			order = append(order, envelope.Type)
+			mu.Unlock()
+			return system.ProcessSectorEvent(hiveHex, sectorHex, message)
+		})
+	})
+	a := h.connectSector("alpha", 0)
+	createFaction(t, []*e2eSector{a}, []int64{9}, event.FactionCreated{
+		Tag:            "XYZ",
+		Name:           "X-Ray",
+		FounderID:      2,
+		FounderSteamID: 76561198000000002,
+	})
+
+	mu.Lock()
+	order = nil
+	mu.Unlock()
+	created, err := a.client.Send(event.TypeFactionCreated, event.FactionCreated{
+		FactionID:      7,
+		Tag:            "ABC",
+		Name:           "Alpha",
+		FounderID:      1,
+		FounderSteamID: 76561198000000001,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	war, err := a.client.Send(event.TypeFactionDeclareWar, event.FactionPeaceWar{FromFactionID: 7, ToFactionID: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+	for _, call := range []*client.Call{created, war} {
+		ack, err := call.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ack.Success {
+			t.Fatalf("%s failed: %s %s", call.ID, ack.Code, ack.Message)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{event.TypeFactionCreated, event.TypeFactionDeclareWar}; !reflect.DeepEqual(order, want) {
+		t.Errorf("processed %v, want %v", order, want)
+	}
+}
+
+func TestRejectedEventIsNotForwarded(t *testing.T) {
+	h := newE2EHive(t)
+	a := h.connectSector("alpha", 0)
+	b := h.connectSector("bravo", 1)
+
+	createFaction(t, []*e2eSector{a, b}, []int64{1, 2}, event.FactionCreated{
+		Tag:            "ABC",
+		Name:           "Alpha",
+		FounderID:      1,
+		FounderSteamID: 76561198000000001,
+	})
+
+	join := event.FactionMember{FactionID: 1, PlayerID: 3, PlayerSteamID: 76561198000000002}
+	id := a.mustSend(t, event.TypeFactionMemberSendJoin, join)
+	forwarded := join
+	forwarded.FactionID = 2
+	b.expect(t, id, event.TypeFactionMemberSendJoin, forwarded)
+
+	_, ack := a.send(t, event.TypeFactionMemberSendJoin, join)
+	if ack.Success || ack.Code != api.CodeConflict {
+		t.Errorf("expected a conflict for the second join, got %+v", ack)
+	}
+
+	_, ack = a.send(t, event.TypeFactionMemberSendJoin, event.FactionMember{FactionID: 99, PlayerID: 3, PlayerSteamID: 76561198000000002})
+	if ack.Success || ack.Code != api.CodeNotFound {
+		t.Errorf("expected unknown factions to be not found, got %+v", ack)
+	}
+
+	if members := h.faction("ABC").Members; len(members) != 1 {
+		t.Errorf("expected one member, got %+v", members)
+	}
+	b.expectNone(t)
+}
+
+func TestAnnouncement(t *testing.T) {
+	h := newE2EHive(t)
+	a := h.connectSector("alpha", 0)
+	b := h.connectSector("bravo", 1)
+
+	var result hive.AnnouncementResult
+	h.do(http.MethodPost, "/api/hive/"+h.hiveID+"/announcement", map[string]interface{}{
+		"message": "restart in 5 minutes",
+	}, &result)
+	if result.Sectors != 2 {
+		t.Errorf("expected the announcement to reach 2 sectors, got %d", result.Sectors)
+	}
+	for _, s := range []*e2eSector{a, b} {
+		select {
+		case e := <-s.events:
+			if e.Type != protocol.TypeAnnouncement || e.Raw != `{"message":"restart in 5 minutes"}` {
+				t.Errorf("%s: unexpected %s %s", s.name, e.Type, e.Raw)
+			}
+		case <-time.After(e2eTimeout):
+			t.Fatalf("%s: no announcement received", s.name)
+		}
+	}
+
+	h.do(http.MethodPost, "/api/hive/"+h.hiveID+"/announcement", map[string]interface{}{
+		"message":   "only bravo",
+		"sector_id": b.id,
+	}, &result)
+	if result.Sectors != 1 {
+		t.Errorf("expected the announcement to reach 1 sector, got %d", result.Sectors)
+	}
+	select {
+	case e := <-b.events:
+		if e.Type != protocol.TypeAnnouncement {
+			t.Errorf("bravo: unexpected %s %s", e.Type, e.Raw)
+		}
+	case <-time.After(e2eTimeout):
+		t.Fatal("bravo: no announcement received")
+	}
+	a.expectNone(t)
+}
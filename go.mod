@@ -4,4 +4,6 @@ require (
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8 // indirect
 	github.com/gorilla/mux v1.6.2 // indirect
 	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/capture"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time to wait for the ack of a replayed event.
+	replayAckTimeout = 10 * time.Second
+
+	// Time for the hive to process an event of a sector without acks.
+	replaySettle = 50 * time.Millisecond
+
+	// Maximum number of reported message divergences per sector.
+	maxSectorDivergences = 20
+)
+
+// replay feeds a capture into a fresh system and hub on an in-memory store and
+// writes the divergences in outgoing messages and faction state to out. The
+// events are replayed one after another, each waits for its ack. A capture
+// with gaps is reported as incomplete and never matches.
+func replay(path string, out io.Writer) (bool, error) {
+	records, err := capture.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if len(records) == 0 || records[0].Kind != capture.KindSnapshot || records[0].Snapshot == nil {
+		return false, fmt.Errorf("%s does not start with a snapshot", path)
+	}
+	hiveHex := records[0].HiveID
+
+	system, err := hive.NewSystemWithStore(store.NewMemory(), hive.DefaultDatabase)
+	if err != nil {
+		return false, err
+	}
+	if err := system.Restore(records[0].Snapshot); err != nil {
+		return false, err
+	}
+
+	// sectors created during the capture are only in the final snapshot
+	var final *capture.Snapshot
+	for _, record := range records[1:] {
+		if record.Kind == capture.KindSnapshot {
+			final = record.Snapshot
+		}
+	}
+	if final != nil {
+		if err := system.Restore(&capture.Snapshot{Sectors: final.Sectors}); err != nil {
+			return false, err
+		}
+	}
+
+	sent := &sentMessages{sectors: make(map[string][]string)}
+	hub := notification.NewHub()
+	connect(system, hub)
+	hub.RegisterRecorder(sent.record)
+	go hub.Run()
+
+	server := httptest.NewServer(api.Recover(newRouter(system, hub)))
+	defer server.Close()
+
+	r := &replayer{
+		url:         "ws" + strings.TrimPrefix(server.URL, "http"),
+		hiveHex:     hiveHex,
+		connections: make(map[string]*replayConnection),
+	}
+	defer r.closeAll()
+
+	expected := make(map[string][]string)
+	gaps, dropped := 0, 0
+	for _, record := range records[1:] {
+		switch record.Kind {
+		case capture.KindGap:
+			gaps++
+			dropped += record.Dropped
+		case capture.KindConnect:
+			r.connect(record)
+		case capture.KindDisconnect:
+			r.disconnect(record.SectorID)
+		case capture.KindReceive:
+			r.receive(record)
+		case capture.KindSend:
+			if !isAnnouncement(record.Message) {
+				expected[record.SectorID] = append(expected[record.SectorID], record.Message)
+			}
+		}
+	}
+	r.closeAll()
+
+	fmt.Fprintf(out, "replayed %d records of hive %s\n", len(records), hiveHex)
+	if gaps > 0 {
+		fmt.Fprintf(out, "capture is incomplete: %d records dropped in %d gaps, the replay misses them\n", dropped, gaps)
+	}
+	divergences := r.divergences
+	actual := sent.snapshot()
+
+	if final == nil {
+		fmt.Fprintln(out, "capture has no final snapshot, faction state not compared")
+	} else {
+		current, err := system.Snapshot(hiveHex)
+		if err != nil {
+			return false, err
+		}
+
+		// factions created during the replay got new ids
+		ids, err := factionIDs(final, current)
+		if err != nil {
+			return false, err
+		}
+		for sectorHex, messages := range actual {
+			for i, message := range messages {
+				for replayed, captured := range ids {
+					message = strings.Replace(message, replayed, captured, -1)
+				}
+				actual[sectorHex][i] = message
+			}
+		}
+
+		factionDivergences, err := diffFactions(final, current)
+		if err != nil {
+			return false, err
+		}
+		divergences = append(divergences, factionDivergences...)
+	}
+	divergences = append(diffMessages(expected, actual), divergences...)
+
+	for _, v := range divergences {
+		fmt.Fprintln(out, v)
+	}
+	if len(divergences) > 0 {
+		fmt.Fprintf(out, "replay diverged: %d differences\n", len(divergences))
+		return false, nil
+	}
+	if gaps > 0 {
+		fmt.Fprintln(out, "replay matched the incomplete capture")
+		return false, nil
+	}
+	fmt.Fprintln(out, "replay matched")
+	return true, nil
+}
+
+// sentMessages records the messages the replaying hub sends per sector.
+type sentMessages struct {
+	mu      sync.Mutex
+	sectors map[string][]string
+}
+
+func (s *sentMessages) record(record capture.Record) {
+	if record.Kind != capture.KindSend || isAnnouncement(record.Message) {
+		return
+	}
+
+	s.mu.Lock()
+	s.sectors[record.SectorID] = append(s.sectors[record.SectorID], record.Message)
+	s.mu.Unlock()
+}
+
+func (s *sentMessages) snapshot() map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sectors := make(map[string][]string, len(s.sectors))
+	for k, v := range s.sectors {
+		sectors[k] = append([]string(nil), v...)
+	}
+	return sectors
+}
+
+// isAnnouncement reports whether a message is an announcement of the
+// operators, those are sent through the API and not replayed.
+func isAnnouncement(message string) bool {
+	var envelope protocol.Envelope
+	return json.Unmarshal([]byte(message), &envelope) == nil && envelope.Type == protocol.TypeAnnouncement
+}
+
+// replayer plays the sectors of a capture.
+type replayer struct {
+	url         string
+	hiveHex     string
+	connections map[string]*replayConnection
+	divergences []string
+}
+
+type replayConnection struct {
+	conn    *websocket.Conn
+	welcome protocol.Welcome
+	acks    chan protocol.Ack
+	done    chan struct{}
+}
+
+func (r *replayer) diverged(format string, args ...interface{}) {
+	r.divergences = append(r.divergences, fmt.Sprintf(format, args...))
+}
+
+// connect opens the connection of a sector with the recorded hello.
+func (r *replayer) connect(record capture.Record) {
+	r.disconnect(record.SectorID)
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s/ws/hive/%s/sector/%s", r.url, r.hiveHex, record.SectorID), nil)
+	if err != nil {
+		r.diverged("sector %s: connect: %v", record.SectorID, err)
+		return
+	}
+
+	c := &replayConnection{
+		conn: conn,
+		acks: make(chan protocol.Ack, 16),
+		done: make(chan struct{}),
+	}
+
+	// legacy sectors connect without a hello
+	if record.Message != "" {
+		c.welcome, err = replayHandshake(conn, record.Message)
+		if err != nil {
+			conn.Close()
+			r.diverged("sector %s: handshake: %v", record.SectorID, err)
+			return
+		}
+	}
+
+	r.connections[record.SectorID] = c
+	go c.read()
+}
+
+func replayHandshake(conn *websocket.Conn, hello string) (protocol.Welcome, error) {
+	var welcome protocol.Welcome
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(hello)); err != nil {
+		return welcome, err
+	}
+
+	messageType, frame, err := conn.ReadMessage()
+	if err != nil {
+		return welcome, err
+	}
+	codec := protocol.CodecFor(protocol.EncodingJSON)
+	if messageType == websocket.BinaryMessage {
+		codec = protocol.CodecFor(protocol.EncodingMsgpack)
+	}
+	data, err := codec.Decode(frame)
+	if err != nil {
+		return welcome, err
+	}
+
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return welcome, err
+	}
+	if envelope.Type != protocol.TypeWelcome {
+		return welcome, fmt.Errorf("expected %s, got %s", protocol.TypeWelcome, envelope.Type)
+	}
+
+	err = json.Unmarshal([]byte(envelope.Raw), &welcome)
+	return welcome, err
+}
+
+// read passes the acks of the hive to the replayer until the connection
+// closes.
+func (c *replayConnection) read() {
+	defer close(c.done)
+
+	codec := c.welcome.Codec()
+	for {
+		_, frame, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		data, err := codec.Decode(frame)
+		if err != nil {
+			continue
+		}
+		var envelope protocol.Envelope
+		if json.Unmarshal(data, &envelope) != nil || envelope.Type != protocol.TypeAck {
+			continue
+		}
+
+		var ack protocol.Ack
+		if json.Unmarshal([]byte(envelope.Raw), &ack) != nil {
+			continue
+		}
+		select {
+		case c.acks <- ack:
+		default:
+		}
+	}
+}
+
+// receive sends a recorded event of a sector and waits until the hive
+// processed it.
+func (r *replayer) receive(record capture.Record) {
+	c, ok := r.connections[record.SectorID]
+	if !ok {
+		r.diverged("sector %s: event while not connected: %s", record.SectorID, record.Message)
+		return
+	}
+
+	frame, err := c.welcome.Codec().Encode([]byte(record.Message))
+	if err != nil {
+		r.diverged("sector %s: encode: %v", record.SectorID, err)
+		return
+	}
+	messageType := websocket.TextMessage
+	if c.welcome.Codec().Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	if err := c.conn.WriteMessage(messageType, frame); err != nil {
+		r.diverged("sector %s: send: %v", record.SectorID, err)
+		return
+	}
+
+	var envelope protocol.Envelope
+	json.Unmarshal([]byte(record.Message), &envelope)
+	if !c.welcome.Acknowledges() || envelope.ID == "" {
+		time.Sleep(replaySettle)
+		return
+	}
+
+	timeout := time.After(replayAckTimeout)
+	for {
+		select {
+		case ack := <-c.acks:
+			if ack.EventID == envelope.ID {
+				return
+			}
+		case <-c.done:
+			r.diverged("sector %s: connection closed before the ack of %s", record.SectorID, envelope.ID)
+			return
+		case <-timeout:
+			r.diverged("sector %s: no ack of %s within %s", record.SectorID, envelope.ID, replayAckTimeout)
+			return
+		}
+	}
+}
+
+// disconnect closes the connection of a sector.
+func (r *replayer) disconnect(sectorHex string) {
+	c, ok := r.connections[sectorHex]
+	if !ok {
+		return
+	}
+	delete(r.connections, sectorHex)
+
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+	}
+	c.conn.Close()
+}
+
+func (r *replayer) closeAll() {
+	for sectorHex := range r.connections {
+		r.disconnect(sectorHex)
+	}
+}
+
+// diffMessages compares the messages sent to every sector.
+func diffMessages(expected map[string][]string, actual map[string][]string) []string {
+	sectors := make(map[string]bool)
+	for k := range expected {
+		sectors[k] = true
+	}
+	for k := range actual {
+		sectors[k] = true
+	}
+	sorted := make([]string, 0, len(sectors))
+	for k := range sectors {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var divergences []string
+	for _, sectorHex := range sorted {
+		want, got := expected[sectorHex], actual[sectorHex]
+
+		reported := 0
+		for i := 0; i < len(want) || i < len(got); i++ {
+			if reported == maxSectorDivergences {
+				divergences = append(divergences, fmt.Sprintf("sector %s: further messages differ", sectorHex))
+				break
+			}
+
+			switch {
+			case i >= len(got):
+				divergences = append(divergences, fmt.Sprintf("sector %s: message %d missing: %s", sectorHex, i+1, want[i]))
+			case i >= len(want):
+				divergences = append(divergences, fmt.Sprintf("sector %s: message %d unexpected: %s", sectorHex, i+1, got[i]))
+			case !sameMessage(want[i], got[i]):
+				divergences = append(divergences, fmt.Sprintf("sector %s: message %d differs:\n  capture: %s\n  replay:  %s", sectorHex, i+1, want[i], got[i]))
+			default:
+				continue
+			}
+			reported++
+		}
+	}
+	return divergences
+}
+
+// sameMessage compares two messages by their content, independent of the
+// formatting of their JSON.
+func sameMessage(a string, b string) bool {
+	if a == b {
+		return true
+	}
+
+	var ea, eb protocol.Envelope
+	if json.Unmarshal([]byte(a), &ea) != nil || json.Unmarshal([]byte(b), &eb) != nil {
+		return false
+	}
+	if ea.ID != eb.ID || ea.Type != eb.Type {
+		return false
+	}
+
+	var ra, rb interface{}
+	if json.Unmarshal([]byte(ea.Raw), &ra) != nil || json.Unmarshal([]byte(eb.Raw), &rb) != nil {
+		return ea.Raw == eb.Raw
+	}
+	return reflect.DeepEqual(ra, rb)
+}
+
+// factionIDs maps the ids of the replayed factions to the captured ones with
+// the same tag.
+func factionIDs(expected *capture.Snapshot, actual *capture.Snapshot) (map[string]string, error) {
+	captured, err := hive.SnapshotFactions(expected)
+	if err != nil {
+		return nil, err
+	}
+	replayed, err := hive.SnapshotFactions(actual)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(captured))
+	for _, v := range captured {
+		tags[v.Tag] = v.ID.Hex()
+	}
+	ids := make(map[string]string, len(replayed))
+	for _, v := range replayed {
+		if id, ok := tags[v.Tag]; ok && id != v.ID.Hex() {
+			ids[v.ID.Hex()] = id
+		}
+	}
+	return ids, nil
+}
+
+// factionState is the comparable state of a faction. Relations refer to the
+// other faction by tag, factions created during a replay get new ids.
+type factionState struct {
+	Name             string
+	Description      string
+	PrivateInfo      string
+	AcceptHumans     bool
+	FounderSteamID   uint64
+	AutoAcceptMember bool
+	AutoAcceptPeace  bool
+	Members          []hive.FactionMember
+	Sectors          []hive.FactionSector
+	Relations        map[string]hive.FactionRelationState
+}
+
+func factionStates(snapshot *capture.Snapshot) (map[string]factionState, error) {
+	factions, err := hive.SnapshotFactions(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(factions))
+	for _, v := range factions {
+		tags[v.ID.Hex()] = v.Tag
+	}
+
+	states := make(map[string]factionState, len(factions))
+	for _, v := range factions {
+		state := factionState{
+			Name:             v.Name,
+			Description:      v.Description,
+			PrivateInfo:      v.PrivateInfo,
+			AcceptHumans:     v.AcceptHumans,
+			FounderSteamID:   v.FounderSteamID,
+			AutoAcceptMember: v.AutoAcceptMember,
+			AutoAcceptPeace:  v.AutoAcceptPeace,
+			Members:          v.Members,
+			Sectors:          v.Sectors,
+			Relations:        make(map[string]hive.FactionRelationState, len(v.Relations)),
+		}
+		for _, relation := range v.Relations {
+			tag, ok := tags[relation.FactionID.Hex()]
+			if !ok {
+				tag = relation.FactionID.Hex()
+			}
+			state.Relations[tag] = relation.Relation
+		}
+		states[v.Tag] = state
+	}
+	return states, nil
+}
+
+// diffFactions compares the factions of the capture with the replayed ones.
+func diffFactions(expected *capture.Snapshot, actual *capture.Snapshot) ([]string, error) {
+	want, err := factionStates(expected)
+	if err != nil {
+		return nil, err
+	}
+	got, err := factionStates(actual)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]bool)
+	for k := range want {
+		tags[k] = true
+	}
+	for k := range got {
+		tags[k] = true
+	}
+	sorted := make([]string, 0, len(tags))
+	for k := range tags {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var divergences []string
+	for _, tag := range sorted {
+		w, inCapture := want[tag]
+		g, inReplay := got[tag]
+		switch {
+		case !inReplay:
+			divergences = append(divergences, fmt.Sprintf("faction %s: missing after the replay", tag))
+			continue
+		case !inCapture:
+			divergences = append(divergences, fmt.Sprintf("faction %s: created by the replay only", tag))
+			continue
+		}
+
+		wv, gv := reflect.ValueOf(w), reflect.ValueOf(g)
+		for i := 0; i < wv.NumField(); i++ {
+			a, b := wv.Field(i).Interface(), gv.Field(i).Interface()
+			if reflect.DeepEqual(a, b) || (isEmpty(wv.Field(i)) && isEmpty(gv.Field(i))) {
+				continue
+			}
+			divergences = append(divergences, fmt.Sprintf("faction %s: %s differs:\n  capture: %+v\n  replay:  %+v", tag, wv.Type().Field(i).Name, a, b))
+		}
+	}
+	return divergences, nil
+}
+
+// isEmpty reports whether a slice or map field has no elements, nil and empty
+// are the same state.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/capture"
+	"github.com/fankserver/torchapi-hive-system/src/event"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+)
+
+// captureScenario runs a short faction scenario with capture and returns the
+// capture file.
+func captureScenario(t *testing.T) string {
+	dir := t.TempDir()
+
+	var recorder *capture.Recorder
+	h := newE2EHive(t, func(system *hive.System, hub *notification.Hub) {
+		var err error
+		recorder, err = capture.NewRecorder(dir, nil, system.Snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub.RegisterRecorder(recorder.Record)
+	})
+	a := h.connectSector("alpha", 0)
+	b := h.connectSector("bravo", 1)
+
+	createFaction(t, []*e2eSector{a, b}, []int64{1, 2}, event.FactionCreated{
+		Tag:            "ABC",
+		Name:           "Alpha",
+		FounderID:      1,
+		FounderSteamID: 76561198000000001,
+	})
+	join := event.FactionMember{FactionID: 1, PlayerID: 3, PlayerSteamID: 76561198000000002}
+	id := a.mustSend(t, event.TypeFactionMemberSendJoin, join)
+	forwarded := join
+	forwarded.FactionID = 2
+	b.expect(t, id, event.TypeFactionMemberSendJoin, forwarded)
+	a.send(t, event.TypeFactionMemberSendJoin, join)
+	b.expectNone(t)
+
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, h.hiveID+"-*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v %v", files, err)
+	}
+	return files[0]
+}
+
+// writeCapture replaces the records of a capture file.
+func writeCapture(t *testing.T, path string, records []capture.Record) {
+	var lines []string
+	for _, v := range records {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(data))
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayMatchesCapture(t *testing.T) {
+	path := captureScenario(t)
+
+	var out bytes.Buffer
+	matched, err := replay(path, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matched {
+		t.Fatalf("expected the replay to match:\n%s", out.String())
+	}
+}
+
+func TestReplayReportsDivergences(t *testing.T) {
+	path := captureScenario(t)
+
+	// drop the join of the final state, the replay adds it again
+	records, err := capture.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final := records[len(records)-1].Snapshot
+	final.Factions[0] = bytes.Replace(final.Factions[0], []byte(`"members":[`), []byte(`"members":[],"ignored":[`), 1)
+
+	writeCapture(t, path, records)
+
+	var out bytes.Buffer
+	matched, err := replay(path, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched || !strings.Contains(out.String(), "faction ABC: Members differs") {
+		t.Fatalf("expected a divergence of the members, got:\n%s", out.String())
+	}
+}
+
+func TestReplayReportsIncompleteCapture(t *testing.T) {
+	path := captureScenario(t)
+
+	records, err := capture.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gap := capture.Record{Time: records[0].Time, Kind: capture.KindGap, HiveID: records[0].HiveID, Dropped: 3}
+	records = append(records[:1], append([]capture.Record{gap}, records[1:]...)...)
+	writeCapture(t, path, records)
+
+	var out bytes.Buffer
+	matched, err := replay(path, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched || !strings.Contains(out.String(), "capture is incomplete: 3 records dropped") {
+		t.Fatalf("expected an incomplete capture, got:\n%s", out.String())
+	}
+}
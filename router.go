@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// authorizeObserver checks the observer token of a request.
+func authorizeObserver(system *hive.System, w http.ResponseWriter, r *http.Request) (bson.ObjectId, bool) {
+	hiveID := bson.ObjectIdHex(mux.Vars(r)["hive_id"])
+
+	valid, err := system.IsObserverTokenValid(hiveID, api.RequestToken(r))
+	if err != nil {
+		api.WriteError(w, err)
+		return hiveID, false
+	}
+
+	if !valid {
+		api.WriteError(w, api.Unauthorized("invalid observer token"))
+		return hiveID, false
+	}
+
+	return hiveID, true
+}
+
+func newRouter(system *hive.System, hub *notification.Hub) *mux.Router {
+	router := mux.NewRouter()
+	router.NotFoundHandler = api.NotFoundHandler()
+	router.MethodNotAllowedHandler = api.MethodNotAllowedHandler()
+	router.Use(api.ValidateIDs)
+	router.HandleFunc("/", func(writer http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(writer, "TorchAPI Hive System")
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/ws/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		hiveID := bson.ObjectIdHex(vars["hive_id"])
+		sectorID := bson.ObjectIdHex(vars["sector_id"])
+
+		valid, err := system.IsSectorValid(hiveID, sectorID)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+
+		if !valid {
+			api.WriteError(w, api.NotFound("sector not found"))
+			return
+		}
+
+		valid, err = system.IsSectorTokenValid(hiveID, sectorID, api.RequestToken(r))
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+
+		if !valid {
+			api.WriteError(w, api.Unauthorized("invalid sector token"))
+			return
+		}
+
+		notification.ServeWs(hub, w, r, hiveID.Hex(), sectorID.Hex())
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/ws/hive/{hive_id:[a-z0-9]+}/observe", func(w http.ResponseWriter, r *http.Request) {
+		hiveID, ok := authorizeObserver(system, w, r)
+		if !ok {
+			return
+		}
+
+		var types, sectors []string
+		if v := r.URL.Query().Get("types"); v != "" {
+			types = strings.Split(v, ",")
+		}
+		if v := r.URL.Query().Get("sector"); v != "" {
+			sectors = strings.Split(v, ",")
+		}
+
+		notification.ServeObserver(hub, w, r, hiveID.Hex(), types, sectors)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/api/openapi.json", api.ServeOpenAPI).Methods(http.MethodGet)
+	router.HandleFunc("/api/docs", api.ServeDocs).Methods(http.MethodGet)
+	router.HandleFunc("/api/schema/event", hive.GetSectorEventSchemas).Methods(http.MethodGet)
+	router.HandleFunc("/api/schema/event/{event_type}", hive.GetSectorEventSchema).Methods(http.MethodGet)
+	router.HandleFunc("/api/schema/frame", hive.GetFrameSchemas).Methods(http.MethodGet)
+	router.HandleFunc("/api/schema/frame/{encoding}", hive.GetFrameSchema).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive", system.GetHives).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive", system.CreateHive).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}", system.GetHive).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}", system.UpdateHive).Methods(http.MethodPut)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}", system.PatchHive).Methods(http.MethodPatch)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}", system.DeleteHive).Methods(http.MethodDelete)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/announcement", system.CreateAnnouncement).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/events", func(w http.ResponseWriter, r *http.Request) {
+		hiveID, ok := authorizeObserver(system, w, r)
+		if !ok {
+			return
+		}
+
+		notification.ServeEvents(hub, w, r, hiveID.Hex())
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/observer_token", system.CreateObserverToken).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook", system.GetWebhooks).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook", system.CreateWebhook).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook/{webhook_id:[a-z0-9]+}", system.GetWebhook).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook/{webhook_id:[a-z0-9]+}", system.UpdateWebhook).Methods(http.MethodPut)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook/{webhook_id:[a-z0-9]+}", system.PatchWebhook).Methods(http.MethodPatch)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook/{webhook_id:[a-z0-9]+}", system.DeleteWebhook).Methods(http.MethodDelete)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook/{webhook_id:[a-z0-9]+}/delivery", system.GetWebhookDeliveries).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook/{webhook_id:[a-z0-9]+}/delivery/{delivery_id:[a-z0-9]+}", system.GetWebhookDelivery).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/webhook/{webhook_id:[a-z0-9]+}/delivery/{delivery_id:[a-z0-9]+}/redeliver", system.RedeliverWebhookDelivery).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/dead_letter", system.GetDeadLetters).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/dead_letter/{dead_letter_id:[a-z0-9]+}", system.GetDeadLetter).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/dead_letter/{dead_letter_id:[a-z0-9]+}", system.UpdateDeadLetter).Methods(http.MethodPut)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/dead_letter/{dead_letter_id:[a-z0-9]+}", system.PatchDeadLetter).Methods(http.MethodPatch)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/dead_letter/{dead_letter_id:[a-z0-9]+}", system.DeleteDeadLetter).Methods(http.MethodDelete)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/dead_letter/{dead_letter_id:[a-z0-9]+}/retry", system.RetryDeadLetter).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction", system.GetFactions).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction", system.DeleteFactions).Methods(http.MethodDelete)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction/tag/{tag}", system.GetFactionDetail).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction/{faction_id:[a-z0-9]+}", system.GetFactionDetail).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction/{faction_id:[a-z0-9]+}/members", system.GetFactionMembers).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction/{faction_id:[a-z0-9]+}/relations", system.GetFactionRelations).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector", system.GetSectors).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector", system.CreateSector).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", system.GetSector).Methods(http.MethodGet)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", system.UpdateSector).Methods(http.MethodPut)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", system.PatchSector).Methods(http.MethodPatch)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", system.DeleteSector).Methods(http.MethodDelete)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}/token", system.CreateSectorToken).Methods(http.MethodPost)
+	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}/token", system.DeleteSectorToken).Methods(http.MethodDelete)
+
+	return router
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/gorilla/mux"
+)
+
+var routeVariable = regexp.MustCompile(`\{([^:}]+):[^}]+\}`)
+
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func registeredRoutes(t *testing.T) map[string][]string {
+	router := newRouter(&hive.System{}, notification.NewHub())
+
+	routes := make(map[string][]string)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("route %s does not restrict its methods", template)
+			return nil
+		}
+
+		path := routeVariable.ReplaceAllString(template, "{$1}")
+		routes[path] = append(routes[path], methods...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return routes
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(api.OpenAPI(), &doc); err != nil {
+		t.Fatalf("openapi document is invalid: %v", err)
+	}
+
+	routes := registeredRoutes(t)
+	for path, methods := range routes {
+		for _, method := range methods {
+			if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("route %s %s is missing in the openapi document", method, path)
+			}
+		}
+	}
+
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+
+			found := false
+			for _, v := range routes[path] {
+				if strings.ToLower(v) == method {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("openapi document describes %s %s which is not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIReferencesResolve(t *testing.T) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(api.OpenAPI(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				var target interface{} = doc
+				for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					m, _ := target.(map[string]interface{})
+					target = m[key]
+				}
+				if target == nil {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"net/http"
+)
+
+// ServeDocs serves a self-contained documentation UI for the document
+// served by ServeOpenAPI.
+func ServeDocs(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
+
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>TorchAPI Hive System API</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 1100px; padding: 1em; color: #222; }
+h1 small { color: #888; font-weight: normal; font-size: .5em; }
+details { border: 1px solid #ddd; border-radius: 4px; margin: .4em 0; }
+summary { cursor: pointer; padding: .5em; font-family: monospace; font-size: 1.05em; }
+.op { padding: 0 1em 1em; }
+.method { display: inline-block; width: 5em; font-weight: bold; text-transform: uppercase; }
+.get { color: #1a7f37; } .post { color: #0969da; } .put, .patch { color: #9a6700; } .delete { color: #cf222e; }
+table { border-collapse: collapse; margin: .5em 0; }
+td, th { border: 1px solid #ddd; padding: .2em .5em; text-align: left; vertical-align: top; }
+pre { background: #f6f8fa; padding: .5em; overflow: auto; max-height: 25em; }
+textarea { width: 100%; height: 6em; font-family: monospace; }
+input[type=text] { width: 20em; }
+</style>
+</head>
+<body>
+<h1>TorchAPI Hive System <small id="version"></small></h1>
+<p id="description"></p>
+<div id="operations"></div>
+<h2>Schemas</h2>
+<div id="schemas"></div>
+<script>
+(function () {
+  var specURL = "openapi.json";
+
+  function el(tag, attrs, children) {
+    var node = document.createElement(tag);
+    Object.keys(attrs || {}).forEach(function (k) { node.setAttribute(k, attrs[k]); });
+    (children || []).forEach(function (c) {
+      node.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+    });
+    return node;
+  }
+
+  function resolve(spec, obj) {
+    if (!obj || !obj.$ref) { return obj; }
+    return obj.$ref.split("/").slice(1).reduce(function (o, k) { return o[k]; }, spec);
+  }
+
+  function schemaName(schema) {
+    if (!schema) { return ""; }
+    if (schema.$ref) { return schema.$ref.split("/").pop(); }
+    if (schema.type === "array") { return schemaName(schema.items) + "[]"; }
+    return schema.type || "";
+  }
+
+  function renderOperation(spec, path, method, op, shared) {
+    var params = (shared || []).concat(op.parameters || []).map(function (p) { return resolve(spec, p); });
+    var body = el("div", { "class": "op" });
+    if (op.description) { body.appendChild(el("p", {}, [op.description])); }
+
+    var inputs = {};
+    if (params.length) {
+      var rows = params.map(function (p) {
+        var input = el("input", { type: "text", placeholder: p.schema && p.schema["default"] !== undefined ? String(p.schema["default"]) : "" });
+        inputs[p.name] = { param: p, input: input };
+        return el("tr", {}, [el("td", {}, [p.name + (p.required ? " *" : "")]), el("td", {}, [p["in"]]),
+          el("td", {}, [schemaName(p.schema)]), el("td", {}, [p.description || ""]), el("td", {}, [input])]);
+      });
+      body.appendChild(el("table", {}, [el("tr", {}, [el("th", {}, ["name"]), el("th", {}, ["in"]), el("th", {}, ["type"]),
+        el("th", {}, ["description"]), el("th", {}, ["value"])])].concat(rows)));
+    }
+
+    var textarea = null;
+    var requestBody = resolve(spec, op.requestBody);
+    if (requestBody) {
+      var media = requestBody.content["application/json"];
+      body.appendChild(el("p", {}, ["Request body: " + schemaName(media.schema)]));
+      textarea = el("textarea", {});
+      body.appendChild(textarea);
+    }
+
+    var responses = Object.keys(op.responses).map(function (code) {
+      var r = resolve(spec, op.responses[code]);
+      var content = r.content && (r.content["application/json"] || r.content[Object.keys(r.content)[0]]);
+      return el("tr", {}, [el("td", {}, [code]), el("td", {}, [r.description]), el("td", {}, [content ? schemaName(content.schema) : ""])]);
+    });
+    body.appendChild(el("table", {}, [el("tr", {}, [el("th", {}, ["status"]), el("th", {}, ["description"]), el("th", {}, ["schema"])])].concat(responses)));
+
+    if (path.indexOf("/ws/") !== 0) {
+      var output = el("pre", {});
+      var button = el("button", {}, ["Try it"]);
+      button.onclick = function () {
+        var url = path;
+        var query = [];
+        Object.keys(inputs).forEach(function (name) {
+          var value = inputs[name].input.value;
+          if (inputs[name].param["in"] === "path") {
+            url = url.replace("{" + name + "}", encodeURIComponent(value));
+          } else if (value !== "") {
+            query.push(encodeURIComponent(name) + "=" + encodeURIComponent(value));
+          }
+        });
+        if (query.length) { url += "?" + query.join("&"); }
+
+        var init = { method: method.toUpperCase(), headers: {} };
+        if (textarea && textarea.value) {
+          init.body = textarea.value;
+          init.headers["Content-Type"] = "application/json";
+        }
+        output.textContent = init.method + " " + url + "\n...";
+        fetch(url, init).then(function (res) {
+          var headers = [];
+          res.headers.forEach(function (v, k) { headers.push(k + ": " + v); });
+          return res.text().then(function (text) {
+            try { text = JSON.stringify(JSON.parse(text), null, 2); } catch (e) {}
+            output.textContent = init.method + " " + url + "\n" + res.status + " " + res.statusText + "\n" + headers.join("\n") + "\n\n" + text;
+          });
+        }).catch(function (e) { output.textContent = String(e); });
+      };
+      body.appendChild(button);
+      body.appendChild(output);
+    }
+
+    return el("details", {}, [el("summary", {}, [el("span", { "class": "method " + method }, [method]), path + "  " + (op.summary || "")]), body]);
+  }
+
+  fetch(specURL).then(function (res) { return res.json(); }).then(function (spec) {
+    document.getElementById("version").textContent = spec.info.version;
+    document.getElementById("description").textContent = spec.info.description || "";
+
+    var operations = document.getElementById("operations");
+    (spec.tags || []).forEach(function (tag) {
+      var section = el("div", {}, [el("h2", {}, [tag.name])]);
+      Object.keys(spec.paths).forEach(function (path) {
+        var item = spec.paths[path];
+        ["get", "post", "put", "patch", "delete"].forEach(function (method) {
+          var op = item[method];
+          if (op && (op.tags || []).indexOf(tag.name) >= 0) {
+            section.appendChild(renderOperation(spec, path, method, op, item.parameters));
+          }
+        });
+      });
+      operations.appendChild(section);
+    });
+
+    var schemas = document.getElementById("schemas");
+    Object.keys(spec.components.schemas).forEach(function (name) {
+      schemas.appendChild(el("details", {}, [el("summary", {}, [name]),
+        el("pre", {}, [JSON.stringify(spec.components.schemas[name], null, 2)])]));
+    });
+  });
+})();
+</script>
+</body>
+</html>
+`
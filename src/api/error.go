@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/globalsign/mgo"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CodeBadRequest       = "bad_request"
+	CodeValidationFailed = "validation_failed"
+	CodeInvalidID        = "invalid_id"
+	CodeUnauthorized     = "unauthorized"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeDuplicateKey     = "duplicate_key"
+	CodeInternal         = "internal_error"
+	CodeUnavailable      = "unavailable"
+)
+
+// Error is the body of every failed API request.
+type Error struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Field   string      `json:"field,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return e.Message
+}
+
+type envelope struct {
+	Error *Error `json:"error"`
+}
+
+func BadRequest(message string) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeBadRequest,
+		Message: message,
+	}
+}
+
+func Validation(field string, message string) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeValidationFailed,
+		Message: message,
+		Field:   field,
+	}
+}
+
+func Unauthorized(message string) *Error {
+	return &Error{
+		Status:  http.StatusUnauthorized,
+		Code:    CodeUnauthorized,
+		Message: message,
+	}
+}
+
+func NotFound(message string) *Error {
+	return &Error{
+		Status:  http.StatusNotFound,
+		Code:    CodeNotFound,
+		Message: message,
+	}
+}
+
+func Unavailable(message string) *Error {
+	return &Error{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CodeUnavailable,
+		Message: message,
+	}
+}
+
+func Conflict(message string, details interface{}) *Error {
+	return &Error{
+		Status:  http.StatusConflict,
+		Code:    CodeConflict,
+		Message: message,
+		Details: details,
+	}
+}
+
+// FromError maps an arbitrary error to an API error. Errors that are not
+// known are reported as internal errors without exposing their text.
+func FromError(err error) *Error {
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return BadRequest(err.Error())
+	}
+
+	if err == mgo.ErrNotFound {
+		return NotFound("resource not found")
+	}
+
+	if mgo.IsDup(err) {
+		return &Error{
+			Status:  http.StatusConflict,
+			Code:    CodeDuplicateKey,
+			Message: "resource already exists",
+		}
+	}
+
+	logrus.Errorln(err)
+	return &Error{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternal,
+		Message: http.StatusText(http.StatusInternalServerError),
+	}
+}
+
+// WriteError writes err as JSON error envelope.
+func WriteError(w http.ResponseWriter, err error) {
+	apiErr := FromError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	if err := json.NewEncoder(w).Encode(envelope{Error: apiErr}); err != nil {
+		logrus.Errorln(err)
+	}
+}
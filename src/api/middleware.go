@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestToken returns the token of a request, sent as bearer token or as
+// token query parameter for clients that cannot set headers.
+func RequestToken(r *http.Request) string {
+	token := r.URL.Query().Get("token")
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		token = strings.TrimPrefix(v, "Bearer ")
+	}
+	return token
+}
+
+// Recover turns panics of the wrapped handler into internal errors. The error
+// is only written if the handler has not started its response, a hijacked or
+// partly written response is left to the server. http.ErrAbortHandler is
+// passed on.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoverWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			logrus.Errorf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+			if rw.started {
+				return
+			}
+			WriteError(rw, &Error{
+				Status:  http.StatusInternalServerError,
+				Code:    CodeInternal,
+				Message: http.StatusText(http.StatusInternalServerError),
+			})
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// recoverWriter records whether a response was started. It passes flushes
+// and hijacks on for event streams and websockets.
+type recoverWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *recoverWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoverWriter) Write(data []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recoverWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.started = true
+		flusher.Flush()
+	}
+}
+
+func (w *recoverWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	w.started = true
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *recoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ValidateIDs rejects requests whose route variables ending in "_id" are not
+// valid object ids.
+func ValidateIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range mux.Vars(r) {
+			if !strings.HasSuffix(k, "_id") || bson.IsObjectIdHex(v) {
+				continue
+			}
+
+			WriteError(w, &Error{
+				Status:  http.StatusBadRequest,
+				Code:    CodeInvalidID,
+				Message: "malformed id " + v,
+				Field:   k,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, NotFound("no route for "+r.URL.Path))
+	})
+}
+
+func MethodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, &Error{
+			Status:  http.StatusMethodNotAllowed,
+			Code:    CodeMethodNotAllowed,
+			Message: r.Method + " is not allowed for " + r.URL.Path,
+		})
+	})
+}
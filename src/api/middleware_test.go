@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		body    string
+	}{
+		{
+			name: "panic before the response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			},
+			status: http.StatusInternalServerError,
+			body:   `{"error":{"code":"internal_error","message":"Internal Server Error"}}`,
+		},
+		{
+			name: "panic after the header",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				panic("boom")
+			},
+			status: http.StatusAccepted,
+		},
+		{
+			name: "panic after a flushed event",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("data: 1\n\n"))
+				w.(http.Flusher).Flush()
+				panic("boom")
+			},
+			status: http.StatusOK,
+			body:   "data: 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Recover(tt.handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if body := strings.TrimSpace(w.Body.String()); body != tt.body {
+				t.Errorf("expected body %q, got %q", tt.body, body)
+			}
+		})
+	}
+}
+
+func TestRecoverPassesAbortHandler(t *testing.T) {
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler, got %v", v)
+		}
+	}()
+
+	Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
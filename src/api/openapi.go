@@ -0,0 +1,2974 @@
+package api
+
+import (
+	"net/http"
+)
+
+// OpenAPI returns the OpenAPI 3 description of the REST API.
+func OpenAPI() []byte {
+	return []byte(openAPIDocument)
+}
+
+func ServeOpenAPI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPI())
+}
+
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "TorchAPI Hive System",
+    "version": "1.0.0",
+    "description": "REST API of the hive that connects the sectors of a Space Engineers server cluster."
+  },
+  "tags": [
+    {
+      "name": "hive"
+    },
+    {
+      "name": "sector"
+    },
+    {
+      "name": "faction"
+    },
+    {
+      "name": "webhook"
+    },
+    {
+      "name": "dead letter"
+    },
+    {
+      "name": "event schema",
+      "description": "JSON Schemas (draft-07) of the raw payload of every sector event type. Events are validated before they are processed: the properties identifying the faction, player or state and the values an update replaces are required, property names match case-insensitively, unknown properties are ignored and entity ids must be positive. An invalid event fails with validation_failed, the field names the first invalid property. The frames of the binary encodings are described per encoding."
+    },
+    {
+      "name": "websocket"
+    },
+    {
+      "name": "meta"
+    }
+  ],
+  "paths": {
+    "/": {
+      "get": {
+        "tags": [
+          "meta"
+        ],
+        "summary": "Service banner",
+        "operationId": "getBanner",
+        "responses": {
+          "200": {
+            "description": "Service name.",
+            "content": {
+              "text/plain": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/api/openapi.json": {
+      "get": {
+        "tags": [
+          "meta"
+        ],
+        "summary": "This document",
+        "operationId": "getOpenAPI",
+        "responses": {
+          "200": {
+            "description": "OpenAPI document.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/api/docs": {
+      "get": {
+        "tags": [
+          "meta"
+        ],
+        "summary": "Interactive API documentation",
+        "operationId": "getDocs",
+        "responses": {
+          "200": {
+            "description": "Documentation UI.",
+            "content": {
+              "text/html": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/api/hive": {
+      "get": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "List hives",
+        "operationId": "listHives",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/limit"
+          },
+          {
+            "$ref": "#/components/parameters/cursor"
+          },
+          {
+            "$ref": "#/components/parameters/fields"
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "description": "Field to sort by, prefixed with - for descending order.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "name",
+                "-name"
+              ]
+            }
+          },
+          {
+            "name": "name",
+            "in": "query",
+            "required": false,
+            "description": "Exact hive name.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "name_prefix",
+            "in": "query",
+            "required": false,
+            "description": "Hive name prefix.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of hives.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Hive"
+                  }
+                }
+              }
+            },
+            "headers": {
+              "X-Total-Count": {
+                "description": "Number of items matching the filters.",
+                "schema": {
+                  "type": "integer"
+                }
+              },
+              "X-Next-Cursor": {
+                "description": "Cursor of the next page, absent on the last page.",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Create a hive",
+        "operationId": "createHive",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/HiveInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "Created hive.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Hive"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Get a hive",
+        "operationId": "getHive",
+        "responses": {
+          "200": {
+            "description": "Hive.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Hive"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Replace a hive",
+        "operationId": "updateHive",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/HiveInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Updated hive.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Hive"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      },
+      "patch": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Update fields of a hive",
+        "operationId": "patchHive",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/HivePatch"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Updated hive.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Hive"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Delete a hive with its sectors, factions and webhooks",
+        "operationId": "deleteHive",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/mode"
+          },
+          {
+            "$ref": "#/components/parameters/dry_run"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Removed resources.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/DeleteReport"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/faction": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "faction"
+        ],
+        "summary": "List factions",
+        "operationId": "listFactions",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/limit"
+          },
+          {
+            "$ref": "#/components/parameters/cursor"
+          },
+          {
+            "$ref": "#/components/parameters/fields"
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "description": "Field to sort by, prefixed with - for descending order.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "tag",
+                "name",
+                "-tag",
+                "-name"
+              ]
+            }
+          },
+          {
+            "name": "tag",
+            "in": "query",
+            "required": false,
+            "description": "Exact faction tag.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "tag_prefix",
+            "in": "query",
+            "required": false,
+            "description": "Faction tag prefix.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "name_prefix",
+            "in": "query",
+            "required": false,
+            "description": "Faction name prefix.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "member",
+            "in": "query",
+            "required": false,
+            "description": "Steam id of a member.",
+            "schema": {
+              "type": "integer"
+            }
+          },
+          {
+            "name": "sector",
+            "in": "query",
+            "required": false,
+            "description": "Id of a sector the faction exists in.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of factions.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Faction"
+                  }
+                }
+              }
+            },
+            "headers": {
+              "X-Total-Count": {
+                "description": "Number of items matching the filters.",
+                "schema": {
+                  "type": "integer"
+                }
+              },
+              "X-Next-Cursor": {
+                "description": "Cursor of the next page, absent on the last page.",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "faction"
+        ],
+        "summary": "Delete all factions of a hive",
+        "operationId": "deleteFactions",
+        "responses": {
+          "200": {
+            "description": "Factions removed."
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/faction/tag/{tag}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "name": "tag",
+          "in": "path",
+          "required": true,
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "get": {
+        "tags": [
+          "faction"
+        ],
+        "summary": "Get a faction by tag",
+        "operationId": "getFactionByTag",
+        "responses": {
+          "200": {
+            "description": "Faction.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Faction"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/faction/{faction_id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/faction_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "faction"
+        ],
+        "summary": "Get a faction",
+        "operationId": "getFaction",
+        "responses": {
+          "200": {
+            "description": "Faction.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Faction"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/faction/{faction_id}/members": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/faction_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "faction"
+        ],
+        "summary": "List the members of a faction",
+        "operationId": "getFactionMembers",
+        "responses": {
+          "200": {
+            "description": "Members.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/FactionMember"
+                  }
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/faction/{faction_id}/relations": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/faction_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "faction"
+        ],
+        "summary": "List the relations of a faction",
+        "operationId": "getFactionRelations",
+        "responses": {
+          "200": {
+            "description": "Relations.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/FactionRelationDetail"
+                  }
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/sector": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "List sectors",
+        "operationId": "listSectors",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/limit"
+          },
+          {
+            "$ref": "#/components/parameters/cursor"
+          },
+          {
+            "$ref": "#/components/parameters/fields"
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "description": "Field to sort by, prefixed with - for descending order.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "name",
+                "state",
+                "max_player",
+                "player_count",
+                "-name",
+                "-state",
+                "-max_player",
+                "-player_count"
+              ]
+            }
+          },
+          {
+            "name": "state",
+            "in": "query",
+            "required": false,
+            "description": "Sector state, by name or number.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "name",
+            "in": "query",
+            "required": false,
+            "description": "Exact sector name.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "name_prefix",
+            "in": "query",
+            "required": false,
+            "description": "Sector name prefix.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of sectors.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Sector"
+                  }
+                }
+              }
+            },
+            "headers": {
+              "X-Total-Count": {
+                "description": "Number of items matching the filters.",
+                "schema": {
+                  "type": "integer"
+                }
+              },
+              "X-Next-Cursor": {
+                "description": "Cursor of the next page, absent on the last page.",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "Create a sector",
+        "operationId": "createSector",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/SectorInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "Created sector.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Sector"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/sector/{sector_id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/sector_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "Get a sector",
+        "operationId": "getSector",
+        "responses": {
+          "200": {
+            "description": "Sector.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Sector"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "Replace a sector",
+        "operationId": "updateSector",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/SectorInput"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Updated sector.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Sector"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      },
+      "patch": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "Update fields of a sector",
+        "operationId": "patchSector",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/SectorPatch"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Updated sector.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Sector"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "Delete a sector and its faction entries",
+        "operationId": "deleteSector",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/mode"
+          },
+          {
+            "$ref": "#/components/parameters/dry_run"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Removed resources.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/DeleteReport"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      }
+    },
+    "/ws/hive/{hive_id}/sector/{sector_id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/sector_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "websocket"
+        ],
+        "summary": "Sector event channel",
+        "description": "Upgrades to a websocket that exchanges sector events with the hive. A sector with a token has to send it as bearer token or as token query parameter. Every message is an envelope {\"id\", \"type\", \"raw\"} with a JSON encoded payload in raw. Events of protocol version 2 carry a unique id of at most 64 characters; an event resent with an id processed within the last 24 hours is acknowledged without being applied or forwarded again. A copy sent while the event is still in process waits up to 5 seconds for its result and is otherwise answered with a failed ack with refused set and code unavailable. The first message should be a hello envelope carrying protocol_version, min_protocol_version, plugin_version and the supported events; the hive answers with a welcome envelope carrying the negotiated protocol_version and events, or closes the connection with code 4001 if no common version exists. Sectors that start with another message, or send nothing within the hello wait of the hive (2 seconds by default), are treated as protocol version 1 and receive the events of the hive from then on; a hello sent later closes the connection with code 4000. The hello may list preferred encodings (msgpack, json); the welcome names the chosen encoding, which applies to the welcome and every later message. msgpack frames are binary messages of the form {\"id\", \"type\", \"payload\"} with the payload embedded as map, described by /api/schema/frame/msgpack. The permessage-deflate extension is supported. When the sector does not keep up with its messages the backpressure policy of the hive applies; a disconnected sector is closed with code 1013. A sector has one connection at a time: depending on the connection policy of the hive system a new connection either takes over, closing the old connection with code 4002, or is closed with code 4003 while the sector is connected. When the hive shuts down it stops processing new events, answering each of them with a failed ack with refused set and code unavailable (protocol version 2), to be resent after reconnecting, or by closing with code 1012 (protocol version 1), sends the queued messages and closes with code 1012 and the reason \"hive restarting, reconnect in N seconds\"; undelivered messages are sent after reconnecting. Sectors of protocol version 1 receive their events echoed. From protocol version 2 every event is answered with an ack envelope whose raw payload is {\"event_id\", \"success\", \"duplicate\", \"queued\", \"refused\", \"code\", \"message\", \"field\"}; a failed event was not applied by the hive and carries an error code such as validation_failed, not_found, conflict, bad_request, unavailable or internal_error. An event failing with a transient error is stored as dead letter and retried by the hive; its ack carries queued and a later ack reports the final result. From protocol version 2 the hive may send announcement envelopes without id, carrying a message of the operators for the players.",
+        "operationId": "connectSector",
+        "responses": {
+          "101": {
+            "description": "Switching to the websocket protocol."
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/observer_token": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "post": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Generate the observer token of a hive",
+        "operationId": "createObserverToken",
+        "description": "Generates a new token for the observer websocket. The previous token stops working. Once the hive has an observer token a new one is only generated for a request with the current token, sent as bearer token or as token query parameter.",
+        "responses": {
+          "201": {
+            "description": "The new token.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/ObserverToken"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/ws/hive/{hive_id}/observe": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "websocket"
+        ],
+        "summary": "Observer activity stream",
+        "operationId": "observeHive",
+        "description": "Upgrades to a read-only websocket that streams every Activity of the hive as JSON text message. Messages sent by the observer are ignored.",
+        "parameters": [
+          {
+            "name": "token",
+            "in": "query",
+            "required": false,
+            "description": "Observer token, alternatively sent as Authorization: Bearer header.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "types",
+            "in": "query",
+            "required": false,
+            "description": "Comma separated activity or event types to stream, all if empty.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "sector",
+            "in": "query",
+            "required": false,
+            "description": "Comma separated sector ids to stream, all if empty.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "101": {
+            "description": "Switching to the websocket protocol."
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/announcement": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "post": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Send an announcement",
+        "operationId": "createAnnouncement",
+        "description": "Sends a message of the operators to the connected sectors of the hive as an announcement envelope whose raw payload is {\"message\"}. Sectors of protocol version 1 do not receive announcements. Observers receive an announcement activity.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/AnnouncementRequest"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The number of sectors the announcement was sent to.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/AnnouncementResult"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/events": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "hive"
+        ],
+        "summary": "Stream the hive activity as server-sent events",
+        "operationId": "streamHiveEvents",
+        "description": "Streams every Activity of the hive as text/event-stream. Each event carries the activity id, the activity type as event name and the Activity as JSON data. A Last-Event-ID header (or last_event_id parameter) replays the logged activities after that id before the live stream; activities are logged for 7 days. A replay is sent in parts of 1000 activities: a longer replay ends the stream with a replay_truncated event whose id and data {\"last_event_id\"} name the last replayed activity, and the client resumes from there. A comment is sent every 15 seconds as heartbeat. Requires the observer token.",
+        "parameters": [
+          {
+            "name": "token",
+            "in": "query",
+            "required": false,
+            "description": "Observer token, alternatively sent as Authorization: Bearer header.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "types",
+            "in": "query",
+            "required": false,
+            "description": "Comma separated activity or event types to stream, all if empty.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "sector",
+            "in": "query",
+            "required": false,
+            "description": "Comma separated sector ids to stream, all if empty.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "last_event_id",
+            "in": "query",
+            "required": false,
+            "description": "Resume after this event id, used if the Last-Event-ID header is not set.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "Last-Event-ID",
+            "in": "header",
+            "required": false,
+            "description": "Resume after this event id.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Event stream of Activity objects.",
+            "content": {
+              "text/event-stream": {
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/webhook": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "List webhooks",
+        "operationId": "listWebhooks",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/limit"
+          },
+          {
+            "$ref": "#/components/parameters/cursor"
+          },
+          {
+            "$ref": "#/components/parameters/fields"
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "description": "Field to sort by, prefixed with - for descending order.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "url",
+                "-url"
+              ]
+            }
+          },
+          {
+            "name": "type",
+            "in": "query",
+            "required": false,
+            "description": "Webhooks subscribed to this type.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of webhooks.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Webhook"
+                  }
+                }
+              }
+            },
+            "headers": {
+              "X-Total-Count": {
+                "description": "Number of items matching the filters.",
+                "schema": {
+                  "type": "integer"
+                }
+              },
+              "X-Next-Cursor": {
+                "description": "Cursor of the next page, absent on the last page.",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "Create a webhook",
+        "operationId": "createWebhook",
+        "responses": {
+          "201": {
+            "description": "Created webhook with its secret.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Webhook"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        },
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/WebhookInput"
+              }
+            }
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/webhook/{webhook_id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/webhook_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "Get a webhook",
+        "operationId": "getWebhook",
+        "responses": {
+          "200": {
+            "description": "The webhook.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Webhook"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "Replace a webhook",
+        "operationId": "updateWebhook",
+        "responses": {
+          "200": {
+            "description": "Updated webhook.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Webhook"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        },
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/WebhookInput"
+              }
+            }
+          }
+        }
+      },
+      "patch": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "Update fields of a webhook",
+        "operationId": "patchWebhook",
+        "responses": {
+          "200": {
+            "description": "Updated webhook.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Webhook"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        },
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/WebhookPatch"
+              }
+            }
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "Delete a webhook with its delivery log",
+        "operationId": "deleteWebhook",
+        "responses": {
+          "204": {
+            "description": "Webhook deleted."
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/webhook/{webhook_id}/delivery": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/webhook_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "List the deliveries of a webhook",
+        "operationId": "listWebhookDeliveries",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/limit"
+          },
+          {
+            "$ref": "#/components/parameters/cursor"
+          },
+          {
+            "$ref": "#/components/parameters/fields"
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "description": "Field to sort by, prefixed with - for descending order.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "created_at",
+                "status",
+                "-created_at",
+                "-status"
+              ]
+            }
+          },
+          {
+            "name": "status",
+            "in": "query",
+            "required": false,
+            "description": "Delivery status.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "pending",
+                "retrying",
+                "delivered",
+                "failed"
+              ]
+            }
+          },
+          {
+            "name": "event",
+            "in": "query",
+            "required": false,
+            "description": "Event type.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of deliveries.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/WebhookDelivery"
+                  }
+                }
+              }
+            },
+            "headers": {
+              "X-Total-Count": {
+                "description": "Number of items matching the filters.",
+                "schema": {
+                  "type": "integer"
+                }
+              },
+              "X-Next-Cursor": {
+                "description": "Cursor of the next page, absent on the last page.",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/webhook/{webhook_id}/delivery/{delivery_id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/webhook_id"
+        },
+        {
+          "$ref": "#/components/parameters/delivery_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "Get a delivery",
+        "operationId": "getWebhookDelivery",
+        "responses": {
+          "200": {
+            "description": "The delivery.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/WebhookDelivery"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/webhook/{webhook_id}/delivery/{delivery_id}/redeliver": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/webhook_id"
+        },
+        {
+          "$ref": "#/components/parameters/delivery_id"
+        }
+      ],
+      "post": {
+        "tags": [
+          "webhook"
+        ],
+        "summary": "Redeliver a delivery",
+        "operationId": "redeliverWebhookDelivery",
+        "responses": {
+          "202": {
+            "description": "The queued delivery, sent in the background.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/WebhookDelivery"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        },
+        "description": "Sends the payload of a finished delivery again as a new delivery. A pending or retrying delivery that is not attempted at the moment, e.g. one left by a restart, is attempted again right away; a delivery that is being attempted fails with conflict."
+      }
+    },
+    "/api/hive/{hive_id}/dead_letter": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "dead letter"
+        ],
+        "summary": "List the failed sector events",
+        "operationId": "listDeadLetters",
+        "parameters": [
+          {
+            "$ref": "#/components/parameters/limit"
+          },
+          {
+            "$ref": "#/components/parameters/cursor"
+          },
+          {
+            "$ref": "#/components/parameters/fields"
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "description": "Field to sort by, prefixed with - for descending order.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "created_at",
+                "updated_at",
+                "status",
+                "-created_at",
+                "-updated_at",
+                "-status"
+              ]
+            }
+          },
+          {
+            "name": "status",
+            "in": "query",
+            "required": false,
+            "description": "Dead letter status.",
+            "schema": {
+              "type": "string",
+              "enum": [
+                "retrying",
+                "processing",
+                "failed",
+                "resolved"
+              ]
+            }
+          },
+          {
+            "name": "sector",
+            "in": "query",
+            "required": false,
+            "description": "Sector id.",
+            "schema": {
+              "type": "string"
+            }
+          },
+          {
+            "name": "event_type",
+            "in": "query",
+            "required": false,
+            "description": "Event type.",
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of dead letters.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/DeadLetter"
+                  }
+                }
+              }
+            },
+            "headers": {
+              "X-Total-Count": {
+                "description": "Number of items matching the filters.",
+                "schema": {
+                  "type": "integer"
+                }
+              },
+              "X-Next-Cursor": {
+                "description": "Cursor of the next page, absent on the last page.",
+                "schema": {
+                  "type": "string"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/dead_letter/{dead_letter_id}": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/dead_letter_id"
+        }
+      ],
+      "get": {
+        "tags": [
+          "dead letter"
+        ],
+        "summary": "Get a dead letter",
+        "operationId": "getDeadLetter",
+        "responses": {
+          "200": {
+            "description": "The dead letter.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/DeadLetter"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "dead letter"
+        ],
+        "summary": "Replace the event of a dead letter",
+        "operationId": "updateDeadLetter",
+        "responses": {
+          "200": {
+            "description": "Updated dead letter.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/DeadLetter"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        },
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/DeadLetterInput"
+              }
+            }
+          }
+        },
+        "description": "Fixes the event of a dead letter before it is retried. Processing and resolved dead letters cannot be edited."
+      },
+      "patch": {
+        "tags": [
+          "dead letter"
+        ],
+        "summary": "Update the event of a dead letter",
+        "operationId": "patchDeadLetter",
+        "responses": {
+          "200": {
+            "description": "Updated dead letter.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/DeadLetter"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        },
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/DeadLetterPatch"
+              }
+            }
+          }
+        },
+        "description": "Fixes the event of a dead letter before it is retried. Processing and resolved dead letters cannot be edited."
+      },
+      "delete": {
+        "tags": [
+          "dead letter"
+        ],
+        "summary": "Discard a dead letter",
+        "operationId": "deleteDeadLetter",
+        "responses": {
+          "204": {
+            "description": "Dead letter deleted."
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/dead_letter/{dead_letter_id}/retry": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/dead_letter_id"
+        }
+      ],
+      "post": {
+        "tags": [
+          "dead letter"
+        ],
+        "summary": "Retry a dead letter",
+        "operationId": "retryDeadLetter",
+        "responses": {
+          "202": {
+            "description": "The dead letter, queued for processing.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/DeadLetter"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          },
+          "409": {
+            "$ref": "#/components/responses/Conflict"
+          }
+        },
+        "description": "Processes the event of a dead letter again. The dead letter is resolved if it succeeds, the ack is sent to the sector."
+      }
+    },
+    "/api/schema/event": {
+      "get": {
+        "tags": [
+          "event schema"
+        ],
+        "summary": "List the schemas of the sector events",
+        "operationId": "listSectorEventSchemas",
+        "responses": {
+          "200": {
+            "description": "Schemas by event type.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "additionalProperties": {
+                    "$ref": "#/components/schemas/JSONSchema"
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/api/schema/event/{event_type}": {
+      "parameters": [
+        {
+          "name": "event_type",
+          "in": "path",
+          "required": true,
+          "description": "Event type, e.g. factionMemberSendJoin.",
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "get": {
+        "tags": [
+          "event schema"
+        ],
+        "summary": "Get the schema of a sector event",
+        "operationId": "getSectorEventSchema",
+        "responses": {
+          "200": {
+            "description": "The schema of the raw payload.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/JSONSchema"
+                }
+              }
+            }
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/schema/frame": {
+      "get": {
+        "tags": [
+          "event schema"
+        ],
+        "summary": "List the schemas of the binary websocket frames",
+        "operationId": "listFrameSchemas",
+        "responses": {
+          "200": {
+            "description": "Schemas by encoding.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "additionalProperties": {
+                    "$ref": "#/components/schemas/JSONSchema"
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/api/schema/frame/{encoding}": {
+      "parameters": [
+        {
+          "name": "encoding",
+          "in": "path",
+          "required": true,
+          "description": "Encoding negotiated in the hello, e.g. msgpack.",
+          "schema": {
+            "type": "string"
+          }
+        }
+      ],
+      "get": {
+        "tags": [
+          "event schema"
+        ],
+        "summary": "Get the schema of a binary websocket frame",
+        "operationId": "getFrameSchema",
+        "responses": {
+          "200": {
+            "description": "The schema of the frame.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/JSONSchema"
+                }
+              }
+            }
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    },
+    "/api/hive/{hive_id}/sector/{sector_id}/token": {
+      "parameters": [
+        {
+          "$ref": "#/components/parameters/hive_id"
+        },
+        {
+          "$ref": "#/components/parameters/sector_id"
+        }
+      ],
+      "post": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "Generate the token of a sector",
+        "operationId": "createSectorToken",
+        "description": "Generates a new token the sector has to present when connecting to its websocket. The previous token stops working and the sector is disconnected. Once the sector has a token a new one is only generated for a request with the current token, sent as bearer token or as token query parameter.",
+        "responses": {
+          "201": {
+            "description": "The new token.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/SectorToken"
+                }
+              }
+            }
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      },
+      "delete": {
+        "tags": [
+          "sector"
+        ],
+        "summary": "Remove the token of a sector",
+        "operationId": "deleteSectorToken",
+        "description": "Removes the token of a sector, it may connect without a token again. The request has to carry the current token, sent as bearer token or as token query parameter.",
+        "responses": {
+          "204": {
+            "description": "The token was removed."
+          },
+          "400": {
+            "$ref": "#/components/responses/BadRequest"
+          },
+          "401": {
+            "$ref": "#/components/responses/Unauthorized"
+          },
+          "404": {
+            "$ref": "#/components/responses/NotFound"
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "hive_id": {
+        "name": "hive_id",
+        "in": "path",
+        "required": true,
+        "schema": {
+          "$ref": "#/components/schemas/ObjectId"
+        }
+      },
+      "sector_id": {
+        "name": "sector_id",
+        "in": "path",
+        "required": true,
+        "schema": {
+          "$ref": "#/components/schemas/ObjectId"
+        }
+      },
+      "faction_id": {
+        "name": "faction_id",
+        "in": "path",
+        "required": true,
+        "schema": {
+          "$ref": "#/components/schemas/ObjectId"
+        }
+      },
+      "limit": {
+        "name": "limit",
+        "in": "query",
+        "required": false,
+        "description": "Page size.",
+        "schema": {
+          "type": "integer",
+          "minimum": 1,
+          "maximum": 1000,
+          "default": 100
+        }
+      },
+      "cursor": {
+        "name": "cursor",
+        "in": "query",
+        "required": false,
+        "description": "Value of X-Next-Cursor of the previous page.",
+        "schema": {
+          "type": "string"
+        }
+      },
+      "fields": {
+        "name": "fields",
+        "in": "query",
+        "required": false,
+        "description": "Comma separated list of fields to return, id is always included.",
+        "schema": {
+          "type": "string"
+        }
+      },
+      "mode": {
+        "name": "mode",
+        "in": "query",
+        "required": false,
+        "description": "cascade removes dependents, restrict refuses to delete when dependents exist.",
+        "schema": {
+          "type": "string",
+          "enum": [
+            "cascade",
+            "restrict"
+          ],
+          "default": "cascade"
+        }
+      },
+      "dry_run": {
+        "name": "dry_run",
+        "in": "query",
+        "required": false,
+        "description": "Only report what would be removed.",
+        "schema": {
+          "type": "boolean",
+          "default": false
+        }
+      },
+      "webhook_id": {
+        "name": "webhook_id",
+        "in": "path",
+        "required": true,
+        "description": "Webhook id.",
+        "schema": {
+          "$ref": "#/components/schemas/ObjectId"
+        }
+      },
+      "delivery_id": {
+        "name": "delivery_id",
+        "in": "path",
+        "required": true,
+        "description": "Delivery id.",
+        "schema": {
+          "$ref": "#/components/schemas/ObjectId"
+        }
+      },
+      "dead_letter_id": {
+        "name": "dead_letter_id",
+        "in": "path",
+        "required": true,
+        "description": "Dead letter id.",
+        "schema": {
+          "$ref": "#/components/schemas/ObjectId"
+        }
+      }
+    },
+    "responses": {
+      "BadRequest": {
+        "description": "Malformed request.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/ErrorEnvelope"
+            }
+          }
+        }
+      },
+      "NotFound": {
+        "description": "Resource not found.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/ErrorEnvelope"
+            }
+          }
+        }
+      },
+      "Conflict": {
+        "description": "Conflicting resource state.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/ErrorEnvelope"
+            }
+          }
+        }
+      },
+      "Unauthorized": {
+        "description": "Missing or invalid credentials.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "$ref": "#/components/schemas/ErrorEnvelope"
+            }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "ObjectId": {
+        "type": "string",
+        "pattern": "^[0-9a-f]{24}$"
+      },
+      "Hive": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "name": {
+            "type": "string"
+          },
+          "backpressure_policy": {
+            "type": "string",
+            "enum": [
+              "disconnect",
+              "drop_oldest",
+              "coalesce",
+              "spill"
+            ],
+            "description": "Handling of sectors that do not keep up with their messages: disconnect drops the connection, drop_oldest discards the oldest queued message, coalesce replaces a queued message of the same type and faction, spill persists messages until the sector caught up. Acks are never discarded or coalesced. A sector that overflows repeatedly is reported with a sector_slow activity."
+          }
+        }
+      },
+      "HiveInput": {
+        "type": "object",
+        "required": [
+          "name"
+        ],
+        "additionalProperties": false,
+        "properties": {
+          "name": {
+            "type": "string",
+            "minLength": 1
+          },
+          "backpressure_policy": {
+            "type": "string",
+            "enum": [
+              "disconnect",
+              "drop_oldest",
+              "coalesce",
+              "spill"
+            ],
+            "description": "Handling of sectors that do not keep up with their messages: disconnect drops the connection, drop_oldest discards the oldest queued message, coalesce replaces a queued message of the same type and faction, spill persists messages until the sector caught up. Acks are never discarded or coalesced. A sector that overflows repeatedly is reported with a sector_slow activity.",
+            "default": "disconnect"
+          }
+        }
+      },
+      "HivePatch": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "name": {
+            "type": "string",
+            "minLength": 1
+          },
+          "backpressure_policy": {
+            "type": "string",
+            "enum": [
+              "disconnect",
+              "drop_oldest",
+              "coalesce",
+              "spill"
+            ],
+            "description": "Handling of sectors that do not keep up with their messages: disconnect drops the connection, drop_oldest discards the oldest queued message, coalesce replaces a queued message of the same type and faction, spill persists messages until the sector caught up. Acks are never discarded or coalesced. A sector that overflows repeatedly is reported with a sector_slow activity."
+          }
+        }
+      },
+      "SectorPosition": {
+        "type": "object",
+        "properties": {
+          "x": {
+            "type": "integer",
+            "minimum": -10000,
+            "maximum": 10000
+          },
+          "y": {
+            "type": "integer",
+            "minimum": -10000,
+            "maximum": 10000
+          }
+        }
+      },
+      "SectorState": {
+        "type": "integer",
+        "description": "0 unknown, 1 offline, 2 booting, 3 online.",
+        "enum": [
+          0,
+          1,
+          2,
+          3
+        ]
+      },
+      "Sector": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "name": {
+            "type": "string"
+          },
+          "address": {
+            "type": "string"
+          },
+          "state": {
+            "$ref": "#/components/schemas/SectorState"
+          },
+          "max_player": {
+            "type": "integer"
+          },
+          "player_count": {
+            "type": "integer"
+          },
+          "position": {
+            "$ref": "#/components/schemas/SectorPosition"
+          },
+          "protocol": {
+            "allOf": [
+              {
+                "$ref": "#/components/schemas/SectorProtocol"
+              }
+            ],
+            "nullable": true
+          },
+          "last_faction_sync": {
+            "type": "string",
+            "format": "date-time",
+            "nullable": true
+          },
+          "last_currency_sync": {
+            "type": "string",
+            "format": "date-time",
+            "nullable": true
+          },
+          "slow_at": {
+            "type": "string",
+            "format": "date-time",
+            "nullable": true,
+            "description": "Last time the sector was reported as consistently slow."
+          }
+        }
+      },
+      "SectorInput": {
+        "type": "object",
+        "required": [
+          "name",
+          "address",
+          "max_player",
+          "position"
+        ],
+        "additionalProperties": false,
+        "properties": {
+          "name": {
+            "type": "string",
+            "minLength": 1
+          },
+          "address": {
+            "type": "string",
+            "description": "host:port of the game server."
+          },
+          "max_player": {
+            "type": "integer",
+            "minimum": 0
+          },
+          "position": {
+            "$ref": "#/components/schemas/SectorPosition"
+          }
+        }
+      },
+      "SectorPatch": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "name": {
+            "type": "string",
+            "minLength": 1
+          },
+          "address": {
+            "type": "string",
+            "description": "host:port of the game server."
+          },
+          "max_player": {
+            "type": "integer",
+            "minimum": 0
+          },
+          "position": {
+            "$ref": "#/components/schemas/SectorPosition"
+          }
+        }
+      },
+      "FactionSector": {
+        "type": "object",
+        "properties": {
+          "sector_id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "entity_id": {
+            "type": "integer",
+            "format": "int64"
+          }
+        }
+      },
+      "FactionRelationState": {
+        "type": "integer",
+        "description": "0 neutral, 1 peace requested, 2 peace, 3 war.",
+        "enum": [
+          0,
+          1,
+          2,
+          3
+        ]
+      },
+      "FactionRelation": {
+        "type": "object",
+        "properties": {
+          "faction_id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "state": {
+            "$ref": "#/components/schemas/FactionRelationState"
+          }
+        }
+      },
+      "FactionRelationDetail": {
+        "type": "object",
+        "properties": {
+          "faction_id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "tag": {
+            "type": "string"
+          },
+          "name": {
+            "type": "string"
+          },
+          "state": {
+            "$ref": "#/components/schemas/FactionRelationState"
+          }
+        }
+      },
+      "FactionMember": {
+        "type": "object",
+        "properties": {
+          "steam_id": {
+            "type": "integer",
+            "format": "uint64"
+          },
+          "state": {
+            "type": "integer",
+            "description": "0 join requested, 1 joined.",
+            "enum": [
+              0,
+              1
+            ]
+          },
+          "is_leader": {
+            "type": "boolean"
+          }
+        }
+      },
+      "Faction": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "tag": {
+            "type": "string"
+          },
+          "name": {
+            "type": "string"
+          },
+          "description": {
+            "type": "string"
+          },
+          "private_info": {
+            "type": "string"
+          },
+          "accept_humans": {
+            "type": "boolean"
+          },
+          "founder_steam_id": {
+            "type": "integer",
+            "format": "uint64"
+          },
+          "auto_accept_member": {
+            "type": "boolean"
+          },
+          "auto_accept_peace": {
+            "type": "boolean"
+          },
+          "relations": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/FactionRelation"
+            }
+          },
+          "members": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/FactionMember"
+            }
+          },
+          "sectors": {
+            "type": "array",
+            "items": {
+              "$ref": "#/components/schemas/FactionSector"
+            }
+          }
+        }
+      },
+      "DeleteReport": {
+        "type": "object",
+        "properties": {
+          "dry_run": {
+            "type": "boolean"
+          },
+          "hives": {
+            "type": "integer"
+          },
+          "sectors": {
+            "type": "integer"
+          },
+          "factions": {
+            "type": "integer"
+          },
+          "faction_sectors": {
+            "type": "integer"
+          },
+          "members": {
+            "type": "integer"
+          },
+          "relations": {
+            "type": "integer"
+          }
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": [
+          "code",
+          "message"
+        ],
+        "properties": {
+          "code": {
+            "type": "string",
+            "enum": [
+              "bad_request",
+              "validation_failed",
+              "invalid_id",
+              "not_found",
+              "method_not_allowed",
+              "conflict",
+              "duplicate_key",
+              "internal_error"
+            ]
+          },
+          "message": {
+            "type": "string"
+          },
+          "field": {
+            "type": "string"
+          },
+          "details": {
+            "description": "Additional information, e.g. the DeleteReport of a refused delete."
+          }
+        }
+      },
+      "ErrorEnvelope": {
+        "type": "object",
+        "required": [
+          "error"
+        ],
+        "properties": {
+          "error": {
+            "$ref": "#/components/schemas/Error"
+          }
+        }
+      },
+      "SectorProtocol": {
+        "type": "object",
+        "description": "Protocol negotiated by the last connection of the sector.",
+        "properties": {
+          "version": {
+            "type": "integer"
+          },
+          "plugin_version": {
+            "type": "string"
+          },
+          "events": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          },
+          "connected_at": {
+            "type": "string",
+            "format": "date-time"
+          }
+        }
+      },
+      "ObserverToken": {
+        "type": "object",
+        "properties": {
+          "token": {
+            "type": "string",
+            "description": "Observer token, only returned once."
+          }
+        }
+      },
+      "Activity": {
+        "type": "object",
+        "description": "Processed event or state change streamed to observers.",
+        "properties": {
+          "type": {
+            "type": "string",
+            "enum": [
+              "sector_event",
+              "sector_connected",
+              "sector_disconnected",
+              "sector_state",
+              "sector_players",
+              "sector_slow",
+              "faction_created",
+              "faction_changed",
+              "announcement"
+            ]
+          },
+          "hive_id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "sector_id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "event_type": {
+            "type": "string",
+            "description": "Sector event type for sector_event and faction activities."
+          },
+          "time": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "data": {
+            "description": "Payload of the activity: the event payload for sector_event, the faction for faction activities, the changed fields for sector_state and sector_players, overflows and slow_at for sector_slow."
+          },
+          "id": {
+            "type": "string",
+            "description": "Event id, usable as Last-Event-ID."
+          }
+        }
+      },
+      "Webhook": {
+        "type": "object",
+        "description": "Requests are signed: X-Hive-Signature is sha256= followed by the hex encoded HMAC-SHA256 of X-Hive-Timestamp, a dot and the body. X-Hive-Event names the event, X-Hive-Delivery the delivery.",
+        "properties": {
+          "id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "url": {
+            "type": "string",
+            "format": "uri",
+            "description": "http or https endpoint receiving POST requests."
+          },
+          "secret": {
+            "type": "string",
+            "minLength": 16,
+            "description": "Only returned when the webhook is created."
+          },
+          "types": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "Activity or event types to deliver, all if empty."
+          },
+          "template": {
+            "type": "string",
+            "description": "Go text/template rendering the JSON payload from the Activity as encoded in JSON, e.g. {\"content\": {{json .data.name}}}. The Activity is delivered if empty."
+          },
+          "active": {
+            "type": "boolean",
+            "default": true
+          }
+        }
+      },
+      "WebhookInput": {
+        "type": "object",
+        "required": [
+          "url"
+        ],
+        "additionalProperties": false,
+        "properties": {
+          "url": {
+            "type": "string",
+            "format": "uri",
+            "description": "http or https endpoint receiving POST requests."
+          },
+          "secret": {
+            "type": "string",
+            "minLength": 16,
+            "description": "Key of the HMAC-SHA256 signature in X-Hive-Signature, generated if empty. Never returned after creation."
+          },
+          "types": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "Activity or event types to deliver, all if empty."
+          },
+          "template": {
+            "type": "string",
+            "description": "Go text/template rendering the JSON payload from the Activity as encoded in JSON, e.g. {\"content\": {{json .data.name}}}. The Activity is delivered if empty."
+          },
+          "active": {
+            "type": "boolean",
+            "default": true
+          }
+        }
+      },
+      "WebhookPatch": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "url": {
+            "type": "string",
+            "format": "uri",
+            "description": "http or https endpoint receiving POST requests."
+          },
+          "secret": {
+            "type": "string",
+            "minLength": 16,
+            "description": "Key of the HMAC-SHA256 signature in X-Hive-Signature, generated if empty. Never returned after creation."
+          },
+          "types": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "description": "Activity or event types to deliver, all if empty."
+          },
+          "template": {
+            "type": "string",
+            "description": "Go text/template rendering the JSON payload from the Activity as encoded in JSON, e.g. {\"content\": {{json .data.name}}}. The Activity is delivered if empty."
+          },
+          "active": {
+            "type": "boolean",
+            "default": true
+          }
+        }
+      },
+      "WebhookDelivery": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "webhook_id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "activity_id": {
+            "type": "string"
+          },
+          "event": {
+            "type": "string",
+            "description": "Event type, or activity type for activities without event."
+          },
+          "payload": {
+            "type": "string",
+            "description": "Rendered request body."
+          },
+          "status": {
+            "type": "string",
+            "enum": [
+              "pending",
+              "retrying",
+              "delivered",
+              "failed"
+            ]
+          },
+          "attempts": {
+            "type": "integer"
+          },
+          "response_status": {
+            "type": "integer",
+            "description": "Status of the last response, absent if none was received."
+          },
+          "error": {
+            "type": "string"
+          },
+          "redelivery_of": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "created_at": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "updated_at": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "next_attempt_at": {
+            "type": "string",
+            "format": "date-time",
+            "description": "Time of the next attempt. Retries back off exponentially, requests failing with a status other than 408, 429 or 5xx are not retried. Pending and retrying deliveries are resumed after a restart."
+          }
+        }
+      },
+      "DeadLetter": {
+        "type": "object",
+        "description": "A sector event that failed. Events failing with a transient error, like lost database connectivity, are retried automatically with exponential backoff; the others need to be fixed and retried manually. Resolved dead letters are removed after 7 days.",
+        "properties": {
+          "id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "sector_id": {
+            "$ref": "#/components/schemas/ObjectId"
+          },
+          "message": {
+            "type": "string",
+            "description": "Event envelope as sent by the sector."
+          },
+          "event_id": {
+            "type": "string"
+          },
+          "event_type": {
+            "type": "string"
+          },
+          "status": {
+            "type": "string",
+            "enum": [
+              "retrying",
+              "processing",
+              "failed",
+              "resolved"
+            ]
+          },
+          "code": {
+            "type": "string",
+            "description": "Error code of the last attempt."
+          },
+          "error": {
+            "type": "string",
+            "description": "Error of the last attempt."
+          },
+          "transient": {
+            "type": "boolean",
+            "description": "Whether the last error was transient."
+          },
+          "attempts": {
+            "type": "integer"
+          },
+          "created_at": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "updated_at": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "next_attempt_at": {
+            "type": "string",
+            "format": "date-time",
+            "description": "Time of the next automatic retry."
+          },
+          "resolved_at": {
+            "type": "string",
+            "format": "date-time"
+          }
+        }
+      },
+      "DeadLetterInput": {
+        "type": "object",
+        "required": [
+          "message"
+        ],
+        "additionalProperties": false,
+        "properties": {
+          "message": {
+            "type": "string",
+            "description": "Event envelope {\"id\", \"type\", \"raw\"} to process on retry."
+          }
+        }
+      },
+      "DeadLetterPatch": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "message": {
+            "type": "string",
+            "description": "Event envelope {\"id\", \"type\", \"raw\"} to process on retry."
+          }
+        }
+      },
+      "JSONSchema": {
+        "type": "object",
+        "description": "JSON Schema draft-07 document.",
+        "additionalProperties": true
+      },
+      "SectorToken": {
+        "type": "object",
+        "properties": {
+          "token": {
+            "type": "string",
+            "description": "Sector token, only returned once."
+          }
+        }
+      },
+      "AnnouncementRequest": {
+        "type": "object",
+        "required": [
+          "message"
+        ],
+        "additionalProperties": false,
+        "properties": {
+          "message": {
+            "type": "string",
+            "minLength": 1,
+            "maxLength": 1024,
+            "description": "Text for the players, leading and trailing whitespace is removed."
+          },
+          "sector_id": {
+            "allOf": [
+              {
+                "$ref": "#/components/schemas/ObjectId"
+              }
+            ],
+            "description": "Sector to announce to, every sector of the hive if omitted."
+          }
+        }
+      },
+      "AnnouncementResult": {
+        "type": "object",
+        "properties": {
+          "sectors": {
+            "type": "integer",
+            "description": "Number of connected sectors the announcement was sent to."
+          }
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,81 @@
+// Package capture records the timeline of the sector connections and
+// messages of a hive, so a production problem can be replayed locally.
+//
+// A capture file holds one JSON record per line. It starts with a snapshot of
+// the hive, its sectors and factions, followed by the connections and
+// messages in the order the hub saw them, and ends with a snapshot taken when
+// the capture stopped. Records are dropped rather than delaying the hub when
+// the files cannot be written fast enough, a gap record in their place counts
+// them.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Record kinds.
+const (
+	KindSnapshot   = "snapshot"
+	KindConnect    = "connect"
+	KindDisconnect = "disconnect"
+	KindReceive    = "receive"
+	KindSend       = "send"
+	KindGap        = "gap"
+)
+
+// Record is an entry of the timeline of a hive.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	HiveID   string    `json:"hive_id"`
+	SectorID string    `json:"sector_id,omitempty"`
+
+	// Message received from or sent to the sector, for a connect the hello
+	// of the sector or empty for legacy sectors.
+	Message string `json:"message,omitempty"`
+
+	// Number of records dropped before a gap.
+	Dropped int `json:"dropped,omitempty"`
+
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+}
+
+// Snapshot holds the documents of a hive in MongoDB extended JSON.
+type Snapshot struct {
+	Hive     json.RawMessage   `json:"hive"`
+	Sectors  []json.RawMessage `json:"sectors"`
+	Factions []json.RawMessage `json:"factions"`
+}
+
+// ReadFile reads the records of a capture file.
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
@@ -0,0 +1,312 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Time between flushes of the capture files.
+const flushPeriod = time.Second
+
+// Records waiting for the writer, further records are dropped.
+const recordBuffer = 4096
+
+var metrics = expvar.NewMap("capture")
+
+// Recorder writes the records of the captured hives to one file per hive in
+// a directory. The files are written by a goroutine of their own, so Record
+// never waits for the disk. Only the first record of a hive waits for the
+// snapshot its capture starts with.
+type Recorder struct {
+	dir string
+
+	// Captured hives, all if empty.
+	hives map[string]bool
+
+	snapshot func(hiveHex string) (*Snapshot, error)
+
+	mu       sync.Mutex
+	captures map[string]*hiveCapture
+
+	records chan entry
+	files   map[string]*hiveFile
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+	closeErr  error
+}
+
+// hiveCapture is the state of the capture of a hive.
+type hiveCapture struct {
+	mu sync.Mutex
+
+	// Whether the opening snapshot was queued.
+	started bool
+
+	// Records dropped since the last queued record.
+	dropped int
+}
+
+// entry is a queued record with the records written before it, the opening
+// snapshot of the capture or the gap of the records dropped before it.
+type entry struct {
+	before []Record
+	record Record
+}
+
+type hiveFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// NewRecorder captures the hives, or every hive if none is given, to files in
+// dir. The snapshot function provides the state of a hive when its capture
+// starts and stops.
+func NewRecorder(dir string, hives []string, snapshot func(hiveHex string) (*Snapshot, error)) (*Recorder, error) {
+	r, err := newRecorder(dir, hives, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	go r.writeLoop()
+	return r, nil
+}
+
+// newRecorder returns a recorder whose writer is not started yet.
+func newRecorder(dir string, hives []string, snapshot func(hiveHex string) (*Snapshot, error)) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		dir:      dir,
+		hives:    make(map[string]bool),
+		snapshot: snapshot,
+		captures: make(map[string]*hiveCapture),
+		records:  make(chan entry, recordBuffer),
+		files:    make(map[string]*hiveFile),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for _, v := range hives {
+		r.hives[v] = true
+	}
+	return r, nil
+}
+
+// Record queues a record for the file of its hive. The first record of a hive
+// takes the snapshot its file starts with. A record is dropped, and counted in
+// the records_dropped metric, if the writer falls behind; a gap record takes
+// the place of the dropped records.
+func (r *Recorder) Record(record Record) {
+	if len(r.hives) > 0 && !r.hives[record.HiveID] {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+
+	c := r.capture(record.HiveID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := entry{record: record}
+	switch {
+	case !c.started:
+		snapshot, err := r.snapshot(record.HiveID)
+		if err != nil {
+			metrics.Add("records_dropped", 1)
+			logrus.Errorln("capture of hive", record.HiveID, "failed:", err)
+			return
+		}
+		e.before = append(e.before, Record{
+			Time:     time.Now(),
+			Kind:     KindSnapshot,
+			HiveID:   record.HiveID,
+			Snapshot: snapshot,
+		})
+	case c.dropped > 0:
+		e.before = append(e.before, gap(record.HiveID, c.dropped))
+	}
+
+	select {
+	case r.records <- e:
+		c.started = true
+		c.dropped = 0
+	default:
+		// a capture that did not start takes a new snapshot with its next
+		// record instead
+		metrics.Add("records_dropped", 1)
+		if c.started {
+			c.dropped++
+		}
+	}
+}
+
+// capture returns the capture state of a hive.
+func (r *Recorder) capture(hiveHex string) *hiveCapture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.captures[hiveHex]
+	if !ok {
+		c = &hiveCapture{}
+		r.captures[hiveHex] = c
+	}
+	return c
+}
+
+// gap is the record of records dropped from the capture of a hive.
+func gap(hiveHex string, dropped int) Record {
+	return Record{
+		Time:    time.Now(),
+		Kind:    KindGap,
+		HiveID:  hiveHex,
+		Dropped: dropped,
+	}
+}
+
+// writeLoop writes the queued records and flushes the files periodically
+// until the recorder is closed.
+func (r *Recorder) writeLoop() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(flushPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-r.records:
+			r.write(e)
+		case <-ticker.C:
+			for hiveHex, hf := range r.files {
+				if err := hf.w.Flush(); err != nil {
+					logrus.Errorln("capture of hive", hiveHex, "failed:", err)
+				}
+			}
+		case <-r.done:
+			// write the records queued before the close
+			for {
+				select {
+				case e := <-r.records:
+					r.write(e)
+				default:
+					r.closeErr = r.closeFiles()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write appends an entry to the file of its hive, the file is opened with the
+// first entry.
+func (r *Recorder) write(e entry) {
+	hiveHex := e.record.HiveID
+	hf, ok := r.files[hiveHex]
+	if !ok {
+		var err error
+		hf, err = r.open(hiveHex)
+		if err != nil {
+			logrus.Errorln("capture of hive", hiveHex, "failed:", err)
+			return
+		}
+		r.files[hiveHex] = hf
+	}
+
+	for _, record := range append(e.before, e.record) {
+		if err := hf.write(record); err != nil {
+			logrus.Errorln("capture of hive", hiveHex, "failed:", err)
+			return
+		}
+	}
+}
+
+// open creates the file of a hive.
+func (r *Recorder) open(hiveHex string) (*hiveFile, error) {
+	name := fmt.Sprintf("%s-%s.jsonl", hiveHex, time.Now().UTC().Format("20060102T150405"))
+	f, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.WithField("file", f.Name()).Infoln("capturing hive", hiveHex)
+	return &hiveFile{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (hf *hiveFile) write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = hf.w.Write(data)
+	return err
+}
+
+// Close writes the queued records, ends every capture with a snapshot of its
+// hive and closes the files.
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	<-r.stopped
+	return r.closeErr
+}
+
+// closeFiles ends every capture with the gap of the records dropped last and a
+// snapshot of its hive and closes the files.
+func (r *Recorder) closeFiles() error {
+	var firstErr error
+	for hiveHex, hf := range r.files {
+		c := r.capture(hiveHex)
+		c.mu.Lock()
+		dropped := c.dropped
+		c.dropped = 0
+		c.mu.Unlock()
+
+		var err error
+		if dropped > 0 {
+			err = hf.write(gap(hiveHex, dropped))
+		}
+
+		var snapshot *Snapshot
+		if err == nil {
+			snapshot, err = r.snapshot(hiveHex)
+		}
+		if err == nil {
+			err = hf.write(Record{
+				Time:     time.Now(),
+				Kind:     KindSnapshot,
+				HiveID:   hiveHex,
+				Snapshot: snapshot,
+			})
+		}
+		if err == nil {
+			err = hf.w.Flush()
+		}
+		if closeErr := hf.f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
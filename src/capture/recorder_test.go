@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"expvar"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func droppedRecords() int64 {
+	if v, ok := metrics.Get("records_dropped").(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// readCapture reads the only capture file in dir.
+func readCapture(t *testing.T, dir string) []Record {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "hive-*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v %v", files, err)
+	}
+	records, err := ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestRecordDoesNotBlock(t *testing.T) {
+	dir := t.TempDir()
+
+	// the writer falls behind until it is started
+	snapshots := 0
+	recorder, err := newRecorder(dir, nil, func(hiveHex string) (*Snapshot, error) {
+		snapshots++
+		return &Snapshot{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := droppedRecords()
+
+	const records = recordBuffer + 10
+	start := time.Now()
+	for i := 0; i < records; i++ {
+		recorder.Record(Record{Kind: KindReceive, HiveID: "hive", SectorID: "sector", Message: "{}"})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("recording took %s", elapsed)
+	}
+	if got := droppedRecords() - dropped; got != 10 {
+		t.Errorf("dropped %d records, want 10", got)
+	}
+	if snapshots != 1 {
+		t.Errorf("took %d snapshots before the writer started, want 1", snapshots)
+	}
+
+	go recorder.writeLoop()
+	for len(recorder.records) == cap(recorder.records) {
+		time.Sleep(time.Millisecond)
+	}
+	recorder.Record(Record{Kind: KindSend, HiveID: "hive", SectorID: "sector", Message: "{}"})
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the opening snapshot, the records kept, the gap of the dropped ones,
+	// the record after it and the closing snapshot
+	written := readCapture(t, dir)
+	if want := recordBuffer + 4; len(written) != want {
+		t.Fatalf("got %d records, want %d", len(written), want)
+	}
+	if written[0].Kind != KindSnapshot || written[len(written)-1].Kind != KindSnapshot {
+		t.Errorf("capture does not start and end with a snapshot")
+	}
+	if gap := written[recordBuffer+1]; gap.Kind != KindGap || gap.Dropped != 10 {
+		t.Errorf("got %s of %d records, want a gap of 10 records", gap.Kind, gap.Dropped)
+	}
+	if written[recordBuffer+2].Kind != KindSend {
+		t.Errorf("got %s after the gap, want the record after it", written[recordBuffer+2].Kind)
+	}
+}
+
+func TestRecordTakesTheOpeningSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	state := "before"
+	recorder, err := NewRecorder(dir, nil, func(hiveHex string) (*Snapshot, error) {
+		return &Snapshot{Hive: []byte(`"` + state + `"`)}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hub changes the state right after recording the event
+	recorder.Record(Record{Kind: KindReceive, HiveID: "hive", SectorID: "sector", Message: "{}"})
+	state = "after"
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	written := readCapture(t, dir)
+	if len(written) != 3 {
+		t.Fatalf("got %d records, want 3", len(written))
+	}
+	if got := string(written[0].Snapshot.Hive); got != `"before"` {
+		t.Errorf("capture starts with state %s, want \"before\"", got)
+	}
+}
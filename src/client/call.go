@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+)
+
+// Call is an event sent to the hive, waiting for its ack.
+type Call struct {
+	ID     string
+	Type   string
+	SentAt time.Time
+
+	message []byte
+	seq     uint64
+
+	once   sync.Once
+	done   chan struct{}
+	mu     sync.Mutex
+	queued bool
+	ack    protocol.Ack
+	err    error
+}
+
+func newCall(id string, eventType string, message []byte, seq uint64) *Call {
+	return &Call{
+		ID:      id,
+		Type:    eventType,
+		SentAt:  time.Now(),
+		message: message,
+		seq:     seq,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *Call) acknowledge(ack protocol.Ack) {
+	if ack.Queued {
+		c.mu.Lock()
+		c.queued = true
+		c.mu.Unlock()
+		return
+	}
+
+	c.once.Do(func() {
+		c.ack = ack
+		close(c.done)
+	})
+}
+
+func (c *Call) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Done is closed when the final ack arrived or the client stopped.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Queued reports whether the hive failed the event temporarily and retries
+// it. The event must not be rolled back, its final ack follows.
+func (c *Call) Queued() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queued
+}
+
+// Result returns the final ack, or the error that stopped the client before
+// the ack arrived. It is valid once Done is closed.
+func (c *Call) Result() (protocol.Ack, error) {
+	<-c.done
+	return c.ack, c.err
+}
+
+// Wait waits for the final ack.
+func (c *Call) Wait(ctx context.Context) (protocol.Ack, error) {
+	select {
+	case <-c.done:
+		return c.ack, c.err
+	case <-ctx.Done():
+		return protocol.Ack{}, ctx.Err()
+	}
+}
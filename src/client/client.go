@@ -0,0 +1,518 @@
+// Package client connects a sector to the hive over the sector protocol. It
+// negotiates the protocol, authenticates with the sector token, reconnects
+// with backoff and resends every event until the hive acknowledged it.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/event"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+
+	writeWait = 10 * time.Second
+)
+
+var (
+	// ErrUnauthorized is returned by Run when the hive rejects the token.
+	ErrUnauthorized = errors.New("invalid sector token")
+	// ErrSectorNotFound is returned by Run when the hive does not know the
+	// sector.
+	ErrSectorNotFound = errors.New("sector not found")
+	// ErrClosed is returned for events sent after Run returned.
+	ErrClosed = errors.New("client closed")
+)
+
+// Config configures a Client.
+type Config struct {
+	// URL is the base url of the hive system, http(s) or ws(s).
+	URL      string
+	HiveID   string
+	SectorID string
+	// Token is sent as bearer token, required if the sector has a token.
+	Token string
+
+	PluginVersion string
+	// Events lists the event types the sector handles, every type if empty.
+	Events []string
+	// Encoding is the preferred wire encoding, JSON if empty.
+	Encoding string
+
+	// MinBackoff and MaxBackoff limit the delay between reconnects.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Handler is called with every event the hive sends, on the read
+	// goroutine of the connection.
+	Handler func(e Event)
+	// OnConnect is called after every handshake, before the events waiting
+	// for their ack are resent.
+	OnConnect func(welcome protocol.Welcome)
+
+	// Dialer defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+}
+
+// Event is an event the hive sent to the sector.
+type Event struct {
+	ID   string
+	Type string
+	Raw  string
+	// Payload points to the decoded payload, see event.New. It is nil for
+	// unknown types.
+	Payload interface{}
+}
+
+// Client is the connection of one sector. Events are accepted before and
+// between connections and sent as soon as the sector is connected.
+type Client struct {
+	cfg    Config
+	url    string
+	prefix string
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	welcome protocol.Welcome
+	pending map[string]*Call
+	ids     uint64
+	seq     uint64
+	err     error
+}
+
+// New validates cfg and returns a client. It connects when Run is called.
+func New(cfg Config) (*Client, error) {
+	if cfg.HiveID == "" || cfg.SectorID == "" {
+		return nil, errors.New("hive id and sector id are required")
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	u.Path = fmt.Sprintf("/ws/hive/%s/sector/%s", cfg.HiveID, cfg.SectorID)
+
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = defaultMaxBackoff
+		if cfg.MaxBackoff < cfg.MinBackoff {
+			cfg.MaxBackoff = cfg.MinBackoff
+		}
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = websocket.DefaultDialer
+	}
+
+	return &Client{
+		cfg: cfg,
+		url: u.String(),
+		// event ids must stay unique across restarts of the sector
+		prefix:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		pending: make(map[string]*Call),
+	}, nil
+}
+
+// Run connects the sector and reconnects after connection losses until ctx is
+// done or the hive refuses the sector for good. Events without ack fail with
+// the returned error.
+func (c *Client) Run(ctx context.Context) error {
+	err := c.run(ctx)
+
+	c.mu.Lock()
+	c.err = err
+	calls := c.pendingCalls()
+	c.pending = make(map[string]*Call)
+	c.mu.Unlock()
+
+	for _, call := range calls {
+		call.fail(err)
+	}
+	return err
+}
+
+func (c *Client) run(ctx context.Context) error {
+	backoff := c.cfg.MinBackoff
+	for {
+		connected, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if permanent(err) {
+			return err
+		}
+
+		if connected {
+			backoff = c.cfg.MinBackoff
+		}
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseServiceRestart {
+			if d, ok := protocol.ParseRestartReason(closeErr.Text); ok {
+				delay = d
+			}
+		}
+		logrus.WithFields(logrus.Fields{
+			"hive":   c.cfg.HiveID,
+			"sector": c.cfg.SectorID,
+			"delay":  delay,
+		}).Warnln("sector connection lost:", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if !connected {
+			backoff *= 2
+			if backoff > c.cfg.MaxBackoff {
+				backoff = c.cfg.MaxBackoff
+			}
+		}
+	}
+}
+
+// permanent reports whether reconnecting after err is pointless.
+func permanent(err error) bool {
+	if err == ErrUnauthorized || err == ErrSectorNotFound {
+		return true
+	}
+
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		switch closeErr.Code {
+		case protocol.CloseProtocolError, protocol.CloseIncompatibleVersion, protocol.CloseSectorTakenOver:
+			return true
+		}
+	}
+	return false
+}
+
+// session runs one connection. It reports whether the handshake succeeded.
+func (c *Client) session(ctx context.Context) (bool, error) {
+	header := http.Header{}
+	if c.cfg.Token != "" {
+		header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+
+	conn, resp, err := c.cfg.Dialer.DialContext(ctx, c.url, header)
+	if err != nil {
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusUnauthorized:
+				return false, ErrUnauthorized
+			case http.StatusNotFound:
+				return false, ErrSectorNotFound
+			}
+		}
+		return false, err
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	welcome, err := c.handshake(conn)
+	if err != nil {
+		return false, err
+	}
+	if c.cfg.OnConnect != nil {
+		c.cfg.OnConnect(welcome)
+	}
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+
+	// resend the events without ack in the order they were sent; the
+	// connection is published once none is left, so events sent meanwhile
+	// queue behind them
+	var resent uint64
+	for {
+		c.mu.Lock()
+		var calls []*Call
+		for _, call := range c.pendingCalls() {
+			if call.seq > resent {
+				calls = append(calls, call)
+			}
+		}
+		if len(calls) == 0 {
+			c.conn = conn
+			c.welcome = welcome
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+
+		for _, call := range calls {
+			if err := c.write(conn, welcome, call); err != nil {
+				return true, err
+			}
+			resent = call.seq
+		}
+	}
+
+	return true, c.read(conn, welcome)
+}
+
+func (c *Client) handshake(conn *websocket.Conn) (protocol.Welcome, error) {
+	var welcome protocol.Welcome
+
+	hello := protocol.Hello{
+		ProtocolVersion: protocol.Version,
+		PluginVersion:   c.cfg.PluginVersion,
+		Events:          c.cfg.Events,
+		Encodings:       []string{protocol.EncodingJSON},
+	}
+	if c.cfg.Encoding != "" && c.cfg.Encoding != protocol.EncodingJSON {
+		hello.Encodings = []string{c.cfg.Encoding, protocol.EncodingJSON}
+	}
+	message, err := protocol.Message(protocol.TypeHello, hello)
+	if err != nil {
+		return welcome, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		return welcome, err
+	}
+
+	messageType, frame, err := conn.ReadMessage()
+	if err != nil {
+		return welcome, err
+	}
+	codec := protocol.CodecFor(protocol.EncodingJSON)
+	if messageType == websocket.BinaryMessage {
+		codec = protocol.CodecFor(protocol.EncodingMsgpack)
+	}
+	envelope, err := decode(codec, frame)
+	if err != nil {
+		return welcome, err
+	}
+	if envelope.Type != protocol.TypeWelcome {
+		return welcome, fmt.Errorf("expected %s, got %s", protocol.TypeWelcome, envelope.Type)
+	}
+
+	err = json.Unmarshal([]byte(envelope.Raw), &welcome)
+	return welcome, err
+}
+
+func decode(codec protocol.Codec, frame []byte) (protocol.Envelope, error) {
+	var envelope protocol.Envelope
+
+	data, err := codec.Decode(frame)
+	if err != nil {
+		return envelope, err
+	}
+
+	err = json.Unmarshal(data, &envelope)
+	return envelope, err
+}
+
+func (c *Client) read(conn *websocket.Conn, welcome protocol.Welcome) error {
+	codec := welcome.Codec()
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		envelope, err := decode(codec, frame)
+		if err != nil {
+			logrus.Errorln("malformed message:", err)
+			continue
+		}
+
+		if envelope.Type == protocol.TypeAck {
+			var ack protocol.Ack
+			if err := json.Unmarshal([]byte(envelope.Raw), &ack); err != nil {
+				logrus.Errorln("malformed ack:", err)
+				continue
+			}
+			c.acknowledge(ack)
+			continue
+		}
+
+		if c.cfg.Handler == nil {
+			continue
+		}
+		e := Event{
+			ID:   envelope.ID,
+			Type: envelope.Type,
+			Raw:  envelope.Raw,
+		}
+		if payload, ok := event.New(envelope.Type); ok {
+			if err := json.Unmarshal([]byte(envelope.Raw), payload); err != nil {
+				logrus.Errorf("malformed %s event: %v", envelope.Type, err)
+				continue
+			}
+			e.Payload = payload
+		}
+		c.cfg.Handler(e)
+	}
+}
+
+func (c *Client) acknowledge(ack protocol.Ack) {
+	if ack.Refused {
+		// the hive did not take the event, it is resent after reconnecting
+		return
+	}
+
+	c.mu.Lock()
+	call, ok := c.pending[ack.EventID]
+	if ok && !ack.Queued {
+		delete(c.pending, ack.EventID)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		// the ack of an event resent after a reconnect
+		return
+	}
+	call.acknowledge(ack)
+}
+
+// write sends an event. Hives without acks complete it once it is written.
+func (c *Client) write(conn *websocket.Conn, welcome protocol.Welcome, call *Call) error {
+	frame, err := welcome.Codec().Encode(call.message)
+	if err != nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if welcome.Codec().Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	c.writeMu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err = conn.WriteMessage(messageType, frame)
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if !welcome.Acknowledges() {
+		c.acknowledge(protocol.Ack{
+			EventID: call.ID,
+			Success: true,
+		})
+	}
+	return nil
+}
+
+// pendingCalls returns the events without ack in the order they were sent.
+// The caller holds c.mu.
+func (c *Client) pendingCalls() []*Call {
+	calls := make([]*Call, 0, len(c.pending))
+	for _, call := range c.pending {
+		calls = append(calls, call)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].seq < calls[j].seq })
+	return calls
+}
+
+// Send sends an event with a generated id.
+func (c *Client) Send(eventType string, payload interface{}) (*Call, error) {
+	c.mu.Lock()
+	c.ids++
+	id := c.prefix + "-" + strconv.FormatUint(c.ids, 36)
+	c.mu.Unlock()
+
+	return c.SendWithID(id, eventType, payload)
+}
+
+// SendWithID sends an event with the given id. Events with an id the hive
+// processed before are acknowledged as duplicate without being applied.
+func (c *Client) SendWithID(id string, eventType string, payload interface{}) (*Call, error) {
+	if id == "" || len(id) > protocol.MaxEventIDLength {
+		return nil, fmt.Errorf("event id must be 1 to %d characters long", protocol.MaxEventIDLength)
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	message, err := json.Marshal(protocol.Envelope{
+		ID:   id,
+		Type: eventType,
+		Raw:  string(raw),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%v: %v", ErrClosed, err)
+	}
+	if _, ok := c.pending[id]; ok {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("event %s is waiting for its ack", id)
+	}
+	c.seq++
+	call := newCall(id, eventType, message, c.seq)
+	c.pending[id] = call
+	conn, welcome := c.conn, c.welcome
+	c.mu.Unlock()
+
+	if conn != nil {
+		// a failed write is repeated after reconnecting
+		if err := c.write(conn, welcome, call); err != nil {
+			conn.Close()
+		}
+	}
+	return call, nil
+}
+
+// Pending returns the number of events waiting for their ack.
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Welcome returns the negotiated protocol, false while disconnected.
+func (c *Client) Welcome() (protocol.Welcome, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.welcome, c.conn != nil
+}
@@ -0,0 +1,316 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/event"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// fakeHive accepts sector connections and hands each connection, after the
+// handshake, to the next handler.
+func fakeHive(t *testing.T, handlers ...func(conn *websocket.Conn)) *httptest.Server {
+	connections := make(chan func(conn *websocket.Conn), len(handlers))
+	for _, h := range handlers {
+		connections <- h
+	}
+
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "invalid sector token", http.StatusUnauthorized)
+			return
+		}
+
+		var handler func(conn *websocket.Conn)
+		select {
+		case handler = <-connections:
+		default:
+			http.Error(w, "unexpected connection", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		var hello protocol.Envelope
+		if err := conn.ReadJSON(&hello); err != nil || hello.Type != protocol.TypeHello {
+			t.Errorf("expected hello, got %v %v", hello, err)
+			return
+		}
+		welcome, _ := protocol.Message(protocol.TypeWelcome, protocol.Welcome{
+			ProtocolVersion: protocol.Version,
+			Events:          event.Types,
+			Encoding:        protocol.EncodingJSON,
+		})
+		conn.WriteMessage(websocket.TextMessage, welcome)
+
+		handler(conn)
+	}))
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) protocol.Envelope {
+	var envelope protocol.Envelope
+	if err := conn.ReadJSON(&envelope); err != nil {
+		t.Error(err)
+	}
+	return envelope
+}
+
+func writeAck(conn *websocket.Conn, ack protocol.Ack) {
+	message, _ := protocol.Message(protocol.TypeAck, ack)
+	conn.WriteMessage(websocket.TextMessage, message)
+}
+
+func newTestClient(t *testing.T, server *httptest.Server, handler func(e Event)) *Client {
+	c, err := New(Config{
+		URL:        server.URL,
+		HiveID:     "5c2b7d3e9f1a4b0012345678",
+		SectorID:   "5c2b7d3e9f1a4b0087654321",
+		Token:      "secret",
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+		Handler:    handler,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func waitResult(t *testing.T, call *Call) (protocol.Ack, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return call.Wait(ctx)
+}
+
+func TestSendWaitsForAck(t *testing.T) {
+	server := fakeHive(t, func(conn *websocket.Conn) {
+		e := readEvent(t, conn)
+		if e.Type != event.TypeFactionCreated {
+			t.Errorf("unexpected event %s", e.Type)
+		}
+		writeAck(conn, protocol.Ack{EventID: e.ID, Queued: true})
+		writeAck(conn, protocol.Ack{EventID: e.ID, Success: true})
+		conn.ReadMessage()
+	})
+	defer server.Close()
+
+	c := newTestClient(t, server, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	call, err := c.FactionCreated(event.FactionCreated{FactionID: 1, Tag: "ABC", Name: "Alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ack, err := waitResult(t, call)
+	if err != nil || !ack.Success {
+		t.Fatalf("expected success, got %+v %v", ack, err)
+	}
+	if !call.Queued() {
+		t.Error("expected the queued ack to be recorded")
+	}
+	if c.Pending() != 0 {
+		t.Errorf("expected no pending events, got %d", c.Pending())
+	}
+}
+
+func TestResendAfterReconnect(t *testing.T) {
+	ids := make(chan string, 2)
+	server := fakeHive(t, func(conn *websocket.Conn) {
+		// lose the connection before the ack
+		ids <- readEvent(t, conn).ID
+	}, func(conn *websocket.Conn) {
+		e := readEvent(t, conn)
+		ids <- e.ID
+		writeAck(conn, protocol.Ack{EventID: e.ID, Success: true, Duplicate: true})
+		conn.ReadMessage()
+	})
+	defer server.Close()
+
+	c := newTestClient(t, server, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	call, err := c.FactionDeclareWar(event.FactionPeaceWar{FromFactionID: 1, ToFactionID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ack, err := waitResult(t, call)
+	if err != nil || !ack.Success || !ack.Duplicate {
+		t.Fatalf("expected duplicate success, got %+v %v", ack, err)
+	}
+	if first, second := <-ids, <-ids; first != second || first != call.ID {
+		t.Errorf("expected the event to be resent with id %s, got %s and %s", call.ID, first, second)
+	}
+}
+
+// slowConn delays every write, so a resend takes a while.
+type slowConn struct {
+	net.Conn
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return c.Conn.Write(b)
+}
+
+func TestEventsSentDuringResendFollowIt(t *testing.T) {
+	const resent = 200
+
+	received := make(chan []string, 1)
+	server := fakeHive(t, func(conn *websocket.Conn) {
+		var ids []string
+		for len(ids) < resent+1 {
+			ids = append(ids, readEvent(t, conn).ID)
+		}
+		received <- ids
+		conn.ReadMessage()
+	})
+	defer server.Close()
+
+	c := newTestClient(t, server, nil)
+	c.cfg.Dialer = &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return slowConn{conn}, err
+		},
+	}
+	var calls []*Call
+	for i := 0; i < resent; i++ {
+		call, err := c.FactionMemberSendJoin(event.FactionMember{FactionID: 1, PlayerID: int64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = append(calls, call)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	// send as soon as the client reports the connection
+	for {
+		if _, ok := c.Welcome(); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	call, err := c.FactionMemberLeave(event.FactionMember{FactionID: 1, PlayerID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = append(calls, call)
+
+	select {
+	case ids := <-received:
+		for i, id := range ids {
+			if id != calls[i].ID {
+				t.Fatalf("event %d: got %s, want %s", i, id, calls[i].ID)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not received")
+	}
+}
+
+func TestRefusedEventIsResent(t *testing.T) {
+	server := fakeHive(t, func(conn *websocket.Conn) {
+		e := readEvent(t, conn)
+		writeAck(conn, protocol.Ack{EventID: e.ID, Refused: true, Code: "unavailable"})
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, protocol.RestartReason(0)))
+	}, func(conn *websocket.Conn) {
+		e := readEvent(t, conn)
+		writeAck(conn, protocol.Ack{EventID: e.ID, Success: true})
+		conn.ReadMessage()
+	})
+	defer server.Close()
+
+	c := newTestClient(t, server, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	call, err := c.FactionDeclareWar(event.FactionPeaceWar{FromFactionID: 1, ToFactionID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ack, err := waitResult(t, call)
+	if err != nil || !ack.Success {
+		t.Fatalf("expected the resent event to succeed, got %+v %v", ack, err)
+	}
+}
+
+func TestReceiveDecodesPayload(t *testing.T) {
+	server := fakeHive(t, func(conn *websocket.Conn) {
+		message, _ := protocol.Message(event.TypeFactionMemberSendJoin, event.FactionMember{
+			FactionID:     7,
+			PlayerSteamID: 76561198000000001,
+		})
+		conn.WriteMessage(websocket.TextMessage, message)
+		conn.ReadMessage()
+	})
+	defer server.Close()
+
+	events := make(chan Event, 1)
+	c := newTestClient(t, server, func(e Event) {
+		events <- e
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	select {
+	case e := <-events:
+		member, ok := e.Payload.(*event.FactionMember)
+		if !ok {
+			t.Fatalf("unexpected payload %T", e.Payload)
+		}
+		if member.FactionID != 7 || member.PlayerSteamID != 76561198000000001 {
+			t.Errorf("unexpected payload %+v", member)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestUnauthorizedStopsClient(t *testing.T) {
+	server := fakeHive(t)
+	defer server.Close()
+
+	c := newTestClient(t, server, nil)
+	c.cfg.Token = "wrong"
+
+	call, err := c.ServerStateChange(event.ServerStateChanged{State: "Loaded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Run(context.Background()); err != ErrUnauthorized {
+		t.Fatalf("expected %v, got %v", ErrUnauthorized, err)
+	}
+	if _, err := waitResult(t, call); err != ErrUnauthorized {
+		t.Errorf("expected the pending event to fail with %v, got %v", ErrUnauthorized, err)
+	}
+	if _, err := c.ServerStateChange(event.ServerStateChanged{State: "Loaded"}); err == nil {
+		t.Error("expected an error sending on a stopped client")
+	}
+}
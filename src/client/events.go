@@ -0,0 +1,67 @@
+package client
+
+import "github.com/fankserver/torchapi-hive-system/src/event"
+
+func (c *Client) ServerStateChange(e event.ServerStateChanged) (*Call, error) {
+	return c.Send(event.TypeServerStateChange, e)
+}
+
+func (c *Client) FactionCreated(e event.FactionCreated) (*Call, error) {
+	return c.Send(event.TypeFactionCreated, e)
+}
+
+func (c *Client) FactionCreatedComplete(e event.FactionCreatedComplete) (*Call, error) {
+	return c.Send(event.TypeFactionCreatedComplete, e)
+}
+
+func (c *Client) FactionEdited(e event.FactionEdited) (*Call, error) {
+	return c.Send(event.TypeFactionEdited, e)
+}
+
+func (c *Client) FactionAutoAcceptChanged(e event.FactionAutoAcceptChanged) (*Call, error) {
+	return c.Send(event.TypeFactionAutoAcceptChanged, e)
+}
+
+func (c *Client) FactionMemberSendJoin(e event.FactionMember) (*Call, error) {
+	return c.Send(event.TypeFactionMemberSendJoin, e)
+}
+
+func (c *Client) FactionMemberCancelJoin(e event.FactionMember) (*Call, error) {
+	return c.Send(event.TypeFactionMemberCancelJoin, e)
+}
+
+func (c *Client) FactionMemberAcceptJoin(e event.FactionMember) (*Call, error) {
+	return c.Send(event.TypeFactionMemberAcceptJoin, e)
+}
+
+func (c *Client) FactionMemberPromote(e event.FactionMember) (*Call, error) {
+	return c.Send(event.TypeFactionMemberPromote, e)
+}
+
+func (c *Client) FactionMemberDemote(e event.FactionMember) (*Call, error) {
+	return c.Send(event.TypeFactionMemberDemote, e)
+}
+
+func (c *Client) FactionMemberKick(e event.FactionMember) (*Call, error) {
+	return c.Send(event.TypeFactionMemberKick, e)
+}
+
+func (c *Client) FactionMemberLeave(e event.FactionMember) (*Call, error) {
+	return c.Send(event.TypeFactionMemberLeave, e)
+}
+
+func (c *Client) FactionSendPeaceRequest(e event.FactionPeaceWar) (*Call, error) {
+	return c.Send(event.TypeFactionSendPeaceRequest, e)
+}
+
+func (c *Client) FactionCancelPeaceRequest(e event.FactionPeaceWar) (*Call, error) {
+	return c.Send(event.TypeFactionCancelPeaceRequest, e)
+}
+
+func (c *Client) FactionAcceptPeace(e event.FactionPeaceWar) (*Call, error) {
+	return c.Send(event.TypeFactionAcceptPeace, e)
+}
+
+func (c *Client) FactionDeclareWar(e event.FactionPeaceWar) (*Call, error) {
+	return c.Send(event.TypeFactionDeclareWar, e)
+}
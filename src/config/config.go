@@ -0,0 +1,272 @@
+// Package config loads the settings of the hive system from a YAML file and
+// TORCHHIVE_* environment variables, which override the file.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the settings of the hive system. Websocket, connection policy,
+// reconnect delay and log level can change while the system runs, the others
+// need a restart.
+type Config struct {
+	// Address of the API and websocket server.
+	Listen string `yaml:"listen"`
+
+	// Address of the pprof and metrics server.
+	DebugListen string `yaml:"debug_listen"`
+
+	Database  Database  `yaml:"database"`
+	Websocket Websocket `yaml:"websocket"`
+
+	// Handling of a second connection of a connected sector: takeover or
+	// reject.
+	ConnectionPolicy string `yaml:"connection_policy"`
+
+	// Reconnect delay announced to sectors on shutdown.
+	ReconnectDelay time.Duration `yaml:"reconnect_delay"`
+
+	// File keeping the dead letters the database did not take until it is
+	// reachable again. Without a file they are kept in memory.
+	DeadLetterSpool string `yaml:"dead_letter_spool"`
+
+	// Level of the log: debug, info, warning or error.
+	LogLevel string `yaml:"log_level"`
+}
+
+type Database struct {
+	// MongoDB connection string.
+	Connection string `yaml:"connection"`
+
+	Name string `yaml:"name"`
+}
+
+// Websocket holds the settings of the sector and observer connections, see
+// notification.Settings.
+type Websocket struct {
+	ReadBufferSize  int           `yaml:"read_buffer_size"`
+	WriteBufferSize int           `yaml:"write_buffer_size"`
+	WriteWait       time.Duration `yaml:"write_wait"`
+	PongWait        time.Duration `yaml:"pong_wait"`
+	PingPeriod      time.Duration `yaml:"ping_period"`
+	MaxMessageSize  int64         `yaml:"max_message_size"`
+	HelloWait       time.Duration `yaml:"hello_wait"`
+}
+
+// Default returns the settings used without a config file.
+func Default() *Config {
+	settings := notification.DefaultSettings()
+	return &Config{
+		Listen:      ":8080",
+		DebugListen: ":6060",
+		Database: Database{
+			Connection: "mongodb://localhost",
+			Name:       hive.DefaultDatabase,
+		},
+		Websocket: Websocket{
+			ReadBufferSize:  settings.ReadBufferSize,
+			WriteBufferSize: settings.WriteBufferSize,
+			WriteWait:       settings.WriteWait,
+			PongWait:        settings.PongWait,
+			PingPeriod:      settings.PingPeriod,
+			MaxMessageSize:  settings.MaxMessageSize,
+			HelloWait:       settings.HelloWait,
+		},
+		ConnectionPolicy: notification.ConnectionTakeover,
+		ReconnectDelay:   10 * time.Second,
+		LogLevel:         "info",
+	}
+}
+
+// Load reads the config file, if path is not empty, over the defaults and
+// applies the environment variables. Unknown keys in the file are an error.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides the settings with the environment variables that are
+// set.
+func (c *Config) applyEnv(lookup func(key string) (string, bool)) error {
+	str := func(target *string) func(string) error {
+		return func(v string) error {
+			*target = v
+			return nil
+		}
+	}
+	integer := func(target *int) func(string) error {
+		return func(v string) error {
+			n, err := strconv.Atoi(v)
+			*target = n
+			return err
+		}
+	}
+	integer64 := func(target *int64) func(string) error {
+		return func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			*target = n
+			return err
+		}
+	}
+	duration := func(target *time.Duration) func(string) error {
+		return func(v string) error {
+			d, err := time.ParseDuration(v)
+			*target = d
+			return err
+		}
+	}
+
+	vars := []struct {
+		key   string
+		apply func(string) error
+	}{
+		{"TORCHHIVE_LISTEN", str(&c.Listen)},
+		{"TORCHHIVE_DEBUG_LISTEN", str(&c.DebugListen)},
+		{"TORCHHIVE_DB_CONNECTION", str(&c.Database.Connection)},
+		{"TORCHHIVE_DB_NAME", str(&c.Database.Name)},
+		{"TORCHHIVE_WS_READ_BUFFER_SIZE", integer(&c.Websocket.ReadBufferSize)},
+		{"TORCHHIVE_WS_WRITE_BUFFER_SIZE", integer(&c.Websocket.WriteBufferSize)},
+		{"TORCHHIVE_WS_WRITE_WAIT", duration(&c.Websocket.WriteWait)},
+		{"TORCHHIVE_WS_PONG_WAIT", duration(&c.Websocket.PongWait)},
+		{"TORCHHIVE_WS_PING_PERIOD", duration(&c.Websocket.PingPeriod)},
+		{"TORCHHIVE_WS_MAX_MESSAGE_SIZE", integer64(&c.Websocket.MaxMessageSize)},
+		{"TORCHHIVE_WS_HELLO_WAIT", duration(&c.Websocket.HelloWait)},
+		{"TORCHHIVE_CONNECTION_POLICY", str(&c.ConnectionPolicy)},
+		{"TORCHHIVE_RECONNECT_DELAY", duration(&c.ReconnectDelay)},
+		{"TORCHHIVE_DEAD_LETTER_SPOOL", str(&c.DeadLetterSpool)},
+		{"TORCHHIVE_LOG_LEVEL", str(&c.LogLevel)},
+	}
+	for _, v := range vars {
+		value, ok := lookup(v.key)
+		if !ok {
+			continue
+		}
+		if err := v.apply(value); err != nil {
+			return fmt.Errorf("%s: %v", v.key, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all problems at once.
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen == "" {
+		invalid("listen is required")
+	}
+	if c.DebugListen == "" {
+		invalid("debug_listen is required")
+	}
+	if c.Database.Connection == "" {
+		invalid("database.connection is required")
+	}
+	if c.Database.Name == "" || strings.ContainsAny(c.Database.Name, `/\. "$`) {
+		invalid("database.name %q is not a valid database name", c.Database.Name)
+	}
+	if err := c.Websocket.Settings().Validate(); err != nil {
+		invalid("websocket: %v", err)
+	}
+	if c.ConnectionPolicy != notification.ConnectionTakeover && c.ConnectionPolicy != notification.ConnectionReject {
+		invalid("connection_policy %q must be %s or %s", c.ConnectionPolicy, notification.ConnectionTakeover, notification.ConnectionReject)
+	}
+	if c.ReconnectDelay < 0 {
+		invalid("reconnect_delay must not be negative")
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		invalid("log_level: %v", err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// restartSettings are the settings that only take effect after a restart.
+// keep sets the value of the running config in next and reports whether it
+// differed.
+var restartSettings = []struct {
+	name string
+	keep func(running *Config, next *Config) bool
+}{
+	{"listen", func(running *Config, next *Config) bool {
+		changed := running.Listen != next.Listen
+		next.Listen = running.Listen
+		return changed
+	}},
+	{"debug_listen", func(running *Config, next *Config) bool {
+		changed := running.DebugListen != next.DebugListen
+		next.DebugListen = running.DebugListen
+		return changed
+	}},
+	{"database", func(running *Config, next *Config) bool {
+		changed := running.Database != next.Database
+		next.Database = running.Database
+		return changed
+	}},
+	{"dead_letter_spool", func(running *Config, next *Config) bool {
+		changed := running.DeadLetterSpool != next.DeadLetterSpool
+		next.DeadLetterSpool = running.DeadLetterSpool
+		return changed
+	}},
+}
+
+// RestartRequired returns the settings that differ in next but only take
+// effect after a restart.
+func (c *Config) RestartRequired(next *Config) []string {
+	kept := *next
+	return c.KeepRestartSettings(&kept)
+}
+
+// KeepRestartSettings sets the settings of next that only take effect after a
+// restart to their value in c and returns those that differed.
+func (c *Config) KeepRestartSettings(next *Config) []string {
+	var changed []string
+	for _, setting := range restartSettings {
+		if setting.keep(c, next) {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// Settings returns the websocket settings of the hub.
+func (w Websocket) Settings() notification.Settings {
+	return notification.Settings{
+		ReadBufferSize:  w.ReadBufferSize,
+		WriteBufferSize: w.WriteBufferSize,
+		WriteWait:       w.WriteWait,
+		PongWait:        w.PongWait,
+		PingPeriod:      w.PingPeriod,
+		MaxMessageSize:  w.MaxMessageSize,
+		HelloWait:       w.HelloWait,
+	}
+}
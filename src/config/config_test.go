@@ -0,0 +1,121 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := ioutil.WriteFile(path, []byte(`
+listen: ":9090"
+database:
+  name: hive_test
+websocket:
+  pong_wait: 30s
+  ping_period: 20s
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TORCHHIVE_DB_NAME", "hive_env")
+	t.Setenv("TORCHHIVE_WS_MAX_MESSAGE_SIZE", "1024")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Listen != ":9090" || c.DebugListen != ":6060" {
+		t.Errorf("expected the file over the defaults, got %q %q", c.Listen, c.DebugListen)
+	}
+	if c.Database.Name != "hive_env" || c.Database.Connection != "mongodb://localhost" {
+		t.Errorf("expected the environment over the file, got %+v", c.Database)
+	}
+	if ws := c.Websocket; ws.PongWait != 30*time.Second || ws.PingPeriod != 20*time.Second || ws.MaxMessageSize != 1024 || ws.ReadBufferSize != 1024 {
+		t.Errorf("unexpected websocket settings %+v", ws)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte("listen_address: \":9090\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Database.Name = "torch.hive"
+	c.Websocket.PingPeriod = c.Websocket.PongWait
+	c.ConnectionPolicy = "queue"
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected an invalid config")
+	}
+	for _, v := range []string{"database.name", "ping period", "connection_policy"} {
+		if !strings.Contains(err.Error(), v) {
+			t.Errorf("expected %q to report %s", err, v)
+		}
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	c := Default()
+	next := Default()
+	next.Database.Name = "other"
+	next.Websocket.MaxMessageSize = 1024
+	next.LogLevel = "debug"
+
+	if changed := c.RestartRequired(next); len(changed) != 1 || changed[0] != "database" {
+		t.Errorf("expected only the database to need a restart, got %v", changed)
+	}
+}
+
+func TestKeepRestartSettings(t *testing.T) {
+	c := Default()
+	next := Default()
+	next.Listen = ":9090"
+	next.DebugListen = ":7070"
+	next.Database.Name = "other"
+	next.DeadLetterSpool = "/var/lib/hive/spool"
+	next.Websocket.MaxMessageSize = 1024
+	next.LogLevel = "debug"
+
+	changed := c.KeepRestartSettings(next)
+	if len(changed) != 4 {
+		t.Errorf("expected four settings to need a restart, got %v", changed)
+	}
+	if changed := c.RestartRequired(next); len(changed) != 0 {
+		t.Errorf("expected the restart settings to be kept, got %v changed", changed)
+	}
+
+	// only the settings that change while the system runs differ
+	want := *c
+	want.Websocket.MaxMessageSize = 1024
+	want.LogLevel = "debug"
+	if *next != want {
+		t.Errorf("got %+v, want %+v", *next, want)
+	}
+}
+
+func TestExampleMatchesDefault(t *testing.T) {
+	c, err := Load("../../config.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *c != *Default() {
+		t.Errorf("config.example.yml differs from the defaults: %+v", c)
+	}
+}
@@ -0,0 +1,112 @@
+// Package event defines the events exchanged between the sectors and the hive
+// and their payloads.
+package event
+
+const (
+	TypeServerStateChange         = "serverStateChange"
+	TypeFactionCreated            = "factionCreated"
+	TypeFactionCreatedComplete    = "factionCreatedComplete"
+	TypeFactionEdited             = "factionEdited"
+	TypeFactionAutoAcceptChanged  = "factionAutoAcceptChanged"
+	TypeFactionMemberSendJoin     = "factionMemberSendJoin"
+	TypeFactionMemberCancelJoin   = "factionMemberCancelJoin"
+	TypeFactionMemberAcceptJoin   = "factionMemberAcceptJoin"
+	TypeFactionMemberPromote      = "factionMemberPromote"
+	TypeFactionMemberDemote       = "factionMemberDemote"
+	TypeFactionMemberKick         = "factionMemberKick"
+	TypeFactionMemberLeave        = "factionMemberLeave"
+	TypeFactionSendPeaceRequest   = "factionSendPeaceRequest"
+	TypeFactionCancelPeaceRequest = "factionCancelPeaceRequest"
+	TypeFactionAcceptPeace        = "factionAcceptPeace"
+	TypeFactionDeclareWar         = "factionDeclareWar"
+)
+
+// Types lists every sector event type.
+var Types = []string{
+	TypeServerStateChange,
+	TypeFactionCreated,
+	TypeFactionCreatedComplete,
+	TypeFactionEdited,
+	TypeFactionAutoAcceptChanged,
+	TypeFactionMemberSendJoin,
+	TypeFactionMemberCancelJoin,
+	TypeFactionMemberAcceptJoin,
+	TypeFactionMemberPromote,
+	TypeFactionMemberDemote,
+	TypeFactionMemberKick,
+	TypeFactionMemberLeave,
+	TypeFactionSendPeaceRequest,
+	TypeFactionCancelPeaceRequest,
+	TypeFactionAcceptPeace,
+	TypeFactionDeclareWar,
+}
+
+type ServerStateChanged struct {
+	State string
+}
+
+type FactionCreated struct {
+	FactionID      int64 `json:"FactionId"`
+	Tag            string
+	Name           string
+	Description    string
+	PrivateInfo    string
+	AcceptHumans   bool
+	FounderID      int64  `json:"FounderId"`
+	FounderSteamID uint64 `json:"FounderSteamId"`
+	FounderName    string
+}
+
+type FactionCreatedComplete struct {
+	FactionID int64 `json:"FactionId"`
+	Tag       string
+}
+
+type FactionEdited struct {
+	FactionID   int64 `json:"FactionId"`
+	Tag         string
+	Name        string
+	Description string
+	PrivateInfo string
+}
+
+type FactionAutoAcceptChanged struct {
+	FactionID        int64 `json:"FactionId"`
+	AutoAcceptMember bool
+	AutoAcceptPeace  bool
+}
+
+type FactionMember struct {
+	FactionID     int64  `json:"FactionId"`
+	PlayerID      int64  `json:"PlayerId"`
+	PlayerSteamID uint64 `json:"PlayerSteamId"`
+	PlayerName    string
+}
+
+type FactionPeaceWar struct {
+	FromFactionID int64 `json:"FromFactionId"`
+	ToFactionID   int64 `json:"ToFactionId"`
+}
+
+// New returns a pointer to the zero payload of an event type, or false for
+// unknown types.
+func New(eventType string) (interface{}, bool) {
+	switch eventType {
+	case TypeServerStateChange:
+		return &ServerStateChanged{}, true
+	case TypeFactionCreated:
+		return &FactionCreated{}, true
+	case TypeFactionCreatedComplete:
+		return &FactionCreatedComplete{}, true
+	case TypeFactionEdited:
+		return &FactionEdited{}, true
+	case TypeFactionAutoAcceptChanged:
+		return &FactionAutoAcceptChanged{}, true
+	case TypeFactionMemberSendJoin, TypeFactionMemberCancelJoin, TypeFactionMemberAcceptJoin,
+		TypeFactionMemberPromote, TypeFactionMemberDemote, TypeFactionMemberKick, TypeFactionMemberLeave:
+		return &FactionMember{}, true
+	case TypeFactionSendPeaceRequest, TypeFactionCancelPeaceRequest, TypeFactionAcceptPeace, TypeFactionDeclareWar:
+		return &FactionPeaceWar{}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,108 @@
+package hive
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo/bson"
+)
+
+const CollectionActivity = "activity_log"
+
+// Logged activities are removed after activityRetention.
+const activityRetention = 7 * 24 * time.Hour
+
+type activityRecord struct {
+	ID        bson.ObjectId `bson:"_id"`
+	HiveID    bson.ObjectId `bson:"hive_id"`
+	SectorID  bson.ObjectId `bson:"sector_id,omitempty"`
+	Type      string        `bson:"type"`
+	EventType string        `bson:"event_type,omitempty"`
+	Time      time.Time     `bson:"time"`
+	Data      string        `bson:"data,omitempty"`
+}
+
+// LogActivity persists an activity for resuming event streams.
+func (s *System) LogActivity(activity *notification.Activity) error {
+	record := activityRecord{
+		ID:        bson.ObjectIdHex(activity.ID),
+		HiveID:    bson.ObjectIdHex(activity.HiveID),
+		Type:      activity.Type,
+		EventType: activity.EventType,
+		Time:      activity.Time,
+	}
+	if bson.IsObjectIdHex(activity.SectorID) {
+		record.SectorID = bson.ObjectIdHex(activity.SectorID)
+	}
+	if activity.Data != nil {
+		data, err := json.Marshal(activity.Data)
+		if err != nil {
+			return err
+		}
+		record.Data = string(data)
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	return conn.DB(s.database).C(CollectionActivity).Insert(record)
+}
+
+// ActivitiesSince returns the logged activities of a hive after lastID,
+// filtered by activity or event types and sectors.
+func (s *System) ActivitiesSince(hiveHex string, lastID string, types []string, sectors []string, limit int) ([]*notification.Activity, error) {
+	if !bson.IsObjectIdHex(lastID) {
+		return nil, api.Validation("Last-Event-ID", "must be an event id")
+	}
+
+	filter := bson.M{
+		"hive_id": bson.ObjectIdHex(hiveHex),
+		"_id":     bson.M{"$gt": bson.ObjectIdHex(lastID)},
+	}
+	if len(types) > 0 {
+		filter["$or"] = []bson.M{
+			{"type": bson.M{"$in": types}},
+			{"event_type": bson.M{"$in": types}},
+		}
+	}
+	if len(sectors) > 0 {
+		sectorIDs := make([]bson.ObjectId, 0, len(sectors))
+		for _, v := range sectors {
+			if !bson.IsObjectIdHex(v) {
+				return nil, api.Validation("sector", "must be a list of sector ids")
+			}
+			sectorIDs = append(sectorIDs, bson.ObjectIdHex(v))
+		}
+		filter["sector_id"] = bson.M{"$in": sectorIDs}
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var records []activityRecord
+	err := conn.DB(s.database).C(CollectionActivity).Find(filter).Sort("_id").Limit(limit).All(&records)
+	if err != nil {
+		return nil, err
+	}
+
+	activities := make([]*notification.Activity, len(records))
+	for i, record := range records {
+		activities[i] = &notification.Activity{
+			ID:        record.ID.Hex(),
+			Type:      record.Type,
+			HiveID:    record.HiveID.Hex(),
+			EventType: record.EventType,
+			Time:      record.Time,
+		}
+		if record.SectorID != "" {
+			activities[i].SectorID = record.SectorID.Hex()
+		}
+		if record.Data != "" {
+			activities[i].Data = json.RawMessage(record.Data)
+		}
+	}
+
+	return activities, nil
+}
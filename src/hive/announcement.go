@@ -0,0 +1,88 @@
+package hive
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+// Maximum length of an announcement in characters.
+const maxAnnouncementLength = 1024
+
+type announcementRequest struct {
+	Message string `json:"message"`
+
+	// Sector to announce to, every sector of the hive if empty.
+	SectorID bson.ObjectId `json:"sector_id,omitempty"`
+}
+
+// AnnouncementResult reports the number of sectors an announcement was sent
+// to.
+type AnnouncementResult struct {
+	Sectors int `json:"sectors"`
+}
+
+// RegisterAnnouncementHandler sets the function that sends announcements to
+// the connected sectors of a hive.
+func (s *System) RegisterAnnouncementHandler(announcementHandler func(hiveHex string, sectorHex string, message string) (int, error)) {
+	s.announcementHandler = announcementHandler
+}
+
+// CreateAnnouncement sends a message of the operators to the connected
+// sectors of a hive.
+func (s *System) CreateAnnouncement(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hiveID := bson.ObjectIdHex(vars["hive_id"])
+
+	var req announcementRequest
+	if err := decodeBody(r, &req); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" {
+		api.WriteError(w, api.Validation("message", "message is required"))
+		return
+	}
+	if len([]rune(req.Message)) > maxAnnouncementLength {
+		api.WriteError(w, api.Validation("message", fmt.Sprintf("message must not exceed %d characters", maxAnnouncementLength)))
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionHive).FindId(hiveID).One(nil)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	sectorHex := ""
+	if req.SectorID != "" {
+		err = conn.DB(s.database).C(CollectionSector).Find(bson.M{
+			"_id":     req.SectorID,
+			"hive_id": hiveID,
+		}).One(nil)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		sectorHex = req.SectorID.Hex()
+	}
+
+	result := AnnouncementResult{}
+	if s.announcementHandler != nil {
+		result.Sectors, err = s.announcementHandler(hiveID.Hex(), sectorHex, req.Message)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
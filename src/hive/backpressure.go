@@ -0,0 +1,141 @@
+package hive
+
+import (
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo/bson"
+	"github.com/sirupsen/logrus"
+)
+
+const CollectionSectorSpill = "sector_spill"
+
+// SectorSpill is a message queued for a sector under the spill policy.
+type SectorSpill struct {
+	ID       bson.ObjectId `bson:"_id,omitempty"`
+	HiveID   bson.ObjectId `bson:"hive_id"`
+	SectorID bson.ObjectId `bson:"sector_id"`
+	Message  []byte        `bson:"message"`
+}
+
+func validBackpressurePolicy(policy string) bool {
+	for _, v := range notification.BackpressurePolicies {
+		if v == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterPolicyChangeHandler sets the function notified when the backpressure
+// policy of a hive changed.
+func (s *System) RegisterPolicyChangeHandler(policyChangeHandler func(hiveHex string, policy string)) {
+	s.policyChangeHandler = policyChangeHandler
+}
+
+// BackpressurePolicy returns the policy applied to slow sectors of a hive.
+func (s *System) BackpressurePolicy(hiveHex string) (string, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var h Hive
+	err := conn.DB(s.database).C(CollectionHive).FindId(bson.ObjectIdHex(hiveHex)).Select(bson.M{
+		"backpressure_policy": 1,
+	}).One(&h)
+	if err != nil {
+		return "", err
+	}
+
+	if h.BackpressurePolicy == "" {
+		return notification.PolicyDisconnect, nil
+	}
+	return h.BackpressurePolicy, nil
+}
+
+// SectorSlow records that a sector is consistently not keeping up with its
+// messages and warns the admins through the activity of the hive.
+func (s *System) SectorSlow(hiveHex string, sectorHex string, overflows int) {
+	logrus.WithFields(logrus.Fields{
+		"hive":      hiveHex,
+		"sector":    sectorHex,
+		"overflows": overflows,
+	}).Warnln("sector is slow")
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	now := time.Now()
+	err := conn.DB(s.database).C(CollectionSector).UpdateId(bson.ObjectIdHex(sectorHex), bson.M{
+		"$set": bson.M{
+			"slow_at": now,
+		},
+	})
+	if err != nil {
+		logrus.Errorln(err)
+	}
+
+	s.publish(bson.ObjectIdHex(hiveHex), bson.ObjectIdHex(sectorHex), notification.ActivitySectorSlow, "", bson.M{
+		"overflows": overflows,
+		"slow_at":   now,
+	})
+}
+
+// SpillSectorMessage persists a message of a sector under the spill policy.
+func (s *System) SpillSectorMessage(hiveHex string, sectorHex string, message []byte) error {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	return conn.DB(s.database).C(CollectionSectorSpill).Insert(SectorSpill{
+		ID:       bson.NewObjectId(),
+		HiveID:   bson.ObjectIdHex(hiveHex),
+		SectorID: bson.ObjectIdHex(sectorHex),
+		Message:  message,
+	})
+}
+
+// UnspillSectorMessages removes and returns the oldest spilled messages of a
+// sector.
+func (s *System) UnspillSectorMessages(hiveHex string, sectorHex string, limit int) ([][]byte, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var spills []SectorSpill
+	err := conn.DB(s.database).C(CollectionSectorSpill).Find(bson.M{
+		"hive_id":   bson.ObjectIdHex(hiveHex),
+		"sector_id": bson.ObjectIdHex(sectorHex),
+	}).Sort("_id").Limit(limit).All(&spills)
+	if err != nil {
+		return nil, err
+	}
+	if len(spills) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]bson.ObjectId, len(spills))
+	messages := make([][]byte, len(spills))
+	for i, spill := range spills {
+		ids[i] = spill.ID
+		messages[i] = spill.Message
+	}
+
+	_, err = conn.DB(s.database).C(CollectionSectorSpill).RemoveAll(bson.M{
+		"_id": bson.M{"$in": ids},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// CountSpilledSectorMessages returns the number of spilled messages of a
+// sector.
+func (s *System) CountSpilledSectorMessages(hiveHex string, sectorHex string) (int, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	return conn.DB(s.database).C(CollectionSectorSpill).Find(bson.M{
+		"hive_id":   bson.ObjectIdHex(hiveHex),
+		"sector_id": bson.ObjectIdHex(sectorHex),
+	}).Count()
+}
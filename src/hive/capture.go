@@ -0,0 +1,120 @@
+package hive
+
+import (
+	"github.com/fankserver/torchapi-hive-system/src/capture"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Snapshot returns the hive, its sectors and factions for a capture. Token
+// hashes are left out, replayed sectors connect without a token.
+func (s *System) Snapshot(hiveHex string) (*capture.Snapshot, error) {
+	hiveID := bson.ObjectIdHex(hiveHex)
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var h bson.M
+	err := conn.DB(s.database).C(CollectionHive).FindId(hiveID).One(&h)
+	if err != nil {
+		return nil, err
+	}
+	delete(h, "observer_token")
+
+	var sectors []bson.M
+	err = conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"hive_id": hiveID,
+	}).Sort("_id").All(&sectors)
+	if err != nil {
+		return nil, err
+	}
+
+	var factions []bson.M
+	err = conn.DB(s.database).C(CollectionFaction).Find(bson.M{
+		"hive_id": hiveID,
+	}).Sort("_id").All(&factions)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &capture.Snapshot{}
+	if snapshot.Hive, err = bson.MarshalJSON(h); err != nil {
+		return nil, err
+	}
+	for _, v := range sectors {
+		delete(v, "token")
+		data, err := bson.MarshalJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Sectors = append(snapshot.Sectors, data)
+	}
+	for _, v := range factions {
+		data, err := bson.MarshalJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Factions = append(snapshot.Factions, data)
+	}
+
+	return snapshot, nil
+}
+
+// Restore inserts the documents of a snapshot that are not stored yet.
+func (s *System) Restore(snapshot *capture.Snapshot) error {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	restore := func(collection string, data []byte) error {
+		var doc bson.M
+		if err := bson.UnmarshalJSON(data, &doc); err != nil {
+			return err
+		}
+		err := conn.DB(s.database).C(collection).Insert(doc)
+		if mgo.IsDup(err) {
+			return nil
+		}
+		return err
+	}
+
+	if snapshot.Hive != nil {
+		if err := restore(CollectionHive, snapshot.Hive); err != nil {
+			return err
+		}
+	}
+	for _, v := range snapshot.Sectors {
+		if err := restore(CollectionSector, v); err != nil {
+			return err
+		}
+	}
+	for _, v := range snapshot.Factions {
+		if err := restore(CollectionFaction, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SnapshotFactions decodes the factions of a snapshot.
+func SnapshotFactions(snapshot *capture.Snapshot) ([]Faction, error) {
+	factions := make([]Faction, 0, len(snapshot.Factions))
+	for _, v := range snapshot.Factions {
+		var doc bson.M
+		if err := bson.UnmarshalJSON(v, &doc); err != nil {
+			return nil, err
+		}
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		var faction Faction
+		if err := bson.Unmarshal(data, &faction); err != nil {
+			return nil, err
+		}
+		factions = append(factions, faction)
+	}
+
+	return factions, nil
+}
@@ -0,0 +1,505 @@
+package hive
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const CollectionDeadLetter = "dead_letter"
+
+const (
+	// DeadLetterRetrying is waiting for an automatic retry at NextAttemptAt.
+	DeadLetterRetrying = "retrying"
+	// DeadLetterProcessing is queued for processing.
+	DeadLetterProcessing = "processing"
+	// DeadLetterFailed needs to be fixed and retried manually.
+	DeadLetterFailed = "failed"
+	// DeadLetterResolved was processed by a retry.
+	DeadLetterResolved = "resolved"
+)
+
+const (
+	// Dead letters are retried automatically deadLetterAttempts times with a
+	// delay doubling from deadLetterBackoff up to deadLetterMaxBackoff.
+	deadLetterAttempts   = 10
+	deadLetterBackoff    = time.Minute
+	deadLetterMaxBackoff = time.Hour
+
+	// Period of checking for dead letters due for a retry.
+	deadLetterRetryPeriod = 30 * time.Second
+
+	// Dead letters processing longer are considered lost and retried.
+	deadLetterProcessingTimeout = 10 * time.Minute
+
+	// Resolved dead letters are removed after deadLetterRetention.
+	deadLetterRetention = 7 * 24 * time.Hour
+)
+
+// DeadLetter is a sector event that failed.
+type DeadLetter struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	HiveID   bson.ObjectId `json:"-" bson:"hive_id"`
+	SectorID bson.ObjectId `json:"sector_id" bson:"sector_id"`
+
+	// Message is the event as sent by the sector.
+	Message   string `json:"message" bson:"message"`
+	EventID   string `json:"event_id,omitempty" bson:"event_id,omitempty"`
+	EventType string `json:"event_type,omitempty" bson:"event_type,omitempty"`
+
+	Status    string `json:"status" bson:"status"`
+	Code      string `json:"code,omitempty" bson:"code,omitempty"`
+	Error     string `json:"error,omitempty" bson:"error,omitempty"`
+	Transient bool   `json:"transient" bson:"transient"`
+	Attempts  int    `json:"attempts" bson:"attempts"`
+
+	CreatedAt     time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" bson:"updated_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty" bson:"next_attempt_at,omitempty"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+}
+
+// setMessage replaces the event and the fields derived from it.
+func (d *DeadLetter) setMessage(message string) {
+	d.Message = message
+	d.EventID, d.EventType = "", ""
+
+	var event EventSectorChange
+	if err := json.Unmarshal([]byte(message), &event); err == nil {
+		d.EventID, d.EventType = event.ID, event.Type
+	}
+}
+
+// fail records a failed attempt and schedules the next retry if the error
+// is transient.
+func (d *DeadLetter) fail(cause error, transient bool, now time.Time) {
+	apiErr := api.FromError(cause)
+	d.Code = apiErr.Code
+	d.Error = cause.Error()
+	d.Transient = transient
+	d.UpdatedAt = now
+	d.NextAttemptAt = nil
+
+	if !transient || d.Attempts >= deadLetterAttempts {
+		d.Status = DeadLetterFailed
+		return
+	}
+
+	delay := deadLetterBackoff
+	for i := 1; i < d.Attempts && delay < deadLetterMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > deadLetterMaxBackoff {
+		delay = deadLetterMaxBackoff
+	}
+	next := now.Add(delay)
+	d.Status = DeadLetterRetrying
+	d.NextAttemptAt = &next
+}
+
+type deadLetterPatch struct {
+	Message *string `json:"message"`
+}
+
+func (p deadLetterPatch) apply(d *DeadLetter, replace bool) error {
+	if p.Message == nil {
+		if replace {
+			return api.Validation("message", "is required")
+		}
+		return nil
+	}
+
+	var event EventSectorChange
+	if err := json.Unmarshal([]byte(*p.Message), &event); err != nil {
+		return api.Validation("message", "must be an event envelope: "+err.Error())
+	}
+	if event.Type == "" {
+		return api.Validation("message", "event type is required")
+	}
+
+	d.setMessage(*p.Message)
+	return nil
+}
+
+var (
+	deadLetterSortFields = listFields{
+		"created_at": "created_at",
+		"updated_at": "updated_at",
+		"status":     "status",
+	}
+	deadLetterProjectFields = listFields{
+		"sector_id":       "sector_id",
+		"message":         "message",
+		"event_id":        "event_id",
+		"event_type":      "event_type",
+		"status":          "status",
+		"code":            "code",
+		"error":           "error",
+		"transient":       "transient",
+		"attempts":        "attempts",
+		"created_at":      "created_at",
+		"updated_at":      "updated_at",
+		"next_attempt_at": "next_attempt_at",
+		"resolved_at":     "resolved_at",
+	}
+)
+
+// RegisterRetryHandler sets the function that queues the event of a dead
+// letter for processing.
+func (s *System) RegisterRetryHandler(retryHandler func(hiveHex string, sectorHex string, deadLetterID string, message []byte) bool) {
+	s.retryHandler = retryHandler
+}
+
+// Transient reports whether err is caused by lost database connectivity.
+// Errors that know whether they are transient, like the causes of spooled
+// dead letters, tell themselves.
+func (s *System) Transient(err error) bool {
+	if err == nil || err == mgo.ErrNotFound || mgo.IsDup(err) {
+		return false
+	}
+
+	switch err := err.(type) {
+	case *api.Error:
+		return false
+	case net.Error:
+		return true
+	case interface{ Transient() bool }:
+		return err.Transient()
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	message := err.Error()
+	return strings.Contains(message, "no reachable servers") || strings.Contains(message, "Closed explicitly")
+}
+
+// SaveDeadLetter stores a failed sector event and reports whether it is
+// retried automatically.
+func (s *System) SaveDeadLetter(hiveHex string, sectorHex string, message []byte, cause error) (bool, error) {
+	now := time.Now()
+	d := DeadLetter{
+		ID:        bson.NewObjectId(),
+		HiveID:    bson.ObjectIdHex(hiveHex),
+		SectorID:  bson.ObjectIdHex(sectorHex),
+		Attempts:  1,
+		CreatedAt: now,
+	}
+	d.setMessage(string(message))
+	d.fail(cause, s.Transient(cause), now)
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionDeadLetter).Insert(d)
+	if err != nil {
+		return false, err
+	}
+
+	return d.Status == DeadLetterRetrying, nil
+}
+
+// ResolveDeadLetter records the result of a retried dead letter and reports
+// whether it is retried again.
+func (s *System) ResolveDeadLetter(deadLetterID string, cause error) (bool, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	c := conn.DB(s.database).C(CollectionDeadLetter)
+
+	var d DeadLetter
+	err := c.FindId(bson.ObjectIdHex(deadLetterID)).One(&d)
+	if err == mgo.ErrNotFound {
+		// deleted while it was retried
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	d.Attempts++
+	if cause == nil {
+		d.Status = DeadLetterResolved
+		d.UpdatedAt = now
+		d.NextAttemptAt = nil
+		d.ResolvedAt = &now
+	} else {
+		d.fail(cause, s.Transient(cause), now)
+	}
+
+	if err := c.UpdateId(d.ID, d); err != nil {
+		return false, err
+	}
+
+	return d.Status == DeadLetterRetrying, nil
+}
+
+// retryDeadLetter queues a dead letter for processing.
+func (s *System) retryDeadLetter(c store.Collection, d *DeadLetter) error {
+	if s.retryHandler == nil {
+		return api.Conflict("sector events are not processed", nil)
+	}
+
+	err := c.UpdateId(d.ID, bson.M{
+		"$set": bson.M{
+			"status":     DeadLetterProcessing,
+			"updated_at": time.Now(),
+		},
+		"$unset": bson.M{
+			"next_attempt_at": 1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if !s.retryHandler(d.HiveID.Hex(), d.SectorID.Hex(), d.ID.Hex(), []byte(d.Message)) {
+		// restore the dead letter for the next attempt
+		if err := c.UpdateId(d.ID, d); err != nil {
+			logrus.Errorln(err)
+		}
+		return api.Conflict("hive is shutting down", nil)
+	}
+
+	return nil
+}
+
+// RetryDeadLetters periodically retries the dead letters that failed with a
+// transient error.
+func (s *System) RetryDeadLetters() {
+	ticker := time.NewTicker(deadLetterRetryPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.retryDueDeadLetters()
+	}
+}
+
+func (s *System) retryDueDeadLetters() {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	c := conn.DB(s.database).C(CollectionDeadLetter)
+
+	now := time.Now()
+	var due []DeadLetter
+	err := c.Find(bson.M{
+		"$or": []bson.M{
+			{
+				"status":          DeadLetterRetrying,
+				"next_attempt_at": bson.M{"$lte": now},
+			},
+			{
+				"status":     DeadLetterProcessing,
+				"updated_at": bson.M{"$lte": now.Add(-deadLetterProcessingTimeout)},
+			},
+		},
+	}).Sort("created_at").Limit(100).All(&due)
+	if err != nil {
+		logrus.Errorln(err)
+		return
+	}
+
+	for i := range due {
+		if err := s.retryDeadLetter(c, &due[i]); err != nil {
+			logrus.Errorln(err)
+			return
+		}
+	}
+}
+
+func (s *System) findDeadLetter(w http.ResponseWriter, r *http.Request) (*DeadLetter, bool) {
+	vars := mux.Vars(r)
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var d DeadLetter
+	err := conn.DB(s.database).C(CollectionDeadLetter).Find(bson.M{
+		"_id":     bson.ObjectIdHex(vars["dead_letter_id"]),
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}).One(&d)
+	if err != nil {
+		api.WriteError(w, err)
+		return nil, false
+	}
+
+	return &d, true
+}
+
+func (s *System) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	opts, err := parseListOptions(r, deadLetterSortFields, deadLetterProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := bson.M{
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}
+	if v := query.Get("status"); v != "" {
+		switch v {
+		case DeadLetterRetrying, DeadLetterProcessing, DeadLetterFailed, DeadLetterResolved:
+			filter["status"] = v
+		default:
+			api.WriteError(w, api.Validation("status", "unknown dead letter status "+v))
+			return
+		}
+	}
+	if v := query.Get("sector"); v != "" {
+		if !bson.IsObjectIdHex(v) {
+			api.WriteError(w, api.Validation("sector", "must be a sector id"))
+			return
+		}
+		filter["sector_id"] = bson.ObjectIdHex(v)
+	}
+	if v := query.Get("event_type"); v != "" {
+		filter["event_type"] = v
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	docs, total, next, err := opts.find(conn.DB(s.database).C(CollectionDeadLetter), filter, deadLetterProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	deadLetters := make([]DeadLetter, len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(&deadLetters[i]); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	}
+
+	opts.writeList(w, deadLetters, total, next)
+}
+
+func (s *System) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.findDeadLetter(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+func (s *System) UpdateDeadLetter(w http.ResponseWriter, r *http.Request) {
+	s.updateDeadLetter(w, r, true)
+}
+
+func (s *System) PatchDeadLetter(w http.ResponseWriter, r *http.Request) {
+	s.updateDeadLetter(w, r, false)
+}
+
+func (s *System) updateDeadLetter(w http.ResponseWriter, r *http.Request, replace bool) {
+	var patch deadLetterPatch
+	if err := decodeBody(r, &patch); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	d, ok := s.findDeadLetter(w, r)
+	if !ok {
+		return
+	}
+
+	if d.Status == DeadLetterProcessing || d.Status == DeadLetterResolved {
+		api.WriteError(w, api.Conflict("dead letter is "+d.Status, nil))
+		return
+	}
+
+	if err := patch.apply(d, replace); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	d.UpdatedAt = time.Now()
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionDeadLetter).Update(bson.M{
+		"_id":    d.ID,
+		"status": bson.M{"$nin": []string{DeadLetterProcessing, DeadLetterResolved}},
+	}, bson.M{
+		"$set": bson.M{
+			"message":    d.Message,
+			"event_id":   d.EventID,
+			"event_type": d.EventType,
+			"updated_at": d.UpdatedAt,
+		},
+	})
+	if err == mgo.ErrNotFound {
+		api.WriteError(w, api.Conflict("dead letter is being retried", nil))
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+func (s *System) DeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.findDeadLetter(w, r)
+	if !ok {
+		return
+	}
+
+	if d.Status == DeadLetterProcessing {
+		api.WriteError(w, api.Conflict("dead letter is being retried", nil))
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionDeadLetter).RemoveId(d.ID)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *System) RetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.findDeadLetter(w, r)
+	if !ok {
+		return
+	}
+
+	if d.Status == DeadLetterProcessing || d.Status == DeadLetterResolved {
+		api.WriteError(w, api.Conflict("dead letter is "+d.Status, nil))
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	if err := s.retryDeadLetter(conn.DB(s.database).C(CollectionDeadLetter), d); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	d.Status = DeadLetterProcessing
+	d.NextAttemptAt = nil
+	writeJSON(w, http.StatusAccepted, d)
+}
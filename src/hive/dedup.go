@@ -0,0 +1,122 @@
+package hive
+
+import (
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const CollectionSectorEvent = "sector_event"
+
+// Event ids of a sector are remembered for eventDedupWindow, an event resent
+// within the window is not processed again.
+const eventDedupWindow = 24 * time.Hour
+
+// A claim that was not completed within eventClaimTimeout is left by a
+// process that stopped while applying the event, the event may be claimed
+// again.
+const eventClaimTimeout = 2 * time.Minute
+
+// sectorEvent records an event id a sector sent. Pending is set from the
+// claim until the event was applied.
+type sectorEvent struct {
+	ID       string        `bson:"_id"`
+	HiveID   bson.ObjectId `bson:"hive_id"`
+	SectorID bson.ObjectId `bson:"sector_id"`
+	Time     time.Time     `bson:"time"`
+	Pending  bool          `bson:"pending,omitempty"`
+}
+
+func sectorEventID(sectorHex string, eventID string) string {
+	return sectorHex + ":" + eventID
+}
+
+// ClaimEvent records the event id of a sector as pending and reports false
+// if the sector sent it before. An event that is still pending returns
+// notification.ErrEventInFlight, unless its claim timed out.
+func (s *System) ClaimEvent(hiveHex string, sectorHex string, eventID string) (bool, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	c := conn.DB(s.database).C(CollectionSectorEvent)
+	id := sectorEventID(sectorHex, eventID)
+	now := time.Now()
+	err := c.Insert(sectorEvent{
+		ID:       id,
+		HiveID:   bson.ObjectIdHex(hiveHex),
+		SectorID: bson.ObjectIdHex(sectorHex),
+		Time:     now,
+		Pending:  true,
+	})
+	if err == nil {
+		return true, nil
+	}
+	if !mgo.IsDup(err) {
+		return false, err
+	}
+
+	// take over a claim that timed out
+	err = c.Update(bson.M{
+		"_id":     id,
+		"pending": true,
+		"time":    bson.M{"$lt": now.Add(-eventClaimTimeout)},
+	}, bson.M{
+		"$set": bson.M{
+			"time": now,
+		},
+	})
+	if err == nil {
+		return true, nil
+	}
+	if err != mgo.ErrNotFound {
+		return false, err
+	}
+
+	var previous sectorEvent
+	err = c.FindId(id).One(&previous)
+	if err == mgo.ErrNotFound {
+		// released in between, the caller claims it again
+		return false, notification.ErrEventInFlight
+	}
+	if err != nil {
+		return false, err
+	}
+	if previous.Pending {
+		return false, notification.ErrEventInFlight
+	}
+
+	return false, nil
+}
+
+// CompleteEvent marks the claimed event id of a sector as applied.
+func (s *System) CompleteEvent(hiveHex string, sectorHex string, eventID string) error {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionSectorEvent).Update(bson.M{
+		"_id":     sectorEventID(sectorHex, eventID),
+		"pending": true,
+	}, bson.M{
+		"$unset": bson.M{
+			"pending": "",
+		},
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// ReleaseEvent forgets an event id of a sector.
+func (s *System) ReleaseEvent(hiveHex string, sectorHex string, eventID string) error {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionSectorEvent).RemoveId(sectorEventID(sectorHex, eventID))
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package hive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestClaimEvent(t *testing.T) {
+	s, err := NewSystemWithStore(store.NewMemory(), DefaultDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hiveHex, sectorHex := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+
+	claim := func(eventID string) (bool, error) {
+		t.Helper()
+		return s.ClaimEvent(hiveHex, sectorHex, eventID)
+	}
+
+	if fresh, err := claim("a"); !fresh || err != nil {
+		t.Fatalf("first claim: got %v %v, want fresh", fresh, err)
+	}
+	if _, err := claim("a"); err != notification.ErrEventInFlight {
+		t.Fatalf("claim while pending: got %v, want %v", err, notification.ErrEventInFlight)
+	}
+
+	if err := s.CompleteEvent(hiveHex, sectorHex, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := claim("a"); fresh || err != nil {
+		t.Fatalf("claim after completion: got %v %v, want duplicate", fresh, err)
+	}
+
+	if err := s.ReleaseEvent(hiveHex, sectorHex, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := claim("a"); !fresh || err != nil {
+		t.Fatalf("claim after release: got %v %v, want fresh", fresh, err)
+	}
+
+	// a claim left by a stopped process is taken over once it timed out
+	if _, err := claim("b"); err != nil {
+		t.Fatal(err)
+	}
+	err = s.db.DB(s.database).C(CollectionSectorEvent).UpdateId(sectorEventID(sectorHex, "b"), bson.M{
+		"$set": bson.M{
+			"time": time.Now().Add(-eventClaimTimeout - time.Second),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := claim("b"); !fresh || err != nil {
+		t.Fatalf("claim after timeout: got %v %v, want fresh", fresh, err)
+	}
+}
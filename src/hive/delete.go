@@ -0,0 +1,190 @@
+package hive
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DeleteModeCascade  = "cascade"
+	DeleteModeRestrict = "restrict"
+)
+
+// DeleteReport describes what a delete removed, or would remove on a dry run.
+type DeleteReport struct {
+	DryRun         bool `json:"dry_run"`
+	Hives          int  `json:"hives"`
+	Sectors        int  `json:"sectors"`
+	Factions       int  `json:"factions"`
+	FactionSectors int  `json:"faction_sectors"`
+	Members        int  `json:"members"`
+	Relations      int  `json:"relations"`
+}
+
+func (r DeleteReport) hasDependents() bool {
+	return r.Sectors > 0 || r.hasFactionDependents()
+}
+
+// hasFactionDependents reports whether the delete touches factions, their
+// sector entries, members or relations.
+func (r DeleteReport) hasFactionDependents() bool {
+	return r.Factions > 0 || r.FactionSectors > 0 || r.Members > 0 || r.Relations > 0
+}
+
+type deleteOptions struct {
+	mode   string
+	dryRun bool
+}
+
+func parseDeleteOptions(r *http.Request) (deleteOptions, error) {
+	opts := deleteOptions{
+		mode: r.URL.Query().Get("mode"),
+	}
+	switch opts.mode {
+	case "":
+		opts.mode = DeleteModeCascade
+	case DeleteModeCascade, DeleteModeRestrict:
+	default:
+		return opts, api.Validation("mode", "must be "+DeleteModeCascade+" or "+DeleteModeRestrict)
+	}
+
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, api.Validation("dry_run", "must be a boolean")
+		}
+		opts.dryRun = dryRun
+	}
+
+	return opts, nil
+}
+
+// RegisterDisconnectHandler sets the function used to drop the websocket
+// connections of deleted sectors. An empty sectorHex addresses every sector
+// of a deleted hive.
+func (s *System) RegisterDisconnectHandler(disconnectHandler func(hiveHex string, sectorHex string)) {
+	s.disconnectHandler = disconnectHandler
+}
+
+func (s *System) disconnect(hiveID bson.ObjectId, sectorID bson.ObjectId) {
+	if s.disconnectHandler == nil {
+		return
+	}
+
+	sectorHex := ""
+	if sectorID != "" {
+		sectorHex = sectorID.Hex()
+	}
+	s.disconnectHandler(hiveID.Hex(), sectorHex)
+}
+
+// planSectorDelete collects the faction changes caused by removing a sector.
+// Factions that are only present in this sector are removed entirely, all
+// others only lose their sector entry.
+func (s *System) planSectorDelete(conn store.Session, hiveID bson.ObjectId, sectorID bson.ObjectId) (DeleteReport, []bson.ObjectId, error) {
+	var report DeleteReport
+
+	var factions []Faction
+	err := conn.DB(s.database).C(CollectionFaction).Find(bson.M{
+		"hive_id":           hiveID,
+		"sectors.sector_id": sectorID,
+	}).Select(bson.M{
+		"members": 1,
+		"sectors": 1,
+	}).All(&factions)
+	if err != nil {
+		return report, nil, err
+	}
+
+	var removed []bson.ObjectId
+	for _, faction := range factions {
+		remaining := 0
+		for _, v := range faction.Sectors {
+			if v.SectorID == sectorID {
+				report.FactionSectors++
+			} else {
+				remaining++
+			}
+		}
+
+		if remaining == 0 {
+			removed = append(removed, faction.ID)
+			report.Factions++
+			report.Members += len(faction.Members)
+		}
+	}
+
+	report.Relations, err = s.countRelations(conn, hiveID, removed)
+	if err != nil {
+		return report, nil, err
+	}
+
+	return report, removed, nil
+}
+
+func (s *System) countRelations(conn store.Session, hiveID bson.ObjectId, factionIDs []bson.ObjectId) (int, error) {
+	if len(factionIDs) == 0 {
+		return 0, nil
+	}
+
+	var factions []Faction
+	err := conn.DB(s.database).C(CollectionFaction).Find(bson.M{
+		"hive_id":              hiveID,
+		"_id":                  bson.M{"$nin": factionIDs},
+		"relations.faction_id": bson.M{"$in": factionIDs},
+	}).Select(bson.M{
+		"relations": 1,
+	}).All(&factions)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := make(map[bson.ObjectId]bool, len(factionIDs))
+	for _, v := range factionIDs {
+		removed[v] = true
+	}
+
+	count := 0
+	for _, faction := range factions {
+		for _, v := range faction.Relations {
+			if removed[v.FactionID] {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+func (s *System) removeFactions(conn store.Session, hiveID bson.ObjectId, factionIDs []bson.ObjectId) error {
+	if len(factionIDs) == 0 {
+		return nil
+	}
+
+	_, err := conn.DB(s.database).C(CollectionFaction).UpdateAll(
+		bson.M{
+			"hive_id":              hiveID,
+			"relations.faction_id": bson.M{"$in": factionIDs},
+		},
+		bson.M{
+			"$pull": bson.M{
+				"relations": bson.M{
+					"faction_id": bson.M{"$in": factionIDs},
+				},
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.DB(s.database).C(CollectionFaction).RemoveAll(bson.M{
+		"hive_id": hiveID,
+		"_id":     bson.M{"$in": factionIDs},
+	})
+	return err
+}
@@ -1,67 +1,36 @@
 package hive
 
+import "github.com/fankserver/torchapi-hive-system/src/event"
+
 const (
-	EventTypeServerStateChange         = "serverStateChange"
-	EventTypeFactionCreated            = "factionCreated"
-	EventTypeFactionCreatedComplete    = "factionCreatedComplete"
-	EventTypeFactionEdited             = "factionEdited"
-	EventTypeFactionAutoAcceptChanged  = "factionAutoAcceptChanged"
-	EventTypeFactionMemberSendJoin     = "factionMemberSendJoin"
-	EventTypeFactionMemberCancelJoin   = "factionMemberCancelJoin"
-	EventTypeFactionMemberAcceptJoin   = "factionMemberAcceptJoin"
-	EventTypeFactionMemberPromote      = "factionMemberPromote"
-	EventTypeFactionMemberDemote       = "factionMemberDemote"
-	EventTypeFactionMemberKick         = "factionMemberKick"
-	EventTypeFactionMemberLeave        = "factionMemberLeave"
-	EventTypeFactionSendPeaceRequest   = "factionSendPeaceRequest"
-	EventTypeFactionCancelPeaceRequest = "factionCancelPeaceRequest"
-	EventTypeFactionAcceptPeace        = "factionAcceptPeace"
-	EventTypeFactionDeclareWar         = "factionDeclareWar"
+	EventTypeServerStateChange         = event.TypeServerStateChange
+	EventTypeFactionCreated            = event.TypeFactionCreated
+	EventTypeFactionCreatedComplete    = event.TypeFactionCreatedComplete
+	EventTypeFactionEdited             = event.TypeFactionEdited
+	EventTypeFactionAutoAcceptChanged  = event.TypeFactionAutoAcceptChanged
+	EventTypeFactionMemberSendJoin     = event.TypeFactionMemberSendJoin
+	EventTypeFactionMemberCancelJoin   = event.TypeFactionMemberCancelJoin
+	EventTypeFactionMemberAcceptJoin   = event.TypeFactionMemberAcceptJoin
+	EventTypeFactionMemberPromote      = event.TypeFactionMemberPromote
+	EventTypeFactionMemberDemote       = event.TypeFactionMemberDemote
+	EventTypeFactionMemberKick         = event.TypeFactionMemberKick
+	EventTypeFactionMemberLeave        = event.TypeFactionMemberLeave
+	EventTypeFactionSendPeaceRequest   = event.TypeFactionSendPeaceRequest
+	EventTypeFactionCancelPeaceRequest = event.TypeFactionCancelPeaceRequest
+	EventTypeFactionAcceptPeace        = event.TypeFactionAcceptPeace
+	EventTypeFactionDeclareWar         = event.TypeFactionDeclareWar
 )
 
-type ServerStateChanged struct {
-	State string
-}
-
-type EventFactionCreated struct {
-	FactionID      int64 `json:"FactionId"`
-	Tag            string
-	Name           string
-	Description    string
-	PrivateInfo    string
-	AcceptHumans   bool
-	FounderID      int64  `json:"FounderId"`
-	FounderSteamID uint64 `json:"FounderSteamId"`
-	FounderName    string
-}
-
-type EventFactionCreatedComplete struct {
-	FactionID int64 `json:"FactionId"`
-	Tag       string
-}
-
-type EventFactionEdited struct {
-	FactionID   int64 `json:"FactionId"`
-	Tag         string
-	Name        string
-	Description string
-	PrivateInfo string
-}
-
-type EventFactionAutoAcceptChangeEvent struct {
-	FactionID        int64 `json:"FactionId"`
-	AutoAcceptMember bool
-	AutoAcceptPeace  bool
-}
-
-type EventFactionMember struct {
-	FactionID     int64  `json:"FactionId"`
-	PlayerID      int64  `json:"PlayerId"`
-	PlayerSteamID uint64 `json:"PlayerSteamId"`
-	PlayerName    string
-}
-
-type EventFactionPeaceWar struct {
-	FromFactionID int64 `json:"FromFactionId"`
-	ToFactionID   int64 `json:"ToFactionId"`
-}
+// SectorEventTypes lists the event types the hive handles.
+var SectorEventTypes = event.Types
+
+// The payloads are shared with the clients of the sector protocol.
+type (
+	ServerStateChanged                = event.ServerStateChanged
+	EventFactionCreated               = event.FactionCreated
+	EventFactionCreatedComplete       = event.FactionCreatedComplete
+	EventFactionEdited                = event.FactionEdited
+	EventFactionAutoAcceptChangeEvent = event.FactionAutoAcceptChanged
+	EventFactionMember                = event.FactionMember
+	EventFactionPeaceWar              = event.FactionPeaceWar
+)
@@ -0,0 +1,163 @@
+package hive
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/schema"
+	"github.com/gorilla/mux"
+)
+
+// objectSchema describes an event payload. Only the fields identifying the
+// faction, player or state and the values an update replaces are required and
+// unknown fields are allowed, so payloads of older and newer plugins pass.
+func objectSchema(title string, description string, required []string, properties map[string]*schema.Schema) *schema.Schema {
+	return &schema.Schema{
+		Schema:      schema.Draft,
+		ID:          "/api/schema/event/" + title,
+		Title:       title,
+		Description: description,
+		Type:        schema.TypeObject,
+		Properties:  properties,
+		Required:    required,
+	}
+}
+
+// entityID is the id of a game entity, 0 is no entity.
+func entityID(description string) *schema.Schema {
+	minimum := json.Number("1")
+	return &schema.Schema{
+		Description: description,
+		Type:        schema.TypeInteger,
+		Minimum:     &minimum,
+	}
+}
+
+func steamID(description string) *schema.Schema {
+	minimum := json.Number("1")
+	maximum := json.Number("18446744073709551615")
+	return &schema.Schema{
+		Description: description,
+		Type:        schema.TypeInteger,
+		Minimum:     &minimum,
+		Maximum:     &maximum,
+	}
+}
+
+func text(description string, minLength int) *schema.Schema {
+	return &schema.Schema{
+		Description: description,
+		Type:        schema.TypeString,
+		MinLength:   &minLength,
+	}
+}
+
+func flag(description string) *schema.Schema {
+	return &schema.Schema{
+		Description: description,
+		Type:        schema.TypeBoolean,
+	}
+}
+
+func memberSchema(eventType string, description string) *schema.Schema {
+	return objectSchema(eventType, description, []string{"FactionId", "PlayerSteamId"}, map[string]*schema.Schema{
+		"FactionId":     entityID("Faction in the sector."),
+		"PlayerId":      entityID("Identity of the player in the sector."),
+		"PlayerSteamId": steamID("Steam id of the player."),
+		"PlayerName":    text("Name of the player.", 0),
+	})
+}
+
+func peaceWarSchema(eventType string, description string) *schema.Schema {
+	return objectSchema(eventType, description, []string{"FromFactionId", "ToFactionId"}, map[string]*schema.Schema{
+		"FromFactionId": entityID("Faction in the sector that caused the event."),
+		"ToFactionId":   entityID("Faction in the sector the event is directed at."),
+	})
+}
+
+// SectorEventSchemas describes the raw payload of every sector event type.
+var SectorEventSchemas = map[string]*schema.Schema{
+	EventTypeServerStateChange: objectSchema(EventTypeServerStateChange, "The session of the sector changed its state.", []string{"State"}, map[string]*schema.Schema{
+		"State": {
+			Description: "New session state.",
+			Type:        schema.TypeString,
+			Enum:        []interface{}{"Loading", "Loaded", "Unloading", "Unloaded"},
+		},
+	}),
+	EventTypeFactionCreated: objectSchema(EventTypeFactionCreated, "A faction was founded in the sector.", []string{"FactionId", "Tag", "Name", "FounderSteamId"}, map[string]*schema.Schema{
+		"FactionId":      entityID("Faction in the sector."),
+		"Tag":            text("Faction tag.", 1),
+		"Name":           text("Faction name.", 1),
+		"Description":    text("Public description.", 0),
+		"PrivateInfo":    text("Private information of the members.", 0),
+		"AcceptHumans":   flag("Whether players may join."),
+		"FounderId":      entityID("Identity of the founder in the sector."),
+		"FounderSteamId": steamID("Steam id of the founder."),
+		"FounderName":    text("Name of the founder.", 0),
+	}),
+	EventTypeFactionCreatedComplete: objectSchema(EventTypeFactionCreatedComplete, "A faction created by another sector was created in the sector.", []string{"FactionId", "Tag"}, map[string]*schema.Schema{
+		"FactionId": entityID("Faction in the sector."),
+		"Tag":       text("Faction tag.", 1),
+	}),
+	EventTypeFactionEdited: objectSchema(EventTypeFactionEdited, "A faction was edited in the sector.", []string{"FactionId", "Tag", "Name"}, map[string]*schema.Schema{
+		"FactionId":   entityID("Faction in the sector."),
+		"Tag":         text("Faction tag.", 1),
+		"Name":        text("Faction name.", 1),
+		"Description": text("Public description.", 0),
+		"PrivateInfo": text("Private information of the members.", 0),
+	}),
+	EventTypeFactionAutoAcceptChanged: objectSchema(EventTypeFactionAutoAcceptChanged, "The auto accept settings of a faction changed in the sector.", []string{"FactionId", "AutoAcceptMember", "AutoAcceptPeace"}, map[string]*schema.Schema{
+		"FactionId":        entityID("Faction in the sector."),
+		"AutoAcceptMember": flag("Whether join requests are accepted automatically."),
+		"AutoAcceptPeace":  flag("Whether peace requests are accepted automatically."),
+	}),
+	EventTypeFactionMemberSendJoin:     memberSchema(EventTypeFactionMemberSendJoin, "A player asked to join a faction."),
+	EventTypeFactionMemberCancelJoin:   memberSchema(EventTypeFactionMemberCancelJoin, "A player withdrew a join request."),
+	EventTypeFactionMemberAcceptJoin:   memberSchema(EventTypeFactionMemberAcceptJoin, "A join request was accepted."),
+	EventTypeFactionMemberPromote:      memberSchema(EventTypeFactionMemberPromote, "A member was promoted to leader."),
+	EventTypeFactionMemberDemote:       memberSchema(EventTypeFactionMemberDemote, "A leader was demoted to member."),
+	EventTypeFactionMemberKick:         memberSchema(EventTypeFactionMemberKick, "A member was kicked."),
+	EventTypeFactionMemberLeave:        memberSchema(EventTypeFactionMemberLeave, "A member left the faction."),
+	EventTypeFactionSendPeaceRequest:   peaceWarSchema(EventTypeFactionSendPeaceRequest, "A faction proposed peace."),
+	EventTypeFactionCancelPeaceRequest: peaceWarSchema(EventTypeFactionCancelPeaceRequest, "A faction withdrew its peace proposal."),
+	EventTypeFactionAcceptPeace:        peaceWarSchema(EventTypeFactionAcceptPeace, "A faction accepted peace."),
+	EventTypeFactionDeclareWar:         peaceWarSchema(EventTypeFactionDeclareWar, "A faction declared war."),
+}
+
+// validateSectorEvent checks the raw payload of an event against the schema
+// of its type. Unknown types are left to the event handler.
+func validateSectorEvent(eventType string, raw string) error {
+	s, ok := SectorEventSchemas[eventType]
+	if !ok {
+		return nil
+	}
+
+	err := s.Validate([]byte(raw))
+	if err == nil {
+		return nil
+	}
+
+	errs := err.(schema.Errors)
+	field := "raw"
+	if errs[0].Path != "" {
+		field += "." + errs[0].Path
+	}
+	apiErr := api.Validation(field, "invalid "+eventType+" event: "+errs.Error())
+	apiErr.Details = errs
+	return apiErr
+}
+
+func GetSectorEventSchemas(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, SectorEventSchemas)
+}
+
+func GetSectorEventSchema(w http.ResponseWriter, r *http.Request) {
+	s, ok := SectorEventSchemas[mux.Vars(r)["event_type"]]
+	if !ok {
+		api.WriteError(w, api.NotFound("unknown event type"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,90 @@
+package hive
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestValidateLegacySectorEvents(t *testing.T) {
+	// payloads of an older plugin: other key casing, fields it did not send
+	// yet and fields the hive does not know
+	legacy := []struct {
+		eventType string
+		raw       string
+	}{
+		{EventTypeServerStateChange, `{"state":"Loaded","SessionName":"Sector 1"}`},
+		{EventTypeFactionCreated, `{"FactionID":17,"Tag":"ABC","Name":"Alpha","FounderSteamID":76561198000000001,"Score":0}`},
+		{EventTypeFactionCreatedComplete, `{"factionId":18,"tag":"ABC"}`},
+		{EventTypeFactionEdited, `{"FactionID":17,"Tag":"ABC","Name":"Alpha Prime"}`},
+		{EventTypeFactionAutoAcceptChanged, `{"FactionID":17,"AutoAcceptMember":true,"AutoAcceptPeace":false}`},
+		{EventTypeFactionMemberAcceptJoin, `{"FactionID":17,"PlayerSteamID":76561198000000002,"PlayerName":"Bob"}`},
+		{EventTypeFactionDeclareWar, `{"FromFactionID":17,"ToFactionID":19,"SenderId":5}`},
+	}
+	for _, event := range legacy {
+		if err := validateSectorEvent(event.eventType, event.raw); err != nil {
+			t.Errorf("%s %s: %v", event.eventType, event.raw, err)
+		}
+	}
+
+	var created EventFactionCreated
+	if err := json.Unmarshal([]byte(legacy[1].raw), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.FactionID != 17 || created.FounderSteamID != 76561198000000001 {
+		t.Errorf("got %+v, want the legacy fields decoded", created)
+	}
+
+	invalid := []struct {
+		eventType string
+		raw       string
+	}{
+		{EventTypeFactionCreated, `{"FactionID":17,"Name":"Alpha","FounderSteamID":76561198000000001}`},
+		{EventTypeFactionEdited, `{"FactionID":17,"Tag":"ABC"}`},
+		{EventTypeFactionMemberKick, `{"factionid":0,"playersteamid":76561198000000002}`},
+	}
+	for _, event := range invalid {
+		if err := validateSectorEvent(event.eventType, event.raw); err == nil {
+			t.Errorf("%s %s: got no error", event.eventType, event.raw)
+		}
+	}
+}
+
+func TestFrameSchemaDescribesMsgpackFrames(t *testing.T) {
+	event, err := json.Marshal(protocol.Envelope{
+		ID:   "event-1",
+		Type: EventTypeFactionCreated,
+		Raw:  `{"FactionId":17,"Tag":"ABC","Name":"Alpha","FounderSteamId":76561198000000001}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping, err := json.Marshal(protocol.Envelope{Type: "ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range [][]byte{event, ping} {
+		frame, err := protocol.CodecFor(protocol.EncodingMsgpack).Encode(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f map[string]interface{}
+		if err := msgpack.Unmarshal(frame, &f); err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := FrameSchemas[protocol.EncodingMsgpack].Validate(data); err != nil {
+			t.Errorf("%s: %v", data, err)
+		}
+	}
+
+	if err := FrameSchemas[protocol.EncodingMsgpack].Validate([]byte(`{"id":"event-1","payload":"{}"}`)); err == nil {
+		t.Error("got no error for a frame without type and an encoded payload")
+	}
+}
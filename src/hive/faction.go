@@ -1,12 +1,14 @@
 package hive
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/gorilla/mux"
 )
@@ -35,7 +37,7 @@ type FactionSector struct {
 }
 
 type FactionRelation struct {
-	FactionID bson.ObjectId        `json:"sector_id" bson:"sector_id"`
+	FactionID bson.ObjectId        `json:"faction_id" bson:"faction_id"`
 	Relation  FactionRelationState `json:"state" bson:"state"`
 }
 
@@ -61,25 +63,184 @@ type Faction struct {
 	Sectors          []FactionSector   `json:"sectors" bson:"sectors"`
 }
 
+var (
+	factionSortFields = listFields{
+		"tag":  "tag",
+		"name": "name",
+	}
+	factionProjectFields = listFields{
+		"tag":                "tag",
+		"name":               "name",
+		"description":        "description",
+		"private_info":       "private_info",
+		"accept_humans":      "accept_humans",
+		"founder_steam_id":   "founder_steam_id",
+		"auto_accept_member": "auto_accept_member",
+		"auto_accept_peace":  "auto_accept_peace",
+		"relations":          "relations",
+		"members":            "members",
+		"sectors":            "sectors",
+	}
+)
+
 func (s *System) GetFactions(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
+	opts, err := parseListOptions(r, factionSortFields, factionProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := bson.M{
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}
+	if v := query.Get("tag"); v != "" {
+		filter["tag"] = v
+	} else if v := query.Get("tag_prefix"); v != "" {
+		filter["tag"] = prefixFilter(v)
+	}
+	if v := query.Get("name_prefix"); v != "" {
+		filter["name"] = prefixFilter(v)
+	}
+	if v := query.Get("member"); v != "" {
+		steamID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			api.WriteError(w, api.Validation("member", "must be a steam id"))
+			return
+		}
+		filter["members.steam_id"] = steamID
+	}
+	if v := query.Get("sector"); v != "" {
+		if !bson.IsObjectIdHex(v) {
+			api.WriteError(w, api.Validation("sector", "must be a sector id"))
+			return
+		}
+		filter["sectors.sector_id"] = bson.ObjectIdHex(v)
+	}
+
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	var factions []Faction
-	err := conn.DB("torchhive").C(CollectionFaction).Find(bson.M{
+	docs, total, next, err := opts.find(conn.DB(s.database).C(CollectionFaction), filter, factionProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	factions := make([]Faction, len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(&factions[i]); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	}
+
+	opts.writeList(w, factions, total, next)
+}
+
+type FactionRelationDetail struct {
+	FactionID bson.ObjectId        `json:"faction_id"`
+	Tag       string               `json:"tag"`
+	Name      string               `json:"name"`
+	Relation  FactionRelationState `json:"state"`
+}
+
+func (s *System) findFaction(w http.ResponseWriter, r *http.Request) (*Faction, bool) {
+	vars := mux.Vars(r)
+
+	query := bson.M{
 		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
-	}).All(&factions)
+	}
+	if tag, ok := vars["tag"]; ok {
+		query["tag"] = tag
+	} else {
+		query["_id"] = bson.ObjectIdHex(vars["faction_id"])
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var faction Faction
+	err := conn.DB(s.database).C(CollectionFaction).Find(query).One(&faction)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err)
+		return nil, false
+	}
+
+	return &faction, true
+}
+
+func (s *System) GetFactionDetail(w http.ResponseWriter, r *http.Request) {
+	faction, ok := s.findFaction(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, faction)
+}
+
+func (s *System) GetFactionMembers(w http.ResponseWriter, r *http.Request) {
+	faction, ok := s.findFaction(w, r)
+	if !ok {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(factions); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	members := faction.Members
+	if members == nil {
+		members = []FactionMember{}
 	}
+
+	writeJSON(w, http.StatusOK, members)
+}
+
+func (s *System) GetFactionRelations(w http.ResponseWriter, r *http.Request) {
+	faction, ok := s.findFaction(w, r)
+	if !ok {
+		return
+	}
+
+	factionIDs := make([]bson.ObjectId, 0, len(faction.Relations))
+	for _, v := range faction.Relations {
+		factionIDs = append(factionIDs, v.FactionID)
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var related []Faction
+	err := conn.DB(s.database).C(CollectionFaction).Find(bson.M{
+		"hive_id": faction.HiveID,
+		"_id":     bson.M{"$in": factionIDs},
+	}).Select(bson.M{
+		"tag":  1,
+		"name": 1,
+	}).All(&related)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	byID := make(map[bson.ObjectId]Faction, len(related))
+	for _, v := range related {
+		byID[v.ID] = v
+	}
+
+	relations := make([]FactionRelationDetail, 0, len(faction.Relations))
+	for _, v := range faction.Relations {
+		relation := FactionRelationDetail{
+			FactionID: v.FactionID,
+			Relation:  v.Relation,
+		}
+		if other, ok := byID[v.FactionID]; ok {
+			relation.Tag = other.Tag
+			relation.Name = other.Name
+		}
+		relations = append(relations, relation)
+	}
+
+	writeJSON(w, http.StatusOK, relations)
 }
 
 func (s *System) DeleteFactions(w http.ResponseWriter, r *http.Request) {
@@ -88,11 +249,11 @@ func (s *System) DeleteFactions(w http.ResponseWriter, r *http.Request) {
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	_, err := conn.DB("torchhive").C(CollectionFaction).RemoveAll(bson.M{
+	_, err := conn.DB(s.database).C(CollectionFaction).RemoveAll(bson.M{
 		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err)
 		return
 	}
 }
@@ -101,13 +262,14 @@ func (s *System) CreateFaction(hiveID bson.ObjectId, sectorID bson.ObjectId, eve
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	return conn.DB("torchhive").C(CollectionFaction).Insert(Faction{
-		HiveID:       hiveID,
-		Name:         event.Name,
-		Tag:          event.Tag,
-		Description:  event.Description,
-		PrivateInfo:  event.PrivateInfo,
-		AcceptHumans: event.AcceptHumans,
+	return conn.DB(s.database).C(CollectionFaction).Insert(Faction{
+		HiveID:         hiveID,
+		Name:           event.Name,
+		Tag:            event.Tag,
+		Description:    event.Description,
+		PrivateInfo:    event.PrivateInfo,
+		AcceptHumans:   event.AcceptHumans,
+		FounderSteamID: event.FounderSteamID,
 		Sectors: []FactionSector{
 			{
 				SectorID: sectorID,
@@ -121,7 +283,7 @@ func (s *System) AddFactionSector(hiveID bson.ObjectId, sectorID bson.ObjectId,
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	return conn.DB("torchhive").C(CollectionFaction).Update(
+	return conn.DB(s.database).C(CollectionFaction).Update(
 		bson.M{
 			"hive_id": hiveID,
 			"tag":     event.Tag,
@@ -142,7 +304,7 @@ func (s *System) GetFaction(hiveID bson.ObjectId, sectorID bson.ObjectId, factio
 	defer conn.Close()
 
 	var faction Faction
-	err := conn.DB("torchhive").C(CollectionFaction).Find(bson.M{
+	err := conn.DB(s.database).C(CollectionFaction).Find(bson.M{
 		"hive_id": hiveID,
 		"sectors": bson.M{
 			"$elemMatch": bson.M{
@@ -162,7 +324,7 @@ func (s *System) EditFaction(hiveID bson.ObjectId, sectorID bson.ObjectId, event
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	return conn.DB("torchhive").C(CollectionFaction).Update(
+	return conn.DB(s.database).C(CollectionFaction).Update(
 		bson.M{
 			"hive_id": hiveID,
 			"sectors": bson.M{
@@ -187,7 +349,7 @@ func (s *System) ChangeAutoAccept(hiveID bson.ObjectId, sectorID bson.ObjectId,
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	return conn.DB("torchhive").C(CollectionFaction).Update(
+	return conn.DB(s.database).C(CollectionFaction).Update(
 		bson.M{
 			"hive_id": hiveID,
 			"sectors": bson.M{
@@ -217,7 +379,7 @@ func (s *System) SendPeaceRequest(hiveID bson.ObjectId, sectorID bson.ObjectId,
 	})
 	errWg.Go(func() error {
 		var err error
-		toFaction, err = s.getFaction(hiveID, sectorID, event.ToFactionID)
+		toFaction, err = s.getRelatedFaction(hiveID, sectorID, event.ToFactionID)
 		return err
 	})
 	err := errWg.Wait()
@@ -239,7 +401,7 @@ func (s *System) CancelPeaceRequest(hiveID bson.ObjectId, sectorID bson.ObjectId
 	})
 	errWg.Go(func() error {
 		var err error
-		toFaction, err = s.getFaction(hiveID, sectorID, event.ToFactionID)
+		toFaction, err = s.getRelatedFaction(hiveID, sectorID, event.ToFactionID)
 		return err
 	})
 	err := errWg.Wait()
@@ -262,7 +424,7 @@ func (s *System) AcceptPeace(hiveID bson.ObjectId, sectorID bson.ObjectId, event
 	})
 	errWg.Go(func() error {
 		var err error
-		toFaction, err = s.getFaction(hiveID, sectorID, event.ToFactionID)
+		toFaction, err = s.getRelatedFaction(hiveID, sectorID, event.ToFactionID)
 		return err
 	})
 	err := errWg.Wait()
@@ -284,7 +446,7 @@ func (s *System) DeclareWar(hiveID bson.ObjectId, sectorID bson.ObjectId, event
 	})
 	errWg.Go(func() error {
 		var err error
-		toFaction, err = s.getFaction(hiveID, sectorID, event.ToFactionID)
+		toFaction, err = s.getRelatedFaction(hiveID, sectorID, event.ToFactionID)
 		return err
 	})
 	err := errWg.Wait()
@@ -300,7 +462,7 @@ func (s *System) getFaction(hiveID bson.ObjectId, sectorID bson.ObjectId, entity
 	defer conn.Close()
 
 	var faction Faction
-	err := conn.DB("torchhive").C(CollectionFaction).Find(bson.M{
+	err := conn.DB(s.database).C(CollectionFaction).Find(bson.M{
 		"hive_id": hiveID,
 		"sectors": bson.M{
 			"$elemMatch": bson.M{
@@ -316,54 +478,36 @@ func (s *System) getFaction(hiveID bson.ObjectId, sectorID bson.ObjectId, entity
 	return &faction, nil
 }
 
-func (s *System) updateFactionRelation(state FactionRelationState, fromFaction *Faction, toFaction *Faction) error {
-	errWg := errgroup.Group{}
-	errWg.Go(func() error {
-		conn := s.db.Copy()
-		defer conn.Close()
-
-		found := false
-		for _, v := range fromFaction.Relations {
-			if v.FactionID != toFaction.ID {
-				continue
-			}
+// factionPendingError is returned for a relation to a faction that is not
+// created in the sector yet.
+type factionPendingError struct {
+	entityID int64
+}
 
-			found = true
-			err := conn.DB("torchhive").C(CollectionFaction).Update(
-				bson.M{
-					"_id":                  fromFaction.ID,
-					"relations.faction_id": toFaction.ID,
-				},
-				bson.M{
-					"$set": bson.M{
-						"relations.$.state": state,
-					},
-				},
-			)
-			if err != nil {
-				return err
-			}
+func (e *factionPendingError) Error() string {
+	return fmt.Sprintf("faction %d is not created in the sector yet", e.entityID)
+}
 
-			break
-		}
+// Transient reports true, the creation of the faction may still be queued.
+func (e *factionPendingError) Transient() bool {
+	return true
+}
 
-		if found {
-			return nil
-		}
+// getRelatedFaction returns the faction a relation event is directed at.
+// Relation events are ordered by the faction sending them, so the creation of
+// the other faction may be processed after the event, which is then retried.
+func (s *System) getRelatedFaction(hiveID bson.ObjectId, sectorID bson.ObjectId, entityID int64) (*Faction, error) {
+	faction, err := s.getFaction(hiveID, sectorID, entityID)
+	if err == mgo.ErrNotFound {
+		return nil, &factionPendingError{entityID: entityID}
+	}
+	return faction, err
+}
 
-		return conn.DB("torchhive").C(CollectionFaction).Update(
-			bson.M{
-				"_id": fromFaction.ID,
-			},
-			bson.M{
-				"$push": bson.M{
-					"relations": bson.M{
-						"faction_id": toFaction.ID,
-						"state":      state,
-					},
-				},
-			},
-		)
+func (s *System) updateFactionRelation(state FactionRelationState, fromFaction *Faction, toFaction *Faction) error {
+	errWg := errgroup.Group{}
+	errWg.Go(func() error {
+		return s.setFactionRelation(fromFaction.ID, toFaction.ID, state)
 	})
 	errWg.Go(func() error {
 		// leave old state if peace is requested
@@ -371,54 +515,60 @@ func (s *System) updateFactionRelation(state FactionRelationState, fromFaction *
 			return nil
 		}
 
-		conn := s.db.Copy()
-		defer conn.Close()
-
-		found := false
-		for _, v := range toFaction.Relations {
-			if v.FactionID != fromFaction.ID {
-				continue
-			}
-
-			found = true
-			err := conn.DB("torchhive").C(CollectionFaction).Update(
-				bson.M{
-					"_id":                  fromFaction.ID,
-					"relations.faction_id": toFaction.ID,
-				},
-				bson.M{
-					"$set": bson.M{
-						"relations.$.state": state,
-					},
-				},
-			)
-			if err != nil {
-				return err
-			}
+		return s.setFactionRelation(toFaction.ID, fromFaction.ID, state)
+	})
 
-			break
-		}
+	return errWg.Wait()
+}
 
-		if found {
-			return nil
-		}
+// setFactionRelation sets the relation of a faction to another faction. Each
+// step is a single conditional update: the relation is only pushed while the
+// faction has none to the other faction, so concurrent events cannot store it
+// twice.
+func (s *System) setFactionRelation(factionID bson.ObjectId, otherID bson.ObjectId, state FactionRelationState) error {
+	conn := s.db.Copy()
+	defer conn.Close()
 
-		return conn.DB("torchhive").C(CollectionFaction).Update(
+	c := conn.DB(s.database).C(CollectionFaction)
+	set := func() error {
+		return c.Update(
 			bson.M{
-				"_id": fromFaction.ID,
+				"_id":                  factionID,
+				"relations.faction_id": otherID,
 			},
 			bson.M{
-				"$push": bson.M{
-					"relations": bson.M{
-						"faction_id": toFaction.ID,
-						"state":      state,
-					},
+				"$set": bson.M{
+					"relations.$.state": state,
 				},
 			},
 		)
-	})
+	}
 
-	return errWg.Wait()
+	err := set()
+	if err != mgo.ErrNotFound {
+		return err
+	}
+
+	err = c.Update(
+		bson.M{
+			"_id":                  factionID,
+			"relations.faction_id": bson.M{"$ne": otherID},
+		},
+		bson.M{
+			"$push": bson.M{
+				"relations": bson.M{
+					"faction_id": otherID,
+					"state":      state,
+				},
+			},
+		},
+	)
+	if err != mgo.ErrNotFound {
+		return err
+	}
+
+	// the relation was pushed by a concurrent event
+	return set()
 }
 
 func (s *System) MemberSendJoin(hiveID bson.ObjectId, sectorID bson.ObjectId, event EventFactionMember) (*Faction, error) {
@@ -429,14 +579,14 @@ func (s *System) MemberSendJoin(hiveID bson.ObjectId, sectorID bson.ObjectId, ev
 
 	for _, v := range faction.Members {
 		if v.SteamID == event.PlayerSteamID {
-			return nil, fmt.Errorf("steam id %d want to join in faction %s but exists", event.PlayerSteamID, faction.ID.Hex())
+			return nil, api.Conflict(fmt.Sprintf("steam id %d want to join in faction %s but exists", event.PlayerSteamID, faction.ID.Hex()), nil)
 		}
 	}
 
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	err = conn.DB("torchhive").C(CollectionFaction).Update(
+	err = conn.DB(s.database).C(CollectionFaction).Update(
 		bson.M{
 			"_id": faction.ID,
 		},
@@ -470,13 +620,13 @@ func (s *System) MemberLeave(hiveID bson.ObjectId, sectorID bson.ObjectId, event
 	}
 
 	if !found {
-		return nil, fmt.Errorf("steam id %d want to leave in faction %s but not exists", event.PlayerSteamID, faction.ID.Hex())
+		return nil, api.Conflict(fmt.Sprintf("steam id %d want to leave in faction %s but not exists", event.PlayerSteamID, faction.ID.Hex()), nil)
 	}
 
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	err = conn.DB("torchhive").C(CollectionFaction).Update(
+	err = conn.DB(s.database).C(CollectionFaction).Update(
 		bson.M{
 			"_id": faction.ID,
 		},
@@ -509,20 +659,20 @@ func (s *System) MemberAcceptJoin(hiveID bson.ObjectId, sectorID bson.ObjectId,
 	}
 
 	if !found {
-		return nil, fmt.Errorf("steam id %d want to accept join in faction %s but not exists", event.PlayerSteamID, faction.ID.Hex())
+		return nil, api.Conflict(fmt.Sprintf("steam id %d want to accept join in faction %s but not exists", event.PlayerSteamID, faction.ID.Hex()), nil)
 	}
 
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	err = conn.DB("torchhive").C(CollectionFaction).Update(
+	err = conn.DB(s.database).C(CollectionFaction).Update(
 		bson.M{
 			"_id":              faction.ID,
 			"members.steam_id": event.PlayerSteamID,
 		},
 		bson.M{
 			"$set": bson.M{
-				"members.$.steam_id": FactionMemberJoined,
+				"members.$.state": FactionMemberJoined,
 			},
 		},
 	)
@@ -547,13 +697,13 @@ func (s *System) MemberPromoteDemote(hiveID bson.ObjectId, sectorID bson.ObjectI
 	}
 
 	if !found {
-		return nil, fmt.Errorf("steam id %d want to accept join in faction %s but not exists", event.PlayerSteamID, faction.ID.Hex())
+		return nil, api.Conflict(fmt.Sprintf("steam id %d want to accept join in faction %s but not exists", event.PlayerSteamID, faction.ID.Hex()), nil)
 	}
 
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	err = conn.DB("torchhive").C(CollectionFaction).Update(
+	err = conn.DB(s.database).C(CollectionFaction).Update(
 		bson.M{
 			"_id":              faction.ID,
 			"members.steam_id": event.PlayerSteamID,
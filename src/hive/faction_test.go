@@ -0,0 +1,53 @@
+package hive
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestConcurrentRelationsAreStoredOnce(t *testing.T) {
+	s, err := NewSystemWithStore(store.NewMemory(), DefaultDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hiveID := bson.NewObjectId()
+	a := &Faction{ID: bson.NewObjectId(), HiveID: hiveID, Tag: "A"}
+	b := &Faction{ID: bson.NewObjectId(), HiveID: hiveID, Tag: "B"}
+	if err := s.db.DB(s.database).C(CollectionFaction).Insert(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// both factions declare war on each other at the same time, each with
+	// the relations it read before the other one wrote
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := s.updateFactionRelation(FactionRelationWar, a, b); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := s.updateFactionRelation(FactionRelationWar, b, a); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, faction := range []*Faction{a, b} {
+		var stored Faction
+		if err := s.db.DB(s.database).C(CollectionFaction).FindId(faction.ID).One(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if len(stored.Relations) != 1 || stored.Relations[0].Relation != FactionRelationWar {
+			t.Errorf("%s: expected a single war relation, got %+v", faction.Tag, stored.Relations)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package hive
+
+import (
+	"net/http"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/fankserver/torchapi-hive-system/src/schema"
+	"github.com/gorilla/mux"
+)
+
+// FrameSchemas describes the websocket frames of every binary encoding. The
+// JSON encoding sends the envelope as is.
+var FrameSchemas = map[string]*schema.Schema{
+	protocol.EncodingMsgpack: {
+		Schema:      schema.Draft,
+		ID:          "/api/schema/frame/" + protocol.EncodingMsgpack,
+		Title:       protocol.EncodingMsgpack,
+		Description: "A MessagePack map sent as binary websocket message. Unlike the JSON envelope the payload is embedded as map instead of an encoded string, integers keep their full 64 bits.",
+		Type:        schema.TypeObject,
+		Properties: map[string]*schema.Schema{
+			"id":   text("Id of the event, acks carry it as EventId. Omitted if the message is no event.", 1),
+			"type": text("Message type, e.g. hello, ack or factionCreated.", 1),
+			"payload": {
+				Description: "Payload of the message, for events the raw payload described by /api/schema/event/{event_type}. Omitted if the message has none.",
+				Type:        schema.TypeObject,
+			},
+		},
+		Required: []string{"type"},
+	},
+}
+
+func GetFrameSchemas(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, FrameSchemas)
+}
+
+func GetFrameSchema(w http.ResponseWriter, r *http.Request) {
+	s, ok := FrameSchemas[mux.Vars(r)["encoding"]]
+	if !ok {
+		api.WriteError(w, api.NotFound("unknown encoding"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s)
+}
@@ -1,51 +1,330 @@
 package hive
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/fankserver/torchapi-hive-system/src/store"
 	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
 )
 
 const CollectionHive = "hive"
 
 type Hive struct {
-	ID   bson.ObjectId `json:"id" bson:"_id,omitempty"`
-	Name string        `json:"name" bson:"name"`
+	ID                 bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Name               string        `json:"name" bson:"name"`
+	BackpressurePolicy string        `json:"backpressure_policy" bson:"backpressure_policy,omitempty"`
+	ObserverToken      string        `json:"-" bson:"observer_token,omitempty"`
+}
+
+type hivePatch struct {
+	Name               *string `json:"name"`
+	BackpressurePolicy *string `json:"backpressure_policy"`
+}
+
+func (p hivePatch) apply(h *Hive, replace bool) error {
+	if p.Name == nil {
+		if replace {
+			return api.Validation("name", "is required")
+		}
+	} else {
+		h.Name = strings.TrimSpace(*p.Name)
+	}
+
+	if h.Name == "" {
+		return api.Validation("name", "must not be empty")
+	}
+
+	if p.BackpressurePolicy != nil {
+		h.BackpressurePolicy = *p.BackpressurePolicy
+	} else if replace {
+		h.BackpressurePolicy = ""
+	}
+	if h.BackpressurePolicy == "" {
+		h.BackpressurePolicy = notification.PolicyDisconnect
+	}
+	if !validBackpressurePolicy(h.BackpressurePolicy) {
+		return api.Validation("backpressure_policy", "must be one of "+strings.Join(notification.BackpressurePolicies, ", "))
+	}
+
+	return nil
+}
+
+func (s *System) validateHive(conn store.Session, h Hive) error {
+	count, err := conn.DB(s.database).C(CollectionHive).Find(bson.M{
+		"_id":  bson.M{"$ne": h.ID},
+		"name": h.Name,
+	}).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return api.Conflict(fmt.Sprintf("hive name %q is already taken", h.Name), nil)
+	}
+
+	return nil
 }
 
 func (s *System) CreateHive(w http.ResponseWriter, r *http.Request) {
+	var patch hivePatch
+	if err := decodeBody(r, &patch); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	h := Hive{
+		ID: bson.NewObjectId(),
+	}
+	if err := patch.apply(&h, true); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	if err := s.validateHive(conn, h); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err := conn.DB(s.database).C(CollectionHive).Insert(h)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, h)
+}
+
+func (s *System) GetHive(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
 	var h Hive
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-	if err := decoder.Decode(&h); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	err := conn.DB(s.database).C(CollectionHive).FindId(bson.ObjectIdHex(vars["hive_id"])).One(&h)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h)
+}
+
+func (s *System) UpdateHive(w http.ResponseWriter, r *http.Request) {
+	s.updateHive(w, r, true)
+}
+
+func (s *System) PatchHive(w http.ResponseWriter, r *http.Request) {
+	s.updateHive(w, r, false)
+}
+
+func (s *System) updateHive(w http.ResponseWriter, r *http.Request, replace bool) {
+	vars := mux.Vars(r)
+
+	var patch hivePatch
+	if err := decodeBody(r, &patch); err != nil {
+		api.WriteError(w, err)
 		return
 	}
 
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	err := conn.DB("torchhive").C(CollectionHive).Insert(h)
+	var h Hive
+	err := conn.DB(s.database).C(CollectionHive).FindId(bson.ObjectIdHex(vars["hive_id"])).One(&h)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	policy := h.BackpressurePolicy
+
+	if err := patch.apply(&h, replace); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	if err := s.validateHive(conn, h); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = conn.DB(s.database).C(CollectionHive).UpdateId(h.ID, bson.M{
+		"$set": bson.M{
+			"name":                h.Name,
+			"backpressure_policy": h.BackpressurePolicy,
+		},
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err)
 		return
 	}
+
+	if h.BackpressurePolicy != policy && s.policyChangeHandler != nil {
+		s.policyChangeHandler(h.ID.Hex(), h.BackpressurePolicy)
+	}
+
+	writeJSON(w, http.StatusOK, h)
 }
 
+var (
+	hiveSortFields = listFields{
+		"name": "name",
+	}
+	hiveProjectFields = listFields{
+		"name":                "name",
+		"backpressure_policy": "backpressure_policy",
+	}
+)
+
 func (s *System) GetHives(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r, hiveSortFields, hiveProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := bson.M{}
+	if v := query.Get("name"); v != "" {
+		filter["name"] = v
+	} else if v := query.Get("name_prefix"); v != "" {
+		filter["name"] = prefixFilter(v)
+	}
+
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	var h []Hive
-	err := conn.DB("torchhive").C(CollectionHive).Find(nil).All(&h)
+	docs, total, next, err := opts.find(conn.DB(s.database).C(CollectionHive), filter, hiveProjectFields)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(h); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	h := make([]Hive, len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(&h[i]); err != nil {
+			api.WriteError(w, err)
+			return
+		}
 	}
+
+	opts.writeList(w, h, total, next)
+}
+
+func (s *System) DeleteHive(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	opts, err := parseDeleteOptions(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	hiveID := bson.ObjectIdHex(vars["hive_id"])
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	count, err := conn.DB(s.database).C(CollectionHive).FindId(hiveID).Count()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if count == 0 {
+		api.WriteError(w, api.NotFound("hive not found"))
+		return
+	}
+
+	report := DeleteReport{
+		DryRun: opts.dryRun,
+		Hives:  1,
+	}
+
+	report.Sectors, err = conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"hive_id": hiveID,
+	}).Count()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	var factions []Faction
+	err = conn.DB(s.database).C(CollectionFaction).Find(bson.M{
+		"hive_id": hiveID,
+	}).Select(bson.M{
+		"members":   1,
+		"relations": 1,
+		"sectors":   1,
+	}).All(&factions)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	for _, faction := range factions {
+		report.Factions++
+		report.FactionSectors += len(faction.Sectors)
+		report.Members += len(faction.Members)
+		report.Relations += len(faction.Relations)
+	}
+
+	if opts.mode == DeleteModeRestrict && report.hasDependents() {
+		api.WriteError(w, api.Conflict("hive has dependents", report))
+		return
+	}
+
+	if opts.dryRun {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	_, err = conn.DB(s.database).C(CollectionFaction).RemoveAll(bson.M{
+		"hive_id": hiveID,
+	})
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	_, err = conn.DB(s.database).C(CollectionSector).RemoveAll(bson.M{
+		"hive_id": hiveID,
+	})
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	_, err = conn.DB(s.database).C(CollectionSectorSpill).RemoveAll(bson.M{
+		"hive_id": hiveID,
+	})
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	for _, collection := range []string{CollectionSectorEvent, CollectionDeadLetter, CollectionActivity, CollectionWebhook, CollectionWebhookDelivery} {
+		_, err = conn.DB(s.database).C(collection).RemoveAll(bson.M{
+			"hive_id": hiveID,
+		})
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	}
+
+	err = conn.DB(s.database).C(CollectionHive).RemoveId(hiveID)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	s.disconnect(hiveID, "")
+
+	writeJSON(w, http.StatusOK, report)
 }
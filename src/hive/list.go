@@ -0,0 +1,242 @@
+package hive
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listFields maps the json field names of a resource to its bson field names.
+// Only the listed fields can be used for sorting and projection.
+type listFields map[string]string
+
+type listOptions struct {
+	limit     int
+	sortField string
+	sortDesc  bool
+	cursor    *listCursor
+	fields    []string
+}
+
+type listCursor struct {
+	Sort  string        `bson:"s"`
+	Value interface{}   `bson:"v,omitempty"`
+	ID    bson.ObjectId `bson:"id"`
+}
+
+func parseListOptions(r *http.Request, sortable listFields, projectable listFields) (listOptions, error) {
+	query := r.URL.Query()
+	opts := listOptions{
+		limit: defaultListLimit,
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return opts, api.Validation("limit", "must be between 1 and "+strconv.Itoa(maxListLimit))
+		}
+		opts.limit = limit
+	}
+
+	if v := query.Get("sort"); v != "" {
+		if strings.HasPrefix(v, "-") {
+			opts.sortDesc = true
+			v = v[1:]
+		}
+
+		field, ok := sortable[v]
+		if !ok {
+			return opts, api.Validation("sort", "unknown sort field "+v)
+		}
+		opts.sortField = field
+	}
+
+	if v := query.Get("fields"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if _, ok := projectable[field]; !ok {
+				return opts, api.Validation("fields", "unknown field "+field)
+			}
+			opts.fields = append(opts.fields, field)
+		}
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return opts, api.Validation("cursor", "is malformed")
+		}
+
+		var cursor listCursor
+		if err := bson.Unmarshal(data, &cursor); err != nil || !cursor.ID.Valid() {
+			return opts, api.Validation("cursor", "is malformed")
+		}
+		if cursor.Sort != opts.sortSpec() {
+			return opts, api.Validation("cursor", "was created for a different sort order")
+		}
+		opts.cursor = &cursor
+	}
+
+	return opts, nil
+}
+
+func (o listOptions) sortSpec() string {
+	if o.sortField == "" {
+		return ""
+	}
+	if o.sortDesc {
+		return "-" + o.sortField
+	}
+	return o.sortField
+}
+
+func (o listOptions) sort() []string {
+	if o.sortField == "" {
+		return []string{"_id"}
+	}
+	if o.sortDesc {
+		return []string{"-" + o.sortField, "-_id"}
+	}
+	return []string{o.sortField, "_id"}
+}
+
+func (o listOptions) cursorFilter() bson.M {
+	if o.cursor == nil {
+		return nil
+	}
+
+	op := "$gt"
+	if o.sortDesc {
+		op = "$lt"
+	}
+
+	if o.sortField == "" {
+		return bson.M{"_id": bson.M{op: o.cursor.ID}}
+	}
+
+	return bson.M{
+		"$or": []bson.M{
+			{o.sortField: bson.M{op: o.cursor.Value}},
+			{o.sortField: o.cursor.Value, "_id": bson.M{op: o.cursor.ID}},
+		},
+	}
+}
+
+// find runs the paginated query and returns the raw documents of the page,
+// the number of documents matching the filter and the cursor of the next page.
+func (o listOptions) find(c store.Collection, filter bson.M, projectable listFields) ([]bson.Raw, int, string, error) {
+	total, err := c.Find(filter).Count()
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	query := filter
+	if cursorFilter := o.cursorFilter(); cursorFilter != nil {
+		query = bson.M{"$and": []bson.M{filter, cursorFilter}}
+	}
+
+	q := c.Find(query).Sort(o.sort()...).Limit(o.limit + 1)
+	if len(o.fields) > 0 {
+		selector := bson.M{"_id": 1}
+		if o.sortField != "" {
+			selector[o.sortField] = 1
+		}
+		for _, field := range o.fields {
+			selector[projectable[field]] = 1
+		}
+		q = q.Select(selector)
+	}
+
+	var docs []bson.Raw
+	if err := q.All(&docs); err != nil {
+		return nil, 0, "", err
+	}
+
+	if len(docs) <= o.limit {
+		return docs, total, "", nil
+	}
+	docs = docs[:o.limit]
+	if len(docs) == 0 {
+		return docs, total, "", nil
+	}
+
+	var last bson.M
+	if err := docs[len(docs)-1].Unmarshal(&last); err != nil {
+		return nil, 0, "", err
+	}
+
+	id, ok := last["_id"].(bson.ObjectId)
+	if !ok {
+		return nil, 0, "", fmt.Errorf("cannot create a cursor after a document with _id %v", last["_id"])
+	}
+	cursor := listCursor{
+		Sort: o.sortSpec(),
+		ID:   id,
+	}
+	if o.sortField != "" {
+		cursor.Value = last[o.sortField]
+	}
+	data, err := bson.Marshal(cursor)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	return docs, total, base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// writeList writes a page of items, reduced to the requested fields.
+func (o listOptions) writeList(w http.ResponseWriter, items interface{}, total int, next string) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
+	if len(o.fields) == 0 {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	var full []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &full); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	projected := make([]map[string]json.RawMessage, 0, len(full))
+	for _, item := range full {
+		v := map[string]json.RawMessage{
+			"id": item["id"],
+		}
+		for _, field := range o.fields {
+			v[field] = item[field]
+		}
+		projected = append(projected, v)
+	}
+
+	writeJSON(w, http.StatusOK, projected)
+}
+
+func prefixFilter(prefix string) bson.RegEx {
+	return bson.RegEx{
+		Pattern: "^" + regexp.QuoteMeta(prefix),
+	}
+}
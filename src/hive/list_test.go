@@ -0,0 +1,45 @@
+package hive
+
+import (
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestListFindCursor(t *testing.T) {
+	c := store.NewMemory().DB(DefaultDatabase).C("list")
+	for i := 0; i < 3; i++ {
+		if err := c.Insert(bson.M{"_id": bson.NewObjectId(), "n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := listOptions{limit: 2}
+	docs, total, next, err := opts.find(c, bson.M{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || total != 3 || next == "" {
+		t.Fatalf("expected 2 of 3 documents and a cursor, got %d of %d and %q", len(docs), total, next)
+	}
+
+	opts.limit = 3
+	if _, _, next, err = opts.find(c, bson.M{}, nil); err != nil || next != "" {
+		t.Fatalf("expected no cursor after the last page, got %q, %v", next, err)
+	}
+}
+
+func TestListFindCursorRequiresObjectID(t *testing.T) {
+	c := store.NewMemory().DB(DefaultDatabase).C("list")
+	for _, id := range []string{"a", "b"} {
+		if err := c.Insert(bson.M{"_id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := listOptions{limit: 1}
+	if _, _, _, err := opts.find(c, bson.M{}, nil); err == nil {
+		t.Fatal("expected an error for a document without an object id")
+	}
+}
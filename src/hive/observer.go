@@ -0,0 +1,181 @@
+package hive
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ObserverToken is returned once when the observer token of a hive is
+// generated, only its hash is stored.
+type ObserverToken struct {
+	Token string `json:"token"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken generates a random access token.
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// tokenMatches compares a token with a stored hash in constant time.
+func tokenMatches(hash string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(token))) == 1
+}
+
+// rotationAllowed reports whether a request may replace or remove the token
+// stored as hash. Only the first token can be created without a token.
+func rotationAllowed(hash string, r *http.Request) bool {
+	if hash == "" {
+		return true
+	}
+	token := api.RequestToken(r)
+	return token != "" && tokenMatches(hash, token)
+}
+
+// storedToken matches the stored token hash in a filter, a missing token as
+// well if hash is empty.
+func storedToken(hash string) interface{} {
+	if hash == "" {
+		return nil
+	}
+	return hash
+}
+
+// RegisterActivityHandler sets the function that streams state changes to the
+// observers of a hive.
+func (s *System) RegisterActivityHandler(activityHandler func(activity *notification.Activity)) {
+	s.activityHandler = activityHandler
+}
+
+func (s *System) publish(hiveID bson.ObjectId, sectorID bson.ObjectId, activityType string, eventType string, data interface{}) {
+	if s.activityHandler == nil {
+		return
+	}
+
+	s.activityHandler(&notification.Activity{
+		Type:      activityType,
+		HiveID:    hiveID.Hex(),
+		SectorID:  sectorID.Hex(),
+		EventType: eventType,
+		Time:      time.Now(),
+		Data:      data,
+	})
+}
+
+// publishFactionChange publishes the current state of the faction a processed
+// event belongs to.
+func (s *System) publishFactionChange(hiveID bson.ObjectId, sectorID bson.ObjectId, eventType string, raw string) {
+	if s.activityHandler == nil || eventType == EventTypeServerStateChange {
+		return
+	}
+
+	entityID, ok := eventFactionID(raw)
+	if !ok {
+		return
+	}
+
+	faction, err := s.getFaction(hiveID, sectorID, entityID)
+	if err != nil {
+		logrus.Errorln(err)
+		return
+	}
+
+	activityType := notification.ActivityFactionChanged
+	if eventType == EventTypeFactionCreated {
+		activityType = notification.ActivityFactionCreated
+	}
+	s.publish(hiveID, sectorID, activityType, eventType, faction)
+}
+
+// CreateObserverToken generates a new observer token for a hive, replacing
+// the previous one. A hive that has a token only gets a new one for a request
+// with the current token.
+func (s *System) CreateObserverToken(w http.ResponseWriter, r *http.Request) {
+	hiveID := bson.ObjectIdHex(mux.Vars(r)["hive_id"])
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var h Hive
+	err := conn.DB(s.database).C(CollectionHive).FindId(hiveID).Select(bson.M{
+		"observer_token": 1,
+	}).One(&h)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if !rotationAllowed(h.ObserverToken, r) {
+		api.WriteError(w, api.Unauthorized("the current observer token is required"))
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = conn.DB(s.database).C(CollectionHive).Update(bson.M{
+		"_id":            hiveID,
+		"observer_token": storedToken(h.ObserverToken),
+	}, bson.M{
+		"$set": bson.M{
+			"observer_token": hashToken(token),
+		},
+	})
+	if err == mgo.ErrNotFound {
+		api.WriteError(w, api.Unauthorized("the observer token was replaced concurrently"))
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ObserverToken{
+		Token: token,
+	})
+}
+
+// IsObserverTokenValid reports whether token grants read access to the
+// activity of a hive.
+func (s *System) IsObserverTokenValid(hiveID bson.ObjectId, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var h Hive
+	err := conn.DB(s.database).C(CollectionHive).FindId(hiveID).Select(bson.M{
+		"observer_token": 1,
+	}).One(&h)
+	if err != nil {
+		return false, err
+	}
+	if h.ObserverToken == "" {
+		return false, nil
+	}
+
+	return tokenMatches(h.ObserverToken, token), nil
+}
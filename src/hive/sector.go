@@ -1,10 +1,18 @@
 package hive
 
 import (
-	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/gorilla/mux"
 )
@@ -20,71 +28,343 @@ const (
 	SectorStateOnline
 )
 
+// Sector coordinates are limited to this distance from the hive origin.
+const maxSectorCoordinate = 10000
+
+type SectorPosition struct {
+	X int `json:"x" bson:"x"`
+	Y int `json:"y" bson:"y"`
+}
+
+// SectorProtocol is the protocol negotiated by the last connection of a sector.
+type SectorProtocol struct {
+	Version       int       `json:"version" bson:"version"`
+	PluginVersion string    `json:"plugin_version" bson:"plugin_version"`
+	Events        []string  `json:"events" bson:"events"`
+	ConnectedAt   time.Time `json:"connected_at" bson:"connected_at"`
+}
+
 type Sector struct {
-	ID          bson.ObjectId `json:"id" bson:"_id,omitempty"`
-	HiveID      bson.ObjectId `json:"-" bson:"hive_id"`
-	Name        string        `json:"name" bson:"name"`
-	Address     string        `json:"address" bson:"address"`
-	State       SectorState   `json:"state" bson:"state"`
-	MaxPlayer   int           `json:"max_player" bson:"max_player"`
-	PlayerCount int           `json:"player_count" bson:"player_count"`
-	Position    struct {
-		X int `json:"x" bson:"x"`
-		Y int `json:"y" bson:"y"`
-	} `json:"position" bson:"position"`
-	LastFactionSync  *time.Time `json:"last_faction_sync" bson:"last_faction_sync"`
-	LastCurrencySync *time.Time `json:"last_currency_sync" bson:"last_currency_sync"`
+	ID               bson.ObjectId   `json:"id" bson:"_id,omitempty"`
+	HiveID           bson.ObjectId   `json:"-" bson:"hive_id"`
+	Name             string          `json:"name" bson:"name"`
+	Address          string          `json:"address" bson:"address"`
+	State            SectorState     `json:"state" bson:"state"`
+	MaxPlayer        int             `json:"max_player" bson:"max_player"`
+	PlayerCount      int             `json:"player_count" bson:"player_count"`
+	Position         SectorPosition  `json:"position" bson:"position"`
+	Protocol         *SectorProtocol `json:"protocol" bson:"protocol,omitempty"`
+	LastFactionSync  *time.Time      `json:"last_faction_sync" bson:"last_faction_sync"`
+	LastCurrencySync *time.Time      `json:"last_currency_sync" bson:"last_currency_sync"`
+	SlowAt           *time.Time      `json:"slow_at" bson:"slow_at,omitempty"`
+	Token            string          `json:"-" bson:"token,omitempty"`
+}
+
+// SectorToken is returned once when the token of a sector is generated, only
+// its hash is stored.
+type SectorToken struct {
+	Token string `json:"token"`
+}
+
+type sectorPatch struct {
+	Name      *string         `json:"name"`
+	Address   *string         `json:"address"`
+	MaxPlayer *int            `json:"max_player"`
+	Position  *SectorPosition `json:"position"`
+}
+
+func (p sectorPatch) apply(hs *Sector, replace bool) error {
+	if replace {
+		switch {
+		case p.Name == nil:
+			return api.Validation("name", "is required")
+		case p.Address == nil:
+			return api.Validation("address", "is required")
+		case p.MaxPlayer == nil:
+			return api.Validation("max_player", "is required")
+		case p.Position == nil:
+			return api.Validation("position", "is required")
+		}
+	}
+
+	if p.Name != nil {
+		hs.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.Address != nil {
+		hs.Address = strings.TrimSpace(*p.Address)
+	}
+	if p.MaxPlayer != nil {
+		hs.MaxPlayer = *p.MaxPlayer
+	}
+	if p.Position != nil {
+		hs.Position = *p.Position
+	}
+
+	if hs.Name == "" {
+		return api.Validation("name", "must not be empty")
+	}
+
+	host, port, err := net.SplitHostPort(hs.Address)
+	if err != nil {
+		return api.Validation("address", "must be in the form host:port")
+	}
+	if host == "" {
+		return api.Validation("address", "host must not be empty")
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 || portNumber > 65535 {
+		return api.Validation("address", "port must be between 1 and 65535")
+	}
+
+	if hs.MaxPlayer < 0 {
+		return api.Validation("max_player", "must not be negative")
+	}
+
+	if abs(hs.Position.X) > maxSectorCoordinate || abs(hs.Position.Y) > maxSectorCoordinate {
+		return api.Validation("position", fmt.Sprintf("coordinates must be within %d of the origin", maxSectorCoordinate))
+	}
+
+	return nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (s *System) validateSector(conn store.Session, hs Sector) error {
+	var sectors []Sector
+	err := conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"_id":     bson.M{"$ne": hs.ID},
+		"hive_id": hs.HiveID,
+		"$or": []bson.M{
+			{"name": hs.Name},
+			{"position.x": hs.Position.X, "position.y": hs.Position.Y},
+		},
+	}).All(&sectors)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range sectors {
+		if v.Name == hs.Name {
+			return api.Conflict(fmt.Sprintf("sector name %q is already taken", hs.Name), nil)
+		}
+
+		return api.Conflict(fmt.Sprintf("position %d,%d is already taken by sector %q", hs.Position.X, hs.Position.Y, v.Name), nil)
+	}
+
+	return nil
 }
 
 func (s *System) CreateSector(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
+	var patch sectorPatch
+	if err := decodeBody(r, &patch); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	hs := Sector{
+		ID:     bson.NewObjectId(),
+		HiveID: bson.ObjectIdHex(vars["hive_id"]),
+	}
+	if err := patch.apply(&hs, true); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionHive).FindId(hs.HiveID).One(nil)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	if err := s.validateSector(conn, hs); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = conn.DB(s.database).C(CollectionSector).Insert(hs)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, hs)
+}
+
+func (s *System) GetSector(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
 	var hs Sector
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-	if err := decoder.Decode(&hs); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	err := conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"_id":     bson.ObjectIdHex(vars["sector_id"]),
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}).One(&hs)
+	if err != nil {
+		api.WriteError(w, err)
 		return
 	}
 
-	hs.HiveID = bson.ObjectIdHex(vars["hive_id"])
+	writeJSON(w, http.StatusOK, hs)
+}
+
+func (s *System) UpdateSector(w http.ResponseWriter, r *http.Request) {
+	s.updateSector(w, r, true)
+}
+
+func (s *System) PatchSector(w http.ResponseWriter, r *http.Request) {
+	s.updateSector(w, r, false)
+}
+
+func (s *System) updateSector(w http.ResponseWriter, r *http.Request, replace bool) {
+	vars := mux.Vars(r)
+
+	var patch sectorPatch
+	if err := decodeBody(r, &patch); err != nil {
+		api.WriteError(w, err)
+		return
+	}
 
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	err := conn.DB("torchhive").C(CollectionSector).Insert(hs)
+	var hs Sector
+	err := conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"_id":     bson.ObjectIdHex(vars["sector_id"]),
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}).One(&hs)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	if err := patch.apply(&hs, replace); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	if err := s.validateSector(conn, hs); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = conn.DB(s.database).C(CollectionSector).UpdateId(hs.ID, bson.M{
+		"$set": bson.M{
+			"name":       hs.Name,
+			"address":    hs.Address,
+			"max_player": hs.MaxPlayer,
+			"position":   hs.Position,
+		},
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err)
 		return
 	}
+
+	writeJSON(w, http.StatusOK, hs)
+}
+
+var (
+	sectorSortFields = listFields{
+		"name":         "name",
+		"state":        "state",
+		"max_player":   "max_player",
+		"player_count": "player_count",
+	}
+	sectorProjectFields = listFields{
+		"name":               "name",
+		"address":            "address",
+		"state":              "state",
+		"max_player":         "max_player",
+		"player_count":       "player_count",
+		"position":           "position",
+		"protocol":           "protocol",
+		"last_faction_sync":  "last_faction_sync",
+		"last_currency_sync": "last_currency_sync",
+	}
+	sectorStateNames = map[string]SectorState{
+		"unknown": SectorStateUnknown,
+		"offline": SectorStateOffline,
+		"booting": SectorStateBooting,
+		"online":  SectorStateOnline,
+	}
+)
+
+func parseSectorState(v string) (SectorState, error) {
+	if state, ok := sectorStateNames[strings.ToLower(v)]; ok {
+		return state, nil
+	}
+
+	state, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || SectorState(state) > SectorStateOnline {
+		return 0, api.Validation("state", "unknown sector state "+v)
+	}
+
+	return SectorState(state), nil
 }
 
 func (s *System) GetSectors(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
+	opts, err := parseListOptions(r, sectorSortFields, sectorProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := bson.M{
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}
+	if v := query.Get("state"); v != "" {
+		state, err := parseSectorState(v)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		filter["state"] = state
+	}
+	if v := query.Get("name"); v != "" {
+		filter["name"] = v
+	} else if v := query.Get("name_prefix"); v != "" {
+		filter["name"] = prefixFilter(v)
+	}
+
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	var hs []Sector
-	err := conn.DB("torchhive").C(CollectionSector).Find(bson.M{
-		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
-	}).All(&hs)
+	docs, total, next, err := opts.find(conn.DB(s.database).C(CollectionSector), filter, sectorProjectFields)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(hs); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	hs := make([]Sector, len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(&hs[i]); err != nil {
+			api.WriteError(w, err)
+			return
+		}
 	}
+
+	opts.writeList(w, hs, total, next)
 }
 
 func (s *System) IsSectorValid(hiveID bson.ObjectId, sectorID bson.ObjectId) (bool, error) {
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	count, err := conn.DB("torchhive").C(CollectionSector).Find(bson.M{
+	count, err := conn.DB(s.database).C(CollectionSector).Find(bson.M{
 		"_id":     sectorID,
 		"hive_id": hiveID,
 	}).Count()
@@ -95,11 +375,177 @@ func (s *System) IsSectorValid(hiveID bson.ObjectId, sectorID bson.ObjectId) (bo
 	return count > 0, nil
 }
 
+// IsSectorTokenValid reports whether token grants a sector access to the
+// websocket. Sectors without a token accept every connection.
+func (s *System) IsSectorTokenValid(hiveID bson.ObjectId, sectorID bson.ObjectId, token string) (bool, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var hs Sector
+	err := conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"_id":     sectorID,
+		"hive_id": hiveID,
+	}).Select(bson.M{
+		"token": 1,
+	}).One(&hs)
+	if err != nil {
+		return false, err
+	}
+	if hs.Token == "" {
+		return true, nil
+	}
+
+	return token != "" && tokenMatches(hs.Token, token), nil
+}
+
+// CreateSectorToken generates a new token for a sector, replacing the previous
+// one. A sector that has a token only gets a new one for a request with the
+// current token. The sector is disconnected and must reconnect with the new
+// token.
+func (s *System) CreateSectorToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hiveID := bson.ObjectIdHex(vars["hive_id"])
+	sectorID := bson.ObjectIdHex(vars["sector_id"])
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	current, ok := s.currentSectorToken(conn, w, r, hiveID, sectorID)
+	if !ok {
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = conn.DB(s.database).C(CollectionSector).Update(bson.M{
+		"_id":     sectorID,
+		"hive_id": hiveID,
+		"token":   storedToken(current),
+	}, bson.M{
+		"$set": bson.M{
+			"token": hashToken(token),
+		},
+	})
+	if err == mgo.ErrNotFound {
+		api.WriteError(w, api.Unauthorized("the sector token was replaced concurrently"))
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	s.disconnect(hiveID, sectorID)
+
+	writeJSON(w, http.StatusCreated, SectorToken{
+		Token: token,
+	})
+}
+
+// DeleteSectorToken removes the token of a sector, it may connect without
+// one again. The request has to carry the current token.
+func (s *System) DeleteSectorToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hiveID := bson.ObjectIdHex(vars["hive_id"])
+	sectorID := bson.ObjectIdHex(vars["sector_id"])
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	current, ok := s.currentSectorToken(conn, w, r, hiveID, sectorID)
+	if !ok {
+		return
+	}
+	if current == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := conn.DB(s.database).C(CollectionSector).Update(bson.M{
+		"_id":     sectorID,
+		"hive_id": hiveID,
+		"token":   current,
+	}, bson.M{
+		"$unset": bson.M{
+			"token": "",
+		},
+	})
+	if err == mgo.ErrNotFound {
+		api.WriteError(w, api.Unauthorized("the sector token was replaced concurrently"))
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// currentSectorToken returns the stored token hash of a sector if the request
+// may replace it, otherwise it writes the error.
+func (s *System) currentSectorToken(conn store.Session, w http.ResponseWriter, r *http.Request, hiveID bson.ObjectId, sectorID bson.ObjectId) (string, bool) {
+	var hs Sector
+	err := conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"_id":     sectorID,
+		"hive_id": hiveID,
+	}).Select(bson.M{
+		"token": 1,
+	}).One(&hs)
+	if err != nil {
+		api.WriteError(w, err)
+		return "", false
+	}
+	if !rotationAllowed(hs.Token, r) {
+		api.WriteError(w, api.Unauthorized("the current sector token is required"))
+		return "", false
+	}
+	return hs.Token, true
+}
+
+// SectorHandshake negotiates the protocol of a connecting sector and records
+// the result on the sector.
+func (s *System) SectorHandshake(hiveHex string, sectorHex string, hello protocol.Hello) (protocol.Welcome, error) {
+	welcome, err := protocol.Negotiate(hello, SectorEventTypes)
+	if err != nil {
+		return welcome, err
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err = conn.DB(s.database).C(CollectionSector).Update(
+		bson.M{
+			"_id":     bson.ObjectIdHex(sectorHex),
+			"hive_id": bson.ObjectIdHex(hiveHex),
+		},
+		bson.M{
+			"$set": bson.M{
+				"protocol": SectorProtocol{
+					Version:       welcome.ProtocolVersion,
+					PluginVersion: hello.PluginVersion,
+					Events:        welcome.Events,
+					ConnectedAt:   time.Now(),
+				},
+			},
+		},
+	)
+	if err != nil {
+		return welcome, err
+	}
+
+	return welcome, nil
+}
+
 func (s *System) UpdateSectorState(hiveID bson.ObjectId, sectorID bson.ObjectId, state SectorState) error {
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	return conn.DB("torchhive").C(CollectionSector).Update(
+	err := conn.DB(s.database).C(CollectionSector).Update(
 		bson.M{
 			"_id":     sectorID,
 			"hive_id": hiveID,
@@ -110,12 +556,21 @@ func (s *System) UpdateSectorState(hiveID bson.ObjectId, sectorID bson.ObjectId,
 			},
 		},
 	)
+	if err != nil {
+		return err
+	}
+
+	s.publish(hiveID, sectorID, notification.ActivitySectorState, "", bson.M{
+		"state": state,
+	})
+	return nil
 }
+
 func (s *System) UpdateSectorPlayers(hiveID bson.ObjectId, sectorID bson.ObjectId, maxPlayers int, currentPlayers int) error {
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	return conn.DB("torchhive").C(CollectionSector).Update(
+	err := conn.DB(s.database).C(CollectionSector).Update(
 		bson.M{
 			"_id":     sectorID,
 			"hive_id": hiveID,
@@ -127,20 +582,108 @@ func (s *System) UpdateSectorPlayers(hiveID bson.ObjectId, sectorID bson.ObjectI
 			},
 		},
 	)
+	if err != nil {
+		return err
+	}
+
+	s.publish(hiveID, sectorID, notification.ActivitySectorPlayers, "", bson.M{
+		"max_player":   maxPlayers,
+		"player_count": currentPlayers,
+	})
+	return nil
 }
 
 func (s *System) DeleteSector(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
+	opts, err := parseDeleteOptions(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	hiveID := bson.ObjectIdHex(vars["hive_id"])
+	sectorID := bson.ObjectIdHex(vars["sector_id"])
+
 	conn := s.db.Copy()
 	defer conn.Close()
 
-	err := conn.DB("torchhive").C(CollectionSector).Remove(bson.M{
-		"_id":     bson.ObjectIdHex(vars["sector_id"]),
-		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	count, err := conn.DB(s.database).C(CollectionSector).Find(bson.M{
+		"_id":     sectorID,
+		"hive_id": hiveID,
+	}).Count()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if count == 0 {
+		api.WriteError(w, api.NotFound("sector not found"))
+		return
+	}
+
+	report, removedFactions, err := s.planSectorDelete(conn, hiveID, sectorID)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	report.Sectors = 1
+	report.DryRun = opts.dryRun
+
+	if opts.mode == DeleteModeRestrict && report.hasFactionDependents() {
+		api.WriteError(w, api.Conflict("sector has dependents", report))
+		return
+	}
+
+	if opts.dryRun {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	_, err = conn.DB(s.database).C(CollectionFaction).UpdateAll(
+		bson.M{
+			"hive_id":           hiveID,
+			"sectors.sector_id": sectorID,
+		},
+		bson.M{
+			"$pull": bson.M{
+				"sectors": bson.M{
+					"sector_id": sectorID,
+				},
+			},
+		},
+	)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = s.removeFactions(conn, hiveID, removedFactions)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	for _, collection := range []string{CollectionSectorSpill, CollectionSectorEvent, CollectionDeadLetter} {
+		_, err = conn.DB(s.database).C(collection).RemoveAll(bson.M{
+			"hive_id":   hiveID,
+			"sector_id": sectorID,
+		})
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	}
+
+	err = conn.DB(s.database).C(CollectionSector).Remove(bson.M{
+		"_id":     sectorID,
+		"hive_id": hiveID,
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err)
 		return
 	}
+
+	s.disconnect(hiveID, sectorID)
+
+	writeJSON(w, http.StatusOK, report)
 }
@@ -2,17 +2,37 @@ package hive
 
 import (
 	"encoding/json"
-
+	"net/http"
+	"strconv"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/fankserver/torchapi-hive-system/src/store"
+	"github.com/fankserver/torchapi-hive-system/src/webhook"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/sirupsen/logrus"
 )
 
+// DefaultDatabase is the name of the database the system uses by default.
+const DefaultDatabase = "torchhive"
+
 type System struct {
-	db *mgo.Session
+	db store.Session
+
+	// Name of the database.
+	database string
+
+	disconnectHandler   func(hiveHex string, sectorHex string)
+	policyChangeHandler func(hiveHex string, policy string)
+	activityHandler     func(activity *notification.Activity)
+	redeliveryHandler   func(wh webhook.Webhook, delivery webhook.Delivery) (webhook.Delivery, error)
+	retryHandler        func(hiveHex string, sectorHex string, deadLetterID string, message []byte) bool
+	announcementHandler func(hiveHex string, sectorHex string, message string) (int, error)
 }
 
-func NewSystem(dbConnectionString string) (*System, error) {
+func NewSystem(dbConnectionString string, database string) (*System, error) {
 	dialInfo, err := mgo.ParseURL(dbConnectionString)
 	if err != nil {
 		return nil, err
@@ -25,14 +45,149 @@ func NewSystem(dbConnectionString string) (*System, error) {
 	}
 	logrus.Info("2")
 
-	return &System{
-		db: mongoSession,
-	}, nil
+	return NewSystemWithStore(store.Mongo(mongoSession), database)
 }
 
-type EventSectorChange struct {
-	Type string `json:"type"`
-	Raw  string `json:"raw"`
+// NewSystemWithStore creates the system on an open store, for example the
+// in-memory store of the tests.
+func NewSystemWithStore(session store.Session, database string) (*System, error) {
+	s := &System{
+		db:       session,
+		database: database,
+	}
+	if err := s.ensureIndexes(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *System) ensureIndexes() error {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	indexes := map[string][][]string{
+		CollectionSector: {
+			{"hive_id", "name"},
+		},
+		CollectionFaction: {
+			{"hive_id", "tag"},
+			{"hive_id", "members.steam_id"},
+			{"hive_id", "sectors.sector_id"},
+		},
+		CollectionSectorSpill: {
+			{"hive_id", "sector_id", "_id"},
+		},
+		CollectionSectorEvent: {
+			{"hive_id", "sector_id"},
+		},
+		CollectionDeadLetter: {
+			{"hive_id", "status"},
+			{"hive_id", "sector_id"},
+			{"status", "next_attempt_at"},
+		},
+		CollectionActivity: {
+			{"hive_id", "_id"},
+		},
+		CollectionWebhook: {
+			{"hive_id", "active"},
+		},
+		CollectionWebhookDelivery: {
+			{"webhook_id", "created_at"},
+			{"status", "next_attempt_at"},
+		},
+	}
+	for collection, keys := range indexes {
+		for _, key := range keys {
+			err := conn.DB(s.database).C(collection).EnsureIndexKey(key...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := conn.DB(s.database).C(CollectionActivity).EnsureIndex(mgo.Index{
+		Key:         []string{"time"},
+		ExpireAfter: activityRetention,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = conn.DB(s.database).C(CollectionSectorEvent).EnsureIndex(mgo.Index{
+		Key:         []string{"time"},
+		ExpireAfter: eventDedupWindow,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = conn.DB(s.database).C(CollectionDeadLetter).EnsureIndex(mgo.Index{
+		Key:         []string{"resolved_at"},
+		ExpireAfter: deadLetterRetention,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return api.BadRequest("malformed request body: " + err.Error())
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorln(err)
+	}
+}
+
+type EventSectorChange = protocol.Envelope
+
+// EventPartitionKey returns the faction an event belongs to, events of the
+// same faction must be processed in order. Relation events are keyed by the
+// faction sending them, so they follow its creation and membership changes;
+// the other faction is updated with conditional updates and a relation to a
+// faction that is not created yet is retried.
+func (s *System) EventPartitionKey(message []byte) string {
+	var event EventSectorChange
+	if err := json.Unmarshal(message, &event); err != nil {
+		return ""
+	}
+
+	factionID, ok := eventFactionID(event.Raw)
+	if !ok {
+		return ""
+	}
+	return strconv.FormatInt(factionID, 10)
+}
+
+// eventFactionID returns the entity id of the faction that caused an event.
+func eventFactionID(raw string) (int64, bool) {
+	var key struct {
+		FactionID     *int64 `json:"FactionId"`
+		FromFactionID *int64 `json:"FromFactionId"`
+	}
+	if err := json.Unmarshal([]byte(raw), &key); err != nil {
+		return 0, false
+	}
+
+	switch {
+	case key.FactionID != nil:
+		return *key.FactionID, true
+	case key.FromFactionID != nil:
+		return *key.FromFactionID, true
+	}
+	return 0, false
 }
 
 func (s *System) ProcessSectorEvent(hiveHex string, sectorHex string, message []byte) (broadcast bool, sectorEvents map[string][]byte, err error) {
@@ -47,7 +202,20 @@ func (s *System) ProcessSectorEvent(hiveHex string, sectorHex string, message []
 	logrus.Info(event.Type)
 	logrus.Info(event.Raw)
 
+	err = validateSectorEvent(event.Type, event.Raw)
+	if err != nil {
+		return
+	}
+
+	raw := event.Raw
+	defer func() {
+		if err == nil {
+			s.publishFactionChange(hiveID, sectorID, event.Type, raw)
+		}
+	}()
+
 	promote := false
+	sectorEvents = make(map[string][]byte)
 
 	switch event.Type {
 	case EventTypeServerStateChange:
@@ -99,8 +267,6 @@ func (s *System) ProcessSectorEvent(hiveHex string, sectorHex string, message []
 			return
 		}
 
-		sectorEvents = make(map[string][]byte)
-
 		var faction *Faction
 		faction, err = s.GetFaction(hiveID, sectorID, factionEdited.FactionID)
 		if err != nil {
@@ -137,8 +303,6 @@ func (s *System) ProcessSectorEvent(hiveHex string, sectorHex string, message []
 			return
 		}
 
-		sectorEvents = make(map[string][]byte)
-
 		var faction *Faction
 		faction, err = s.GetFaction(hiveID, sectorID, factionAutoAcceptChange.FactionID)
 		if err != nil {
@@ -498,6 +662,7 @@ func (s *System) ProcessSectorEvent(hiveHex string, sectorHex string, message []
 		}
 	default:
 		logrus.Warnln("received unknown event type", event.Type)
+		err = api.BadRequest("unknown event type " + event.Type)
 	}
 
 	return
@@ -0,0 +1,33 @@
+package hive
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+)
+
+func TestEventPartitionKey(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{`{"FactionId":7,"PlayerId":3}`, "7"},
+		{`{"FactionId":7,"Tag":"ABC"}`, "7"},
+		{`{"FromFactionId":7,"ToFactionId":9}`, "7"},
+		{`{"FromFactionId":9,"ToFactionId":7}`, "9"},
+		{`{"FromFactionId":9}`, "9"},
+		{`{"PlayerId":3}`, ""},
+	}
+
+	s := &System{}
+	for _, tt := range tests {
+		message, err := protocol.Message("FactionDeclareWar", json.RawMessage(tt.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.EventPartitionKey(message); got != tt.want {
+			t.Errorf("%s: expected key %q, got %q", tt.raw, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package hive
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/webhook"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+const (
+	CollectionWebhook         = "webhook"
+	CollectionWebhookDelivery = "webhook_delivery"
+)
+
+type webhookPatch struct {
+	URL      *string   `json:"url"`
+	Secret   *string   `json:"secret"`
+	Types    *[]string `json:"types"`
+	Template *string   `json:"template"`
+	Active   *bool     `json:"active"`
+}
+
+func (p webhookPatch) apply(wh *webhook.Webhook, replace bool) error {
+	if replace && p.URL == nil {
+		return api.Validation("url", "is required")
+	}
+
+	if p.URL != nil {
+		wh.URL = strings.TrimSpace(*p.URL)
+	}
+	if p.Secret != nil {
+		wh.Secret = *p.Secret
+	}
+	if p.Types != nil {
+		wh.Types = *p.Types
+	} else if replace {
+		wh.Types = nil
+	}
+	if p.Template != nil {
+		wh.Template = *p.Template
+	} else if replace {
+		wh.Template = ""
+	}
+	if p.Active != nil {
+		wh.Active = *p.Active
+	} else if replace {
+		wh.Active = true
+	}
+
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return api.Validation("url", "must be an absolute http or https url")
+	}
+
+	if wh.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		wh.Secret = hex.EncodeToString(buf)
+	}
+	if len(wh.Secret) < 16 {
+		return api.Validation("secret", "must be at least 16 characters")
+	}
+
+	for _, v := range wh.Types {
+		if v == "" {
+			return api.Validation("types", "must not contain empty types")
+		}
+	}
+	if wh.Types == nil {
+		wh.Types = []string{}
+	}
+
+	if _, err := webhook.ParseTemplate(wh.Template); err != nil {
+		return api.Validation("template", err.Error())
+	}
+
+	return nil
+}
+
+var (
+	webhookSortFields = listFields{
+		"url": "url",
+	}
+	webhookProjectFields = listFields{
+		"url":      "url",
+		"types":    "types",
+		"template": "template",
+		"active":   "active",
+	}
+	deliverySortFields = listFields{
+		"created_at": "created_at",
+		"status":     "status",
+	}
+	deliveryProjectFields = listFields{
+		"webhook_id":      "webhook_id",
+		"activity_id":     "activity_id",
+		"event":           "event",
+		"payload":         "payload",
+		"status":          "status",
+		"attempts":        "attempts",
+		"response_status": "response_status",
+		"error":           "error",
+		"redelivery_of":   "redelivery_of",
+		"created_at":      "created_at",
+		"updated_at":      "updated_at",
+		"next_attempt_at": "next_attempt_at",
+	}
+)
+
+// RegisterRedeliveryHandler sets the function that sends a logged delivery
+// again.
+func (s *System) RegisterRedeliveryHandler(redeliveryHandler func(wh webhook.Webhook, delivery webhook.Delivery) (webhook.Delivery, error)) {
+	s.redeliveryHandler = redeliveryHandler
+}
+
+// ActiveWebhooks returns the active webhooks of a hive.
+func (s *System) ActiveWebhooks(hiveHex string) ([]webhook.Webhook, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var webhooks []webhook.Webhook
+	err := conn.DB(s.database).C(CollectionWebhook).Find(bson.M{
+		"hive_id": bson.ObjectIdHex(hiveHex),
+		"active":  true,
+	}).All(&webhooks)
+	if err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// SaveDelivery writes a delivery to the delivery log.
+func (s *System) SaveDelivery(delivery *webhook.Delivery) error {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	_, err := conn.DB(s.database).C(CollectionWebhookDelivery).UpsertId(delivery.ID, delivery)
+	return err
+}
+
+// DueDeliveries returns the pending and retrying deliveries whose next
+// attempt is due.
+func (s *System) DueDeliveries(now time.Time, limit int) ([]webhook.Delivery, error) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var deliveries []webhook.Delivery
+	err := conn.DB(s.database).C(CollectionWebhookDelivery).Find(bson.M{
+		"status":          bson.M{"$in": []string{webhook.StatusPending, webhook.StatusRetrying}},
+		"next_attempt_at": bson.M{"$lte": now},
+	}).Sort("next_attempt_at").Limit(limit).All(&deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (s *System) findWebhook(w http.ResponseWriter, r *http.Request) (*webhook.Webhook, bool) {
+	vars := mux.Vars(r)
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var wh webhook.Webhook
+	err := conn.DB(s.database).C(CollectionWebhook).Find(bson.M{
+		"_id":     bson.ObjectIdHex(vars["webhook_id"]),
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}).One(&wh)
+	if err != nil {
+		api.WriteError(w, err)
+		return nil, false
+	}
+
+	return &wh, true
+}
+
+func (s *System) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	opts, err := parseListOptions(r, webhookSortFields, webhookProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	filter := bson.M{
+		"hive_id": bson.ObjectIdHex(vars["hive_id"]),
+	}
+	if v := r.URL.Query().Get("type"); v != "" {
+		filter["types"] = v
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	docs, total, next, err := opts.find(conn.DB(s.database).C(CollectionWebhook), filter, webhookProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	webhooks := make([]webhook.Webhook, len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(&webhooks[i]); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		webhooks[i].Secret = ""
+	}
+
+	opts.writeList(w, webhooks, total, next)
+}
+
+func (s *System) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var patch webhookPatch
+	if err := decodeBody(r, &patch); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	wh := webhook.Webhook{
+		ID:     bson.NewObjectId(),
+		HiveID: bson.ObjectIdHex(vars["hive_id"]),
+	}
+	if err := patch.apply(&wh, true); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionHive).FindId(wh.HiveID).One(nil)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = conn.DB(s.database).C(CollectionWebhook).Insert(wh)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	// the secret is only returned once
+	writeJSON(w, http.StatusCreated, wh)
+}
+
+func (s *System) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	wh, ok := s.findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	wh.Secret = ""
+	writeJSON(w, http.StatusOK, wh)
+}
+
+func (s *System) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	s.updateWebhook(w, r, true)
+}
+
+func (s *System) PatchWebhook(w http.ResponseWriter, r *http.Request) {
+	s.updateWebhook(w, r, false)
+}
+
+func (s *System) updateWebhook(w http.ResponseWriter, r *http.Request, replace bool) {
+	var patch webhookPatch
+	if err := decodeBody(r, &patch); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	wh, ok := s.findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if err := patch.apply(wh, replace); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	err := conn.DB(s.database).C(CollectionWebhook).UpdateId(wh.ID, bson.M{
+		"$set": bson.M{
+			"url":      wh.URL,
+			"secret":   wh.Secret,
+			"types":    wh.Types,
+			"template": wh.Template,
+			"active":   wh.Active,
+		},
+	})
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	wh.Secret = ""
+	writeJSON(w, http.StatusOK, wh)
+}
+
+func (s *System) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	wh, ok := s.findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	_, err := conn.DB(s.database).C(CollectionWebhookDelivery).RemoveAll(bson.M{
+		"webhook_id": wh.ID,
+	})
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	err = conn.DB(s.database).C(CollectionWebhook).RemoveId(wh.ID)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *System) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r, deliverySortFields, deliveryProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	wh, ok := s.findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := bson.M{
+		"webhook_id": wh.ID,
+	}
+	if v := query.Get("status"); v != "" {
+		switch v {
+		case webhook.StatusPending, webhook.StatusRetrying, webhook.StatusDelivered, webhook.StatusFailed:
+			filter["status"] = v
+		default:
+			api.WriteError(w, api.Validation("status", "unknown delivery status "+v))
+			return
+		}
+	}
+	if v := query.Get("event"); v != "" {
+		filter["event"] = v
+	}
+
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	docs, total, next, err := opts.find(conn.DB(s.database).C(CollectionWebhookDelivery), filter, deliveryProjectFields)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	deliveries := make([]webhook.Delivery, len(docs))
+	for i, doc := range docs {
+		if err := doc.Unmarshal(&deliveries[i]); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	}
+
+	opts.writeList(w, deliveries, total, next)
+}
+
+func (s *System) findDelivery(w http.ResponseWriter, r *http.Request, wh *webhook.Webhook) (*webhook.Delivery, bool) {
+	conn := s.db.Copy()
+	defer conn.Close()
+
+	var delivery webhook.Delivery
+	err := conn.DB(s.database).C(CollectionWebhookDelivery).Find(bson.M{
+		"_id":        bson.ObjectIdHex(mux.Vars(r)["delivery_id"]),
+		"webhook_id": wh.ID,
+	}).One(&delivery)
+	if err != nil {
+		api.WriteError(w, err)
+		return nil, false
+	}
+
+	return &delivery, true
+}
+
+func (s *System) GetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	wh, ok := s.findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	delivery, ok := s.findDelivery(w, r, wh)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+func (s *System) RedeliverWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	wh, ok := s.findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	delivery, ok := s.findDelivery(w, r, wh)
+	if !ok {
+		return
+	}
+
+	if s.redeliveryHandler == nil {
+		api.WriteError(w, api.Conflict("webhooks are not dispatched", nil))
+		return
+	}
+
+	redelivery, err := s.redeliveryHandler(*wh, *delivery)
+	if err == webhook.ErrInProgress {
+		api.WriteError(w, api.Conflict(err.Error(), nil))
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, redelivery)
+}
@@ -0,0 +1,65 @@
+package notification
+
+import (
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+)
+
+type announcement struct {
+	hiveHex   string
+	sectorHex string
+	text      string
+	message   []byte
+
+	// Receives the number of sectors the announcement was sent to.
+	sent chan int
+}
+
+// Announce sends an announcement to the connected sectors of a hive, or only
+// to sectorHex if it is not empty, and returns the number of sectors it was
+// sent to. Sectors of protocol version 1 do not receive announcements.
+func (h *Hub) Announce(hiveHex string, sectorHex string, text string) (int, error) {
+	message, err := protocol.Message(protocol.TypeAnnouncement, protocol.Announcement{
+		Message: text,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	a := &announcement{
+		hiveHex:   hiveHex,
+		sectorHex: sectorHex,
+		text:      text,
+		message:   message,
+		sent:      make(chan int, 1),
+	}
+	h.announcements <- a
+	return <-a.sent, nil
+}
+
+func (h *Hub) announce(a *announcement) {
+	sent := 0
+	for client := range h.clients {
+		if client.hiveID != a.hiveHex || (a.sectorHex != "" && client.sectorID != a.sectorHex) {
+			continue
+		}
+		if !client.welcome.Acknowledges() {
+			continue
+		}
+
+		h.sendClient(client, a.message)
+		sent++
+	}
+
+	h.publishActivity(&Activity{
+		Type:     ActivityAnnouncement,
+		HiveID:   a.hiveHex,
+		SectorID: a.sectorHex,
+		Time:     time.Now(),
+		Data: protocol.Announcement{
+			Message: a.text,
+		},
+	})
+	a.sent <- sent
+}
@@ -0,0 +1,29 @@
+package notification
+
+import (
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/capture"
+)
+
+// RegisterRecorder sets a function called with the connections of the
+// sectors and every message received from or sent to them, see package
+// capture. The recorder must not block.
+func (h *Hub) RegisterRecorder(recorder func(record capture.Record)) {
+	h.recorder = recorder
+}
+
+// record passes a message of a sector to the recorder.
+func (h *Hub) record(kind string, hiveHex string, sectorHex string, message []byte) {
+	if h.recorder == nil {
+		return
+	}
+
+	h.recorder(capture.Record{
+		Time:     time.Now(),
+		Kind:     kind,
+		HiveID:   hiveHex,
+		SectorID: sectorHex,
+		Message:  string(message),
+	})
+}
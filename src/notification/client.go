@@ -2,39 +2,26 @@ package notification
 
 import (
 	"bytes"
+	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/capture"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-)
-
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	hub *Hub
@@ -42,11 +29,36 @@ type Client struct {
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Queue of outbound messages.
+	outbox *outbox
+
+	// Backpressure policy applied when the outbox is full.
+	policy atomic.Value
+
+	// Messages waiting to be persisted in the spill store.
+	spills    chan []byte
+	spillOnce sync.Once
+
+	// Closed when the write pump stopped.
+	done chan struct{}
+
+	// Result of the registration at the hub.
+	accepted chan bool
 
 	hiveID   string
 	sectorID string
+
+	// Protocol negotiated during the handshake.
+	welcome protocol.Welcome
+
+	// Websocket settings when the connection was opened.
+	settings Settings
+}
+
+// readResult is a message read from the websocket connection.
+type readResult struct {
+	message []byte
+	err     error
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -55,15 +67,50 @@ type Client struct {
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
 func (c *Client) readPump() {
+	registered := false
 	defer func() {
-		c.hub.unregister <- c
+		if registered {
+			c.hub.record(capture.KindDisconnect, c.hiveID, c.sectorID, nil)
+			c.hub.unregister <- c
+		} else {
+			c.outbox.close(0, "")
+		}
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	for {
+	c.conn.SetReadLimit(c.settings.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.settings.PongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.settings.PongWait)); return nil })
+
+	// the first message is read in the background while waiting for the
+	// hello, a sector that is silent for HelloWait is a legacy sector and
+	// registered right away to receive the events of the hive
+	first := make(chan readResult, 1)
+	go func() {
 		_, message, err := c.conn.ReadMessage()
+		first <- readResult{message: message, err: err}
+	}()
+	helloTimer := time.NewTimer(c.settings.HelloWait)
+	select {
+	case result := <-first:
+		helloTimer.Stop()
+		first <- result
+	case <-helloTimer.C:
+		if _, ok := c.handshake(nil); !ok {
+			return
+		}
+		registered = true
+	}
+
+	for {
+		var message []byte
+		var err error
+		if first != nil {
+			result := <-first
+			first = nil
+			message, err = result.message, result.err
+		} else {
+			_, message, err = c.conn.ReadMessage()
+		}
 		if err != nil {
 			logrus.Errorln(err)
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
@@ -72,48 +119,314 @@ func (c *Client) readPump() {
 			break
 		}
 
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.send <- message
-		c.hub.event <- &event{
+		if !registered {
+			message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+			handled, ok := c.handshake(message)
+			if !ok {
+				break
+			}
+			registered = true
+			if handled {
+				continue
+			}
+		} else {
+			message, err = c.welcome.Codec().Decode(message)
+			if err != nil {
+				logrus.Errorln("malformed message from client", c.hiveID, c.sectorID, err)
+				c.close(protocol.CloseProtocolError, "malformed message")
+				break
+			}
+			message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+
+			if isHello(message) {
+				logrus.Errorln("late hello from client", c.hiveID, c.sectorID)
+				c.close(protocol.CloseProtocolError, "hello after the legacy protocol was assumed")
+				break
+			}
+		}
+
+		id, err := eventID(message)
+		if err != nil {
+			logrus.Errorln("invalid event from client", c.hiveID, c.sectorID, err)
+			c.close(protocol.CloseProtocolError, err.Error())
+			break
+		}
+
+		// events are refused while the hub shuts down
+		if c.hub.isDraining() {
+			metrics.Add("events_refused", 1)
+			if !c.refuse(id) {
+				break
+			}
+			continue
+		}
+
+		// legacy sectors expect their events echoed, newer ones receive an
+		// ack once the event was processed
+		c.hub.record(capture.KindReceive, c.hiveID, c.sectorID, message)
+		if !c.welcome.Acknowledges() {
+			c.hub.record(capture.KindSend, c.hiveID, c.sectorID, message)
+			c.outbox.push(outboxItem{message: message}, c.backpressurePolicy())
+		}
+		dispatched := c.hub.dispatch(&event{
 			hiveHex:   c.hiveID,
 			sectorHex: c.sectorID,
+			id:        id,
 			message:   message,
+		})
+		if !dispatched && !c.refuse(id) {
+			break
 		}
 	}
 }
 
+// refuse answers an event the hub refused while shutting down. Newer sectors
+// receive a refused ack with the code unavailable and resend the event after
+// reconnecting, legacy sectors expect no answer and are closed with the
+// restart code. It reports whether the connection stays open.
+func (c *Client) refuse(id string) bool {
+	if !c.welcome.Acknowledges() {
+		c.close(websocket.CloseServiceRestart, "hive restarting")
+		return false
+	}
+
+	apiErr := api.Unavailable("hive restarting")
+	message, err := protocol.Message(protocol.TypeAck, protocol.Ack{
+		EventID: id,
+		Refused: true,
+		Code:    apiErr.Code,
+		Message: apiErr.Message,
+	})
+	if err != nil {
+		logrus.Errorln(err)
+		return true
+	}
+	c.hub.record(capture.KindSend, c.hiveID, c.sectorID, message)
+	c.outbox.push(outboxItem{message: message, ack: true}, c.backpressurePolicy())
+	return true
+}
+
+// handshake negotiates the protocol with the first message of the sector and
+// registers the client at the hub. It reports whether the message was the
+// hello. Sectors that start with another message, or send nothing within
+// HelloWait and pass a nil message, are registered as legacy sectors; their
+// first message is left to the caller.
+func (c *Client) handshake(message []byte) (handled bool, ok bool) {
+	hello := protocol.LegacyHello()
+
+	var envelope protocol.Envelope
+	isHello := json.Unmarshal(message, &envelope) == nil && envelope.Type == protocol.TypeHello
+	if isHello {
+		if err := json.Unmarshal([]byte(envelope.Raw), &hello); err != nil {
+			c.close(protocol.CloseProtocolError, "malformed hello")
+			return false, false
+		}
+	}
+
+	welcome, err := c.hub.handshakeHandler(c.hiveID, c.sectorID, hello)
+	if err != nil {
+		if _, ok := err.(*protocol.VersionError); ok {
+			c.close(protocol.CloseIncompatibleVersion, err.Error())
+		} else {
+			logrus.Errorln(err)
+			c.close(websocket.CloseInternalServerErr, "handshake failed")
+		}
+		return false, false
+	}
+	c.welcome = welcome
+
+	var welcomeMessage []byte
+	if isHello {
+		welcomeMessage, err = protocol.Message(protocol.TypeWelcome, welcome)
+		if err != nil {
+			logrus.Errorln(err)
+			return false, false
+		}
+		c.outbox.push(outboxItem{message: welcomeMessage}, PolicyDisconnect)
+	}
+
+	policy := PolicyDisconnect
+	if c.hub.policyHandler != nil {
+		policy, err = c.hub.policyHandler(c.hiveID)
+		if err != nil {
+			logrus.Errorln(err)
+			policy = PolicyDisconnect
+		}
+	}
+	c.policy.Store(policy)
+
+	if c.hub.spillStore != nil {
+		spilled, err := c.hub.spillStore.CountSpilledSectorMessages(c.hiveID, c.sectorID)
+		if err != nil {
+			logrus.Errorln(err)
+		}
+		c.outbox.setSpilled(spilled)
+	}
+
+	c.hub.register <- c
+	if !<-c.accepted {
+		if c.hub.isDraining() {
+			c.close(websocket.CloseServiceRestart, "hive restarting")
+		} else {
+			c.close(protocol.CloseSectorConnected, "sector is already connected")
+		}
+		return false, false
+	}
+
+	var helloMessage []byte
+	if isHello {
+		helloMessage = message
+	}
+	c.hub.record(capture.KindConnect, c.hiveID, c.sectorID, helloMessage)
+	if welcomeMessage != nil {
+		c.hub.record(capture.KindSend, c.hiveID, c.sectorID, welcomeMessage)
+	}
+
+	return isHello, true
+}
+
+// isHello reports whether message is a hello envelope.
+func isHello(message []byte) bool {
+	var envelope protocol.Envelope
+	return json.Unmarshal(message, &envelope) == nil && envelope.Type == protocol.TypeHello
+}
+
+// close sends a close frame to the sector.
+func (c *Client) close(code int, reason string) {
+	err := c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(c.settings.WriteWait))
+	if err != nil {
+		logrus.Errorln(err)
+	}
+}
+
+func (c *Client) backpressurePolicy() string {
+	policy, _ := c.policy.Load().(string)
+	if policy == "" {
+		return PolicyDisconnect
+	}
+	return policy
+}
+
+// spill hands a message to the spill loop, which persists the messages of the
+// client in order.
+func (c *Client) spill(message []byte) {
+	c.spillOnce.Do(func() {
+		go c.spillLoop()
+	})
+
+	select {
+	case c.spills <- message:
+	default:
+		metrics.Add("spill_lost", 1)
+		logrus.Errorln("spill queue full, message lost for client", c.hiveID, c.sectorID)
+		c.outbox.spillDone()
+	}
+}
+
+func (c *Client) spillLoop() {
+	for {
+		select {
+		case message := <-c.spills:
+			err := c.hub.spillStore.SpillSectorMessage(c.hiveID, c.sectorID, message)
+			if err != nil {
+				metrics.Add("spill_lost", 1)
+				logrus.Errorln(err)
+			}
+			c.outbox.spillDone()
+		case <-c.done:
+			// the connection is gone, persist the remaining messages so they
+			// are sent when the sector reconnects
+			for {
+				select {
+				case message := <-c.spills:
+					if err := c.hub.spillStore.SpillSectorMessage(c.hiveID, c.sectorID, message); err != nil {
+						metrics.Add("spill_lost", 1)
+						logrus.Errorln(err)
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// refill moves spilled messages back into the outbox once it is drained.
+func (c *Client) refill() {
+	if c.hub.spillStore == nil || !c.outbox.needsRefill() {
+		return
+	}
+
+	messages, err := c.hub.spillStore.UnspillSectorMessages(c.hiveID, c.sectorID, outboxSize)
+	if err != nil {
+		logrus.Errorln(err)
+		return
+	}
+	c.outbox.refill(messages, len(messages) < outboxSize)
+}
+
+// write sends a message converted to the protocol and encoding of the client.
+func (c *Client) write(message []byte) error {
+	frame, ok := c.welcome.Convert(message)
+	if !ok {
+		logrus.Infoln("skip unsupported message for client", c.hiveID, c.sectorID)
+		return nil
+	}
+
+	messageType := websocket.TextMessage
+	if c.welcome.Codec().Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.settings.WriteWait))
+	w, err := c.conn.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	w.Write(frame)
+
+	return w.Close()
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.settings.PingPeriod)
 	defer func() {
 		ticker.Stop()
+		close(c.done)
 		c.conn.Close()
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-c.outbox.notify:
+			for {
+				message, ok, closed := c.outbox.pop()
+				if closed {
+					// The hub closed the outbox.
+					c.conn.SetWriteDeadline(time.Now().Add(c.settings.WriteWait))
+					data := []byte{}
+					if code, reason := c.outbox.closeMessage(); code != 0 {
+						data = websocket.FormatCloseMessage(code, reason)
+					}
+					c.conn.WriteMessage(websocket.CloseMessage, data)
+					return
+				}
+				if !ok {
+					break
+				}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+				if err := c.write(message); err != nil {
+					return
+				}
 			}
-			w.Write(message)
 
-			if err := w.Close(); err != nil {
-				return
-			}
+			c.refill()
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.settings.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -123,20 +436,23 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, hiveID string, sectorID string) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	settings := hub.Settings()
+	conn, err := settings.upgrader().Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	client := &Client{
 		hub:      hub,
+		settings: settings,
 		hiveID:   hiveID,
 		sectorID: sectorID,
 		conn:     conn,
-		send:     make(chan []byte, 256),
+		outbox:   newOutbox(),
+		spills:   make(chan []byte, outboxSize),
+		done:     make(chan struct{}),
+		accepted: make(chan bool, 1),
 	}
-	client.hub.register <- client
-
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
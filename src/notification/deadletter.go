@@ -0,0 +1,80 @@
+package notification
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// DeadLetterStore keeps the events that failed.
+type DeadLetterStore interface {
+	// Transient reports whether an event that failed with err may succeed
+	// when it is retried.
+	Transient(err error) bool
+	// SaveDeadLetter stores a failed event and reports whether it is retried
+	// automatically.
+	SaveDeadLetter(hiveHex string, sectorHex string, message []byte, cause error) (bool, error)
+	// ResolveDeadLetter records the result of a retried dead letter, cause is
+	// nil if it succeeded. It reports whether the dead letter is retried
+	// again.
+	ResolveDeadLetter(deadLetterID string, cause error) (bool, error)
+}
+
+// RegisterDeadLetterStore sets the store of the failed events. Without a
+// store failed events are only logged.
+func (h *Hub) RegisterDeadLetterStore(deadLetterStore DeadLetterStore) {
+	h.deadLetterStore = deadLetterStore
+}
+
+// RetryDeadLetter queues the event of a dead letter for processing. It
+// reports false if the hub is shutting down.
+func (h *Hub) RetryDeadLetter(hiveHex string, sectorHex string, deadLetterID string, message []byte) bool {
+	id, _ := eventID(message)
+	return h.dispatch(&event{
+		hiveHex:      hiveHex,
+		sectorHex:    sectorHex,
+		id:           id,
+		message:      message,
+		deadLetterID: deadLetterID,
+	})
+}
+
+func (h *Hub) transient(err error) bool {
+	return h.deadLetterStore != nil && h.deadLetterStore.Transient(err)
+}
+
+// deadLetter stores a failed event or records the result of a retried dead
+// letter.
+func (h *Hub) deadLetter(result *eventResult) {
+	if h.deadLetterStore == nil {
+		return
+	}
+
+	e := result.event
+	var err error
+	switch {
+	case e.deadLetterID != "":
+		result.queued, err = h.deadLetterStore.ResolveDeadLetter(e.deadLetterID, result.err)
+	case result.err != nil:
+		metrics.Add("events_dead_lettered", 1)
+		result.queued, err = h.deadLetterStore.SaveDeadLetter(e.hiveHex, e.sectorHex, e.message, result.err)
+		if err != nil {
+			// keep the dead letter until the store takes it
+			logrus.Warnln("spool dead letter:", err)
+			transient := h.transient(result.err)
+			err = h.spool.add(spooledDeadLetter{
+				HiveHex:   e.hiveHex,
+				SectorHex: e.sectorHex,
+				Message:   string(e.message),
+				Cause:     result.err.Error(),
+				Transient: transient,
+			})
+			result.queued = err == nil && transient
+		}
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"hive":    e.hiveHex,
+			"sector":  e.sectorHex,
+			"message": string(e.message),
+		}).Errorln("dead letter lost:", err)
+	}
+}
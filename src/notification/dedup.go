@@ -0,0 +1,97 @@
+package notification
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrEventInFlight is returned by ClaimEvent for an event id that is being
+// processed.
+var ErrEventInFlight = errors.New("event is being processed")
+
+const (
+	// A duplicate of an event in process is attempted again every
+	// inFlightPoll for up to inFlightWait, without holding up the other
+	// events of its worker. It is refused if the event is still in process.
+	inFlightWait = 5 * time.Second
+	inFlightPoll = 100 * time.Millisecond
+)
+
+// DedupStore remembers the event ids a sector sent within the deduplication
+// window.
+type DedupStore interface {
+	// ClaimEvent records the event id of a sector as pending and reports
+	// false if it was recorded before. It returns ErrEventInFlight while the
+	// recorded event is pending.
+	ClaimEvent(hiveHex string, sectorHex string, eventID string) (bool, error)
+	// CompleteEvent records that a claimed event was applied.
+	CompleteEvent(hiveHex string, sectorHex string, eventID string) error
+	// ReleaseEvent forgets an event id whose processing failed, so the
+	// sector may send it again.
+	ReleaseEvent(hiveHex string, sectorHex string, eventID string) error
+}
+
+// RegisterDedupStore sets the store of the processed event ids. Without a
+// store every event is processed.
+func (h *Hub) RegisterDedupStore(dedupStore DedupStore) {
+	h.dedupStore = dedupStore
+}
+
+// eventID returns the id of the event in message.
+func eventID(message []byte) (string, error) {
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return "", nil
+	}
+
+	if len(envelope.ID) > protocol.MaxEventIDLength {
+		return "", fmt.Errorf("event id is longer than %d characters", protocol.MaxEventIDLength)
+	}
+	return envelope.ID, nil
+}
+
+// claim reports whether e has to be processed. Events without an id are
+// always processed. It returns ErrEventInFlight for a duplicate of an event in
+// process.
+func (h *Hub) claim(e *event) (bool, error) {
+	if h.dedupStore == nil || e.id == "" {
+		return true, nil
+	}
+
+	fresh, err := h.dedupStore.ClaimEvent(e.hiveHex, e.sectorHex, e.id)
+	if err != nil {
+		return false, err
+	}
+	if !fresh {
+		metrics.Add("events_duplicate", 1)
+		logrus.Infoln("skip duplicate event", e.hiveHex, e.sectorHex, e.id)
+	}
+	return fresh, nil
+}
+
+// complete records that the claimed event e was applied.
+func (h *Hub) complete(e *event) {
+	if h.dedupStore == nil || e.id == "" {
+		return
+	}
+
+	if err := h.dedupStore.CompleteEvent(e.hiveHex, e.sectorHex, e.id); err != nil {
+		logrus.Errorln(err)
+	}
+}
+
+// release forgets the id of an event that failed.
+func (h *Hub) release(e *event) {
+	if h.dedupStore == nil || e.id == "" {
+		return
+	}
+
+	if err := h.dedupStore.ReleaseEvent(e.hiveHex, e.sectorHex, e.id); err != nil {
+		logrus.Errorln(err)
+	}
+}
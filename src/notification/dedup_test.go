@@ -0,0 +1,75 @@
+package notification
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// inFlightStore reports the event in flight for the first claims, then as
+// processed before.
+type inFlightStore struct {
+	mu       sync.Mutex
+	inFlight int
+}
+
+func (s *inFlightStore) ClaimEvent(hiveHex string, sectorHex string, eventID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inFlight > 0 {
+		s.inFlight--
+		return false, ErrEventInFlight
+	}
+	return false, nil
+}
+
+func (s *inFlightStore) CompleteEvent(hiveHex string, sectorHex string, eventID string) error {
+	return nil
+}
+
+func (s *inFlightStore) ReleaseEvent(hiveHex string, sectorHex string, eventID string) error {
+	return nil
+}
+
+func TestInFlightDuplicateWaitsForResult(t *testing.T) {
+	_, url := testHub(t, ConnectionTakeover, func(hub *Hub) {
+		hub.RegisterDedupStore(&inFlightStore{inFlight: 2})
+		hub.RegisterEventHandler(func(hiveHex string, sectorHex string, message []byte) (bool, map[string][]byte, error) {
+			t.Error("duplicate event was processed")
+			return false, nil, nil
+		})
+	})
+
+	conn := connectSector(t, url)
+	readWelcome(t, conn)
+
+	message, err := json.Marshal(protocol.Envelope{ID: "event-1", Type: "ServerStateChange", Raw: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	var ack protocol.Ack
+	if err := json.Unmarshal([]byte(envelope.Raw), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if !ack.Success || !ack.Duplicate || ack.Refused {
+		t.Errorf("got %+v, want a duplicate ack", ack)
+	}
+}
@@ -0,0 +1,113 @@
+package notification
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// readFrame reads the next message of a msgpack connection.
+func readFrame(t *testing.T, conn *websocket.Conn) protocol.Envelope {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Fatalf("got message type %d, want binary", messageType)
+	}
+	message, err := protocol.CodecFor(protocol.EncodingMsgpack).Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+func TestMsgpackWithCompression(t *testing.T) {
+	received := make(chan string, 1)
+	_, url := testHub(t, ConnectionTakeover, func(hub *Hub) {
+		hub.RegisterEventHandler(func(hiveHex string, sectorHex string, message []byte) (bool, map[string][]byte, error) {
+			received <- string(message)
+			return false, nil, nil
+		})
+	})
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if extensions := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(extensions, "permessage-deflate") {
+		t.Errorf("got extensions %q, want permessage-deflate", extensions)
+	}
+
+	// the hello is JSON, everything after it msgpack
+	hello, err := protocol.Message(protocol.TypeHello, protocol.Hello{
+		ProtocolVersion: protocol.Version,
+		Encodings:       []string{protocol.EncodingMsgpack},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, hello); err != nil {
+		t.Fatal(err)
+	}
+	envelope := readFrame(t, conn)
+	var welcome protocol.Welcome
+	if err := json.Unmarshal([]byte(envelope.Raw), &welcome); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Type != protocol.TypeWelcome || welcome.Encoding != protocol.EncodingMsgpack {
+		t.Fatalf("got %s %+v, want a msgpack welcome", envelope.Type, welcome)
+	}
+
+	message, err := json.Marshal(protocol.Envelope{
+		ID:   "event-1",
+		Type: "ServerStateChange",
+		Raw:  `{"State":"Loaded","Tick":76561198000000001}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := protocol.CodecFor(protocol.EncodingMsgpack).Encode(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hive processes the canonical JSON envelope
+	select {
+	case processed := <-received:
+		var got protocol.Envelope
+		if err := json.Unmarshal([]byte(processed), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != "event-1" || got.Raw != `{"State":"Loaded","Tick":76561198000000001}` {
+			t.Errorf("processed %s", processed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not processed")
+	}
+
+	envelope = readFrame(t, conn)
+	var ack protocol.Ack
+	if err := json.Unmarshal([]byte(envelope.Raw), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Type != protocol.TypeAck || ack.EventID != "event-1" || !ack.Success {
+		t.Errorf("got %s %+v, want a successful ack", envelope.Type, ack)
+	}
+}
@@ -0,0 +1,282 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Send a comment to event stream clients with this period to keep proxies
+	// from closing idle connections.
+	heartbeatPeriod = 15 * time.Second
+
+	// Maximum number of logged activities replayed on resumption. A longer
+	// replay ends the stream with a replay_truncated event, the client
+	// resumes from the last replayed activity.
+	maxReplay = 1000
+
+	// Event name that tells an event stream client the replay was truncated.
+	eventReplayTruncated = "replay_truncated"
+
+	// Delay before writing an activity to the activity log again after a
+	// transient error, it doubles up to activityLogMaxBackoff.
+	activityLogBackoff    = 500 * time.Millisecond
+	activityLogMaxBackoff = 30 * time.Second
+
+	// Reconnection delay suggested to event stream clients in milliseconds.
+	retryDelay = 3000
+)
+
+// ActivityLog persists activities for resuming event streams.
+type ActivityLog interface {
+	LogActivity(activity *Activity) error
+	// ActivitiesSince returns the activities of a hive logged after the
+	// activity with id lastID, oldest first.
+	ActivitiesSince(hiveHex string, lastID string, types []string, sectors []string, limit int) ([]*Activity, error)
+}
+
+// subscription receives the activities matching its filter.
+type subscription struct {
+	filter activityFilter
+	send   chan *Activity
+}
+
+// RegisterActivityLog sets the log that persists the published activities.
+func (h *Hub) RegisterActivityLog(activityLog ActivityLog) {
+	h.activityLog = activityLog
+}
+
+// RegisterActivityListener adds a function called with every published
+// activity after it was logged. Listeners must not block.
+func (h *Hub) RegisterActivityListener(listener func(activity *Activity)) {
+	h.activityListeners = append(h.activityListeners, listener)
+}
+
+// logActivity queues activity for the activity log and the listeners. The
+// queue is unbounded, so the hub never waits for the log and no activity is
+// lost while the database is slow.
+func (h *Hub) logActivity(activity *Activity) {
+	if h.activityLog == nil && len(h.activityListeners) == 0 {
+		return
+	}
+
+	h.logMu.Lock()
+	h.logQueue = append(h.logQueue, activity)
+	h.logMu.Unlock()
+	metrics.Add("activity_log_pending", 1)
+
+	select {
+	case h.logReady <- struct{}{}:
+	default:
+	}
+}
+
+// writeActivityLog persists the queued activities in order and passes them
+// to the listeners once they are stored, so webhooks and resumed event
+// streams see the same activities.
+func (h *Hub) writeActivityLog() {
+	for range h.logReady {
+		for {
+			h.logMu.Lock()
+			queue := h.logQueue
+			h.logQueue = nil
+			h.logWriting = queue
+			h.logMu.Unlock()
+			if len(queue) == 0 {
+				break
+			}
+
+			for _, activity := range queue {
+				h.writeActivity(activity)
+				h.logMu.Lock()
+				h.logWriting = h.logWriting[1:]
+				h.logMu.Unlock()
+				metrics.Add("activity_log_pending", -1)
+			}
+		}
+	}
+}
+
+// writeActivity stores activity, retrying while the activity log fails with
+// a transient error, and passes it to the listeners.
+func (h *Hub) writeActivity(activity *Activity) {
+	if h.activityLog != nil {
+		delay := activityLogBackoff
+		for {
+			err := h.activityLog.LogActivity(activity)
+			if err == nil {
+				break
+			}
+			if !h.transient(err) {
+				metrics.Add("activity_log_failed", 1)
+				logrus.Errorln(err)
+				break
+			}
+
+			metrics.Add("activity_log_retried", 1)
+			logrus.Warnln("retry activity log after transient error", activity.HiveID, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > activityLogMaxBackoff {
+				delay = activityLogMaxBackoff
+			}
+		}
+	}
+
+	for _, listener := range h.activityListeners {
+		listener(activity)
+	}
+}
+
+// unloggedActivities returns the activities matching filter that are not
+// stored in the activity log yet, oldest first.
+func (h *Hub) unloggedActivities(filter activityFilter) []*Activity {
+	h.logMu.Lock()
+	defer h.logMu.Unlock()
+
+	var activities []*Activity
+	for _, queue := range [][]*Activity{h.logWriting, h.logQueue} {
+		for _, activity := range queue {
+			if filter.matches(activity) {
+				activities = append(activities, activity)
+			}
+		}
+	}
+	return activities
+}
+
+func writeEvent(w http.ResponseWriter, activity *Activity) error {
+	data, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", activity.ID, activity.Type, data)
+	return err
+}
+
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// ServeEvents streams the activity of a hive as server-sent events. The
+// stream is filtered by the comma separated types and sector query
+// parameters, the Last-Event-ID header resumes it from the activity log. A
+// replay of more than maxReplay activities is sent in parts, each ending the
+// stream with a replay_truncated event.
+func ServeEvents(hub *Hub, w http.ResponseWriter, r *http.Request, hiveID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		api.WriteError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	query := r.URL.Query()
+	types := splitList(query.Get("types"))
+	sectors := splitList(query.Get("sector"))
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = query.Get("last_event_id")
+	}
+
+	// subscribe before reading the log, so nothing published in between is
+	// missed
+	sub := &subscription{
+		filter: newActivityFilter(hiveID, types, sectors),
+		send:   make(chan *Activity, 256),
+	}
+	hub.subscribe <- sub
+	defer func() {
+		hub.unsubscribe <- sub
+	}()
+
+	var history []*Activity
+	truncated := false
+	if lastID != "" && hub.activityLog != nil {
+		var err error
+		history, err = hub.activityLog.ActivitiesSince(hiveID, lastID, types, sectors, maxReplay+1)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		if len(history) > maxReplay {
+			history, truncated = history[:maxReplay], true
+		}
+
+		// Activities published before the subscription may still wait for
+		// the log. They follow everything the log returned, those stored
+		// since the query are skipped by id.
+		if !truncated {
+			last := lastID
+			if len(history) > 0 {
+				last = history[len(history)-1].ID
+			}
+			for _, activity := range hub.unloggedActivities(sub.filter) {
+				if len(activity.ID) == len(last) && activity.ID <= last {
+					continue
+				}
+				history = append(history, activity)
+				last = activity.ID
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", retryDelay)
+
+	for _, activity := range history {
+		if err := writeEvent(w, activity); err != nil {
+			return
+		}
+		lastID = activity.ID
+	}
+	if truncated {
+		// end the stream, the client resumes the replay from lastID
+		fmt.Fprintf(w, "id: %s\nevent: %s\ndata: {\"last_event_id\":%q}\n\n", lastID, eventReplayTruncated, lastID)
+		flusher.Flush()
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case activity, ok := <-sub.send:
+			if !ok {
+				// The hub dropped the subscription, the client resumes with
+				// the last event id.
+				return
+			}
+
+			// object ids of the same process are ordered, skip what the log
+			// already delivered
+			if lastID != "" && len(activity.ID) == len(lastID) && activity.ID <= lastID {
+				continue
+			}
+			if err := writeEvent(w, activity); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package notification
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errUnreachable = errors.New("no reachable servers")
+
+// memoryLog is an activity log that fails the first writes with
+// errUnreachable.
+type memoryLog struct {
+	mu       sync.Mutex
+	failures int
+	logged   []*Activity
+}
+
+func (l *memoryLog) LogActivity(activity *Activity) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failures > 0 {
+		l.failures--
+		return errUnreachable
+	}
+	l.logged = append(l.logged, activity)
+	return nil
+}
+
+func (l *memoryLog) ActivitiesSince(hiveHex string, lastID string, types []string, sectors []string, limit int) ([]*Activity, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var activities []*Activity
+	for _, activity := range l.logged {
+		if activity.ID > lastID && len(activities) < limit {
+			activities = append(activities, activity)
+		}
+	}
+	return activities, nil
+}
+
+// transientStore treats errUnreachable as transient.
+type transientStore struct{}
+
+func (transientStore) Transient(err error) bool {
+	return err == errUnreachable
+}
+
+func (transientStore) SaveDeadLetter(hiveHex string, sectorHex string, message []byte, cause error) (bool, error) {
+	return false, nil
+}
+
+func (transientStore) ResolveDeadLetter(deadLetterID string, cause error) (bool, error) {
+	return false, nil
+}
+
+func activityID(i int) string {
+	return fmt.Sprintf("%024x", i+1)
+}
+
+func TestActivityLogIsLossless(t *testing.T) {
+	const activities = 3000
+
+	log := &memoryLog{failures: 1}
+	received := make(chan *Activity, activities)
+	hub := NewHub()
+	hub.RegisterDeadLetterStore(transientStore{})
+	hub.RegisterActivityLog(log)
+	hub.RegisterActivityListener(func(activity *Activity) {
+		received <- activity
+	})
+	go hub.writeActivityLog()
+
+	for i := 0; i < activities; i++ {
+		hub.logActivity(&Activity{ID: activityID(i), HiveID: "hive"})
+	}
+
+	for i := 0; i < activities; i++ {
+		select {
+		case activity := <-received:
+			if activity.ID != activityID(i) {
+				t.Fatalf("activity %d: got %s, want %s", i, activity.ID, activityID(i))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d activities", i, activities)
+		}
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if len(log.logged) != activities {
+		t.Errorf("logged %d of %d activities", len(log.logged), activities)
+	}
+}
+
+func TestServeEventsTruncatesReplay(t *testing.T) {
+	log := &memoryLog{}
+	for i := 0; i < maxReplay+10; i++ {
+		log.logged = append(log.logged, &Activity{ID: activityID(i), HiveID: "hive"})
+	}
+	hub := NewHub()
+	hub.RegisterActivityLog(log)
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeEvents(hub, w, r, "hive")
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", activityID(-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the stream ends after the truncated replay
+	var ids, names []string
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		case strings.HasPrefix(line, "event: "):
+			names = append(names, strings.TrimSpace(strings.TrimPrefix(line, "event: ")))
+		}
+	}
+
+	if len(names) != maxReplay+1 {
+		t.Fatalf("got %d events, want %d", len(names), maxReplay+1)
+	}
+	last := activityID(maxReplay - 1)
+	if names[maxReplay] != eventReplayTruncated || ids[maxReplay] != last {
+		t.Errorf("got last event %s %s, want %s %s", names[maxReplay], ids[maxReplay], eventReplayTruncated, last)
+	}
+}
+
+func TestServeEventsReplaysActivitiesWaitingForTheLog(t *testing.T) {
+	// the log fails long enough for the resume to happen while the second
+	// activity waits for it
+	log := &memoryLog{failures: 2}
+	log.logged = append(log.logged, &Activity{ID: activityID(0), HiveID: "hive"})
+	hub := NewHub()
+	hub.RegisterDeadLetterStore(transientStore{})
+	hub.RegisterActivityLog(log)
+	go hub.Run()
+
+	hub.Publish(&Activity{ID: activityID(1), HiveID: "hive"})
+	for {
+		log.mu.Lock()
+		failures := log.failures
+		log.mu.Unlock()
+		if failures < 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeEvents(hub, w, r, "hive")
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", activityID(0))
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// published after the resume, once the log is written
+	go hub.Publish(&Activity{ID: activityID(2), HiveID: "hive"})
+
+	var ids []string
+	reader := bufio.NewReader(resp.Body)
+	for len(ids) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("got events %v: %v", ids, err)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		}
+	}
+	if ids[0] != activityID(1) || ids[1] != activityID(2) {
+		t.Errorf("got events %v, want %s %s", ids, activityID(1), activityID(2))
+	}
+}
@@ -2,7 +2,16 @@ package notification
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/capture"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 )
 
@@ -12,6 +21,12 @@ type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
+	// Registered client of each sector.
+	sectors map[sectorAddress]*Client
+
+	// Handling of a second connection of a connected sector.
+	connectionPolicy atomic.Value
+
 	// Inbound messages from the clients.
 	broadcast chan []byte
 
@@ -21,92 +36,457 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
-	event        chan *event
-	eventHandler func(hiveHex string, sectorHex string, message []byte) (broadcast bool, sectorEvents map[string][]byte, err error)
+	// Disconnect requests for the clients of deleted hives and sectors.
+	disconnect chan *sectorAddress
+
+	// Results of the event workers.
+	results chan *eventResult
+
+	// Event workers per hive.
+	shards shards
+
+	eventHandler     func(hiveHex string, sectorHex string, message []byte) (broadcast bool, sectorEvents map[string][]byte, err error)
+	partitionHandler func(message []byte) string
+
+	handshakeHandler func(hiveHex string, sectorHex string, hello protocol.Hello) (protocol.Welcome, error)
+
+	// Registered observers.
+	observers map[*Observer]bool
+
+	// Register and unregister requests from the observers.
+	registerObserver   chan *Observer
+	unregisterObserver chan *Observer
+
+	// Activities published to the observers.
+	activity chan *Activity
+
+	// Event stream subscriptions.
+	subscriptions map[*subscription]bool
+
+	// Subscribe and unsubscribe requests from event streams.
+	subscribe   chan *subscription
+	unsubscribe chan *subscription
+
+	// Activities waiting for the activity log and listeners, logReady is
+	// signalled when the queue was empty. logWriting holds the part of the
+	// queue the writer took and has not stored yet.
+	logMu             sync.Mutex
+	logQueue          []*Activity
+	logWriting        []*Activity
+	logReady          chan struct{}
+	activityLog       ActivityLog
+	activityListeners []func(activity *Activity)
+
+	// Shutdown request, the hub stops accepting clients and events once
+	// draining is set.
+	shutdown chan *shutdownRequest
+	draining int32
+
+	// Backpressure policy changes of the hives.
+	policies chan *policyChange
+
+	policyHandler func(hiveHex string) (string, error)
+	slowHandler   func(hiveHex string, sectorHex string, overflows int)
+	spillStore    SpillStore
+
+	// Processed event ids of the sectors.
+	dedupStore DedupStore
+
+	// Events that failed, and their dead letters the store did not take.
+	deadLetterStore DeadLetterStore
+	spool           deadLetterSpool
+
+	// Timeline of the sector connections and messages.
+	recorder func(record capture.Record)
+
+	// Websocket settings for new connections.
+	settings atomic.Value
+
+	// Announcements of the operators for the sectors.
+	announcements chan *announcement
+}
+
+// Connection policies for a sector that connects while already connected.
+const (
+	// ConnectionTakeover closes the old connection.
+	ConnectionTakeover = "takeover"
+	// ConnectionReject closes the new connection.
+	ConnectionReject = "reject"
+)
+
+type policyChange struct {
+	hiveHex string
+	policy  string
+}
+
+type sectorAddress struct {
+	hiveHex   string
+	sectorHex string
 }
 
 type event struct {
 	hiveHex   string
 	sectorHex string
+	id        string
 	message   []byte
+
+	// Partition key, events with the same key are processed in order.
+	key string
+
+	// Dead letter the event is retried from.
+	deadLetterID string
 }
 
 func NewHub() *Hub {
-	return &Hub{
+	h := &Hub{
 		broadcast:  make(chan []byte, 512),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		event:      make(chan *event, 512),
-		clients:    make(map[*Client]bool),
+		disconnect: make(chan *sectorAddress),
+		results:    make(chan *eventResult, 512),
+		policies:   make(chan *policyChange),
+		shutdown:   make(chan *shutdownRequest),
+		observers:  make(map[*Observer]bool),
+
+		announcements: make(chan *announcement),
+
+		registerObserver:   make(chan *Observer),
+		unregisterObserver: make(chan *Observer),
+		activity:           make(chan *Activity, 512),
+
+		subscriptions: make(map[*subscription]bool),
+		subscribe:     make(chan *subscription),
+		unsubscribe:   make(chan *subscription),
+		logReady:      make(chan struct{}, 1),
+		clients:       make(map[*Client]bool),
+		sectors:       make(map[sectorAddress]*Client),
+		shards: shards{
+			hives:   make(map[string]*hiveShard),
+			closing: make(chan struct{}),
+		},
 	}
+	h.settings.Store(DefaultSettings())
+	h.connectionPolicy.Store(ConnectionTakeover)
+	return h
 }
 
 func (h *Hub) RegisterEventHandler(eventHandler func(hiveHex string, sectorHex string, message []byte) (broadcast bool, sectorEvents map[string][]byte, err error)) {
 	h.eventHandler = eventHandler
 }
 
+// RegisterPartitionHandler sets the function that extracts the ordering key of
+// an event. Events of a sector with the same key are processed in order,
+// events with different keys may be processed concurrently.
+func (h *Hub) RegisterPartitionHandler(partitionHandler func(message []byte) string) {
+	h.partitionHandler = partitionHandler
+}
+
+// DisconnectSector closes the connections of a sector. An empty sectorHex
+// closes every connection of a deleted hive and stops its event workers.
+func (h *Hub) DisconnectSector(hiveHex string, sectorHex string) {
+	h.disconnect <- &sectorAddress{
+		hiveHex:   hiveHex,
+		sectorHex: sectorHex,
+	}
+}
+
+// RegisterHandshakeHandler sets the function that negotiates the protocol of
+// newly connected sectors.
+func (h *Hub) RegisterHandshakeHandler(handshakeHandler func(hiveHex string, sectorHex string, hello protocol.Hello) (protocol.Welcome, error)) {
+	h.handshakeHandler = handshakeHandler
+}
+
+// RegisterPolicyHandler sets the function that returns the backpressure
+// policy of a hive.
+func (h *Hub) RegisterPolicyHandler(policyHandler func(hiveHex string) (string, error)) {
+	h.policyHandler = policyHandler
+}
+
+// RegisterSlowHandler sets the function called when a sector overflows its
+// outbox slowThreshold times within slowWindow.
+func (h *Hub) RegisterSlowHandler(slowHandler func(hiveHex string, sectorHex string, overflows int)) {
+	h.slowHandler = slowHandler
+}
+
+// RegisterSpillStore sets the store used by the spill policy. Without a store
+// the spill policy disconnects like PolicyDisconnect.
+func (h *Hub) RegisterSpillStore(spillStore SpillStore) {
+	h.spillStore = spillStore
+}
+
+// SetBackpressurePolicy changes the policy of the connected sectors of a hive.
+func (h *Hub) SetBackpressurePolicy(hiveHex string, policy string) {
+	h.policies <- &policyChange{
+		hiveHex: hiveHex,
+		policy:  policy,
+	}
+}
+
+// SetConnectionPolicy sets the handling of a second connection of a connected
+// sector, ConnectionTakeover or ConnectionReject.
+func (h *Hub) SetConnectionPolicy(policy string) error {
+	switch policy {
+	case ConnectionTakeover, ConnectionReject:
+		h.connectionPolicy.Store(policy)
+		return nil
+	}
+	return fmt.Errorf("unknown connection policy %q", policy)
+}
+
+// registerClient adds client to the hub and reports whether it was accepted.
+// A sector has at most one registered client.
+func (h *Hub) registerClient(client *Client) bool {
+	address := sectorAddress{
+		hiveHex:   client.hiveID,
+		sectorHex: client.sectorID,
+	}
+
+	if h.isDraining() {
+		return false
+	}
+
+	if previous, ok := h.sectors[address]; ok {
+		if h.connectionPolicy.Load() == ConnectionReject {
+			metrics.Add("connections_rejected", 1)
+			logrus.Warnln("reject connection of connected sector", client.hiveID, client.sectorID, client.conn.RemoteAddr())
+			return false
+		}
+
+		metrics.Add("connections_taken_over", 1)
+		logrus.Warnln("connection of sector", client.hiveID, client.sectorID, "from", previous.conn.RemoteAddr(), "taken over by", client.conn.RemoteAddr())
+		h.dropClient(previous, protocol.CloseSectorTakenOver, "sector taken over by a new connection")
+	}
+
+	h.clients[client] = true
+	h.sectors[address] = client
+	h.publishActivity(&Activity{
+		Type:     ActivitySectorConnected,
+		HiveID:   client.hiveID,
+		SectorID: client.sectorID,
+		Time:     time.Now(),
+	})
+	return true
+}
+
+// coalesceKey identifies messages of the same type and faction.
+func (h *Hub) coalesceKey(message []byte) string {
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return ""
+	}
+
+	key := envelope.Type
+	if h.partitionHandler != nil {
+		key += ":" + h.partitionHandler(message)
+	}
+	return key
+}
+
+// dropClient removes client from the hub and closes its connection.
+func (h *Hub) dropClient(client *Client, code int, reason string) {
+	delete(h.clients, client)
+	address := sectorAddress{
+		hiveHex:   client.hiveID,
+		sectorHex: client.sectorID,
+	}
+	if h.sectors[address] == client {
+		delete(h.sectors, address)
+	}
+	client.outbox.close(code, reason)
+
+	h.publishActivity(&Activity{
+		Type:     ActivitySectorDisconnected,
+		HiveID:   client.hiveID,
+		SectorID: client.sectorID,
+		Time:     time.Now(),
+	})
+}
+
+// sendClient queues message for client, applying the backpressure policy of
+// the client if its outbox is full.
+func (h *Hub) sendClient(client *Client, message []byte) {
+	h.send(client, outboxItem{message: message})
+}
+
+// sendAck queues an ack for client, acks are not discarded by the
+// backpressure policy.
+func (h *Hub) sendAck(client *Client, message []byte) {
+	h.send(client, outboxItem{message: message, ack: true})
+}
+
+func (h *Hub) send(client *Client, item outboxItem) {
+	h.record(capture.KindSend, client.hiveID, client.sectorID, item.message)
+
+	policy := client.backpressurePolicy()
+	if policy == PolicySpill && h.spillStore == nil {
+		policy = PolicyDisconnect
+	}
+
+	if policy == PolicyCoalesce && !item.ack {
+		item.key = h.coalesceKey(item.message)
+	}
+
+	result := client.outbox.push(item, policy)
+	switch result {
+	case pushQueued, pushClosed:
+		return
+	case pushReplaced:
+		metrics.Add("messages_coalesced", 1)
+	case pushDropped:
+		metrics.Add("messages_dropped", 1)
+	case pushSpill:
+		metrics.Add("messages_spilled", 1)
+		client.spill(item.message)
+	case pushRejected:
+		metrics.Add("clients_dropped", 1)
+		logrus.Warnln("drop slow client", client.hiveID, client.sectorID)
+		h.dropClient(client, websocket.CloseTryAgainLater, "client too slow")
+		return
+	}
+
+	overflows, slow := client.outbox.overflowed(time.Now())
+	if slow && h.slowHandler != nil {
+		go h.slowHandler(client.hiveID, client.sectorID, overflows)
+	}
+}
+
+// acknowledge answers a processed event to its sector.
+func (h *Hub) acknowledge(result *eventResult) {
+	client, ok := h.sectors[sectorAddress{hiveHex: result.event.hiveHex, sectorHex: result.event.sectorHex}]
+	if !ok || !client.welcome.Acknowledges() {
+		return
+	}
+
+	ack := protocol.Ack{
+		EventID:   result.event.id,
+		Success:   result.err == nil,
+		Duplicate: result.duplicate,
+		Queued:    result.queued,
+		Refused:   result.refused,
+	}
+	switch {
+	case result.refused:
+		ack.Code = api.CodeUnavailable
+		ack.Message = result.err.Error()
+	case result.err != nil:
+		apiErr := api.FromError(result.err)
+		ack.Code = apiErr.Code
+		ack.Message = apiErr.Message
+		ack.Field = apiErr.Field
+	}
+
+	message, err := protocol.Message(protocol.TypeAck, ack)
+	if err != nil {
+		logrus.Errorln(err)
+		return
+	}
+	h.sendAck(client, message)
+}
+
+// handleResult answers a processed event and sends the messages resulting
+// from it.
+func (h *Hub) handleResult(result *eventResult) {
+	h.acknowledge(result)
+
+	event, broadcast, sectorEvents := result.event, result.broadcast, result.sectorEvents
+	if result.err != nil {
+		logrus.Errorln(result.err)
+		return
+	}
+	if result.duplicate {
+		return
+	}
+	h.publishEvent(event)
+
+	if broadcast {
+		logrus.Info("broadcast")
+		for client := range h.clients {
+			if client.hiveID != event.hiveHex || client.sectorID == event.sectorHex {
+				logrus.Infoln("skip client", client.hiveID, client.sectorID)
+				continue
+			}
+			logrus.Infoln("send client", client.hiveID, client.sectorID)
+			h.sendClient(client, event.message)
+		}
+	} else if sectorEvents != nil {
+		logrus.Info("select events")
+		for k, v := range sectorEvents {
+			client, ok := h.sectors[sectorAddress{hiveHex: event.hiveHex, sectorHex: k}]
+			if !ok {
+				logrus.Infoln("skip disconnected sector", event.hiveHex, k)
+				continue
+			}
+			v = bytes.TrimSpace(bytes.Replace(v, newline, space, -1))
+			logrus.Infoln("send client", client.hiveID, client.sectorID)
+			h.sendClient(client, v)
+		}
+	}
+}
+
 func (h *Hub) Run() {
+	if h.activityLog != nil || len(h.activityListeners) > 0 {
+		go h.writeActivityLog()
+	}
+	if h.deadLetterStore != nil {
+		go h.flushDeadLetterSpool()
+	}
+
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			client.accepted <- h.registerClient(client)
+		case observer := <-h.registerObserver:
+			h.observers[observer] = true
+		case observer := <-h.unregisterObserver:
+			if _, ok := h.observers[observer]; ok {
+				delete(h.observers, observer)
+				close(observer.send)
+			}
+		case sub := <-h.subscribe:
+			h.subscriptions[sub] = true
+		case sub := <-h.unsubscribe:
+			if _, ok := h.subscriptions[sub]; ok {
+				delete(h.subscriptions, sub)
+				close(sub.send)
+			}
+		case activity := <-h.activity:
+			h.publishActivity(activity)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.dropClient(client, 0, "")
 			}
-		case message := <-h.broadcast:
+		case address := <-h.disconnect:
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if client.hiveID != address.hiveHex {
+					continue
 				}
+				if address.sectorHex != "" && client.sectorID != address.sectorHex {
+					continue
+				}
+
+				logrus.Infoln("disconnect client", client.hiveID, client.sectorID)
+				h.dropClient(client, 0, "")
 			}
-		case event := <-h.event:
-			broadcast, sectorEvents, err := h.eventHandler(event.hiveHex, event.sectorHex, event.message)
-			if err != nil {
-				logrus.Errorln(err)
-				continue
+			if address.sectorHex == "" {
+				// waits for queued events, which must not block the hub
+				go h.shards.remove(address.hiveHex)
 			}
-
-			if broadcast {
-				logrus.Info("broadcast")
-				for client := range h.clients {
-					if client.hiveID != event.hiveHex || client.sectorID == event.sectorHex {
-						logrus.Infoln("skip client", client.hiveID, client.sectorID)
-						continue
-					}
-					logrus.Infoln("send client", client.hiveID, client.sectorID)
-					select {
-					case client.send <- event.message:
-					default:
-						close(client.send)
-						delete(h.clients, client)
-					}
-					break
-				}
-			} else if sectorEvents != nil {
-				logrus.Info("select events")
-				for k, v := range sectorEvents {
-					for client := range h.clients {
-						if client.hiveID != event.hiveHex || client.sectorID != k {
-							logrus.Infoln("skip client", client.hiveID, client.sectorID)
-							continue
-						}
-						v = bytes.TrimSpace(bytes.Replace(v, newline, space, -1))
-						logrus.Infoln("send client", client.hiveID, client.sectorID)
-						select {
-						case client.send <- v:
-						default:
-							close(client.send)
-							delete(h.clients, client)
-						}
-						break
-					}
+		case change := <-h.policies:
+			for client := range h.clients {
+				if client.hiveID == change.hiveHex {
+					client.policy.Store(change.policy)
 				}
 			}
+		case message := <-h.broadcast:
+			for client := range h.clients {
+				h.sendClient(client, message)
+			}
+		case result := <-h.results:
+			h.handleResult(result)
+		case request := <-h.shutdown:
+			h.drain(request)
+		case a := <-h.announcements:
+			h.announce(a)
 		}
 	}
 }
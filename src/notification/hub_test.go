@@ -0,0 +1,148 @@
+package notification
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// testHub runs a hub with the connection policy behind a websocket server of
+// a single sector. The options set up the hub before it runs.
+func testHub(t *testing.T, policy string, options ...func(*Hub)) (*Hub, string) {
+	t.Helper()
+
+	hub := NewHub()
+	if err := hub.SetConnectionPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	hub.RegisterHandshakeHandler(func(hiveHex string, sectorHex string, hello protocol.Hello) (protocol.Welcome, error) {
+		return protocol.Negotiate(hello, nil)
+	})
+	for _, option := range options {
+		option(hub)
+	}
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r, "hive", "sector")
+	}))
+	t.Cleanup(server.Close)
+
+	return hub, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// connectSector connects as the sector and completes the handshake.
+func connectSector(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	hello, err := protocol.Message(protocol.TypeHello, protocol.Hello{
+		ProtocolVersion: protocol.Version,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, hello); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readWelcome fails unless the next message is the welcome.
+func readWelcome(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Type != protocol.TypeWelcome {
+		t.Fatalf("got %s, want %s", envelope.Type, protocol.TypeWelcome)
+	}
+}
+
+// readClose fails unless the connection is closed with code.
+func readClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Fatalf("got %v, want close %d", err, code)
+		}
+		return
+	}
+}
+
+func TestConnectionTakeover(t *testing.T) {
+	_, url := testHub(t, ConnectionTakeover)
+
+	first := connectSector(t, url)
+	readWelcome(t, first)
+
+	second := connectSector(t, url)
+	readWelcome(t, second)
+	readClose(t, first, protocol.CloseSectorTakenOver)
+}
+
+func TestConnectionReject(t *testing.T) {
+	_, url := testHub(t, ConnectionReject)
+
+	first := connectSector(t, url)
+	readWelcome(t, first)
+
+	second := connectSector(t, url)
+	readClose(t, second, protocol.CloseSectorConnected)
+
+	// the first connection is still registered
+	third := connectSector(t, url)
+	readClose(t, third, protocol.CloseSectorConnected)
+}
+
+func TestSilentLegacySectorIsRegistered(t *testing.T) {
+	connected := make(chan *Activity, 1)
+	_, url := testHub(t, ConnectionTakeover, func(hub *Hub) {
+		settings := hub.Settings()
+		settings.HelloWait = 50 * time.Millisecond
+		if err := hub.SetSettings(settings); err != nil {
+			t.Fatal(err)
+		}
+		hub.RegisterActivityListener(func(activity *Activity) {
+			if activity.Type == ActivitySectorConnected {
+				connected <- activity
+			}
+		})
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("legacy sector was not registered without sending a message")
+	}
+}
@@ -0,0 +1,231 @@
+package notification
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// Activity types streamed to observers.
+const (
+	ActivitySectorEvent        = "sector_event"
+	ActivitySectorConnected    = "sector_connected"
+	ActivitySectorDisconnected = "sector_disconnected"
+	ActivitySectorState        = "sector_state"
+	ActivitySectorPlayers      = "sector_players"
+	ActivitySectorSlow         = "sector_slow"
+	ActivityFactionCreated     = "faction_created"
+	ActivityFactionChanged     = "faction_changed"
+	ActivityAnnouncement       = "announcement"
+)
+
+// Activity is a processed event or state change of a hive.
+type Activity struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	HiveID    string      `json:"hive_id"`
+	SectorID  string      `json:"sector_id,omitempty"`
+	EventType string      `json:"event_type,omitempty"`
+	Time      time.Time   `json:"time"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// activityFilter selects the activities of a hive.
+type activityFilter struct {
+	hiveID string
+
+	// Activity and event types, all if empty.
+	types map[string]bool
+
+	// Sectors, all if empty.
+	sectors map[string]bool
+}
+
+func newActivityFilter(hiveID string, types []string, sectors []string) activityFilter {
+	f := activityFilter{
+		hiveID:  hiveID,
+		types:   make(map[string]bool),
+		sectors: make(map[string]bool),
+	}
+	for _, v := range types {
+		f.types[v] = true
+	}
+	for _, v := range sectors {
+		f.sectors[v] = true
+	}
+	return f
+}
+
+func (f activityFilter) matches(activity *Activity) bool {
+	if activity.HiveID != f.hiveID {
+		return false
+	}
+	if len(f.sectors) > 0 && !f.sectors[activity.SectorID] {
+		return false
+	}
+	if len(f.types) == 0 {
+		return true
+	}
+	return f.types[activity.Type] || (activity.EventType != "" && f.types[activity.EventType])
+}
+
+// Observer is a read-only connection streaming the activity of a hive.
+type Observer struct {
+	hub *Hub
+
+	// The websocket connection.
+	conn *websocket.Conn
+
+	// Buffered channel of outbound messages.
+	send chan []byte
+
+	// Activities to stream.
+	filter activityFilter
+
+	// Websocket settings when the connection was opened.
+	settings Settings
+}
+
+// readPump discards everything but control frames, it only notices when the
+// observer went away.
+func (o *Observer) readPump() {
+	defer func() {
+		o.hub.unregisterObserver <- o
+		o.conn.Close()
+	}()
+	o.conn.SetReadLimit(512)
+	o.conn.SetReadDeadline(time.Now().Add(o.settings.PongWait))
+	o.conn.SetPongHandler(func(string) error { o.conn.SetReadDeadline(time.Now().Add(o.settings.PongWait)); return nil })
+	for {
+		if _, _, err := o.conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+// writePump pumps activities from the hub to the websocket connection.
+func (o *Observer) writePump() {
+	ticker := time.NewTicker(o.settings.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		o.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-o.send:
+			o.conn.SetWriteDeadline(time.Now().Add(o.settings.WriteWait))
+			if !ok {
+				// The hub closed the channel.
+				o.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := o.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			o.conn.SetWriteDeadline(time.Now().Add(o.settings.WriteWait))
+			if err := o.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Publish streams activity to the observers of its hive.
+func (h *Hub) Publish(activity *Activity) {
+	if activity.Time.IsZero() {
+		activity.Time = time.Now()
+	}
+	h.activity <- activity
+}
+
+// publishEvent publishes a processed sector event.
+func (h *Hub) publishEvent(e *event) {
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(e.message, &envelope); err != nil {
+		return
+	}
+
+	h.publishActivity(&Activity{
+		Type:      ActivitySectorEvent,
+		HiveID:    e.hiveHex,
+		SectorID:  e.sectorHex,
+		EventType: envelope.Type,
+		Time:      time.Now(),
+		Data:      json.RawMessage(envelope.Raw),
+	})
+}
+
+// publishActivity logs activity and sends it to the observers and
+// subscriptions. Observers and subscriptions that cannot keep up are dropped.
+func (h *Hub) publishActivity(activity *Activity) {
+	if activity.ID == "" {
+		activity.ID = bson.NewObjectId().Hex()
+	}
+	h.logActivity(activity)
+
+	for sub := range h.subscriptions {
+		if !sub.filter.matches(activity) {
+			continue
+		}
+
+		select {
+		case sub.send <- activity:
+		default:
+			close(sub.send)
+			delete(h.subscriptions, sub)
+		}
+	}
+
+	var message []byte
+	for observer := range h.observers {
+		if !observer.filter.matches(activity) {
+			continue
+		}
+
+		if message == nil {
+			var err error
+			message, err = json.Marshal(activity)
+			if err != nil {
+				logrus.Errorln(err)
+				return
+			}
+		}
+
+		select {
+		case observer.send <- message:
+		default:
+			close(observer.send)
+			delete(h.observers, observer)
+		}
+	}
+}
+
+// ServeObserver handles websocket requests from observers of a hive. types and
+// sectors limit the stream to the given activity or event types and sectors.
+func ServeObserver(hub *Hub, w http.ResponseWriter, r *http.Request, hiveID string, types []string, sectors []string) {
+	settings := hub.Settings()
+	conn, err := settings.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	observer := &Observer{
+		hub:      hub,
+		settings: settings,
+		conn:     conn,
+		send:     make(chan []byte, 256),
+		filter:   newActivityFilter(hiveID, types, sectors),
+	}
+	observer.hub.registerObserver <- observer
+
+	go observer.writePump()
+	go observer.readPump()
+}
@@ -0,0 +1,261 @@
+package notification
+
+import (
+	"sync"
+	"time"
+)
+
+// Backpressure policies applied when the outbox of a client is full.
+const (
+	// PolicyDisconnect drops the client.
+	PolicyDisconnect = "disconnect"
+	// PolicyDropOldest discards the oldest queued message.
+	PolicyDropOldest = "drop_oldest"
+	// PolicyCoalesce replaces a queued message of the same type and faction,
+	// or discards the oldest queued message if there is none.
+	PolicyCoalesce = "coalesce"
+	// PolicySpill moves messages to the spill store until the client caught up.
+	PolicySpill = "spill"
+)
+
+// BackpressurePolicies lists the valid backpressure policies.
+var BackpressurePolicies = []string{PolicyDisconnect, PolicyDropOldest, PolicyCoalesce, PolicySpill}
+
+const (
+	// Number of messages queued for a client.
+	outboxSize = 256
+
+	// A client overflowing its outbox this often within slowWindow is
+	// reported as slow.
+	slowThreshold = 16
+	slowWindow    = time.Minute
+)
+
+// SpillStore persists the messages of clients under the spill policy.
+type SpillStore interface {
+	SpillSectorMessage(hiveHex string, sectorHex string, message []byte) error
+	UnspillSectorMessages(hiveHex string, sectorHex string, limit int) ([][]byte, error)
+	CountSpilledSectorMessages(hiveHex string, sectorHex string) (int, error)
+}
+
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushReplaced
+	pushDropped
+	pushRejected
+	pushSpill
+	pushClosed
+)
+
+type outboxItem struct {
+	message []byte
+	key     string
+
+	// ack is set for acks, they are neither discarded nor coalesced.
+	ack bool
+}
+
+// outbox is the queue of messages from the hub to a client.
+type outbox struct {
+	mu    sync.Mutex
+	items []outboxItem
+
+	// Signals the write pump that items were added or the outbox was closed.
+	notify chan struct{}
+
+	closed      bool
+	closeCode   int
+	closeReason string
+
+	// Messages in the spill store, including those not yet persisted.
+	spilled      int
+	spillPending int
+
+	overflows   int
+	windowStart time.Time
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// push queues an item according to policy. The key of the item identifies
+// the type and faction of the message for coalescing.
+func (o *outbox) push(item outboxItem, policy string) pushResult {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return pushClosed
+	}
+
+	// keep the order while older messages are still in the spill store
+	if o.spilled > 0 && policy == PolicySpill {
+		o.spilled++
+		o.spillPending++
+		return pushSpill
+	}
+
+	if len(o.items) < outboxSize {
+		o.items = append(o.items, item)
+		o.signal()
+		return pushQueued
+	}
+
+	switch policy {
+	case PolicyDropOldest:
+		o.dropOldest(item)
+		return pushDropped
+	case PolicyCoalesce:
+		if item.key != "" && !item.ack {
+			for i := len(o.items) - 1; i >= 0; i-- {
+				if o.items[i].key == item.key {
+					o.items[i].message = item.message
+					return pushReplaced
+				}
+			}
+		}
+		o.dropOldest(item)
+		return pushDropped
+	case PolicySpill:
+		o.spilled++
+		o.spillPending++
+		return pushSpill
+	}
+
+	return pushRejected
+}
+
+// dropOldest queues item in place of the oldest message that is not an ack.
+// Acks are kept so the sector does not resend processed events: if only acks
+// are queued, a new message is discarded and a new ack is queued beyond the
+// size of the outbox.
+func (o *outbox) dropOldest(item outboxItem) {
+	for i, v := range o.items {
+		if !v.ack {
+			copy(o.items[i:], o.items[i+1:])
+			o.items[len(o.items)-1] = item
+			return
+		}
+	}
+
+	if item.ack {
+		o.items = append(o.items, item)
+	}
+}
+
+// overflowed records an overflow and reports whether the client just crossed
+// the slow threshold of the current window.
+func (o *outbox) overflowed(now time.Time) (int, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if now.Sub(o.windowStart) > slowWindow {
+		o.windowStart = now
+		o.overflows = 0
+	}
+	o.overflows++
+
+	return o.overflows, o.overflows == slowThreshold
+}
+
+// pop returns the next message. closed is true once the outbox was closed
+// and all queued messages were returned.
+func (o *outbox) pop() (message []byte, ok bool, closed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.items) == 0 {
+		return nil, false, o.closed
+	}
+
+	message = o.items[0].message
+	o.items[0] = outboxItem{}
+	o.items = o.items[1:]
+	return message, true, false
+}
+
+// drain removes and returns the queued messages.
+func (o *outbox) drain() [][]byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	messages := make([][]byte, len(o.items))
+	for i, item := range o.items {
+		messages[i] = item.message
+	}
+	o.items = nil
+	return messages
+}
+
+// needsRefill reports whether the queue is drained while persisted messages
+// are waiting in the spill store.
+func (o *outbox) needsRefill() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return !o.closed && len(o.items) == 0 && o.spilled > 0 && o.spillPending == 0
+}
+
+func (o *outbox) refill(messages [][]byte, exhausted bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, message := range messages {
+		o.items = append(o.items, outboxItem{message: message})
+	}
+	o.spilled -= len(messages)
+	if exhausted || o.spilled < 0 {
+		o.spilled = 0
+	}
+	o.signal()
+}
+
+func (o *outbox) spillDone() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.spillPending--
+	o.signal()
+}
+
+func (o *outbox) setSpilled(count int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.spilled += count
+	o.signal()
+}
+
+// close stops accepting messages. The write pump sends the queued messages and
+// then closes the connection with code and reason, if code is set.
+func (o *outbox) close(code int, reason string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.closeCode = code
+	o.closeReason = reason
+	o.signal()
+}
+
+func (o *outbox) closeMessage() (int, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.closeCode, o.closeReason
+}
@@ -0,0 +1,73 @@
+package notification
+
+import (
+	"strconv"
+	"testing"
+)
+
+// fullOutbox returns an outbox filled with messages, those at the given
+// indexes are acks.
+func fullOutbox(acks ...int) *outbox {
+	o := newOutbox()
+	isAck := make(map[int]bool)
+	for _, i := range acks {
+		isAck[i] = true
+	}
+	for i := 0; i < outboxSize; i++ {
+		o.push(outboxItem{message: []byte(strconv.Itoa(i)), ack: isAck[i]}, PolicyDisconnect)
+	}
+	return o
+}
+
+func TestDropOldestKeepsAcks(t *testing.T) {
+	o := fullOutbox(0, 1)
+
+	if result := o.push(outboxItem{message: []byte("new")}, PolicyDropOldest); result != pushDropped {
+		t.Fatalf("expected a dropped message, got %v", result)
+	}
+
+	messages := o.drain()
+	if len(messages) != outboxSize {
+		t.Fatalf("expected %d messages, got %d", outboxSize, len(messages))
+	}
+	if string(messages[0]) != "0" || string(messages[1]) != "1" || string(messages[2]) != "3" {
+		t.Errorf("expected the acks 0 and 1 followed by 3, got %s %s %s", messages[0], messages[1], messages[2])
+	}
+	if last := string(messages[len(messages)-1]); last != "new" {
+		t.Errorf("expected the new message last, got %s", last)
+	}
+}
+
+func TestDropOldestOnlyAcks(t *testing.T) {
+	acks := make([]int, outboxSize)
+	for i := range acks {
+		acks[i] = i
+	}
+
+	o := fullOutbox(acks...)
+	o.push(outboxItem{message: []byte("message")}, PolicyDropOldest)
+	if n := len(o.items); n != outboxSize {
+		t.Errorf("expected the new message to be discarded, got %d items", n)
+	}
+
+	o.push(outboxItem{message: []byte("ack"), ack: true}, PolicyDropOldest)
+	if n := len(o.items); n != outboxSize+1 {
+		t.Errorf("expected the new ack to be queued, got %d items", n)
+	}
+}
+
+func TestCoalesceSkipsAcks(t *testing.T) {
+	o := fullOutbox(5)
+	o.items[5].key = "ack"
+
+	if result := o.push(outboxItem{message: []byte("ack"), key: "ack", ack: true}, PolicyCoalesce); result != pushDropped {
+		t.Fatalf("expected the ack to be queued without coalescing, got %v", result)
+	}
+	// the oldest message 0 was discarded
+	if queued := string(o.items[4].message); queued != "5" {
+		t.Errorf("expected the queued ack to be kept, got %s", queued)
+	}
+	if last := string(o.items[len(o.items)-1].message); last != "ack" {
+		t.Errorf("expected the new ack last, got %s", last)
+	}
+}
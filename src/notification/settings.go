@@ -0,0 +1,84 @@
+package notification
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Settings of the websocket connections of sectors and observers. Changed
+// settings apply to connections opened afterwards.
+type Settings struct {
+	// Buffer sizes of the websocket connections in bytes.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Time allowed to write a message to the peer.
+	WriteWait time.Duration
+
+	// Time allowed to read the next pong message from the peer.
+	PongWait time.Duration
+
+	// Send pings to peer with this period. Must be less than PongWait.
+	PingPeriod time.Duration
+
+	// Maximum message size allowed from a sector.
+	MaxMessageSize int64
+
+	// Time a sector has to send its hello before it is registered as a
+	// legacy sector.
+	HelloWait time.Duration
+}
+
+// DefaultSettings returns the settings a hub starts with.
+func DefaultSettings() Settings {
+	return Settings{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		WriteWait:       10 * time.Second,
+		PongWait:        60 * time.Second,
+		PingPeriod:      54 * time.Second,
+		MaxMessageSize:  64 * 1024,
+		HelloWait:       2 * time.Second,
+	}
+}
+
+// Validate checks that the settings are usable.
+func (s Settings) Validate() error {
+	switch {
+	case s.ReadBufferSize <= 0 || s.WriteBufferSize <= 0:
+		return fmt.Errorf("buffer sizes must be positive")
+	case s.WriteWait <= 0 || s.PongWait <= 0 || s.PingPeriod <= 0:
+		return fmt.Errorf("write wait, pong wait and ping period must be positive")
+	case s.PingPeriod >= s.PongWait:
+		return fmt.Errorf("ping period %s must be less than pong wait %s", s.PingPeriod, s.PongWait)
+	case s.MaxMessageSize <= 0:
+		return fmt.Errorf("max message size must be positive")
+	case s.HelloWait <= 0:
+		return fmt.Errorf("hello wait must be positive")
+	}
+	return nil
+}
+
+func (s Settings) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    s.ReadBufferSize,
+		WriteBufferSize:   s.WriteBufferSize,
+		EnableCompression: true,
+	}
+}
+
+// SetSettings replaces the websocket settings for new connections.
+func (h *Hub) SetSettings(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	h.settings.Store(settings)
+	return nil
+}
+
+// Settings returns the current websocket settings.
+func (h *Hub) Settings() Settings {
+	return h.settings.Load().(Settings)
+}
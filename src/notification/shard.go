@@ -0,0 +1,385 @@
+package notification
+
+import (
+	"context"
+	"expvar"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of workers processing the events of one hive.
+	workersPerHive = 4
+
+	// Number of events a worker queues before readPump blocks.
+	workerQueueSize = 64
+
+	// Attempts of an event failing with a transient error before it becomes
+	// a dead letter, the delay between them doubles.
+	transientAttempts = 3
+	transientBackoff  = 500 * time.Millisecond
+)
+
+var metrics = expvar.NewMap("hub")
+
+// hiveShard processes the events of one hive. Events with the same partition
+// key are handled by the same worker and therefore in order.
+type hiveShard struct {
+	hiveHex string
+	workers []chan *event
+}
+
+type eventResult struct {
+	event *event
+	// duplicate is set for an event that was processed before, it has no
+	// side effects.
+	duplicate bool
+	// queued is set for a failed event that is retried later.
+	queued bool
+	// refused is set for a duplicate of an event that is still in process,
+	// the sector sends it again.
+	refused      bool
+	broadcast    bool
+	sectorEvents map[string][]byte
+	err          error
+}
+
+// retry is an event that is attempted again after a delay.
+type retry struct {
+	event   *event
+	attempt int
+	delay   time.Duration
+	started time.Time
+	at      time.Time
+}
+
+// parkedKey holds the retry of a partition key and the events of the key
+// queued behind it.
+type parkedKey struct {
+	retry   *retry
+	waiting []*event
+}
+
+// worker processes the events of one queue of a hive shard. An event that
+// is retried is parked with the later events of its key, so it does not hold
+// up the events of the other keys.
+type worker struct {
+	h      *Hub
+	parked map[string]*parkedKey
+}
+
+func newHiveShard(h *Hub, hiveHex string) *hiveShard {
+	shard := &hiveShard{
+		hiveHex: hiveHex,
+		workers: make([]chan *event, workersPerHive),
+	}
+	for i := range shard.workers {
+		shard.workers[i] = make(chan *event, workerQueueSize)
+		h.shards.workers.Add(1)
+		go shard.work(h, shard.workers[i])
+	}
+
+	return shard
+}
+
+// work processes the events of queue until it is closed and the parked
+// events are done.
+func (s *hiveShard) work(h *Hub, queue chan *event) {
+	defer h.shards.workers.Done()
+
+	w := &worker{
+		h:      h,
+		parked: make(map[string]*parkedKey),
+	}
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for queue != nil || len(w.parked) > 0 {
+		var due <-chan time.Time
+		if at, ok := w.nextRetry(); ok {
+			timer.Reset(time.Until(at))
+			due = timer.C
+		}
+
+		select {
+		case e, ok := <-queue:
+			if !ok {
+				queue = nil
+				break
+			}
+			metrics.Add("queue_depth."+s.hiveHex, -1)
+			w.run(e)
+		case <-due:
+			w.retryDue()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// run processes an event unless an earlier event of its key is parked.
+func (w *worker) run(e *event) {
+	if p, ok := w.parked[e.key]; ok {
+		p.waiting = append(p.waiting, e)
+		return
+	}
+
+	w.attempt(&retry{
+		event:   e,
+		delay:   transientBackoff,
+		started: time.Now(),
+	})
+}
+
+// attempt handles an event once. An event that is retried is parked,
+// otherwise its result is sent to the hub.
+func (w *worker) attempt(r *retry) {
+	r.attempt++
+	result := &eventResult{
+		event: r.event,
+	}
+	w.h.handle(result)
+
+	if delay, ok := w.h.retryDelay(r, result); ok {
+		r.at = time.Now().Add(delay)
+		w.parked[r.event.key] = &parkedKey{retry: r}
+		return
+	}
+
+	w.h.results <- w.h.finish(result)
+}
+
+// nextRetry returns the time of the earliest parked retry.
+func (w *worker) nextRetry() (time.Time, bool) {
+	var next time.Time
+	for _, p := range w.parked {
+		if next.IsZero() || p.retry.at.Before(next) {
+			next = p.retry.at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// retryDue attempts the parked events that are due, followed by the events
+// of their keys that waited for them.
+func (w *worker) retryDue() {
+	now := time.Now()
+	for key, p := range w.parked {
+		if p.retry.at.After(now) {
+			continue
+		}
+
+		delete(w.parked, key)
+		w.attempt(p.retry)
+		for i, e := range p.waiting {
+			if parked, ok := w.parked[key]; ok {
+				parked.waiting = append(parked.waiting, p.waiting[i:]...)
+				break
+			}
+			w.run(e)
+		}
+	}
+}
+
+// retryDelay reports whether an attempted event is retried and the delay
+// before the next attempt. A duplicate of an event in process is retried
+// until inFlightWait passed, an event failing with a transient error up to
+// transientAttempts times with a doubling delay.
+func (h *Hub) retryDelay(r *retry, result *eventResult) (time.Duration, bool) {
+	switch {
+	case result.refused:
+		return inFlightPoll, time.Since(r.started) < inFlightWait
+	case result.err != nil && r.attempt < transientAttempts && h.transient(result.err):
+		metrics.Add("events_retried", 1)
+		logrus.Warnln("retry event after transient error", r.event.hiveHex, r.event.sectorHex, result.err)
+
+		delay := r.delay
+		r.delay *= 2
+		return delay, true
+	}
+	return 0, false
+}
+
+// finish counts the result of an event. An event that failed nevertheless is
+// kept as dead letter.
+func (h *Hub) finish(result *eventResult) *eventResult {
+	switch {
+	case result.refused:
+		// a refused dead letter is retried once its processing timed out
+		metrics.Add("events_in_flight", 1)
+		return result
+	case result.err != nil:
+		metrics.Add("events_failed", 1)
+	case !result.duplicate:
+		metrics.Add("events_processed", 1)
+	}
+
+	h.deadLetter(result)
+	return result
+}
+
+// handle runs the event handler unless the event was processed before.
+func (h *Hub) handle(result *eventResult) {
+	e := result.event
+
+	fresh, err := h.claim(e)
+	if err != nil || !fresh {
+		result.duplicate, result.err = !fresh && err == nil, err
+		result.refused = err == ErrEventInFlight
+		return
+	}
+
+	result.broadcast, result.sectorEvents, result.err = h.eventHandler(e.hiveHex, e.sectorHex, e.message)
+	if result.err != nil {
+		h.release(e)
+		return
+	}
+	h.complete(e)
+}
+
+// enqueue hands the event to its worker. It blocks while the queue of the
+// worker is full, which stops the reading client until the hive caught up,
+// and reports false if the hub starts closing meanwhile.
+func (s *hiveShard) enqueue(e *event, closing <-chan struct{}) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(e.key))
+	queue := s.workers[hash.Sum32()%uint32(len(s.workers))]
+
+	metrics.Add("queue_depth."+s.hiveHex, 1)
+	select {
+	case queue <- e:
+		return true
+	default:
+	}
+
+	metrics.Add("queue_full", 1)
+	logrus.Warnln("event queue full, blocking sector", e.hiveHex, e.sectorHex)
+	select {
+	case queue <- e:
+		return true
+	case <-closing:
+		metrics.Add("queue_depth."+s.hiveHex, -1)
+		return false
+	}
+}
+
+type shards struct {
+	sync.Mutex
+	hives map[string]*hiveShard
+
+	// Held for reading while an event is queued, closing the queues waits
+	// for it. Closing is closed first, so an event waiting for a full queue
+	// is refused instead of holding up the close.
+	queueing  sync.RWMutex
+	closing   chan struct{}
+	closeOnce sync.Once
+	closed    bool
+
+	// Running workers.
+	workers sync.WaitGroup
+}
+
+// close stops accepting events and waits until the workers processed the
+// queued events.
+func (s *shards) close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+
+	s.queueing.Lock()
+	if !s.closed {
+		s.closed = true
+
+		s.Lock()
+		for _, shard := range s.hives {
+			for _, queue := range shard.workers {
+				close(queue)
+			}
+		}
+		s.Unlock()
+	}
+	s.queueing.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// remove stops the workers of a deleted hive after they processed the queued
+// events.
+func (s *shards) remove(hiveHex string) {
+	s.queueing.Lock()
+	defer s.queueing.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.Lock()
+	shard, ok := s.hives[hiveHex]
+	delete(s.hives, hiveHex)
+	s.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, queue := range shard.workers {
+		close(queue)
+	}
+}
+
+func (h *Hub) shard(hiveHex string) *hiveShard {
+	h.shards.Lock()
+	defer h.shards.Unlock()
+
+	shard, ok := h.shards.hives[hiveHex]
+	if !ok {
+		shard = newHiveShard(h, hiveHex)
+		h.shards.hives[hiveHex] = shard
+	}
+
+	return shard
+}
+
+// dispatch queues an event for processing, ordered by its partition key. It
+// reports false if the hub is shutting down and no longer accepts events.
+func (h *Hub) dispatch(e *event) bool {
+	h.shards.queueing.RLock()
+	defer h.shards.queueing.RUnlock()
+
+	if h.shards.closed {
+		metrics.Add("events_refused", 1)
+		return false
+	}
+
+	e.key = e.sectorHex
+	if h.partitionHandler != nil {
+		if v := h.partitionHandler(e.message); v != "" {
+			e.key = e.sectorHex + ":" + v
+		}
+	}
+
+	if !h.shard(e.hiveHex).enqueue(e, h.shards.closing) {
+		metrics.Add("events_refused", 1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package notification
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeletedHiveStopsWorkers(t *testing.T) {
+	hub := NewHub()
+	processed := make(chan string, 1)
+	hub.RegisterEventHandler(func(hiveHex string, sectorHex string, message []byte) (bool, map[string][]byte, error) {
+		processed <- string(message)
+		return false, nil, nil
+	})
+	go hub.Run()
+
+	hub.dispatch(&event{hiveHex: "hive", sectorHex: "sector", message: []byte(`{"type":"test"}`)})
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not processed")
+	}
+
+	hub.DisconnectSector("hive", "")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hub.shards.Lock()
+		_, ok := hub.shards.hives["hive"]
+		hub.shards.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("workers of the deleted hive were not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// every worker exited
+	hub.shards.workers.Wait()
+}
+
+// sameWorker returns a partition value whose events are handled by the same
+// worker as the events of value.
+func sameWorker(sectorHex string, value string) string {
+	worker := func(v string) uint32 {
+		hash := fnv.New32a()
+		hash.Write([]byte(sectorHex + ":" + v))
+		return hash.Sum32() % workersPerHive
+	}
+	for i := 0; ; i++ {
+		other := value + string(rune('a'+i))
+		if worker(other) == worker(value) {
+			return other
+		}
+	}
+}
+
+func TestRetryDoesNotHoldUpOtherKeys(t *testing.T) {
+	other := sameWorker("sector", "retried")
+
+	var mu sync.Mutex
+	failures := 1
+	processed := make(chan string, 3)
+	hub := NewHub()
+	hub.RegisterDeadLetterStore(transientStore{})
+	hub.RegisterPartitionHandler(func(message []byte) string {
+		if string(message) == "later" {
+			return "retried"
+		}
+		return string(message)
+	})
+	hub.RegisterEventHandler(func(hiveHex string, sectorHex string, message []byte) (bool, map[string][]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if string(message) == "retried" && failures > 0 {
+			failures--
+			return false, nil, errUnreachable
+		}
+		processed <- string(message)
+		return false, nil, nil
+	})
+	go hub.Run()
+
+	for _, message := range []string{"retried", "later", other} {
+		hub.dispatch(&event{hiveHex: "hive", sectorHex: "sector", message: []byte(message)})
+	}
+
+	// the other key is processed while the failed event waits for its
+	// retry, the later event of its key waits behind it
+	var order []string
+	for len(order) < 3 {
+		select {
+		case message := <-processed:
+			order = append(order, message)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("processed %v", order)
+		}
+	}
+	if order[0] != other || order[1] != "retried" || order[2] != "later" {
+		t.Errorf("processed %v, want %s retried later", order, other)
+	}
+}
+
+func TestCloseRefusesEventsWaitingForAFullQueue(t *testing.T) {
+	release := make(chan struct{})
+	hub := NewHub()
+	hub.RegisterEventHandler(func(hiveHex string, sectorHex string, message []byte) (bool, map[string][]byte, error) {
+		<-release
+		return false, nil, nil
+	})
+	go hub.Run()
+
+	// the worker is stuck, its queue fills up and the last event waits
+	refused := make(chan bool, 1)
+	go func() {
+		dispatched := true
+		for i := 0; i < workerQueueSize+2 && dispatched; i++ {
+			dispatched = hub.dispatch(&event{hiveHex: "hive", sectorHex: "sector", message: []byte("{}")})
+		}
+		refused <- !dispatched
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := hub.shards.close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case ok := <-refused:
+		if !ok {
+			t.Error("waiting event was queued")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting event was not refused")
+	}
+
+	close(release)
+	hub.shards.workers.Wait()
+}
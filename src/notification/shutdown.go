@@ -0,0 +1,110 @@
+package notification
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+type shutdownRequest struct {
+	reason  string
+	clients chan []*Client
+}
+
+func (h *Hub) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// Shutdown drains the hub. It stops accepting events and connections, waits
+// for the events in process, flushes the queued messages and closes every
+// sector with a reason announcing the reconnect delay. Messages that could not
+// be delivered before ctx is done are persisted in the spill store, spooled
+// dead letters are stored a last time.
+func (h *Hub) Shutdown(ctx context.Context, reconnect time.Duration) error {
+	atomic.StoreInt32(&h.draining, 1)
+
+	err := h.shards.close(ctx)
+	if err != nil {
+		logrus.Errorln("events still in process:", err)
+	}
+
+	request := &shutdownRequest{
+		reason:  protocol.RestartReason(reconnect),
+		clients: make(chan []*Client, 1),
+	}
+	h.shutdown <- request
+	clients := <-request.clients
+
+	for _, client := range clients {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			client.conn.Close()
+			<-client.done
+		}
+		client.persistUndelivered()
+	}
+
+	if h.deadLetterStore != nil {
+		h.spool.flush(h.deadLetterStore)
+		if n := h.spool.len(); n > 0 {
+			logrus.Warnln(n, "dead letters left in the spool, they are lost without a spool file")
+		}
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// drain sends the results of the processed events and closes every client
+// and observer. It runs on the hub goroutine.
+func (h *Hub) drain(request *shutdownRequest) {
+	for len(h.results) > 0 {
+		h.handleResult(<-h.results)
+	}
+
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+		h.dropClient(client, websocket.CloseServiceRestart, request.reason)
+	}
+	for observer := range h.observers {
+		delete(h.observers, observer)
+		close(observer.send)
+	}
+	for sub := range h.subscriptions {
+		delete(h.subscriptions, sub)
+		close(sub.send)
+	}
+
+	request.clients <- clients
+}
+
+// persistUndelivered moves the messages left in the outbox of a stopped client
+// to the spill store, they are sent when the sector reconnects.
+func (c *Client) persistUndelivered() {
+	messages := c.outbox.drain()
+	if len(messages) == 0 {
+		return
+	}
+
+	if c.hub.spillStore == nil {
+		metrics.Add("messages_lost", int64(len(messages)))
+		logrus.Warnln(len(messages), "undelivered messages lost for client", c.hiveID, c.sectorID)
+		return
+	}
+
+	for _, message := range messages {
+		if err := c.hub.spillStore.SpillSectorMessage(c.hiveID, c.sectorID, message); err != nil {
+			metrics.Add("messages_lost", 1)
+			logrus.Errorln(err)
+		}
+	}
+	logrus.Infoln("persisted", len(messages), "undelivered messages for client", c.hiveID, c.sectorID)
+}
@@ -0,0 +1,82 @@
+package notification
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestDrainingHubNacksEvents(t *testing.T) {
+	hub, url := testHub(t, ConnectionTakeover)
+
+	conn := connectSector(t, url)
+	readWelcome(t, conn)
+	atomic.StoreInt32(&hub.draining, 1)
+
+	message, err := json.Marshal(protocol.Envelope{ID: "event-1", Type: "ServerStateChange", Raw: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope protocol.Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	var ack protocol.Ack
+	if err := json.Unmarshal([]byte(envelope.Raw), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Type != protocol.TypeAck || ack.EventID != "event-1" || ack.Success || !ack.Refused || ack.Code != api.CodeUnavailable {
+		t.Errorf("got %s %+v, want a refused ack with code %s", envelope.Type, ack, api.CodeUnavailable)
+	}
+}
+
+func TestDrainingHubClosesLegacySectors(t *testing.T) {
+	hub, url := testHub(t, ConnectionTakeover, func(hub *Hub) {
+		hub.RegisterHandshakeHandler(func(hiveHex string, sectorHex string, hello protocol.Hello) (protocol.Welcome, error) {
+			return protocol.Negotiate(hello, []string{"ServerStateChange"})
+		})
+		hub.RegisterEventHandler(func(hiveHex string, sectorHex string, message []byte) (bool, map[string][]byte, error) {
+			return false, nil, nil
+		})
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the first event registers the legacy sector and is echoed, the second
+	// is refused
+	message, err := json.Marshal(protocol.Envelope{Type: "ServerStateChange", Raw: "{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&hub.draining, 1)
+	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		t.Fatal(err)
+	}
+	readClose(t, conn, websocket.CloseServiceRestart)
+}
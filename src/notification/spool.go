@@ -0,0 +1,189 @@
+package notification
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Period in which the spooled dead letters are moved to the dead letter store.
+const deadLetterSpoolPeriod = 10 * time.Second
+
+// spooledDeadLetter is a failed event whose dead letter could not be stored.
+type spooledDeadLetter struct {
+	HiveHex   string `json:"hive"`
+	SectorHex string `json:"sector"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause"`
+	Transient bool   `json:"transient"`
+}
+
+// spooledCause is the error of a spooled dead letter.
+type spooledCause struct {
+	message   string
+	transient bool
+}
+
+func (e *spooledCause) Error() string {
+	return e.message
+}
+
+// Transient reports whether the event failed with a transient error.
+func (e *spooledCause) Transient() bool {
+	return e.transient
+}
+
+// deadLetterSpool keeps the dead letters that could not be stored, usually
+// because the database is unreachable, until the store takes them. With a
+// path they are appended to that file and survive a restart, otherwise they
+// are kept in memory.
+type deadLetterSpool struct {
+	sync.Mutex
+	path    string
+	pending []spooledDeadLetter
+}
+
+// SetDeadLetterSpool sets the file that keeps the dead letters the store
+// could not take and loads the dead letters left in it. Without a file they
+// are kept in memory.
+func (h *Hub) SetDeadLetterSpool(path string) error {
+	h.spool.Lock()
+	defer h.spool.Unlock()
+
+	h.spool.path = path
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var d spooledDeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			// a line cut off by a crash
+			logrus.Errorln("skip malformed spooled dead letter:", err)
+			continue
+		}
+		h.spool.pending = append(h.spool.pending, d)
+	}
+	if len(h.spool.pending) > 0 {
+		metrics.Add("dead_letters_spooled", int64(len(h.spool.pending)))
+		logrus.Infoln("loaded", len(h.spool.pending), "spooled dead letters")
+	}
+	return scanner.Err()
+}
+
+// add spools a dead letter.
+func (s *deadLetterSpool) add(d spooledDeadLetter) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.path != "" {
+		line, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(line, '\n'))
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.pending = append(s.pending, d)
+	metrics.Add("dead_letters_spooled", 1)
+	return nil
+}
+
+// flush moves the spooled dead letters to the store in order, it stops at
+// the first one the store does not take.
+func (s *deadLetterSpool) flush(store DeadLetterStore) {
+	// dead letters are only appended while the store is called
+	s.Lock()
+	pending := s.pending
+	s.Unlock()
+
+	saved := 0
+	for _, d := range pending {
+		cause := &spooledCause{message: d.Cause, transient: d.Transient}
+		if _, err := store.SaveDeadLetter(d.HiveHex, d.SectorHex, []byte(d.Message), cause); err != nil {
+			logrus.Warnln("dead letter store still failing:", err)
+			break
+		}
+		saved++
+	}
+	if saved == 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.pending = s.pending[saved:]
+	metrics.Add("dead_letters_spooled", -int64(saved))
+	logrus.Infoln("stored", saved, "spooled dead letters")
+	if s.path != "" {
+		if err := s.rewrite(); err != nil {
+			// the stored dead letters are stored again after a restart
+			logrus.Errorln(err)
+		}
+	}
+}
+
+// len returns the number of spooled dead letters.
+func (s *deadLetterSpool) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.pending)
+}
+
+// rewrite replaces the spool file with the pending dead letters. The caller
+// holds the lock.
+func (s *deadLetterSpool) rewrite() error {
+	var data []byte
+	for _, d := range s.pending {
+		line, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// flushDeadLetterSpool periodically moves the spooled dead letters to the
+// dead letter store.
+func (h *Hub) flushDeadLetterSpool() {
+	ticker := time.NewTicker(deadLetterSpoolPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.spool.flush(h.deadLetterStore)
+	}
+}
@@ -0,0 +1,100 @@
+package notification
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// flakyStore fails to save dead letters while down.
+type flakyStore struct {
+	mu    sync.Mutex
+	down  bool
+	saved []string
+}
+
+func (s *flakyStore) Transient(err error) bool {
+	if t, ok := err.(interface{ Transient() bool }); ok {
+		return t.Transient()
+	}
+	return err == errUnreachable
+}
+
+func (s *flakyStore) SaveDeadLetter(hiveHex string, sectorHex string, message []byte, cause error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.down {
+		return false, errUnreachable
+	}
+	s.saved = append(s.saved, string(message))
+	return s.Transient(cause), nil
+}
+
+func (s *flakyStore) ResolveDeadLetter(deadLetterID string, cause error) (bool, error) {
+	return false, nil
+}
+
+func (s *flakyStore) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func failedEvent(message string, err error) *eventResult {
+	return &eventResult{
+		event: &event{hiveHex: "hive", sectorHex: "sector", message: []byte(message)},
+		err:   err,
+	}
+}
+
+func TestDeadLettersAreSpooledWhileStoreIsDown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letters")
+	store := &flakyStore{down: true}
+
+	hub := NewHub()
+	hub.RegisterDeadLetterStore(store)
+	if err := hub.SetDeadLetterSpool(path); err != nil {
+		t.Fatal(err)
+	}
+
+	transient := failedEvent("a", errUnreachable)
+	hub.deadLetter(transient)
+	if !transient.queued {
+		t.Error("expected the spooled transient failure to be queued")
+	}
+	permanent := failedEvent("b", errors.New("invalid"))
+	hub.deadLetter(permanent)
+	if permanent.queued {
+		t.Error("expected the spooled permanent failure not to be queued")
+	}
+
+	// a restarted hub loads the spool and stores it once the store is back
+	restarted := NewHub()
+	restarted.RegisterDeadLetterStore(store)
+	if err := restarted.SetDeadLetterSpool(path); err != nil {
+		t.Fatal(err)
+	}
+	restarted.spool.flush(store)
+	if n := restarted.spool.len(); n != 2 {
+		t.Fatalf("expected 2 spooled dead letters while the store is down, got %d", n)
+	}
+
+	store.setDown(false)
+	restarted.spool.flush(store)
+	if n := restarted.spool.len(); n != 0 {
+		t.Errorf("expected an empty spool, got %d", n)
+	}
+	if len(store.saved) != 2 || store.saved[0] != "a" || store.saved[1] != "b" {
+		t.Errorf("expected a and b to be stored in order, got %v", store.saved)
+	}
+
+	reloaded := NewHub()
+	if err := reloaded.SetDeadLetterSpool(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := reloaded.spool.len(); n != 0 {
+		t.Errorf("expected the spool file to be emptied, got %d", n)
+	}
+}
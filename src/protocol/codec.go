@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// Encodings lists the wire encodings supported by the hive in order of
+// preference.
+var Encodings = []string{EncodingMsgpack, EncodingJSON}
+
+// Codec translates between the canonical JSON form of an envelope, which is
+// what the hive processes, and the frames of one wire encoding.
+type Codec interface {
+	// Binary reports whether frames are sent as binary websocket messages.
+	Binary() bool
+	Encode(message []byte) ([]byte, error)
+	Decode(frame []byte) ([]byte, error)
+}
+
+// CodecFor returns the codec of an encoding. Unknown encodings fall back to
+// JSON.
+func CodecFor(encoding string) Codec {
+	if encoding == EncodingMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Encode(message []byte) ([]byte, error) {
+	return message, nil
+}
+
+func (jsonCodec) Decode(frame []byte) ([]byte, error) {
+	return frame, nil
+}
+
+// msgpackFrame is the MessagePack form of an envelope. Unlike the JSON
+// envelope the payload is embedded as a map instead of an encoded string:
+//
+//	{"type": "factionCreated", "payload": {"FactionId": 1, "Tag": "ABC", ...}}
+type msgpackFrame struct {
+	ID      string             `msgpack:"id,omitempty"`
+	Type    string             `msgpack:"type"`
+	Payload msgpack.RawMessage `msgpack:"payload,omitempty"`
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Encode(message []byte) ([]byte, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, err
+	}
+
+	f := msgpackFrame{
+		ID:   envelope.ID,
+		Type: envelope.Type,
+	}
+	if envelope.Raw != "" {
+		var payload interface{}
+		decoder := json.NewDecoder(bytes.NewReader([]byte(envelope.Raw)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err != nil {
+			return nil, err
+		}
+
+		data, err := msgpack.Marshal(fromJSON(payload))
+		if err != nil {
+			return nil, err
+		}
+		f.Payload = data
+	}
+
+	return msgpack.Marshal(f)
+}
+
+func (msgpackCodec) Decode(frame []byte) ([]byte, error) {
+	var f msgpackFrame
+	if err := msgpack.Unmarshal(frame, &f); err != nil {
+		return nil, err
+	}
+
+	envelope := Envelope{
+		ID:   f.ID,
+		Type: f.Type,
+	}
+	if len(f.Payload) > 0 {
+		// maps are decoded with keys of any type, see toJSON
+		decoder := msgpack.NewDecoder(bytes.NewReader(f.Payload))
+		decoder.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) {
+			return d.DecodeUntypedMap()
+		})
+		payload, err := decoder.DecodeInterface()
+		if err != nil {
+			return nil, err
+		}
+
+		if payload != nil {
+			data, err := json.Marshal(toJSON(payload))
+			if err != nil {
+				return nil, err
+			}
+			envelope.Raw = string(data)
+		}
+	}
+
+	return json.Marshal(envelope)
+}
+
+// fromJSON replaces the json.Number values of a decoded JSON document with
+// integers where possible, so they are not encoded as strings.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = fromJSON(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = fromJSON(child)
+		}
+	}
+	return v
+}
+
+// toJSON converts maps with non string keys, which MessagePack allows, into
+// maps encodable as JSON.
+func toJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[fmt.Sprint(k)] = toJSON(child)
+		}
+		return m
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = toJSON(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = toJSON(child)
+		}
+	}
+	return v
+}
@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// testEnvelopes returns an envelope of every type in its JSON form.
+func testEnvelopes(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	payloads := map[string]interface{}{
+		TypeHello: Hello{
+			ProtocolVersion:    Version,
+			MinProtocolVersion: MinVersion,
+			PluginVersion:      "1.2.3",
+			Events:             []string{"factionCreated", "factionDeclareWar"},
+			Encodings:          []string{EncodingMsgpack, EncodingJSON},
+		},
+		TypeWelcome: Welcome{
+			ProtocolVersion: Version,
+			Events:          []string{},
+			Encoding:        EncodingMsgpack,
+		},
+		TypeAck: Ack{
+			EventID: "event-1",
+			Queued:  true,
+			Code:    "unavailable",
+			Message: "no reachable servers",
+		},
+		TypeAnnouncement: Announcement{
+			Message: "restart in 5 minutes",
+		},
+	}
+
+	envelopes := make(map[string][]byte)
+	for messageType, payload := range payloads {
+		message, err := Message(messageType, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelopes[messageType] = message
+	}
+
+	// a sector event with an id, nested values and numbers of every kind
+	event, err := json.Marshal(Envelope{
+		ID:   "event-2",
+		Type: "factionCreated",
+		Raw:  `{"FactionId":7,"Tag":"ABC","FounderSteamId":76561198000000001,"Score":-3,"Ratio":0.5,"Private":null,"Members":[{"Id":1,"Leader":true}]}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes["event"] = event
+
+	empty, err := json.Marshal(Envelope{Type: "ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes["empty"] = empty
+
+	return envelopes
+}
+
+// decodeJSON decodes a JSON document keeping the numbers exact.
+func decodeJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+
+	if data == "" {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, encoding := range Encodings {
+		codec := CodecFor(encoding)
+		for name, message := range testEnvelopes(t) {
+			frame, err := codec.Encode(message)
+			if err != nil {
+				t.Fatalf("%s %s: encode: %v", encoding, name, err)
+			}
+			decoded, err := codec.Decode(frame)
+			if err != nil {
+				t.Fatalf("%s %s: decode: %v", encoding, name, err)
+			}
+
+			var want, got Envelope
+			if err := json.Unmarshal(message, &want); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(decoded, &got); err != nil {
+				t.Fatalf("%s %s: %v", encoding, name, err)
+			}
+			if got.ID != want.ID || got.Type != want.Type {
+				t.Errorf("%s %s: got %s %s, want %s %s", encoding, name, got.ID, got.Type, want.ID, want.Type)
+			}
+			if !reflect.DeepEqual(decodeJSON(t, got.Raw), decodeJSON(t, want.Raw)) {
+				t.Errorf("%s %s: got payload %s, want %s", encoding, name, got.Raw, want.Raw)
+			}
+		}
+	}
+}
+
+func TestMsgpackFrameLayout(t *testing.T) {
+	message, err := json.Marshal(Envelope{
+		ID:   "event-1",
+		Type: "factionCreated",
+		Raw:  `{"FactionId":7,"FounderSteamId":76561198000000001}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := CodecFor(EncodingMsgpack).Encode(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CodecFor(EncodingMsgpack).Binary() {
+		t.Error("msgpack frames are not binary")
+	}
+
+	// the payload is embedded as map with integer values, not as string
+	var f map[string]interface{}
+	if err := msgpack.Unmarshal(frame, &f); err != nil {
+		t.Fatal(err)
+	}
+	payload, ok := f["payload"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("got payload %T, want a map", f["payload"])
+	}
+	if f["id"] != "event-1" || f["type"] != "factionCreated" {
+		t.Errorf("got id %v type %v", f["id"], f["type"])
+	}
+	if v, ok := payload["FounderSteamId"].(int64); !ok || v != 76561198000000001 {
+		t.Errorf("got steam id %T %v", payload["FounderSteamId"], payload["FounderSteamId"])
+	}
+}
+
+func TestDecodeMsgpackWithIntegerKeys(t *testing.T) {
+	payload, err := msgpack.Marshal(map[interface{}]interface{}{
+		int64(1): "one",
+		"nested": map[interface{}]interface{}{true: int64(2)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := msgpack.Marshal(map[string]interface{}{
+		"type":    "test",
+		"payload": msgpack.RawMessage(payload),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := CodecFor(EncodingMsgpack).Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Raw != `{"1":"one","nested":{"true":2}}` {
+		t.Errorf("got %s", envelope.Raw)
+	}
+}
@@ -0,0 +1,251 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Version is the newest protocol version spoken by the hive.
+	Version = 2
+
+	// MinVersion is the oldest protocol version the hive accepts.
+	MinVersion = LegacyVersion
+
+	// LegacyVersion is assigned to sectors that connect without a handshake.
+	LegacyVersion = 1
+
+	// AckVersion is the first protocol version whose events are answered with
+	// an ack instead of an echo.
+	AckVersion = 2
+)
+
+const (
+	TypeHello        = "hello"
+	TypeWelcome      = "welcome"
+	TypeAck          = "ack"
+	TypeAnnouncement = "announcement"
+)
+
+// Announcement is a message of the hive operators for the players of a
+// sector.
+type Announcement struct {
+	Message string `json:"message"`
+}
+
+// Close codes sent to sectors when the hive ends a connection.
+const (
+	CloseProtocolError       = 4000
+	CloseIncompatibleVersion = 4001
+	// CloseSectorTakenOver closes a connection replaced by a new connection of
+	// the same sector.
+	CloseSectorTakenOver = 4002
+	// CloseSectorConnected rejects a connection of a sector that is already
+	// connected.
+	CloseSectorConnected = 4003
+)
+
+// RestartReason is the reason of the close frame sent when the hive shuts
+// down, announcing when the sector should reconnect.
+func RestartReason(reconnect time.Duration) string {
+	return fmt.Sprintf("hive restarting, reconnect in %d seconds", int(reconnect.Seconds()))
+}
+
+// ParseRestartReason returns the reconnect delay announced by a RestartReason.
+func ParseRestartReason(reason string) (time.Duration, bool) {
+	var seconds int
+	if _, err := fmt.Sscanf(reason, "hive restarting, reconnect in %d seconds", &seconds); err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Envelope wraps every message exchanged between a sector and the hive.
+type Envelope struct {
+	// ID identifies an event of a sector, events resent with the same id are
+	// only processed once. Empty for messages without side effects.
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+	Raw  string `json:"raw"`
+}
+
+// MaxEventIDLength is the longest event id accepted from a sector.
+const MaxEventIDLength = 64
+
+// Hello is the first message a sector sends after connecting.
+type Hello struct {
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version,omitempty"`
+	PluginVersion      string   `json:"plugin_version"`
+	Events             []string `json:"events"`
+
+	// Encodings the sector can read and write, in order of preference.
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+// Welcome is the reply of the hive to a compatible Hello. The welcome and all
+// following messages in both directions use the negotiated encoding.
+type Welcome struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Events          []string `json:"events"`
+	Encoding        string   `json:"encoding"`
+}
+
+// Ack answers an event of a sector. An event that failed was not applied by
+// the hive, the sector should roll back its local changes.
+type Ack struct {
+	EventID string `json:"event_id"`
+	Success bool   `json:"success"`
+	// Duplicate is set for an event that was processed before.
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Queued is set for an event that failed temporarily and is retried by
+	// the hive, it must not be rolled back. Its final result is sent as
+	// another ack.
+	Queued bool `json:"queued,omitempty"`
+	// Refused is set for an event the hive did not take because it shuts
+	// down or still processes an earlier copy of the event, the sector
+	// resends it after reconnecting unless the event is acknowledged before.
+	Refused bool   `json:"refused,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Field   string `json:"field,omitempty"`
+}
+
+type VersionError struct {
+	Requested    int
+	RequestedMin int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("protocol version %d (min %d) is not supported, hive speaks %d to %d", e.Requested, e.RequestedMin, MinVersion, Version)
+}
+
+// LegacyHello describes a sector that started sending events without a
+// handshake.
+func LegacyHello() Hello {
+	return Hello{
+		ProtocolVersion: LegacyVersion,
+	}
+}
+
+// Negotiate picks the highest protocol version both sides speak and the event
+// types both sides support. A Hello without event types accepts all of them.
+func Negotiate(hello Hello, events []string) (Welcome, error) {
+	version := hello.ProtocolVersion
+	if version > Version {
+		version = Version
+	}
+	if version < MinVersion || version < hello.MinProtocolVersion {
+		return Welcome{}, &VersionError{
+			Requested:    hello.ProtocolVersion,
+			RequestedMin: hello.MinProtocolVersion,
+		}
+	}
+
+	welcome := Welcome{
+		ProtocolVersion: version,
+		Encoding:        negotiateEncoding(hello.Encodings),
+	}
+	if len(hello.Events) == 0 {
+		welcome.Events = events
+		return welcome, nil
+	}
+
+	supported := make(map[string]bool, len(hello.Events))
+	for _, v := range hello.Events {
+		supported[v] = true
+	}
+	for _, v := range events {
+		if supported[v] {
+			welcome.Events = append(welcome.Events, v)
+		}
+	}
+
+	return welcome, nil
+}
+
+func negotiateEncoding(encodings []string) string {
+	for _, v := range encodings {
+		for _, supported := range Encodings {
+			if v == supported {
+				return v
+			}
+		}
+	}
+	return EncodingJSON
+}
+
+// Codec returns the codec of the negotiated encoding.
+func (w Welcome) Codec() Codec {
+	return CodecFor(w.Encoding)
+}
+
+// Acknowledges reports whether the events of the sector are answered with an
+// ack.
+func (w Welcome) Acknowledges() bool {
+	return w.ProtocolVersion >= AckVersion
+}
+
+// Accepts reports whether the sector negotiated the event type. Protocol
+// messages are always accepted.
+func (w Welcome) Accepts(eventType string) bool {
+	if eventType == TypeHello || eventType == TypeWelcome {
+		return true
+	}
+	if eventType == TypeAck || eventType == TypeAnnouncement {
+		return w.Acknowledges()
+	}
+
+	for _, v := range w.Events {
+		if v == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert prepares a message of the current protocol version for a sector
+// that negotiated w and encodes it as frame. It reports false if the sector
+// does not understand the message at all.
+func (w Welcome) Convert(message []byte) ([]byte, bool) {
+	var envelope Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, false
+	}
+
+	if !w.Accepts(envelope.Type) {
+		return nil, false
+	}
+
+	if w.ProtocolVersion < Version {
+		// legacy sectors only know the plain envelope
+		data, err := json.Marshal(Envelope{
+			Type: envelope.Type,
+			Raw:  envelope.Raw,
+		})
+		if err != nil {
+			return nil, false
+		}
+		message = data
+	}
+
+	frame, err := w.Codec().Encode(message)
+	if err != nil {
+		return nil, false
+	}
+	return frame, true
+}
+
+// Message encodes v as raw payload of an envelope of the given type.
+func Message(messageType string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Envelope{
+		Type: messageType,
+		Raw:  string(data),
+	})
+}
@@ -0,0 +1,245 @@
+// Package schema validates JSON documents against the subset of JSON Schema
+// used to describe sector events. Unlike JSON Schema, property names match
+// case-insensitively, as encoding/json matches them when the events are
+// decoded.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Draft is the JSON Schema dialect of the published schemas.
+const Draft = "http://json-schema.org/draft-07/schema#"
+
+const (
+	TypeObject  = "object"
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+)
+
+// Schema is a JSON Schema. Only the keywords below are supported.
+type Schema struct {
+	Schema      string `json:"$schema,omitempty"`
+	ID          string `json:"$id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type string        `json:"type"`
+	Enum []interface{} `json:"enum,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+
+	MinLength *int `json:"minLength,omitempty"`
+	MaxLength *int `json:"maxLength,omitempty"`
+
+	Minimum *json.Number `json:"minimum,omitempty"`
+	Maximum *json.Number `json:"maximum,omitempty"`
+}
+
+// Error is a violation of a schema.
+type Error struct {
+	// Path is the dot separated path of the invalid value, empty for the
+	// document itself.
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Errors lists every violation of a document.
+type Errors []Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, v := range e {
+		messages[i] = v.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate checks the JSON document data against s. It returns Errors if the
+// document is invalid.
+func (s *Schema) Validate(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return Errors{{Message: "malformed JSON: " + err.Error()}}
+	}
+	if decoder.More() {
+		return Errors{{Message: "malformed JSON: trailing data"}}
+	}
+
+	var errs Errors
+	s.validate("", v, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func (s *Schema) validate(path string, v interface{}, errs *Errors) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, Error{
+			Path:    path,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	switch s.Type {
+	case TypeObject:
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		s.validateObject(path, object, errs)
+	case TypeString:
+		str, ok := v.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		length := len([]rune(str))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+	case TypeInteger, TypeNumber:
+		number, ok := v.(json.Number)
+		if !ok {
+			fail("must be a number")
+			return
+		}
+		value, ok := new(big.Float).SetString(string(number))
+		if !ok {
+			fail("must be a number")
+			return
+		}
+		if s.Type == TypeInteger && !value.IsInt() {
+			fail("must be an integer")
+			return
+		}
+		if s.Minimum != nil && value.Cmp(bound(*s.Minimum)) < 0 {
+			fail("must be at least %s", *s.Minimum)
+		}
+		if s.Maximum != nil && value.Cmp(bound(*s.Maximum)) > 0 {
+			fail("must be at most %s", *s.Maximum)
+		}
+	case TypeBoolean:
+		if _, ok := v.(bool); !ok {
+			fail("must be a boolean")
+			return
+		}
+	}
+
+	if len(s.Enum) > 0 && !s.allows(v) {
+		values := make([]string, len(s.Enum))
+		for i, allowed := range s.Enum {
+			data, _ := json.Marshal(allowed)
+			values[i] = string(data)
+		}
+		fail("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func (s *Schema) validateObject(path string, object map[string]interface{}, errs *Errors) {
+	for _, name := range s.Required {
+		if !hasProperty(object, name) {
+			*errs = append(*errs, Error{
+				Path:    join(path, name),
+				Message: "is required",
+			})
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		property, ok := s.property(name)
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*errs = append(*errs, Error{
+					Path:    join(path, name),
+					Message: "is not allowed",
+				})
+			}
+			continue
+		}
+		property.validate(join(path, name), object[name], errs)
+	}
+}
+
+// property returns the schema of the property name.
+func (s *Schema) property(name string) (*Schema, bool) {
+	if property, ok := s.Properties[name]; ok {
+		return property, true
+	}
+	for key, property := range s.Properties {
+		if strings.EqualFold(key, name) {
+			return property, true
+		}
+	}
+	return nil, false
+}
+
+// hasProperty reports whether object has the property name.
+func hasProperty(object map[string]interface{}, name string) bool {
+	if _, ok := object[name]; ok {
+		return true
+	}
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) allows(v interface{}) bool {
+	for _, allowed := range s.Enum {
+		if number, ok := v.(json.Number); ok {
+			if fmt.Sprint(allowed) == string(number) {
+				return true
+			}
+			continue
+		}
+		if allowed == v {
+			return true
+		}
+	}
+	return false
+}
+
+func bound(n json.Number) *big.Float {
+	value, _ := new(big.Float).SetString(string(n))
+	return value
+}
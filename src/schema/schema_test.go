@@ -0,0 +1,77 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func testSchema() *Schema {
+	closed := false
+	minLength := 1
+	minimum := json.Number("1")
+	return &Schema{
+		Type: TypeObject,
+		Properties: map[string]*Schema{
+			"FactionId": {Type: TypeInteger, Minimum: &minimum},
+			"Tag":       {Type: TypeString, MinLength: &minLength},
+			"Peace":     {Type: TypeBoolean},
+			"State":     {Type: TypeString, Enum: []interface{}{"Loaded", "Unloading"}},
+		},
+		Required:             []string{"FactionId", "Tag"},
+		AdditionalProperties: &closed,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		errors []Error
+	}{
+		{"valid", `{"FactionId": 76561198000000001, "Tag": "ABC", "Peace": true, "State": "Loaded"}`, nil},
+		{"malformed", `{"FactionId":`, []Error{{"", "malformed JSON: unexpected EOF"}}},
+		{"not an object", `[]`, []Error{{"", "must be an object"}}},
+		{"missing", `{}`, []Error{{"FactionId", "is required"}, {"Tag", "is required"}}},
+		{"zero id", `{"FactionId": 0, "Tag": "ABC"}`, []Error{{"FactionId", "must be at least 1"}}},
+		{"fraction", `{"FactionId": 1.5, "Tag": "ABC"}`, []Error{{"FactionId", "must be an integer"}}},
+		{"id as string", `{"FactionId": "1", "Tag": "ABC"}`, []Error{{"FactionId", "must be a number"}}},
+		{"empty tag", `{"FactionId": 1, "Tag": ""}`, []Error{{"Tag", "must be at least 1 characters long"}}},
+		{"boolean", `{"FactionId": 1, "Tag": "ABC", "Peace": 1}`, []Error{{"Peace", "must be a boolean"}}},
+		{"enum", `{"FactionId": 1, "Tag": "ABC", "State": "Loading"}`, []Error{{"State", `must be one of "Loaded", "Unloading"`}}},
+		{"unknown", `{"FactionId": 1, "Tag": "ABC", "Name": "x"}`, []Error{{"Name", "is not allowed"}}},
+		{"other case", `{"factionID": 1, "TAG": "ABC"}`, nil},
+		{"other case invalid", `{"factionid": 0, "tag": "ABC"}`, []Error{{"factionid", "must be at least 1"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := testSchema().Validate([]byte(test.data))
+			if test.errors == nil {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("expected validation errors, got %v", err)
+			}
+			if len(errs) != len(test.errors) {
+				t.Fatalf("expected %v, got %v", test.errors, errs)
+			}
+			for i := range errs {
+				if errs[i] != test.errors[i] {
+					t.Errorf("expected %v, got %v", test.errors[i], errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestErrorsJoinPaths(t *testing.T) {
+	errs := Errors{{"FactionId", "is required"}, {"", "must be an object"}}
+	if got := errs.Error(); got != "FactionId: is required; must be an object" {
+		t.Errorf("unexpected message %q", got)
+	}
+}
@@ -0,0 +1,506 @@
+package store
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// match reports whether the document matches the query filter.
+func match(doc bson.M, filter bson.M) bool {
+	for key, cond := range filter {
+		switch key {
+		case "$and":
+			for _, sub := range asArray(cond) {
+				subFilter, _ := asDoc(sub)
+				if !match(doc, subFilter) {
+					return false
+				}
+			}
+		case "$or":
+			matched := false
+			for _, sub := range asArray(cond) {
+				subFilter, _ := asDoc(sub)
+				if match(doc, subFilter) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		default:
+			if !matchCond(resolve(doc, strings.Split(key, ".")), cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchCond reports whether one of the values of a field matches the
+// condition, either a value or a document of operators.
+func matchCond(values []interface{}, cond interface{}) bool {
+	ops, ok := asDoc(cond)
+	if !ok || !isOperators(ops) {
+		return matchEqual(values, cond)
+	}
+
+	for op, arg := range ops {
+		var matched bool
+		switch op {
+		case "$eq":
+			matched = matchEqual(values, arg)
+		case "$ne":
+			matched = !matchEqual(values, arg)
+		case "$gt", "$gte", "$lt", "$lte":
+			for _, v := range expand(values) {
+				if !comparable(v, arg) {
+					continue
+				}
+				c := compare(v, arg)
+				if op == "$gt" && c > 0 || op == "$gte" && c >= 0 || op == "$lt" && c < 0 || op == "$lte" && c <= 0 {
+					matched = true
+					break
+				}
+			}
+		case "$in":
+			matched = matchIn(values, arg)
+		case "$nin":
+			matched = !matchIn(values, arg)
+		case "$exists":
+			exists, _ := arg.(bool)
+			matched = (len(values) > 0) == exists
+		case "$regex":
+			matched = matchEqual(values, bson.RegEx{Pattern: arg.(string), Options: stringOption(ops["$options"])})
+		case "$options":
+			matched = true
+		case "$elemMatch":
+			sub, _ := asDoc(arg)
+			for _, v := range values {
+				for _, elem := range asArray(v) {
+					if matchElem(elem, sub) {
+						matched = true
+						break
+					}
+				}
+			}
+		default:
+			// unsupported operators never match
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchElem reports whether an array element matches the condition of an
+// $elemMatch, either a filter of the element fields or operators on the
+// element itself.
+func matchElem(elem interface{}, cond bson.M) bool {
+	if isOperators(cond) {
+		return matchCond([]interface{}{elem}, cond)
+	}
+	doc, ok := asDoc(elem)
+	return ok && match(doc, cond)
+}
+
+func matchEqual(values []interface{}, want interface{}) bool {
+	if len(values) == 0 {
+		return want == nil
+	}
+
+	re, isRegex := want.(bson.RegEx)
+	for _, v := range values {
+		if isRegex {
+			if matchRegex(v, re) {
+				return true
+			}
+			continue
+		}
+		if equal(v, want) {
+			return true
+		}
+		for _, elem := range asArray(v) {
+			if equal(elem, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchIn(values []interface{}, arg interface{}) bool {
+	for _, want := range asArray(arg) {
+		if matchEqual(values, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRegex(v interface{}, re bson.RegEx) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	pattern := re.Pattern
+	if strings.Contains(re.Options, "i") {
+		pattern = "(?i)" + pattern
+	}
+	compiled, err := regexp.Compile(pattern)
+	return err == nil && compiled.MatchString(s)
+}
+
+func stringOption(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// resolve returns the values at a dotted path. Arrays on the way are
+// descended into, so a path can match several values.
+func resolve(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+
+	if doc, ok := asDoc(v); ok {
+		child, ok := doc[parts[0]]
+		if !ok {
+			return nil
+		}
+		return resolve(child, parts[1:])
+	}
+
+	if arr, ok := v.([]interface{}); ok {
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i < 0 || i >= len(arr) {
+				return nil
+			}
+			return resolve(arr[i], parts[1:])
+		}
+
+		var values []interface{}
+		for _, elem := range arr {
+			if _, ok := asDoc(elem); ok {
+				values = append(values, resolve(elem, parts)...)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// lookup returns the first value at a dotted path or nil.
+func lookup(doc bson.M, path string) interface{} {
+	values := resolve(doc, strings.Split(path, "."))
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// expand adds the elements of array values to the values.
+func expand(values []interface{}) []interface{} {
+	var expanded []interface{}
+	for _, v := range values {
+		expanded = append(expanded, v)
+		expanded = append(expanded, asArray(v)...)
+	}
+	return expanded
+}
+
+func asDoc(v interface{}) (bson.M, bool) {
+	switch t := v.(type) {
+	case bson.M:
+		return t, true
+	case map[string]interface{}:
+		return bson.M(t), true
+	}
+	return nil, false
+}
+
+func asArray(v interface{}) []interface{} {
+	arr, _ := v.([]interface{})
+	return arr
+}
+
+func isOperators(doc bson.M) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// number returns a numeric value as int64 or float64.
+func number(v interface{}) (int64, float64, bool, bool) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), 0, true, true
+	case int32:
+		return int64(t), 0, true, true
+	case int64:
+		return t, 0, true, true
+	case float64:
+		return 0, t, false, true
+	}
+	return 0, 0, false, false
+}
+
+func equal(a, b interface{}) bool {
+	if _, _, _, ok := number(a); ok {
+		if _, _, _, ok := number(b); ok {
+			return compare(a, b) == 0
+		}
+		return false
+	}
+
+	switch ta := a.(type) {
+	case time.Time:
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	case []interface{}:
+		tb, ok := b.([]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !equal(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if da, ok := asDoc(a); ok {
+		db, ok := asDoc(b)
+		if !ok || len(da) != len(db) {
+			return false
+		}
+		for key, v := range da {
+			w, ok := db[key]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// typeOrder ranks the types like the sort order of MongoDB.
+func typeOrder(v interface{}) int {
+	if _, _, _, ok := number(v); ok {
+		return 1
+	}
+	switch v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 2
+	case bson.M, map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case []byte:
+		return 5
+	case bson.ObjectId:
+		return 6
+	case bool:
+		return 7
+	case time.Time:
+		return 8
+	}
+	return 9
+}
+
+func comparable(a, b interface{}) bool {
+	return typeOrder(a) == typeOrder(b)
+}
+
+// compare orders two values, values of different types by their type.
+func compare(a, b interface{}) int {
+	oa, ob := typeOrder(a), typeOrder(b)
+	if oa != ob {
+		return oa - ob
+	}
+
+	switch ta := a.(type) {
+	case string:
+		return strings.Compare(ta, b.(string))
+	case []byte:
+		return bytes.Compare(ta, b.([]byte))
+	case bson.ObjectId:
+		return strings.Compare(string(ta), string(b.(bson.ObjectId)))
+	case bool:
+		tb := b.(bool)
+		switch {
+		case ta == tb:
+			return 0
+		case tb:
+			return -1
+		}
+		return 1
+	case time.Time:
+		tb := b.(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+
+	ia, fa, aInt, aOK := number(a)
+	ib, fb, bInt, bOK := number(b)
+	if !aOK || !bOK {
+		return 0
+	}
+	if aInt && bInt {
+		switch {
+		case ia < ib:
+			return -1
+		case ia > ib:
+			return 1
+		}
+		return 0
+	}
+	if aInt {
+		fa = float64(ia)
+	}
+	if bInt {
+		fb = float64(ib)
+	}
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	}
+	return 0
+}
+
+// project applies a field selector of inclusions or exclusions.
+func project(doc bson.M, selector bson.M) bson.M {
+	include := false
+	for key, v := range selector {
+		if key != "_id" && truthy(v) {
+			include = true
+		}
+	}
+
+	if !include {
+		projected := copyDoc(doc)
+		for key, v := range selector {
+			if !truthy(v) {
+				unsetPath(projected, strings.Split(key, "."))
+			}
+		}
+		return projected
+	}
+
+	tree := bson.M{}
+	for key, v := range selector {
+		if !truthy(v) {
+			continue
+		}
+		node := tree
+		parts := strings.Split(key, ".")
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				node[part] = true
+				break
+			}
+			child, ok := node[part].(bson.M)
+			if !ok {
+				child = bson.M{}
+				node[part] = child
+			}
+			node = child
+		}
+	}
+	if v, ok := selector["_id"]; !ok || truthy(v) {
+		tree["_id"] = true
+	}
+
+	return projectTree(doc, tree)
+}
+
+func projectTree(doc bson.M, tree bson.M) bson.M {
+	projected := bson.M{}
+	for key, node := range tree {
+		v, ok := doc[key]
+		if !ok {
+			continue
+		}
+
+		sub, ok := node.(bson.M)
+		if !ok {
+			projected[key] = copyValue(v)
+			continue
+		}
+
+		if d, ok := asDoc(v); ok {
+			projected[key] = projectTree(d, sub)
+		} else if arr, ok := v.([]interface{}); ok {
+			elems := make([]interface{}, 0, len(arr))
+			for _, elem := range arr {
+				if d, ok := asDoc(elem); ok {
+					elems = append(elems, projectTree(d, sub))
+				}
+			}
+			projected[key] = elems
+		}
+	}
+	return projected
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	i, f, isInt, ok := number(v)
+	if !ok {
+		return true
+	}
+	if isInt {
+		return i != 0
+	}
+	return f != 0
+}
+
+func copyDoc(doc bson.M) bson.M {
+	return copyValue(doc).(bson.M)
+}
+
+func copyValue(v interface{}) interface{} {
+	if doc, ok := asDoc(v); ok {
+		copied := make(bson.M, len(doc))
+		for key, value := range doc {
+			copied[key] = copyValue(value)
+		}
+		return copied
+	}
+	if arr, ok := v.([]interface{}); ok {
+		copied := make([]interface{}, len(arr))
+		for i, value := range arr {
+			copied[i] = copyValue(value)
+		}
+		return copied
+	}
+	return v
+}
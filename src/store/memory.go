@@ -0,0 +1,384 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// NewMemory returns an empty in-memory store. It supports the query and
+// update operators the hive system uses, ignores indexes and keeps the
+// documents of a collection in insertion order.
+func NewMemory() Session {
+	return &memorySession{
+		m: &memory{
+			collections: make(map[string][]bson.M),
+		},
+	}
+}
+
+type memory struct {
+	mu          sync.Mutex
+	collections map[string][]bson.M
+}
+
+type memorySession struct {
+	m *memory
+}
+
+func (s *memorySession) Copy() Session {
+	return s
+}
+
+func (s *memorySession) Close() {}
+
+func (s *memorySession) DB(name string) Database {
+	return memoryDatabase{m: s.m, name: name}
+}
+
+type memoryDatabase struct {
+	m    *memory
+	name string
+}
+
+func (d memoryDatabase) C(name string) Collection {
+	return memoryCollection{m: d.m, name: d.name + "." + name}
+}
+
+type memoryCollection struct {
+	m    *memory
+	name string
+}
+
+func (c memoryCollection) Find(query interface{}) Query {
+	return &memoryQuery{c: c, filter: query}
+}
+
+func (c memoryCollection) FindId(id interface{}) Query {
+	return &memoryQuery{c: c, filter: bson.M{"_id": id}}
+}
+
+func (c memoryCollection) Insert(docs ...interface{}) error {
+	normalized := make([]bson.M, 0, len(docs))
+	for _, v := range docs {
+		doc, err := toDoc(v)
+		if err != nil {
+			return err
+		}
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = bson.NewObjectId()
+		}
+		normalized = append(normalized, doc)
+	}
+
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	for _, doc := range normalized {
+		if c.indexOf(doc["_id"]) >= 0 {
+			return duplicateKey(doc["_id"])
+		}
+		c.m.collections[c.name] = append(c.m.collections[c.name], doc)
+	}
+	return nil
+}
+
+func (c memoryCollection) Update(selector interface{}, update interface{}) error {
+	info, err := c.update(selector, update, false)
+	if err == nil && info.Matched == 0 {
+		return mgo.ErrNotFound
+	}
+	return err
+}
+
+func (c memoryCollection) UpdateId(id interface{}, update interface{}) error {
+	return c.Update(bson.M{"_id": id}, update)
+}
+
+func (c memoryCollection) UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	return c.update(selector, update, true)
+}
+
+func (c memoryCollection) UpsertId(id interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	info, err := c.update(bson.M{"_id": id}, update, false)
+	if err != nil || info.Matched > 0 {
+		return info, err
+	}
+
+	doc, err := toDoc(bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+	u, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	doc, err = applyUpdate(doc, u, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	if c.indexOf(doc["_id"]) >= 0 {
+		return nil, duplicateKey(doc["_id"])
+	}
+	c.m.collections[c.name] = append(c.m.collections[c.name], doc)
+	return &mgo.ChangeInfo{UpsertedId: id}, nil
+}
+
+func (c memoryCollection) Remove(selector interface{}) error {
+	info, err := c.remove(selector, false)
+	if err == nil && info.Removed == 0 {
+		return mgo.ErrNotFound
+	}
+	return err
+}
+
+func (c memoryCollection) RemoveId(id interface{}) error {
+	return c.Remove(bson.M{"_id": id})
+}
+
+func (c memoryCollection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	return c.remove(selector, true)
+}
+
+func (c memoryCollection) EnsureIndex(index mgo.Index) error {
+	return nil
+}
+
+func (c memoryCollection) EnsureIndexKey(key ...string) error {
+	return nil
+}
+
+// indexOf returns the position of the document with the id, the caller must
+// hold the lock.
+func (c memoryCollection) indexOf(id interface{}) int {
+	for i, doc := range c.m.collections[c.name] {
+		if equal(doc["_id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c memoryCollection) update(selector interface{}, update interface{}, all bool) (*mgo.ChangeInfo, error) {
+	filter, err := toDoc(selector)
+	if err != nil {
+		return nil, err
+	}
+	u, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	info := &mgo.ChangeInfo{}
+	docs := c.m.collections[c.name]
+	for i, doc := range docs {
+		if !match(doc, filter) {
+			continue
+		}
+
+		updated, err := applyUpdate(doc, u, filter)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = updated
+		info.Matched++
+		info.Updated++
+
+		if !all {
+			break
+		}
+	}
+	return info, nil
+}
+
+func (c memoryCollection) remove(selector interface{}, all bool) (*mgo.ChangeInfo, error) {
+	filter, err := toDoc(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	info := &mgo.ChangeInfo{}
+	docs := c.m.collections[c.name]
+	kept := docs[:0]
+	for _, doc := range docs {
+		if (all || info.Removed == 0) && match(doc, filter) {
+			info.Removed++
+			info.Matched++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	for i := len(kept); i < len(docs); i++ {
+		docs[i] = nil
+	}
+	c.m.collections[c.name] = kept
+	return info, nil
+}
+
+type memoryQuery struct {
+	c        memoryCollection
+	filter   interface{}
+	sort     []string
+	limit    int
+	selector interface{}
+}
+
+func (q *memoryQuery) Sort(fields ...string) Query {
+	q.sort = fields
+	return q
+}
+
+func (q *memoryQuery) Limit(n int) Query {
+	q.limit = n
+	return q
+}
+
+func (q *memoryQuery) Select(selector interface{}) Query {
+	q.selector = selector
+	return q
+}
+
+func (q *memoryQuery) Count() (int, error) {
+	docs, err := q.run()
+	return len(docs), err
+}
+
+func (q *memoryQuery) One(result interface{}) error {
+	docs, err := q.run()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	if result == nil {
+		return nil
+	}
+	return fromDoc(docs[0], result)
+}
+
+func (q *memoryQuery) All(result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("store: result argument must be a slice address")
+	}
+
+	docs, err := q.run()
+	if err != nil {
+		return err
+	}
+
+	slicev := resultv.Elem().Slice(0, 0)
+	elemt := slicev.Type().Elem()
+	for _, doc := range docs {
+		elemp := reflect.New(elemt)
+		if err := fromDoc(doc, elemp.Interface()); err != nil {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+// run returns the sorted and projected documents of the query. Documents
+// without projection are shared with the store and must not be changed.
+func (q *memoryQuery) run() ([]bson.M, error) {
+	filter, err := toDoc(q.filter)
+	if err != nil {
+		return nil, err
+	}
+	var selector bson.M
+	if q.selector != nil {
+		selector, err = toDoc(q.selector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q.c.m.mu.Lock()
+	var docs []bson.M
+	for _, doc := range q.c.m.collections[q.c.name] {
+		if match(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+	q.c.m.mu.Unlock()
+
+	if len(q.sort) > 0 {
+		sort.SliceStable(docs, func(i, j int) bool {
+			for _, field := range q.sort {
+				order := 1
+				if strings.HasPrefix(field, "-") {
+					order = -1
+					field = field[1:]
+				}
+				if c := compare(lookup(docs[i], field), lookup(docs[j], field)); c != 0 {
+					return c*order < 0
+				}
+			}
+			return false
+		})
+	}
+	if q.limit > 0 && len(docs) > q.limit {
+		docs = docs[:q.limit]
+	}
+
+	results := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		if selector != nil {
+			doc = project(doc, selector)
+		}
+		results = append(results, doc)
+	}
+	return results, nil
+}
+
+// toDoc converts a document, selector or update to its stored form by a
+// roundtrip through BSON. Nested documents become bson.M and arrays
+// []interface{}.
+func toDoc(v interface{}) (bson.M, error) {
+	doc := bson.M{}
+	if v == nil {
+		return doc, nil
+	}
+
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func fromDoc(doc bson.M, result interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+func duplicateKey(id interface{}) error {
+	return &mgo.LastError{
+		Code: 11000,
+		Err:  fmt.Sprintf("E11000 duplicate key error: _id %v", id),
+	}
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type testMember struct {
+	SteamID  uint64 `bson:"steam_id"`
+	State    string `bson:"state"`
+	IsLeader bool   `bson:"is_leader"`
+}
+
+type testFaction struct {
+	ID      bson.ObjectId `bson:"_id,omitempty"`
+	Tag     string        `bson:"tag"`
+	Score   int           `bson:"score"`
+	Members []testMember  `bson:"members"`
+}
+
+func testCollection(t *testing.T, docs ...interface{}) Collection {
+	t.Helper()
+
+	c := NewMemory().DB("test").C("factions")
+	if len(docs) > 0 {
+		if err := c.Insert(docs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestInsertAndFind(t *testing.T) {
+	id := bson.NewObjectId()
+	c := testCollection(t, testFaction{ID: id, Tag: "ABC"}, testFaction{Tag: "XYZ"})
+
+	var f testFaction
+	if err := c.FindId(id).One(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Tag != "ABC" {
+		t.Errorf("expected ABC, got %s", f.Tag)
+	}
+
+	var all []testFaction
+	if err := c.Find(nil).All(&all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || !all[1].ID.Valid() {
+		t.Errorf("expected two factions with ids, got %+v", all)
+	}
+
+	if err := c.Find(bson.M{"tag": "NOP"}).One(&f); err != mgo.ErrNotFound {
+		t.Errorf("expected %v, got %v", mgo.ErrNotFound, err)
+	}
+	if err := c.Insert(testFaction{ID: id}); !mgo.IsDup(err) {
+		t.Errorf("expected a duplicate key error, got %v", err)
+	}
+}
+
+func TestQueryOperators(t *testing.T) {
+	c := testCollection(t,
+		testFaction{Tag: "AAA", Score: 1, Members: []testMember{{SteamID: 76561198000000001, State: "joined"}}},
+		testFaction{Tag: "AAB", Score: 2, Members: []testMember{{SteamID: 76561198000000002, State: "request_join"}}},
+		testFaction{Tag: "BBB", Score: 3},
+	)
+
+	tests := []struct {
+		name   string
+		filter bson.M
+		count  int
+	}{
+		{"equal", bson.M{"tag": "AAA"}, 1},
+		{"nested array", bson.M{"members.steam_id": uint64(76561198000000002)}, 1},
+		{"gt", bson.M{"score": bson.M{"$gt": 1}}, 2},
+		{"lte", bson.M{"score": bson.M{"$lte": int64(2)}}, 2},
+		{"in", bson.M{"tag": bson.M{"$in": []string{"AAA", "BBB"}}}, 2},
+		{"nin", bson.M{"tag": bson.M{"$nin": []string{"AAA"}}}, 2},
+		{"ne", bson.M{"tag": bson.M{"$ne": "AAA"}}, 2},
+		{"or", bson.M{"$or": []bson.M{{"tag": "AAA"}, {"score": 3}}}, 2},
+		{"and", bson.M{"$and": []bson.M{{"score": bson.M{"$gt": 1}}, {"score": bson.M{"$lt": 3}}}}, 1},
+		{"regex", bson.M{"tag": bson.RegEx{Pattern: "^AA"}}, 2},
+		{"elemMatch", bson.M{"members": bson.M{"$elemMatch": bson.M{"steam_id": 76561198000000001, "state": "joined"}}}, 1},
+		{"elemMatch mismatch", bson.M{"members": bson.M{"$elemMatch": bson.M{"steam_id": 76561198000000001, "state": "request_join"}}}, 0},
+	}
+	for _, test := range tests {
+		count, err := c.Find(test.filter).Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != test.count {
+			t.Errorf("%s: expected %d, got %d", test.name, test.count, count)
+		}
+	}
+}
+
+func TestSortLimitSelect(t *testing.T) {
+	c := testCollection(t,
+		testFaction{Tag: "B", Score: 2},
+		testFaction{Tag: "A", Score: 2},
+		testFaction{Tag: "C", Score: 1},
+	)
+
+	var docs []bson.Raw
+	if err := c.Find(nil).Sort("-score", "tag").Limit(2).Select(bson.M{"tag": 1}).All(&docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 documents, got %d", len(docs))
+	}
+
+	var first bson.M
+	if err := docs[0].Unmarshal(&first); err != nil {
+		t.Fatal(err)
+	}
+	if first["tag"] != "A" || first["score"] != nil || first["_id"] == nil {
+		t.Errorf("unexpected projection %v", first)
+	}
+}
+
+func TestUpdateOperators(t *testing.T) {
+	id := bson.NewObjectId()
+	c := testCollection(t, testFaction{ID: id, Tag: "ABC", Members: []testMember{
+		{SteamID: 1, State: "joined"},
+		{SteamID: 2, State: "request_join"},
+	}})
+
+	err := c.Update(bson.M{"_id": id, "members.steam_id": 2}, bson.M{
+		"$set": bson.M{"members.$.state": "joined"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(bson.M{"_id": id, "members": bson.M{"$elemMatch": bson.M{"steam_id": 1}}}, bson.M{
+		"$set": bson.M{"members.$.is_leader": true},
+		"$inc": bson.M{"score": 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.UpdateId(id, bson.M{
+		"$push": bson.M{"members": testMember{SteamID: 3, State: "request_join"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.UpdateId(id, bson.M{
+		"$pull": bson.M{"members": bson.M{"steam_id": bson.M{"$in": []int{1}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f testFaction
+	if err := c.FindId(id).One(&f); err != nil {
+		t.Fatal(err)
+	}
+	want := []testMember{{SteamID: 2, State: "joined"}, {SteamID: 3, State: "request_join"}}
+	if f.Score != 5 || len(f.Members) != 2 || f.Members[0] != want[0] || f.Members[1] != want[1] {
+		t.Errorf("unexpected faction %+v", f)
+	}
+
+	if err := c.Update(bson.M{"tag": "NOP"}, bson.M{"$set": bson.M{"score": 1}}); err != mgo.ErrNotFound {
+		t.Errorf("expected %v, got %v", mgo.ErrNotFound, err)
+	}
+	if err := c.Update(bson.M{"_id": id, "members.steam_id": 9}, bson.M{"$set": bson.M{"members.$.state": "x"}}); err != mgo.ErrNotFound {
+		t.Errorf("expected %v, got %v", mgo.ErrNotFound, err)
+	}
+}
+
+func TestUpsertAndRemove(t *testing.T) {
+	c := testCollection(t)
+	id := bson.NewObjectId()
+
+	info, err := c.UpsertId(id, testFaction{Tag: "ABC"})
+	if err != nil || info.UpsertedId != id {
+		t.Fatalf("expected an insert, got %+v %v", info, err)
+	}
+	info, err = c.UpsertId(id, testFaction{Tag: "XYZ"})
+	if err != nil || info.Updated != 1 {
+		t.Fatalf("expected an update, got %+v %v", info, err)
+	}
+
+	var f testFaction
+	if err := c.FindId(id).One(&f); err != nil || f.Tag != "XYZ" || f.ID != id {
+		t.Fatalf("unexpected faction %+v %v", f, err)
+	}
+
+	if err := c.Insert(testFaction{Tag: "A"}, testFaction{Tag: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err = c.RemoveAll(bson.M{"tag": "A"})
+	if err != nil || info.Removed != 2 {
+		t.Fatalf("expected 2 removed, got %+v %v", info, err)
+	}
+	if err := c.RemoveId(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveId(id); err != mgo.ErrNotFound {
+		t.Errorf("expected %v, got %v", mgo.ErrNotFound, err)
+	}
+}
@@ -0,0 +1,100 @@
+// Package store abstracts the parts of MongoDB the hive system uses, so the
+// system runs on a real database or on the in-memory store of the tests.
+package store
+
+import (
+	"github.com/globalsign/mgo"
+)
+
+// Session is a connection to the database, see mgo.Session.
+type Session interface {
+	Copy() Session
+	Close()
+	DB(name string) Database
+}
+
+// Database is a database of a session, see mgo.Database.
+type Database interface {
+	C(name string) Collection
+}
+
+// Collection is a collection of a database, see mgo.Collection. Errors match
+// the ones of mgo: mgo.ErrNotFound for missing documents and errors
+// recognized by mgo.IsDup for duplicate keys.
+type Collection interface {
+	Find(query interface{}) Query
+	FindId(id interface{}) Query
+	Insert(docs ...interface{}) error
+	Update(selector interface{}, update interface{}) error
+	UpdateId(id interface{}, update interface{}) error
+	UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error)
+	UpsertId(id interface{}, update interface{}) (*mgo.ChangeInfo, error)
+	Remove(selector interface{}) error
+	RemoveId(id interface{}) error
+	RemoveAll(selector interface{}) (*mgo.ChangeInfo, error)
+	EnsureIndex(index mgo.Index) error
+	EnsureIndexKey(key ...string) error
+}
+
+// Query is a query of a collection, see mgo.Query.
+type Query interface {
+	Sort(fields ...string) Query
+	Limit(n int) Query
+	Select(selector interface{}) Query
+	Count() (int, error)
+	One(result interface{}) error
+	All(result interface{}) error
+}
+
+// Mongo wraps a MongoDB session.
+func Mongo(session *mgo.Session) Session {
+	return mongoSession{session}
+}
+
+type mongoSession struct {
+	*mgo.Session
+}
+
+func (s mongoSession) Copy() Session {
+	return mongoSession{s.Session.Copy()}
+}
+
+func (s mongoSession) DB(name string) Database {
+	return mongoDatabase{s.Session.DB(name)}
+}
+
+type mongoDatabase struct {
+	*mgo.Database
+}
+
+func (d mongoDatabase) C(name string) Collection {
+	return mongoCollection{d.Database.C(name)}
+}
+
+type mongoCollection struct {
+	*mgo.Collection
+}
+
+func (c mongoCollection) Find(query interface{}) Query {
+	return mongoQuery{c.Collection.Find(query)}
+}
+
+func (c mongoCollection) FindId(id interface{}) Query {
+	return mongoQuery{c.Collection.FindId(id)}
+}
+
+type mongoQuery struct {
+	*mgo.Query
+}
+
+func (q mongoQuery) Sort(fields ...string) Query {
+	return mongoQuery{q.Query.Sort(fields...)}
+}
+
+func (q mongoQuery) Limit(n int) Query {
+	return mongoQuery{q.Query.Limit(n)}
+}
+
+func (q mongoQuery) Select(selector interface{}) Query {
+	return mongoQuery{q.Query.Select(selector)}
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// applyUpdate returns the document changed by the update, either a
+// replacement document or a document of update operators. The filter
+// resolves the positional operator $ in field paths.
+func applyUpdate(doc bson.M, update bson.M, filter bson.M) (bson.M, error) {
+	if !isOperators(update) {
+		replaced := copyDoc(update)
+		replaced["_id"] = doc["_id"]
+		return replaced, nil
+	}
+
+	updated := copyDoc(doc)
+	for op, arg := range update {
+		fields, ok := asDoc(arg)
+		if !ok {
+			return nil, fmt.Errorf("store: %s needs a document", op)
+		}
+
+		for path, value := range fields {
+			parts, err := positional(updated, path, filter)
+			if err != nil {
+				return nil, err
+			}
+
+			switch op {
+			case "$set":
+				err = setPath(updated, parts, value)
+			case "$unset":
+				unsetPath(updated, parts)
+			case "$inc":
+				current := getPath(updated, parts)
+				if current == nil {
+					current = 0
+				}
+				err = setPath(updated, parts, add(current, value))
+			case "$push":
+				arr, ok := getPath(updated, parts).([]interface{})
+				if !ok && getPath(updated, parts) != nil {
+					return nil, fmt.Errorf("store: $push to %s which is not an array", path)
+				}
+				values := []interface{}{value}
+				if each, ok := asDoc(value); ok && each["$each"] != nil {
+					values = asArray(each["$each"])
+				}
+				err = setPath(updated, parts, append(arr, values...))
+			case "$pull":
+				arr := asArray(getPath(updated, parts))
+				kept := make([]interface{}, 0, len(arr))
+				for _, elem := range arr {
+					if !pullMatch(elem, value) {
+						kept = append(kept, elem)
+					}
+				}
+				err = setPath(updated, parts, kept)
+			default:
+				return nil, fmt.Errorf("store: unsupported update operator %s", op)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+// pullMatch reports whether an array element matches the condition of a
+// $pull.
+func pullMatch(elem interface{}, cond interface{}) bool {
+	if sub, ok := asDoc(cond); ok {
+		return matchElem(elem, sub)
+	}
+	return equal(elem, cond)
+}
+
+// positional splits a field path and replaces the positional operator $ with
+// the index of the first array element the filter matched.
+func positional(doc bson.M, path string, filter bson.M) ([]string, error) {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if part != "$" {
+			continue
+		}
+
+		prefix := strings.Join(parts[:i], ".")
+		index := -1
+		for j, elem := range asArray(getPath(doc, parts[:i])) {
+			if matched, _ := matchPositional(elem, prefix, filter); matched {
+				index = j
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("store: the positional operator did not find the match needed from the query for %s", path)
+		}
+		parts[i] = strconv.Itoa(index)
+	}
+	return parts, nil
+}
+
+// matchPositional reports whether an array element matches every condition
+// of the filter on the array at prefix, and whether there was a condition.
+func matchPositional(elem interface{}, prefix string, filter bson.M) (bool, bool) {
+	found := false
+	for key, cond := range filter {
+		switch {
+		case key == "$and":
+			for _, sub := range asArray(cond) {
+				subFilter, _ := asDoc(sub)
+				matched, subFound := matchPositional(elem, prefix, subFilter)
+				if !matched {
+					return false, true
+				}
+				found = found || subFound
+			}
+		case key == prefix:
+			found = true
+			ops, ok := asDoc(cond)
+			if ok && ops["$elemMatch"] != nil {
+				sub, _ := asDoc(ops["$elemMatch"])
+				if !matchElem(elem, sub) {
+					return false, true
+				}
+			} else if !matchCond([]interface{}{elem}, cond) {
+				return false, true
+			}
+		case strings.HasPrefix(key, prefix+"."):
+			found = true
+			rest := strings.Split(key[len(prefix)+1:], ".")
+			if !matchCond(resolve(elem, rest), cond) {
+				return false, true
+			}
+		}
+	}
+	return found, found
+}
+
+// getPath returns the value at a field path without descending into arrays
+// other than by index.
+func getPath(v interface{}, parts []string) interface{} {
+	for _, part := range parts {
+		if doc, ok := asDoc(v); ok {
+			v = doc[part]
+			continue
+		}
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i >= len(arr) {
+			return nil
+		}
+		v = arr[i]
+	}
+	return v
+}
+
+func setPath(v interface{}, parts []string, value interface{}) error {
+	path := strings.Join(parts, ".")
+	for i, part := range parts {
+		last := i == len(parts)-1
+
+		if doc, ok := asDoc(v); ok {
+			if last {
+				doc[part] = value
+				return nil
+			}
+			child, ok := doc[part]
+			if !ok || child == nil {
+				child = bson.M{}
+				doc[part] = child
+			}
+			v = child
+			continue
+		}
+
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("store: cannot set %s", path)
+		}
+		index, err := strconv.Atoi(part)
+		if err != nil || index < 0 || index >= len(arr) {
+			return fmt.Errorf("store: cannot set %s", path)
+		}
+		if last {
+			arr[index] = value
+			return nil
+		}
+		v = arr[index]
+	}
+	return nil
+}
+
+func unsetPath(v interface{}, parts []string) {
+	parent := getPath(v, parts[:len(parts)-1])
+	last := parts[len(parts)-1]
+
+	if doc, ok := asDoc(parent); ok {
+		delete(doc, last)
+		return
+	}
+	if arr, ok := parent.([]interface{}); ok {
+		if i, err := strconv.Atoi(last); err == nil && i >= 0 && i < len(arr) {
+			arr[i] = nil
+		}
+	}
+}
+
+func add(a, b interface{}) interface{} {
+	ia, fa, aInt, _ := number(a)
+	ib, fb, bInt, _ := number(b)
+	if aInt && bInt {
+		return ia + ib
+	}
+	if aInt {
+		fa = float64(ia)
+	}
+	if bInt {
+		fb = float64(ib)
+	}
+	return fa + fb
+}
@@ -0,0 +1,415 @@
+package webhook
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo/bson"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of concurrent requests.
+	workers = 4
+
+	// Number of activities waiting to be matched against the webhooks.
+	queueSize = 1024
+
+	// Deliveries loaded by a sweep.
+	sweepLimit = 100
+
+	// Bounds of the delay before the webhooks of an activity are looked up
+	// again after the store failed.
+	minStoreRetry = 500 * time.Millisecond
+	maxStoreRetry = 30 * time.Second
+)
+
+var metrics = expvar.NewMap("webhook")
+
+// ErrInProgress is returned by Redeliver for a delivery that is attempted.
+var ErrInProgress = errors.New("delivery is still in progress")
+
+// Store provides the webhooks and persists the delivery log.
+type Store interface {
+	ActiveWebhooks(hiveHex string) ([]Webhook, error)
+	SaveDelivery(delivery *Delivery) error
+	// DueDeliveries returns the pending and retrying deliveries whose next
+	// attempt is due at now, the earliest first.
+	DueDeliveries(now time.Time, limit int) ([]Delivery, error)
+}
+
+type job struct {
+	webhook  Webhook
+	delivery *Delivery
+}
+
+// Dispatcher delivers the activities of the hives to their webhooks.
+type Dispatcher struct {
+	store  Store
+	client *http.Client
+
+	// Delay before the first retry, doubled for every further attempt up
+	// to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Attempts before a delivery failed.
+	MaxAttempts int
+
+	// Period in which the due deliveries are loaded from the store: the
+	// retries, the deliveries that did not fit into the queue and those left
+	// by a restart.
+	SweepPeriod time.Duration
+
+	activities chan *notification.Activity
+	jobs       chan *job
+
+	// Deliveries queued or attempted, the sweep leaves them alone.
+	mu       sync.Mutex
+	inFlight map[bson.ObjectId]bool
+}
+
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		store: store,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		Backoff:     10 * time.Second,
+		MaxBackoff:  30 * time.Minute,
+		MaxAttempts: 8,
+		SweepPeriod: 5 * time.Second,
+		activities:  make(chan *notification.Activity, queueSize),
+		jobs:        make(chan *job, queueSize),
+		inFlight:    make(map[bson.ObjectId]bool),
+	}
+}
+
+// Run matches the activities against the webhooks and sends the requests.
+// Every delivery is logged as pending before it is queued, deliveries that do
+// not fit into the queue are sent by the sweep.
+func (d *Dispatcher) Run() {
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	go d.sweepLoop()
+
+	for activity := range d.activities {
+		webhooks := d.activeWebhooks(activity.HiveID)
+
+		for _, webhook := range webhooks {
+			if !webhook.Matches(activity) {
+				continue
+			}
+
+			event := activity.Type
+			if activity.EventType != "" {
+				event = activity.EventType
+			}
+
+			now := time.Now()
+			delivery := &Delivery{
+				ID:            bson.NewObjectId(),
+				WebhookID:     webhook.ID,
+				HiveID:        webhook.HiveID,
+				ActivityID:    activity.ID,
+				Event:         event,
+				Status:        StatusPending,
+				CreatedAt:     now,
+				UpdatedAt:     now,
+				NextAttemptAt: &now,
+			}
+
+			payload, err := webhook.Render(activity)
+			if err != nil {
+				delivery.Status = StatusFailed
+				delivery.Error = "render payload: " + err.Error()
+				delivery.NextAttemptAt = nil
+				d.save(delivery)
+				continue
+			}
+			delivery.Payload = string(payload)
+
+			if err := d.store.SaveDelivery(delivery); err != nil {
+				// the queue holds the only copy of the delivery
+				logrus.Errorln(err)
+				d.claim(delivery.ID)
+				d.jobs <- &job{
+					webhook:  webhook,
+					delivery: delivery,
+				}
+				continue
+			}
+			d.enqueue(webhook, delivery)
+		}
+	}
+}
+
+// activeWebhooks returns the active webhooks of a hive, it retries until the
+// store answers.
+func (d *Dispatcher) activeWebhooks(hiveHex string) []Webhook {
+	delay := minStoreRetry
+	for {
+		webhooks, err := d.store.ActiveWebhooks(hiveHex)
+		if err == nil {
+			return webhooks
+		}
+		logrus.Errorln("load webhooks of hive", hiveHex, "failed, retry in", delay, err)
+
+		time.Sleep(delay)
+		if delay *= 2; delay > maxStoreRetry {
+			delay = maxStoreRetry
+		}
+	}
+}
+
+// Dispatch queues an activity for delivery. It waits while the queue is full.
+func (d *Dispatcher) Dispatch(activity *notification.Activity) {
+	d.activities <- activity
+}
+
+// Redeliver sends a logged delivery again. A failed or delivered delivery is
+// sent as a new delivery, a pending or retrying delivery that is not attempted
+// at the moment, e.g. left by a restart, is attempted again right away.
+func (d *Dispatcher) Redeliver(webhook Webhook, delivery Delivery) (Delivery, error) {
+	now := time.Now()
+
+	if delivery.Status == StatusPending || delivery.Status == StatusRetrying {
+		if !d.claim(delivery.ID) {
+			return Delivery{}, ErrInProgress
+		}
+
+		delivery.UpdatedAt = now
+		delivery.NextAttemptAt = &now
+		if err := d.store.SaveDelivery(&delivery); err != nil {
+			d.release(delivery.ID)
+			return Delivery{}, err
+		}
+		d.release(delivery.ID)
+
+		queued := delivery
+		d.enqueue(webhook, &delivery)
+		return queued, nil
+	}
+
+	redelivery := &Delivery{
+		ID:            bson.NewObjectId(),
+		WebhookID:     webhook.ID,
+		HiveID:        webhook.HiveID,
+		ActivityID:    delivery.ActivityID,
+		Event:         delivery.Event,
+		Payload:       delivery.Payload,
+		Status:        StatusPending,
+		RedeliveryOf:  delivery.ID,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		NextAttemptAt: &now,
+	}
+
+	if err := d.store.SaveDelivery(redelivery); err != nil {
+		return Delivery{}, err
+	}
+	queued := *redelivery
+	d.enqueue(webhook, redelivery)
+
+	return queued, nil
+}
+
+// claim marks a delivery as queued and reports whether it was not before.
+func (d *Dispatcher) claim(deliveryID bson.ObjectId) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.inFlight[deliveryID] {
+		return false
+	}
+	d.inFlight[deliveryID] = true
+	return true
+}
+
+// release lets the sweep load a delivery again.
+func (d *Dispatcher) release(deliveryID bson.ObjectId) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.inFlight, deliveryID)
+}
+
+// enqueue queues a logged delivery unless it is queued already. A delivery
+// that does not fit into the queue is left to the sweep.
+func (d *Dispatcher) enqueue(webhook Webhook, delivery *Delivery) {
+	if d.claim(delivery.ID) {
+		d.push(webhook, delivery)
+	}
+}
+
+// push queues a claimed delivery or releases it if the queue is full.
+func (d *Dispatcher) push(webhook Webhook, delivery *Delivery) {
+	select {
+	case d.jobs <- &job{webhook: webhook, delivery: delivery}:
+	default:
+		d.release(delivery.ID)
+		metrics.Add("deliveries_deferred", 1)
+	}
+}
+
+func (d *Dispatcher) sweepLoop() {
+	ticker := time.NewTicker(d.SweepPeriod)
+	defer ticker.Stop()
+
+	for {
+		d.sweep()
+		<-ticker.C
+	}
+}
+
+// sweep queues the deliveries that are due.
+func (d *Dispatcher) sweep() {
+	// the store is read under the lock, so a released delivery is read as the
+	// attempt left it and not sent again
+	d.mu.Lock()
+	deliveries, err := d.store.DueDeliveries(time.Now(), sweepLimit)
+	claimed := deliveries[:0]
+	for _, delivery := range deliveries {
+		if !d.inFlight[delivery.ID] {
+			d.inFlight[delivery.ID] = true
+			claimed = append(claimed, delivery)
+		}
+	}
+	d.mu.Unlock()
+	if err != nil {
+		logrus.Errorln(err)
+		return
+	}
+
+	webhooks := make(map[bson.ObjectId]map[bson.ObjectId]Webhook)
+	for i := range claimed {
+		delivery := &claimed[i]
+
+		active, ok := webhooks[delivery.HiveID]
+		if !ok {
+			list, err := d.store.ActiveWebhooks(delivery.HiveID.Hex())
+			if err != nil {
+				logrus.Errorln(err)
+				d.release(delivery.ID)
+				continue
+			}
+			active = make(map[bson.ObjectId]Webhook, len(list))
+			for _, webhook := range list {
+				active[webhook.ID] = webhook
+			}
+			webhooks[delivery.HiveID] = active
+		}
+
+		webhook, ok := active[delivery.WebhookID]
+		if !ok {
+			delivery.Status = StatusFailed
+			delivery.Error = "webhook was deleted or deactivated"
+			delivery.UpdatedAt = time.Now()
+			delivery.NextAttemptAt = nil
+			d.save(delivery)
+			d.release(delivery.ID)
+			continue
+		}
+
+		d.push(webhook, delivery)
+	}
+}
+
+func (d *Dispatcher) save(delivery *Delivery) {
+	if err := d.store.SaveDelivery(delivery); err != nil {
+		logrus.Errorln(err)
+	}
+}
+
+func (d *Dispatcher) worker() {
+	for j := range d.jobs {
+		d.attempt(j)
+		d.release(j.delivery.ID)
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	return delay
+}
+
+// attempt sends a delivery and logs the result. A retry is logged with the
+// time of its next attempt and queued by the sweep once it is due.
+func (d *Dispatcher) attempt(j *job) {
+	delivery := j.delivery
+	delivery.Attempts++
+	delivery.NextAttemptAt = nil
+
+	status, err := d.send(j.webhook, delivery)
+	delivery.ResponseStatus = status
+	delivery.UpdatedAt = time.Now()
+
+	switch {
+	case err == nil:
+		delivery.Status = StatusDelivered
+		delivery.Error = ""
+	case retryable(status) && delivery.Attempts < d.MaxAttempts:
+		delivery.Status = StatusRetrying
+		delivery.Error = err.Error()
+
+		next := delivery.UpdatedAt.Add(d.backoff(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	default:
+		delivery.Status = StatusFailed
+		delivery.Error = err.Error()
+	}
+
+	d.save(delivery)
+}
+
+// retryable reports whether a request that failed with status may succeed
+// later. Status is 0 if no response was received.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+func (d *Dispatcher) send(webhook Webhook, delivery *Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TorchAPI-Hive-Webhook")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.ID.Hex())
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,395 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo/bson"
+)
+
+type memoryStore struct {
+	mu         sync.Mutex
+	webhooks   []Webhook
+	deliveries map[bson.ObjectId]Delivery
+	saved      chan Delivery
+}
+
+func newMemoryStore(webhooks ...Webhook) *memoryStore {
+	return &memoryStore{
+		webhooks:   webhooks,
+		deliveries: make(map[bson.ObjectId]Delivery),
+		saved:      make(chan Delivery, 64),
+	}
+}
+
+func (s *memoryStore) ActiveWebhooks(hiveHex string) ([]Webhook, error) {
+	return s.webhooks, nil
+}
+
+func (s *memoryStore) SaveDelivery(delivery *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deliveries[delivery.ID] = *delivery
+	s.saved <- *delivery
+	return nil
+}
+
+func (s *memoryStore) DueDeliveries(now time.Time, limit int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []Delivery
+	for _, delivery := range s.deliveries {
+		if (delivery.Status == StatusPending || delivery.Status == StatusRetrying) && delivery.NextAttemptAt != nil && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// delivery returns the logged state of a delivery.
+func (s *memoryStore) delivery(id bson.ObjectId) Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deliveries[id]
+}
+
+// waitFor returns the first saved delivery in one of the final states.
+func (s *memoryStore) waitFor(t *testing.T) Delivery {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case delivery := <-s.saved:
+			if delivery.Status == StatusDelivered || delivery.Status == StatusFailed {
+				return delivery
+			}
+		case <-timeout:
+			t.Fatal("no delivery finished")
+		}
+	}
+}
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func testServer(statuses ...int) (*httptest.Server, chan request) {
+	requests := make(chan request, 16)
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+
+		mu.Lock()
+		defer mu.Unlock()
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	})), requests
+}
+
+func testDispatcher(store Store) *Dispatcher {
+	d := NewDispatcher(store)
+	d.Backoff = time.Millisecond
+	d.MaxBackoff = 4 * time.Millisecond
+	d.MaxAttempts = 3
+	d.SweepPeriod = 5 * time.Millisecond
+	go d.Run()
+	return d
+}
+
+func testActivity(hiveID bson.ObjectId) *notification.Activity {
+	return &notification.Activity{
+		ID:        bson.NewObjectId().Hex(),
+		Type:      notification.ActivitySectorEvent,
+		HiveID:    hiveID.Hex(),
+		EventType: "factionDeclareWar",
+		Time:      time.Now(),
+		Data:      json.RawMessage(`{"FromFactionId":1,"ToFactionId":2}`),
+	}
+}
+
+func TestDispatchSignsAndRendersTemplate(t *testing.T) {
+	server, requests := testServer()
+	defer server.Close()
+
+	hiveID := bson.NewObjectId()
+	wh := Webhook{
+		ID:       bson.NewObjectId(),
+		HiveID:   hiveID,
+		URL:      server.URL,
+		Secret:   "0123456789abcdef",
+		Types:    []string{"factionDeclareWar"},
+		Template: `{"content": {{json .event_type}}, "from": {{.data.FromFactionId}}}`,
+		Active:   true,
+	}
+	store := newMemoryStore(wh)
+	d := testDispatcher(store)
+
+	d.Dispatch(testActivity(hiveID))
+
+	delivery := store.waitFor(t)
+	if delivery.Status != StatusDelivered || delivery.Attempts != 1 {
+		t.Fatalf("unexpected delivery %+v", delivery)
+	}
+
+	req := <-requests
+	if string(req.body) != `{"content": "factionDeclareWar", "from": 1}` {
+		t.Errorf("unexpected payload %s", req.body)
+	}
+	if req.header.Get(HeaderEvent) != "factionDeclareWar" {
+		t.Errorf("unexpected event header %q", req.header.Get(HeaderEvent))
+	}
+	if req.header.Get(HeaderDelivery) != delivery.ID.Hex() {
+		t.Errorf("unexpected delivery header %q", req.header.Get(HeaderDelivery))
+	}
+
+	timestamp, err := strconv.ParseInt(req.header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.header.Get(HeaderSignature) != Sign(wh.Secret, timestamp, req.body) {
+		t.Errorf("signature does not match")
+	}
+}
+
+func TestDispatchSkipsUnsubscribedTypes(t *testing.T) {
+	server, requests := testServer()
+	defer server.Close()
+
+	hiveID := bson.NewObjectId()
+	store := newMemoryStore(Webhook{
+		ID:     bson.NewObjectId(),
+		HiveID: hiveID,
+		URL:    server.URL,
+		Secret: "0123456789abcdef",
+		Types:  []string{notification.ActivitySectorState},
+		Active: true,
+	})
+	d := testDispatcher(store)
+
+	d.Dispatch(testActivity(hiveID))
+
+	select {
+	case <-requests:
+		t.Fatal("unsubscribed activity was delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatchRetriesWithBackoff(t *testing.T) {
+	server, _ := testServer(http.StatusServiceUnavailable, http.StatusBadGateway)
+	defer server.Close()
+
+	hiveID := bson.NewObjectId()
+	store := newMemoryStore(Webhook{
+		ID:     bson.NewObjectId(),
+		HiveID: hiveID,
+		URL:    server.URL,
+		Secret: "0123456789abcdef",
+		Active: true,
+	})
+	d := testDispatcher(store)
+
+	d.Dispatch(testActivity(hiveID))
+
+	delivery := store.waitFor(t)
+	if delivery.Status != StatusDelivered || delivery.Attempts != 3 {
+		t.Fatalf("expected delivery on the third attempt, got %+v", delivery)
+	}
+}
+
+func TestDispatchFailsAndRedelivers(t *testing.T) {
+	server, requests := testServer(http.StatusBadRequest)
+	defer server.Close()
+
+	hiveID := bson.NewObjectId()
+	wh := Webhook{
+		ID:     bson.NewObjectId(),
+		HiveID: hiveID,
+		URL:    server.URL,
+		Secret: "0123456789abcdef",
+		Active: true,
+	}
+	store := newMemoryStore(wh)
+	d := testDispatcher(store)
+
+	d.Dispatch(testActivity(hiveID))
+
+	failed := store.waitFor(t)
+	if failed.Status != StatusFailed || failed.Attempts != 1 || failed.ResponseStatus != http.StatusBadRequest {
+		t.Fatalf("expected a failed delivery without retries, got %+v", failed)
+	}
+	first := <-requests
+
+	redelivery, err := d.Redeliver(wh, failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redelivery.RedeliveryOf != failed.ID {
+		t.Errorf("redelivery does not reference %s", failed.ID.Hex())
+	}
+
+	delivered := store.waitFor(t)
+	if delivered.ID != redelivery.ID || delivered.Status != StatusDelivered {
+		t.Fatalf("unexpected redelivery %+v", delivered)
+	}
+	if second := <-requests; string(second.body) != string(first.body) {
+		t.Errorf("redelivered payload %s differs from %s", second.body, first.body)
+	}
+}
+
+func TestDispatchDefersDeliveriesWhileTheQueueIsFull(t *testing.T) {
+	const activities = 20
+
+	server, requests := testServer()
+	defer server.Close()
+
+	hiveID := bson.NewObjectId()
+	store := newMemoryStore(Webhook{
+		ID:     bson.NewObjectId(),
+		HiveID: hiveID,
+		URL:    server.URL,
+		Secret: "0123456789abcdef",
+		Active: true,
+	})
+	store.saved = make(chan Delivery, 4*activities)
+	d := NewDispatcher(store)
+	d.SweepPeriod = 5 * time.Millisecond
+	d.jobs = make(chan *job, 1)
+	go d.Run()
+
+	for i := 0; i < activities; i++ {
+		d.Dispatch(testActivity(hiveID))
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < activities; i++ {
+		select {
+		case <-requests:
+		case <-timeout:
+			t.Fatalf("delivered %d of %d activities", i, activities)
+		}
+	}
+}
+
+func TestSweepResumesDeliveriesLeftByARestart(t *testing.T) {
+	server, requests := testServer()
+	defer server.Close()
+
+	hiveID := bson.NewObjectId()
+	wh := Webhook{
+		ID:     bson.NewObjectId(),
+		HiveID: hiveID,
+		URL:    server.URL,
+		Secret: "0123456789abcdef",
+		Active: true,
+	}
+	store := newMemoryStore(wh)
+
+	// a retry scheduled before the restart and a delivery of a deleted webhook
+	due := time.Now().Add(-time.Minute)
+	retrying := Delivery{
+		ID:            bson.NewObjectId(),
+		WebhookID:     wh.ID,
+		HiveID:        hiveID,
+		Payload:       "{}",
+		Status:        StatusRetrying,
+		Attempts:      1,
+		NextAttemptAt: &due,
+	}
+	orphaned := Delivery{
+		ID:            bson.NewObjectId(),
+		WebhookID:     bson.NewObjectId(),
+		HiveID:        hiveID,
+		Payload:       "{}",
+		Status:        StatusPending,
+		NextAttemptAt: &due,
+	}
+	store.deliveries[retrying.ID] = retrying
+	store.deliveries[orphaned.ID] = orphaned
+
+	testDispatcher(store)
+
+	delivered := store.waitFor(t)
+	failed := store.waitFor(t)
+	if delivered.Status == StatusFailed {
+		delivered, failed = failed, delivered
+	}
+	if delivered.ID != retrying.ID || delivered.Status != StatusDelivered || delivered.Attempts != 2 {
+		t.Errorf("unexpected retried delivery %+v", delivered)
+	}
+	if failed.ID != orphaned.ID || failed.Status != StatusFailed {
+		t.Errorf("unexpected delivery of a deleted webhook %+v", failed)
+	}
+	if len(requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(requests))
+	}
+}
+
+func TestRedeliverTakesOverARetryingDelivery(t *testing.T) {
+	server, requests := testServer()
+	defer server.Close()
+
+	hiveID := bson.NewObjectId()
+	wh := Webhook{
+		ID:     bson.NewObjectId(),
+		HiveID: hiveID,
+		URL:    server.URL,
+		Secret: "0123456789abcdef",
+		Active: true,
+	}
+	store := newMemoryStore(wh)
+
+	// the retry is not due for an hour
+	next := time.Now().Add(time.Hour)
+	retrying := Delivery{
+		ID:            bson.NewObjectId(),
+		WebhookID:     wh.ID,
+		HiveID:        hiveID,
+		Payload:       "{}",
+		Status:        StatusRetrying,
+		Attempts:      1,
+		NextAttemptAt: &next,
+	}
+	store.deliveries[retrying.ID] = retrying
+	d := testDispatcher(store)
+
+	queued, err := d.Redeliver(wh, retrying)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued.ID != retrying.ID {
+		t.Errorf("got delivery %s, want %s", queued.ID.Hex(), retrying.ID.Hex())
+	}
+
+	delivered := store.waitFor(t)
+	if delivered.ID != retrying.ID || delivered.Status != StatusDelivered {
+		t.Fatalf("unexpected delivery %+v", delivered)
+	}
+	<-requests
+	if stored := store.delivery(retrying.ID); stored.Attempts != 2 {
+		t.Errorf("got %d attempts, want 2", stored.Attempts)
+	}
+}
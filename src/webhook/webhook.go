@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/fankserver/torchapi-hive-system/src/notification"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Delivery states.
+const (
+	StatusPending   = "pending"
+	StatusRetrying  = "retrying"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Request headers of a delivery.
+const (
+	HeaderEvent     = "X-Hive-Event"
+	HeaderDelivery  = "X-Hive-Delivery"
+	HeaderTimestamp = "X-Hive-Timestamp"
+	HeaderSignature = "X-Hive-Signature"
+)
+
+// Webhook is a subscription of an external endpoint to the activity of a hive.
+type Webhook struct {
+	ID     bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	HiveID bson.ObjectId `json:"-" bson:"hive_id"`
+	URL    string        `json:"url" bson:"url"`
+	// Secret signs the requests, it is only returned when the webhook is
+	// created.
+	Secret string `json:"secret,omitempty" bson:"secret"`
+	// Activity and event types to deliver, all if empty.
+	Types []string `json:"types" bson:"types"`
+	// Template renders the JSON payload from the activity, the activity
+	// itself is delivered if empty.
+	Template string `json:"template" bson:"template"`
+	Active   bool   `json:"active" bson:"active"`
+}
+
+// Delivery is a logged request of a webhook.
+type Delivery struct {
+	ID             bson.ObjectId `json:"id" bson:"_id"`
+	WebhookID      bson.ObjectId `json:"webhook_id" bson:"webhook_id"`
+	HiveID         bson.ObjectId `json:"-" bson:"hive_id"`
+	ActivityID     string        `json:"activity_id" bson:"activity_id"`
+	Event          string        `json:"event" bson:"event"`
+	Payload        string        `json:"payload" bson:"payload"`
+	Status         string        `json:"status" bson:"status"`
+	Attempts       int           `json:"attempts" bson:"attempts"`
+	ResponseStatus int           `json:"response_status,omitempty" bson:"response_status,omitempty"`
+	Error          string        `json:"error,omitempty" bson:"error,omitempty"`
+	RedeliveryOf   bson.ObjectId `json:"redelivery_of,omitempty" bson:"redelivery_of,omitempty"`
+	CreatedAt      time.Time     `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at" bson:"updated_at"`
+	NextAttemptAt  *time.Time    `json:"next_attempt_at,omitempty" bson:"next_attempt_at,omitempty"`
+}
+
+// Matches reports whether the webhook subscribed to activity.
+func (w Webhook) Matches(activity *notification.Activity) bool {
+	if !w.Active || activity.HiveID != w.HiveID.Hex() {
+		return false
+	}
+	if len(w.Types) == 0 {
+		return true
+	}
+	for _, v := range w.Types {
+		if v == activity.Type || (activity.EventType != "" && v == activity.EventType) {
+			return true
+		}
+	}
+	return false
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// ParseTemplate checks a payload template.
+func ParseTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// Render builds the payload of activity. Templates see the activity as it is
+// encoded in JSON, e.g. {{.type}} or {{json .data.name}}.
+func (w Webhook) Render(activity *notification.Activity) ([]byte, error) {
+	data, err := json.Marshal(activity)
+	if err != nil {
+		return nil, err
+	}
+	if w.Template == "" {
+		return data, nil
+	}
+
+	tmpl, err := ParseTemplate(w.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, v); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template did not render valid json")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Sign returns the signature of a request: the hex encoded HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the webhook secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
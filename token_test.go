@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/fankserver/torchapi-hive-system/src/hive"
+)
+
+// token sends a token request with the current token and returns the status
+// and the new token, if any.
+func (h *e2eHive) token(method string, path string, current string) (int, string) {
+	h.t.Helper()
+
+	if current != "" {
+		path += "?token=" + url.QueryEscape(current)
+	}
+	req, err := http.NewRequest(method, h.server.URL+path, nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, body.Token
+}
+
+func TestObserverTokenRotation(t *testing.T) {
+	h := newE2EHive(t)
+	path := "/api/hive/" + h.hiveID + "/observer_token"
+
+	status, first := h.token(http.MethodPost, path, "")
+	if status != http.StatusCreated {
+		t.Fatalf("first token: got status %d", status)
+	}
+
+	for _, current := range []string{"", "wrong"} {
+		if status, _ := h.token(http.MethodPost, path, current); status != http.StatusUnauthorized {
+			t.Errorf("rotate with %q: got status %d, want %d", current, status, http.StatusUnauthorized)
+		}
+	}
+
+	status, second := h.token(http.MethodPost, path, first)
+	if status != http.StatusCreated {
+		t.Fatalf("rotate with the current token: got status %d", status)
+	}
+	if status, _ := h.token(http.MethodPost, path, first); status != http.StatusUnauthorized {
+		t.Errorf("rotate with the replaced token: got status %d", status)
+	}
+	if status, _ := h.token(http.MethodPost, path, second); status != http.StatusCreated {
+		t.Errorf("rotate with the new token: got status %d", status)
+	}
+}
+
+func TestSectorTokenRotation(t *testing.T) {
+	h := newE2EHive(t)
+
+	var sector hive.Sector
+	h.do(http.MethodPost, "/api/hive/"+h.hiveID+"/sector", map[string]interface{}{
+		"name":       "alpha",
+		"address":    "127.0.0.1:27016",
+		"max_player": 16,
+		"position":   hive.SectorPosition{},
+	}, &sector)
+	path := "/api/hive/" + h.hiveID + "/sector/" + sector.ID.Hex() + "/token"
+
+	status, token := h.token(http.MethodPost, path, "")
+	if status != http.StatusCreated {
+		t.Fatalf("first token: got status %d", status)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		current string
+		status  int
+	}{
+		{"rotate without token", http.MethodPost, "", http.StatusUnauthorized},
+		{"rotate with a wrong token", http.MethodPost, "wrong", http.StatusUnauthorized},
+		{"remove without token", http.MethodDelete, "", http.StatusUnauthorized},
+		{"remove with a wrong token", http.MethodDelete, "wrong", http.StatusUnauthorized},
+		{"remove with the current token", http.MethodDelete, token, http.StatusNoContent},
+		{"token after removal", http.MethodPost, "", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if status, _ := h.token(tt.method, path, tt.current); status != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
@@ -3,92 +3,198 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fankserver/torchapi-hive-system/src/api"
+	"github.com/fankserver/torchapi-hive-system/src/capture"
+	"github.com/fankserver/torchapi-hive-system/src/config"
 	"github.com/fankserver/torchapi-hive-system/src/hive"
 	"github.com/fankserver/torchapi-hive-system/src/notification"
-	"github.com/globalsign/mgo/bson"
-	"github.com/gorilla/mux"
+	"github.com/fankserver/torchapi-hive-system/src/webhook"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// Time the hub has on shutdown to finish the events in process and to
+	// flush the queued messages.
+	hubDrainTimeout = 60 * time.Second
+
+	// Time the REST requests still in process have once the hub is drained.
+	serverShutdownTimeout = 10 * time.Second
+)
+
 var (
-	dbConnection = flag.String("dbconn", "mongodb://localhost", "mongodb connection string")
+	configFile       = flag.String("config", os.Getenv("TORCHHIVE_CONFIG"), "YAML config file, reloaded on SIGHUP")
+	dbConnection     = flag.String("dbconn", "mongodb://localhost", "mongodb connection string, overrides the config")
+	reconnectDelay   = flag.Duration("reconnect-delay", 10*time.Second, "reconnect delay announced to sectors on shutdown, overrides the config")
+	connectionPolicy = flag.String("connection-policy", notification.ConnectionTakeover, "handling of a second connection of a connected sector: takeover or reject, overrides the config")
+	captureDir       = flag.String("capture", "", "directory to capture the sector connections and messages to")
+	captureHives     = flag.String("capture-hives", "", "comma separated ids of the captured hives, all if empty")
+	replayFile       = flag.String("replay", "", "replay a capture file against an in-memory hive and report divergences")
 )
 
 func main() {
 	flag.Parse()
 
+	if *replayFile != "" {
+		logrus.SetLevel(logrus.WarnLevel)
+		matched, err := replay(*replayFile, os.Stdout)
+		if err != nil {
+			logrus.Fatalln(err.Error())
+		}
+		if !matched {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logrus.Fatalln(err.Error())
+	}
+	hub := notification.NewHub()
+	if err := applyConfig(hub, cfg); err != nil {
+		logrus.Fatalln(err.Error())
+	}
+	var current atomic.Value
+	current.Store(cfg)
+	go reloadConfig(hub, cfg, &current)
+
 	go func() {
-		logrus.Println(http.ListenAndServe(":6060", nil))
+		logrus.Println(http.ListenAndServe(cfg.DebugListen, nil))
 	}()
 
-	system, err := hive.NewSystem(*dbConnection)
+	system, err := hive.NewSystem(cfg.Database.Connection, cfg.Database.Name)
 	if err != nil {
 		logrus.Fatalln(err.Error())
 	}
+	connect(system, hub)
+	if err := hub.SetDeadLetterSpool(cfg.DeadLetterSpool); err != nil {
+		logrus.Fatalln(err.Error())
+	}
 
-	hub := notification.NewHub()
-	hub.RegisterEventHandler(system.ProcessSectorEvent)
+	var recorder *capture.Recorder
+	if *captureDir != "" {
+		recorder, err = capture.NewRecorder(*captureDir, hiveList(*captureHives), system.Snapshot)
+		if err != nil {
+			logrus.Fatalln(err.Error())
+		}
+		hub.RegisterRecorder(recorder.Record)
+	}
+
+	dispatcher := webhook.NewDispatcher(system)
+	hub.RegisterActivityListener(dispatcher.Dispatch)
+	system.RegisterRedeliveryHandler(dispatcher.Redeliver)
+	go dispatcher.Run()
 	go hub.Run()
+	go system.RetryDeadLetters()
 
 	// subscribe to SIGINT signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 
-	router := mux.NewRouter()
-	router.HandleFunc("/", func(writer http.ResponseWriter, _ *http.Request) {
-		fmt.Fprint(writer, "TorchAPI Hive System")
-	}).Methods(http.MethodGet)
-	router.HandleFunc("/ws/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-
-		hiveID := bson.ObjectIdHex(vars["hive_id"])
-		sectorID := bson.ObjectIdHex(vars["sector_id"])
-
-		valid, err := system.IsSectorValid(hiveID, sectorID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if !valid {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-			return
-		}
-
-		notification.ServeWs(hub, w, r, hiveID.Hex(), sectorID.Hex())
-	})
-	router.HandleFunc("/api/hive", system.GetHives).Methods(http.MethodGet)
-	router.HandleFunc("/api/hive", system.CreateHive).Methods(http.MethodPost)
-	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction", system.GetFactions).Methods(http.MethodGet)
-	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/faction", system.DeleteFactions).Methods(http.MethodDelete)
-	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector", system.GetSectors).Methods(http.MethodGet)
-	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector", system.CreateSector).Methods(http.MethodPost)
-	router.HandleFunc("/api/hive/{hive_id:[a-z0-9]+}/sector/{sector_id:[a-z0-9]+}", system.DeleteSector).Methods(http.MethodDelete)
+	router := newRouter(system, hub)
 
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Addr:    cfg.Listen,
+		Handler: api.Recover(router),
 	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		logrus.Fatalf("listen: %s\n", err)
+	}
+	listener := &onceCloseListener{Listener: ln}
+	stopping := make(chan struct{})
 	go func() {
 		logrus.Info("server started")
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			logrus.Fatalf("listen: %s\n", err)
+		err := srv.Serve(listener)
+		select {
+		case <-stopping:
+		default:
+			if err != http.ErrServerClosed {
+				logrus.Fatalf("listen: %s\n", err)
+			}
 		}
 	}()
 
 	<-quit
 	logrus.Println("shutting down server...")
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctxTimeout); err != nil {
-		logrus.Fatalf("could not shutdown: %v", err)
+
+	// stop accepting connections, drain the hub, which closes the websockets
+	// and event streams, and only then wait for the remaining requests
+	close(stopping)
+	if err := listener.Close(); err != nil {
+		logrus.Errorf("could not close listener: %v", err)
+	}
+
+	hubCtx, cancelHub := context.WithTimeout(context.Background(), hubDrainTimeout)
+	defer cancelHub()
+	if err := hub.Shutdown(hubCtx, current.Load().(*config.Config).ReconnectDelay); err != nil {
+		logrus.Errorf("could not drain hub: %v", err)
+	}
+
+	srvCtx, cancelSrv := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancelSrv()
+	if err := srv.Shutdown(srvCtx); err != nil {
+		logrus.Errorf("could not shutdown: %v", err)
+	}
+
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			logrus.Errorf("could not close capture: %v", err)
+		}
 	}
 	logrus.Println("server gracefully stopped")
 }
+
+// onceCloseListener closes the listener only once, it is closed before the
+// server shuts down.
+type onceCloseListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *onceCloseListener) Close() error {
+	l.once.Do(func() {
+		l.err = l.Listener.Close()
+	})
+	return l.err
+}
+
+// connect registers the hub and the system with each other.
+func connect(system *hive.System, hub *notification.Hub) {
+	hub.RegisterEventHandler(system.ProcessSectorEvent)
+	hub.RegisterHandshakeHandler(system.SectorHandshake)
+	hub.RegisterPartitionHandler(system.EventPartitionKey)
+	hub.RegisterPolicyHandler(system.BackpressurePolicy)
+	hub.RegisterSlowHandler(system.SectorSlow)
+	hub.RegisterSpillStore(system)
+	hub.RegisterDedupStore(system)
+	hub.RegisterDeadLetterStore(system)
+	hub.RegisterActivityLog(system)
+	system.RegisterDisconnectHandler(hub.DisconnectSector)
+	system.RegisterPolicyChangeHandler(hub.SetBackpressurePolicy)
+	system.RegisterActivityHandler(hub.Publish)
+	system.RegisterRetryHandler(hub.RetryDeadLetter)
+	system.RegisterAnnouncementHandler(hub.Announce)
+}
+
+// hiveList splits a comma separated list of hive ids.
+func hiveList(v string) []string {
+	var hives []string
+	for _, id := range strings.Split(v, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			hives = append(hives, id)
+		}
+	}
+	return hives
+}